@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/rchab/dockerproxy/internal/logging"
+)
+
+type contextKey int
+
+const (
+	requestInfoKey contextKey = iota
+	currentSpanKey
+)
+
+// requestInfo is filled in as a request travels down the middleware chain so
+// the access log can report who made it once it completes.
+type requestInfo struct {
+	id      string
+	appName string
+	// the client's Fly token, for FLY_REGISTRY_AUTH. Never log it.
+	authToken string
+	// whether the app is one of OPERATOR_APPS, see pathAllowed
+	operator bool
+	trace    traceContext
+
+	// guards spans and their attributes, which proxy goroutines add to
+	mu    sync.Mutex
+	spans []*span
+}
+
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey).(*requestInfo)
+	return info
+}
+
+// requestLogger returns a log entry tagged with the ID of the request ctx
+// belongs to, if any, so every line about a request can be found by it.
+func requestLogger(ctx context.Context) *logrus.Entry {
+	if info := requestInfoFromContext(ctx); info != nil {
+		return log.WithField("request_id", info.id)
+	}
+	return logrus.NewEntry(log)
+}
+
+// the internal packages log through requestLogger too
+func init() {
+	logging.Logger = requestLogger
+}
+
+func newRequestID() string {
+	return randomHex(8)
+}
+
+// requestID reuses the ID Fly's proxy or the client assigned to the request,
+// so our logs line up with theirs, and makes one up otherwise.
+func requestID(r *http.Request) string {
+	for _, header := range []string{"Fly-Request-Id", "X-Request-Id"} {
+		if id := r.Header.Get(header); id != "" {
+			return id
+		}
+	}
+	return newRequestID()
+}
+
+// countingReader counts the bytes read from a request body. ContentLength is
+// -1 for the chunked uploads docker uses for build contexts.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// accessLog emits one structured log entry per request and returns the
+// request ID to the client in X-Request-Id so the two sides can be correlated.
+// The ID is passed on to dockerd in the same header.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := &requestInfo{id: requestID(r), trace: newTraceContext(r)}
+		w.Header().Set("X-Request-Id", info.id)
+		r.Header.Set("X-Request-Id", info.id)
+		r.Header.Set("traceparent", info.trace.traceparent())
+
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey, info))
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		start := time.Now()
+		m := httpsnoop.CaptureMetrics(next, w, r)
+		exportTrace(info, r, start, m.Code)
+
+		var org string
+		if slug, ok := appOrgSlugs.Load(info.appName); ok {
+			org = slug.(string)
+		}
+
+		log.WithFields(logrus.Fields{
+			"request_id":  info.id,
+			"app":         info.appName,
+			"org":         org,
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      m.Code,
+			"bytes_in":    body.n,
+			"bytes_out":   m.Written,
+			"duration_ms": m.Duration.Milliseconds(),
+			"agent":       r.UserAgent(),
+			"trace_id":    info.trace.traceID,
+			"span_id":     info.trace.spanID,
+			"parent_id":   info.trace.parentID,
+		}).Info("request")
+	})
+}
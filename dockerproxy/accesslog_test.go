@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRequestID(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/_ping", nil)
+	if id := requestID(r); len(id) != 16 {
+		t.Errorf("expected a generated 16 character id, but got %q", id)
+	}
+
+	r.Header.Set("X-Request-Id", "from-client")
+	if id := requestID(r); id != "from-client" {
+		t.Errorf("expected the client's id, but got %q", id)
+	}
+
+	r.Header.Set("Fly-Request-Id", "from-fly")
+	if id := requestID(r); id != "from-fly" {
+		t.Errorf("expected Fly's id to take precedence, but got %q", id)
+	}
+}
+
+func TestAccessLogCountsBody(t *testing.T) {
+	var read int64
+	h := accessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		read = r.Body.(*countingReader).n
+	}))
+
+	r := httptest.NewRequest(http.MethodPost, "/build", strings.NewReader("build context"))
+	r.ContentLength = -1
+	r.Header.Set("Fly-Request-Id", "abc")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if read != int64(len("build context")) {
+		t.Errorf("expected %d bytes counted, but got %d", len("build context"), read)
+	}
+	if got := w.Header().Get("X-Request-Id"); got != "abc" {
+		t.Errorf("expected X-Request-Id abc, but got %q", got)
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	var out bytes.Buffer
+	defer func(w io.Writer, f logrus.Formatter) {
+		log.SetOutput(w)
+		log.SetFormatter(f)
+	}(log.Out, log.Formatter)
+	formatter, err := logFormatter("json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.SetFormatter(formatter)
+	log.SetOutput(&out)
+
+	appOrgSlugs.Store("my-app", "acme")
+	defer appOrgSlugs.Delete("my-app")
+
+	h := accessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestInfoFromContext(r.Context()).appName = "my-app"
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "done")
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/v1.41/build", nil)
+	r.Header.Set("X-Request-Id", "abc")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("expected a JSON log line, but got %q: %v", out.String(), err)
+	}
+	want := map[string]interface{}{
+		"msg":        "request",
+		"request_id": "abc",
+		"app":        "my-app",
+		"org":        "acme",
+		"path":       "/v1.41/build",
+		"status":     float64(http.StatusCreated),
+		"bytes_out":  float64(4),
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("expected %s to be %v, but got %v", k, v, entry[k])
+		}
+	}
+	if _, ok := entry["duration_ms"]; !ok {
+		t.Error("expected a duration")
+	}
+
+	if _, err := logFormatter("xml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// appActivity records when each authenticated app last used the builder. With
+// PER_APP_IDLE=1 the builder only counts as idle once every app has been.
+type appActivity struct {
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+func newAppActivity() *appActivity {
+	return &appActivity{lastSeen: map[string]time.Time{}}
+}
+
+func (a *appActivity) touch(appName string) {
+	if appName == "" {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lastSeen[appName] = time.Now()
+}
+
+// idleFor returns how long it's been since any app was last seen, and false
+// if none has been.
+func (a *appActivity) idleFor() (time.Duration, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var latest time.Time
+	for _, seen := range a.lastSeen {
+		if seen.After(latest) {
+			latest = seen
+		}
+	}
+	if latest.IsZero() {
+		return 0, false
+	}
+	return time.Since(latest), true
+}
+
+func (a *appActivity) snapshot() map[string]time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	out := make(map[string]time.Time, len(a.lastSeen))
+	for app, seen := range a.lastSeen {
+		out[app] = seen
+	}
+	return out
+}
+
+// idleShutdownDelay returns how much longer the builder has to stay idle before
+// it may shut down. The builder needs a full idle window after the last
+// request finished, not just no requests in flight when the timer fires.
+func idleShutdownDelay() time.Duration {
+	idle := time.Since(time.Unix(0, lastRequestDone.Load()))
+	if appIdle, ok := appsLastSeen.idleFor(); perAppIdle && ok && appIdle < idle {
+		idle = appIdle
+	}
+	if remaining := maxIdleDuration.Get() - idle; remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// touchFromContext records activity for the app authRequest put on ctx.
+func touchFromContext(ctx context.Context) {
+	if !perAppIdle {
+		return
+	}
+	if info := requestInfoFromContext(ctx); info != nil {
+		appsLastSeen.touch(info.appName)
+	}
+}
+
+func appActivityHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(appsLastSeen.snapshot()); err != nil {
+			log.Warnln("error writing app activity response", err)
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAppActivity(t *testing.T) {
+	a := newAppActivity()
+	if _, ok := a.idleFor(); ok {
+		t.Fatal("expected no activity yet")
+	}
+
+	a.touch("")
+	if len(a.snapshot()) != 0 {
+		t.Fatal("expected anonymous requests to be ignored")
+	}
+
+	a.touch("my-app")
+	a.mu.Lock()
+	a.lastSeen["old-app"] = time.Now().Add(-time.Hour)
+	a.mu.Unlock()
+
+	idle, ok := a.idleFor()
+	if !ok || idle > time.Minute {
+		t.Errorf("expected the most recent app to count, but idle for %s", idle)
+	}
+	if seen := a.snapshot(); len(seen) != 2 {
+		t.Errorf("expected 2 apps, but got %v", seen)
+	}
+}
+
+func TestIdleShutdownDelay(t *testing.T) {
+	defer func(done int64, idle time.Duration) {
+		lastRequestDone.Store(done)
+		maxIdleDuration.Set(idle)
+	}(lastRequestDone.Load(), maxIdleDuration.Get())
+	maxIdleDuration.Set(10 * time.Minute)
+
+	lastRequestDone.Store(0)
+	if wait := idleShutdownDelay(); wait != 0 {
+		t.Errorf("expected no wait without any requests, but got %s", wait)
+	}
+
+	lastRequestDone.Store(time.Now().Add(-4 * time.Minute).UnixNano())
+	if wait := idleShutdownDelay(); wait < 5*time.Minute || wait > 6*time.Minute {
+		t.Errorf("expected to wait out the rest of the idle window, but got %s", wait)
+	}
+
+	lastRequestDone.Store(time.Now().Add(-time.Hour).UnixNano())
+	if wait := idleShutdownDelay(); wait != 0 {
+		t.Errorf("expected no wait after a full idle window, but got %s", wait)
+	}
+}
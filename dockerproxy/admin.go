@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// adminRequest only lets requests through that present ADMIN_TOKEN, either as
+// a bearer token or as the Basic-Auth password. Admin routes are disabled
+// entirely when no token is configured.
+func adminRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if _, password, ok := r.BasicAuth(); ok {
+			token = password
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			writeDockerError(w, http.StatusUnauthorized, "You are not authorized to administer this builder")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func flushAuthCacheHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var flushed int
+		if appName := strings.TrimSpace(r.URL.Query().Get("app")); appName != "" {
+			prefix := authCacheAppPrefix(appName)
+			for key := range authCache.Items() {
+				if strings.HasPrefix(key, prefix) {
+					authCache.Delete(key)
+					flushed++
+				}
+			}
+			for key := range authStale.Items() {
+				if strings.HasPrefix(key, prefix) {
+					authStale.Delete(key)
+				}
+			}
+			for key := range authRevalidate.Items() {
+				if strings.HasPrefix(key, prefix) {
+					authRevalidate.Delete(key)
+				}
+			}
+		} else {
+			flushed = flushAuthCache()
+		}
+
+		log.Infof("flushed %d auth cache entries", flushed)
+
+		w.WriteHeader(http.StatusOK)
+		err := json.NewEncoder(w).Encode(map[string]int{
+			"flushed": flushed,
+		})
+		if err != nil {
+			log.Warnln("error writing flush response", err)
+		}
+	})
+}
+
+// flushAuthCache forgets every authorization decision, returning how many
+// there were.
+func flushAuthCache() int {
+	flushed := authCache.ItemCount()
+	authCache.Flush()
+	authStale.Flush()
+	authRevalidate.Flush()
+	return flushed
+}
+
+// reloadConfigHandler reloads the config like SIGHUP does, for operators who
+// can reach the builder but not its process.
+func reloadConfigHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		log.Info("reloading config for admin request")
+		pending, err := reloadConfig()
+		if err != nil {
+			log.Errorf("error reloading config: %v", err)
+			writeDockerError(w, http.StatusBadRequest, fmt.Sprintf("config not reloaded: %v", err))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		err = json.NewEncoder(w).Encode(map[string][]string{
+			"restartRequired": append([]string{}, pending...),
+		})
+		if err != nil {
+			log.Warnln("error writing reload response", err)
+		}
+	})
+}
+
+// registerAdminRoutes adds the operator-facing routes, which live on the main
+// listener or on ADMIN_ADDR.
+func registerAdminRoutes(mux *http.ServeMux) {
+	mux.Handle("/admin/flush-auth-cache", wrapAdminMiddlewares(flushAuthCacheHandler()))
+	mux.Handle("/flyio/v1/flushAuthCache", wrapAdminMiddlewares(flushAuthCacheHandler()))
+	mux.Handle("/admin/reload", wrapAdminMiddlewares(reloadConfigHandler()))
+	mux.Handle("/flyio/v1/drain", wrapAdminMiddlewares(drainHandler()))
+	mux.Handle("/admin/recent-builds", wrapAdminMiddlewares(recentBuildsHandler()))
+	mux.Handle("/admin/app-activity", wrapAdminMiddlewares(appActivityHandler()))
+	mux.Handle("/admin/usage", wrapAdminMiddlewares(appUsageHandler()))
+}
+
+func wrapAdminMiddlewares(h http.Handler) http.Handler {
+	return accessLog(
+		upgradeToHTTPs(
+			adminRequest(
+				h,
+			),
+		),
+	)
+}
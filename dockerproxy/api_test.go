@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/superfly/rchab/dockerproxy/internal/auth"
+	"github.com/superfly/rchab/dockerproxy/internal/harness"
+)
+
+// startAPI serves the builder's API in front of a fake dockerd, the way
+// main does, and returns both.
+func startAPI(t *testing.T) (*httptest.Server, *harness.Dockerd) {
+	t.Helper()
+
+	dockerd := harness.NewDockerd(t)
+	defer func(target *url.URL) { dockerTarget = target }(dockerTarget)
+	dockerTarget = dockerd.URL
+	dockerClient, err := newDockerClient(dockerd.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := httptest.NewServer(newAPIMux(dockerClient))
+	t.Cleanup(api.Close)
+	return api, dockerd
+}
+
+func TestAPI(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	defer func(a auth.Authorizer) { authorizer = a }(authorizer)
+	authorizer = fakeAuthorizer
+	defer func(history *buildHistory) { recentBuilds = history }(recentBuilds)
+	recentBuilds = newBuildHistory(10)
+	appsLastSeen = newAppActivity()
+
+	api, dockerd := startAPI(t)
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		status int
+		body   string
+	}{
+		{"ping", http.MethodGet, "/_ping", "good-token", http.StatusOK, "OK"},
+		{"version", http.MethodGet, "/v1.41/version", "good-token", http.StatusOK, `"ApiVersion":"1.41"`},
+		{"build", http.MethodPost, "/v1.41/build", "good-token", http.StatusOK, "Successfully built abc123"},
+		{"pull", http.MethodPost, "/v1.41/images/create?fromImage=alpine", "good-token", http.StatusOK, "Pulling from alpine"},
+		{"push", http.MethodPost, "/v1.41/images/registry.fly.io/my-app/push", "good-token", http.StatusOK, "digest: sha256:abc123"},
+		{"containers are off limits", http.MethodPost, "/v1.41/containers/create", "good-token", http.StatusForbidden, ""},
+		{"wrong token", http.MethodGet, "/_ping", "bad-token", http.StatusUnauthorized, ""},
+		{"health check needs no credentials", http.MethodGet, "/healthz", "", http.StatusOK, "ok"},
+		{"readiness", http.MethodGet, "/readyz", "", http.StatusOK, "ok"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, _ := http.NewRequest(tc.method, api.URL+tc.path, nil)
+			if tc.token != "" {
+				r.SetBasicAuth("my-app", tc.token)
+			}
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != tc.status {
+				t.Fatalf("expected status %d, but got %d: %s", tc.status, resp.StatusCode, body)
+			}
+			if !strings.Contains(string(body), tc.body) {
+				t.Errorf("expected the body to contain %q, but got %q", tc.body, body)
+			}
+		})
+	}
+
+	got := dockerd.Requests()
+	for _, want := range []string{"POST /build", "POST /images/create", "POST /images/registry.fly.io/my-app/push"} {
+		if !slices.Contains(got, want) {
+			t.Errorf("expected dockerd to get %s, but it got %v", want, got)
+		}
+	}
+	if slices.Contains(got, "POST /containers/create") {
+		t.Error("expected the refused request to stop at the proxy")
+	}
+	if builds := recentBuilds.list(); len(builds) != 1 || builds[0].App != "my-app" {
+		t.Errorf("expected one build for my-app, but got %+v", builds)
+	}
+}
+
+func TestAPINoAuth(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	defer func(disabled bool) { noAuth = disabled }(noAuth)
+	noAuth = true
+
+	api, _ := startAPI(t)
+
+	resp, err := http.Get(api.URL + "/_ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected NO_AUTH to let requests without credentials in, but got %d", resp.StatusCode)
+	}
+}
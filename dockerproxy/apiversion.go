@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/docker/docker/api/types/versions"
+)
+
+var (
+	apiVersionPrefix = regexp.MustCompile(`^/v([0-9]+\.[0-9]+)/`)
+	apiVersionFormat = regexp.MustCompile(`^[0-9]+\.[0-9]+$`)
+)
+
+// checkAPIVersionRange fails if MIN_API_VERSION or MAX_API_VERSION aren't
+// docker API versions like "1.41".
+func checkAPIVersionRange() error {
+	for key, val := range map[string]string{"MIN_API_VERSION": minAPIVersion, "MAX_API_VERSION": maxAPIVersion} {
+		if val != "" && !apiVersionFormat.MatchString(val) {
+			return fmt.Errorf("invalid %s %q, expected a version like 1.41", key, val)
+		}
+	}
+	if minAPIVersion != "" && maxAPIVersion != "" && versions.GreaterThan(minAPIVersion, maxAPIVersion) {
+		return fmt.Errorf("MIN_API_VERSION %s is greater than MAX_API_VERSION %s", minAPIVersion, maxAPIVersion)
+	}
+	return nil
+}
+
+// apiVersionAllowed rejects requests pinned to a docker API version outside of
+// [MIN_API_VERSION, MAX_API_VERSION]. Unversioned paths like /_ping always pass.
+func apiVersionAllowed(w http.ResponseWriter, r *http.Request) bool {
+	m := apiVersionPrefix.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		return true
+	}
+	version := m[1]
+
+	if minAPIVersion != "" && versions.LessThan(version, minAPIVersion) {
+		writeDockerError(w, http.StatusBadRequest, fmt.Sprintf("client version %s is too old. Minimum supported API version is %s, please upgrade your client to a newer version", version, minAPIVersion))
+		return false
+	}
+	if maxAPIVersion != "" && versions.GreaterThan(version, maxAPIVersion) {
+		writeDockerError(w, http.StatusBadRequest, fmt.Sprintf("client version %s is too new. Maximum supported API version is %s", version, maxAPIVersion))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+)
+
+const (
+	auditBatchSize     = 256
+	auditFlushInterval = 5 * time.Second
+)
+
+// auditLog records every Docker API request proxied for a client. nil,
+// recording nothing, unless AUDIT_LOG_FILE or AUDIT_LOG_URL is set.
+var auditLog *auditLogger
+
+// auditEntry says who did what to the builder's dockerd, and when.
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	App       string    `json:"app"`
+	Org       string    `json:"org,omitempty"`
+	Source    string    `json:"source"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	// images pushed, pulled, tagged or built
+	Images []string `json:"images,omitempty"`
+	// made with OPERATOR_APPS credentials
+	Operator bool `json:"operator,omitempty"`
+	Status   int  `json:"status"`
+}
+
+// auditLogger appends entries as JSON lines to a file, and posts them in
+// batches to a remote sink. The file is only ever appended to, while the
+// sink can miss entries, so keep the file for a complete record.
+type auditLogger struct {
+	mu   sync.Mutex
+	file *os.File
+
+	url   string
+	token string
+	// nil without a sink
+	sink *batchSender[[]byte]
+}
+
+func newAuditLogger(path, url, token string) (*auditLogger, error) {
+	if path == "" && url == "" {
+		return nil, nil
+	}
+	a := &auditLogger{url: url, token: token}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("could not open the audit log: %w", err)
+		}
+		a.file = f
+	}
+	if url != "" {
+		a.sink = newBatchSender("audit entries", auditBatchSize, 4*auditBatchSize, auditFlushInterval, a.send)
+	}
+	return a, nil
+}
+
+func (a *auditLogger) record(entry auditEntry) {
+	if a == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("could not encode audit entry: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if a.file != nil {
+		a.mu.Lock()
+		_, err := a.file.Write(line)
+		a.mu.Unlock()
+		if err != nil {
+			log.Errorf("could not write audit entry for request %s: %v", entry.RequestID, err)
+		}
+	}
+	if a.sink != nil && !a.sink.add(line) {
+		log.Warnf("audit sink queue full, dropping entry for request %s", entry.RequestID)
+	}
+}
+
+// run posts batches of entries to the sink until close is called.
+func (a *auditLogger) run() {
+	if a.sink != nil {
+		a.sink.run()
+	}
+}
+
+// close flushes what's queued for the sink, giving up after timeout, and
+// closes the file.
+func (a *auditLogger) close(timeout time.Duration) {
+	if a.sink != nil {
+		a.sink.close(timeout)
+	}
+	if a.file != nil {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.file.Sync()
+		a.file.Close()
+	}
+}
+
+func (a *auditLogger) send(batch [][]byte) {
+	if err := a.post(bytes.Join(batch, nil)); err != nil {
+		log.Errorf("could not send %d audit entries: %v", len(batch), err)
+	}
+}
+
+// post sends newline delimited JSON, retrying once.
+func (a *auditLogger) post(body []byte) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodPost, a.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		if a.token != "" {
+			req.Header.Set("Authorization", "Bearer "+a.token)
+		}
+		var resp *http.Response
+		resp, err = (&http.Client{Timeout: 10 * time.Second}).Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < http.StatusBadRequest {
+			return nil
+		}
+		err = fmt.Errorf("audit sink answered %s", resp.Status)
+	}
+	return err
+}
+
+// auditRequests records each request to the audit log once it's done,
+// refused ones included.
+func auditRequests(next http.Handler) http.Handler {
+	if auditLog == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := auditEntry{
+			Time:   time.Now(),
+			Source: requestSource(r),
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Images: auditImages(r),
+		}
+		// hijacked connections never write a status
+		code := http.StatusSwitchingProtocols
+		w = httpsnoop.Wrap(w, httpsnoop.Hooks{
+			WriteHeader: func(writeHeader httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+				return func(c int) {
+					code = c
+					writeHeader(c)
+				}
+			},
+			Write: func(write httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+				return func(b []byte) (int, error) {
+					if code == http.StatusSwitchingProtocols {
+						code = http.StatusOK
+					}
+					return write(b)
+				}
+			},
+		})
+		// the proxy panics when the client hangs up mid-stream, that's still
+		// worth a record
+		defer func() {
+			if info := requestInfoFromContext(r.Context()); info != nil {
+				entry.RequestID = info.id
+				entry.App = info.appName
+				entry.Operator = info.operator
+				if slug, ok := appOrgSlugs.Load(info.appName); ok {
+					entry.Org = slug.(string)
+				}
+			}
+			entry.Status = code
+			auditLog.record(entry)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// auditImages returns the images a request pushes, pulls, tags or builds.
+func auditImages(r *http.Request) []string {
+	query := r.URL.Query()
+	withTag := func(image, tag string) string {
+		if tag != "" {
+			return image + ":" + tag
+		}
+		return image
+	}
+	switch {
+	case buildPath.MatchString(r.URL.Path):
+		return query["t"]
+	case imagePushPath.MatchString(r.URL.Path):
+		return []string{withTag(imagePushPath.FindStringSubmatch(r.URL.Path)[2], query.Get("tag"))}
+	case imagePullPath.MatchString(r.URL.Path) && query.Get("fromImage") != "":
+		return []string{withTag(query.Get("fromImage"), query.Get("tag"))}
+	case imageTagPath.MatchString(r.URL.Path):
+		return []string{imageTagPath.FindStringSubmatch(r.URL.Path)[2], withTag(query.Get("repo"), query.Get("tag"))}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/superfly/rchab/dockerproxy/internal/harness"
+)
+
+func TestRequestPipelineAuditLog(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	logger, err := newAuditLogger(path, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(a *auditLogger) { auditLog = a }(auditLog)
+	auditLog = logger
+
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "{}\n")
+	}))
+	h := accessLog(newAuthRequest(fakeAuthorizer, newDockerProxy(dockerd)))
+	for _, path := range []string{
+		"/v1.41/images/registry.fly.io/my-app/push?tag=deployment-1",
+		"/v1.41/images/create?fromImage=alpine&tag=3.19",
+		"/v1.41/containers/create",
+	} {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r.SetBasicAuth("my-app", "good-token")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	logger.close(time.Second)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []auditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid audit line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 audit entries, but got %d", len(entries))
+	}
+	expected := []struct {
+		images []string
+		status int
+	}{
+		{[]string{"registry.fly.io/my-app:deployment-1"}, http.StatusOK},
+		{[]string{"alpine:3.19"}, http.StatusOK},
+		// refused by the path policy, still recorded
+		{nil, http.StatusForbidden},
+	}
+	for i, entry := range entries {
+		if entry.App != "my-app" || entry.RequestID == "" || entry.Method != http.MethodPost {
+			t.Errorf("expected entry %d to say who made the request, but got %+v", i, entry)
+		}
+		if !reflect.DeepEqual(entry.Images, expected[i].images) || entry.Status != expected[i].status {
+			t.Errorf("expected entry %d for %v with %d, but got %+v", i, expected[i].images, expected[i].status, entry)
+		}
+	}
+}
+
+func TestAuditLoggerSink(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		lines []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		lines = append(lines, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	logger, err := newAuditLogger("", server.URL, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go logger.run()
+	logger.record(auditEntry{App: "a", Path: "/build"})
+	logger.record(auditEntry{App: "b", Path: "/build"})
+	logger.close(5 * time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(lines) != 2 || !strings.Contains(lines[0], `"app":"a"`) || !strings.Contains(lines[1], `"app":"b"`) {
+		t.Errorf("expected both entries in order, but got %q", lines)
+	}
+}
@@ -1,107 +1,431 @@
 package main
 
 import (
+	"cmp"
 	"context"
-	"encoding/json"
-	"fmt"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
 
-	"github.com/superfly/flyctl/api"
+	"github.com/sirupsen/logrus"
+	fly "github.com/superfly/fly-go"
+	"github.com/superfly/graphql"
+	"github.com/superfly/rchab/dockerproxy/internal/auth"
 )
 
+const (
+	// authModeFly checks that the app belongs to the builder's organization via the Fly API
+	authModeFly = "fly"
+	// authModeStatic accepts the tokens in STATIC_AUTH_TOKEN and STATIC_AUTH_TOKENS_FILE, for use outside of Fly
+	authModeStatic = "static"
+	// authModeJWT accepts JWTs signed by an OIDC issuer
+	authModeJWT = "jwt"
+	// authModeNone lets every request in, with or without credentials
+	authModeNone = "none"
+)
+
+// apiDenyReason tells a failed lookup apart from a Fly API failure.
+func apiDenyReason(err error, notFound auth.DenyReason) auth.DenyReason {
+	if err == nil || fly.IsNotFoundError(err) {
+		return notFound
+	}
+	if fly.IsNotAuthenticatedError(err) {
+		return auth.DenyBadCredentials
+	}
+
+	// errors the API reports in a 200 response carry a code
+	var gqlErr *graphql.GraphQLError
+	if errors.As(err, &gqlErr) {
+		switch gqlErr.Extensions.Code {
+		case "NOT_FOUND":
+			return notFound
+		case "UNAUTHORIZED", "UNAUTHENTICATED":
+			return auth.DenyBadCredentials
+		}
+	}
+	return auth.DenyAPIError
+}
+
 func authRequest(next http.Handler) http.Handler {
 	if noAuth {
 		return next
 	}
+	return newAuthRequest(authorizer, next)
+}
 
+// newAuthRequest checks every request's credentials with authz before
+// passing it on to next. See auth.RequestCredentials for what clients can
+// send. With allowAll, for AUTH_MODE=none, they don't have to send any.
+func newAuthRequest(authz auth.Authorizer, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		appName, authToken, ok := r.BasicAuth()
-
-		if !ok || !authorizeRequestWithCache(r.Context(), appName, authToken) {
-			w.WriteHeader(http.StatusUnauthorized)
-			err := json.NewEncoder(w).Encode(map[string]string{
-				"message": "You are not authorized to use this builder",
-			})
-			if err != nil {
-				log.Warnln("error writing response", err)
+		l := requestLogger(r.Context())
+		source := requestSource(r)
+		if authFailuresExceeded(source) {
+			l.Warnf("too many failed auth attempts from %s, rejecting", source)
+			w.Header().Set("Retry-After", strconv.Itoa(int(authFailureCooldown.Seconds())))
+			writeDockerError(w, http.StatusTooManyRequests, "Too many failed authorization attempts, try again later")
+			return
+		}
+
+		appName, authToken, ok := auth.RequestCredentials(r, authz)
+		if _, none := authz.(allowAll); none && !ok {
+			// there's nothing to check credentials against
+			appName, ok = cmp.Or(r.Header.Get(auth.AppNameHeader), anonymousApp), true
+		}
+
+		authorized, reason := false, auth.DenyBadCredentials
+		if ok {
+			ctx, span := startSpan(r.Context(), "auth")
+			span.set("app", appName)
+			authorized, reason = authz.Authorize(ctx, appName, authToken)
+			span.set("authorized", authorized)
+			if !authorized {
+				span.set("deny_reason", reason.String())
+			}
+			span.finish()
+		}
+		if !authorized {
+			l.WithFields(logrus.Fields{
+				"app":         appName,
+				"deny_reason": reason,
+			}).Warn("denied request")
+			if reason.Definitive() {
+				recordAuthFailure(source)
 			}
+			metricAuthFailures.inc(reason.String())
+			writeDockerError(w, http.StatusUnauthorized, renderUnauthorizedMessage(appName, reason))
 			return
 		}
 
+		authFailures.Delete(source)
+
+		operator := isOperator(r, appName)
+
+		// dockerd has no use for the credentials, don't hand them on
+		r.Header.Del("Authorization")
+		r.Header.Del(auth.AppNameHeader)
+		r.Header.Del(operatorTokenHeader)
+
+		if info := requestInfoFromContext(r.Context()); info != nil {
+			info.appName = appName
+			info.authToken = authToken
+			info.operator = operator
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
 
-func authorizeRequestWithCache(ctx context.Context, appName, authToken string) bool {
+// operatorTokenHeader carries OPERATOR_TOKEN. The docker CLI sends it along
+// with every request when it's in HttpHeaders in its config.json.
+const operatorTokenHeader = "Fly-Operator-Token"
+
+// isOperator reports whether r may also run and exec into containers: its
+// app has to be one of OPERATOR_APPS, and it has to present OPERATOR_TOKEN.
+// The app's own credentials aren't enough, every deploy token of the app
+// has those, and operators can start privileged containers on a builder
+// other apps share.
+func isOperator(r *http.Request, appName string) bool {
+	if operatorToken == "" || !slices.Contains(operatorApps.Get(), appName) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(operatorTokenHeader)), []byte(operatorToken)) == 1
+}
+
+// requestSource identifies the client for rate limiting. Behind Fly's proxy
+// that's the address the proxy saw, otherwise the peer address.
+func requestSource(r *http.Request) string {
+	if ip := r.Header.Get("Fly-Client-IP"); ip != "" && trustFlyClientIP {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func authFailuresExceeded(source string) bool {
+	if authFailureLimit <= 0 {
+		return false
+	}
+	failures, ok := authFailures.Get(source)
+	return ok && failures.(int) >= authFailureLimit
+}
+
+// recordAuthFailure counts a failed attempt within authFailureWindow. Once a
+// source hits the limit it stays blocked for authFailureCooldown.
+func recordAuthFailure(source string) {
+	if authFailureLimit <= 0 {
+		return
+	}
+	if err := authFailures.Add(source, 1, authFailureWindow); err == nil {
+		return
+	}
+	failures, err := authFailures.IncrementInt(source, 1)
+	if err != nil {
+		log.Warnf("error counting auth failure for %s: %v", source, err)
+		return
+	}
+	if failures >= authFailureLimit {
+		authFailures.Set(source, failures, authFailureCooldown)
+	}
+}
+
+func authorizeRequestWithCache(ctx context.Context, appName, authToken string) (bool, auth.DenyReason) {
+	l := requestLogger(ctx)
 	if noAuth {
-		return true
+		return true, auth.DenyNone
 	}
 
 	if appName == "" || authToken == "" {
-		return false
+		return false, auth.DenyBadCredentials
+	}
+
+	if authCacheDisabled {
+		return authorizeFromAPI(ctx, appName, authToken)
 	}
 
-	cacheKey := appName + ":" + authToken
+	cacheKey := authCacheKey(appName, authToken)
 	if val, ok := authCache.Get(cacheKey); ok {
-		if authorized, ok := val.(bool); ok {
-			log.Debugln("authorized from cache")
-			return authorized
+		if reason, ok := val.(auth.DenyReason); ok {
+			l.Debugln("authorized from cache")
+			metricAuthCache.inc("hit")
+			spanFromContext(ctx).set("auth.cache", "hit")
+			if reason == auth.DenyNone {
+				rememberForRevalidation(cacheKey, appName, authToken)
+			}
+			return reason == auth.DenyNone, reason
+		}
+	}
+
+	metricAuthCache.inc("miss")
+	spanFromContext(ctx).set("auth.cache", "miss")
+	authorized, reason, shared := authFlights.Do(ctx, cacheKey, func(ctx context.Context) (bool, auth.DenyReason) {
+		ctx, span := startSpan(ctx, "auth.api")
+		authorized, reason := authorizeFromAPI(ctx, appName, authToken)
+		span.set("deny_reason", reason.String())
+		span.finish()
+		// only cache what the API actually answered, an outage isn't a denial
+		if reason.Definitive() {
+			ttl := authCacheTTL.Get()
+			if !authorized {
+				ttl = authNegativeTTL.Get()
+			}
+			authCache.Set(cacheKey, reason, ttl)
+			if authorized && authStaleGrace > 0 {
+				authStale.Set(cacheKey, struct{}{}, ttl+authStaleGrace)
+			}
+			if authorized {
+				rememberForRevalidation(cacheKey, appName, authToken)
+			}
 		}
+		return authorized, reason
+	})
+	if shared {
+		l.Debugln("authorized by a concurrent lookup")
+		spanFromContext(ctx).set("auth.shared", true)
 	}
 
-	authorized := authorizeRequest(ctx, appName, authToken)
-	authCache.Set(cacheKey, authorized, 0)
-	log.Debugln("authorized from api")
-	return authorized
+	if !authorized && reason == auth.DenyAPIError && authStaleGrace > 0 {
+		if _, ok := authStale.Get(cacheKey); ok {
+			l.WithField("app", appName).Error("Fly API unavailable, authorizing from an expired cache entry")
+			metricAuthCache.inc("stale")
+			spanFromContext(ctx).set("auth.cache", "stale")
+			// not DenyNone, so the stale answer doesn't get cached again
+			return true, auth.DenyAPIError
+		}
+	}
+
+	l.Debugln("authorized from api")
+	return authorized, reason
+}
+
+// authorizeFromAPI asks the Fly API, giving each attempt authAPITimeout and
+// retrying API errors. Once the API keeps failing, flyAPIBreaker stops
+// asking for a while and requests get AUTH_API_FAILURE_MODE instead.
+func authorizeFromAPI(ctx context.Context, appName, authToken string) (bool, auth.DenyReason) {
+	l := requestLogger(ctx)
+	if !flyAPIBreaker.allow() {
+		if authAPIFailOpen {
+			l.Warnf("Fly API unavailable, letting app %s in without checking", appName)
+			// not DenyNone, so the answer doesn't get cached
+			return true, auth.DenyAPIError
+		}
+		return false, auth.DenyAPIError
+	}
+
+	for attempt := 0; ; attempt++ {
+		callCtx, cancel := context.WithTimeout(ctx, authAPITimeout)
+		authorized, reason := authorizeRequest(callCtx, appName, authToken)
+		cancel()
+
+		if reason != auth.DenyAPIError || attempt >= authAPIRetries {
+			flyAPIBreaker.record(reason != auth.DenyAPIError)
+			return authorized, reason
+		}
+		if !sleepCtx(ctx, jitteredBackoff(200*time.Millisecond, attempt)) {
+			return authorized, reason
+		}
+		l.Infof("retrying authorization of app %s after a Fly API error", appName)
+	}
+}
+
+// authCacheKey derives the auth cache key for an app and token. Both are
+// hashed, so raw tokens aren't kept in memory and no choice of app name can
+// collide with another app's keys. Keys for one app share authCacheAppPrefix.
+func authCacheKey(appName, authToken string) string {
+	h := sha256.New()
+	// length-prefix the app name so the boundary between the fields is unambiguous
+	binary.Write(h, binary.BigEndian, uint64(len(appName)))
+	h.Write([]byte(appName))
+	h.Write([]byte(authToken))
+	return authCacheAppPrefix(appName) + hex.EncodeToString(h.Sum(nil))
+}
+
+func authCacheAppPrefix(appName string) string {
+	sum := sha256.Sum256([]byte(appName))
+	return hex.EncodeToString(sum[:]) + ":"
 }
 
 // TODO: If we know that we're always going to use 6pn to access builders, we can probably just drop this auth since the network will take care to authorize access within the same org?
-func authorizeRequest(ctx context.Context, appName, authToken string) bool {
-	fly := api.NewClient(authToken, fmt.Sprintf("superfly/rchab/%s", gitSha), "0.0.0.0.0.0.1", log)
+func authorizeRequest(ctx context.Context, appName, authToken string) (bool, auth.DenyReason) {
+	l := requestLogger(ctx)
+	api := newFlyAPI(authToken, l)
+	if isMacaroonToken(authToken) {
+		return authorizeMacaroon(ctx, api, appName, authToken)
+	}
 
-	app, err := fly.GetAppCompact(ctx, appName)
-	if app == nil || err != nil {
-		log.Warnf("Error fetching app %s: %v", appName, err)
-		return false
+	org, err := api.AppOrg(ctx, appName)
+	if org == nil || err != nil {
+		l.Warnf("Error fetching app %s: %v", appName, err)
+		return false, apiDenyReason(err, auth.DenyAppNotFound)
 	}
 
 	// local dev only: we started machine with NO_APP_NAME=1, skip checking that appName from auth is in same org as this builder
 	if noAppName {
-		log.Warnf("Skipping organization check for app %s on builder", appName)
-		return true
+		l.Warnf("Skipping organization check for app %s on builder", appName)
+		return true, auth.DenyNone
+	}
+
+	if len(allowedOrgSlugs.Get()) > 0 {
+		return authorizeOrg(ctx, appName, org.Slug)
 	}
 
 	builderAppName, ok := os.LookupEnv("FLY_APP_NAME")
 	if !ok {
-		log.Warn("FLY_APP_NAME env var is not set!")
-		return false
+		l.Warn("FLY_APP_NAME env var is not set!")
+		return false, auth.DenyMisconfigured
 	}
-	builderApp, err := fly.GetAppCompact(context.TODO(), builderAppName)
-	if builderApp == nil || err != nil {
-		log.Warnf("Error fetching builder app %s", builderAppName)
-		return false
+	builderOrg, err := api.AppOrg(ctx, builderAppName)
+	if builderOrg == nil || err != nil {
+		l.Warnf("Error fetching builder app %s", builderAppName)
+		return false, apiDenyReason(err, auth.DenyMisconfigured)
 	}
-	if app.Organization.ID != builderApp.Organization.ID {
-		log.Warnf("App %s is in %s org, and builder %s is in %s org", appName, app.Organization.Slug, builderAppName, builderApp.Organization.Slug)
-		return false
+	knownBuilderOrg.Store(builderOrg)
+	if !org.same(builderOrg) {
+		l.Warnf("App %s is in %s org, and builder %s is in %s org", appName, org.Slug, builderAppName, builderOrg.Slug)
+		return false, auth.DenyOrgMismatch
 	}
 
-	appOrg, err := fly.GetOrganizationBySlug(context.TODO(), app.Organization.Slug)
-	if appOrg == nil || err != nil {
-		log.Warnf("Error fetching org %s: %v", app.Organization.Slug, err)
-		return false
+	if appOrg, err := api.Org(ctx, org.Slug); appOrg == nil || err != nil {
+		l.Warnf("Error fetching org %s: %v", org.Slug, err)
+		return false, apiDenyReason(err, auth.DenyOrgNotFound)
 	}
-	builderOrg, err := fly.GetOrganizationBySlug(context.TODO(), builderApp.Organization.Slug)
-	if builderOrg == nil || err != nil {
-		log.Warnf("Error fetching org %s: %v", builderApp.Organization.Slug, err)
-		return false
+
+	metricAuthorizedOrgs.inc(org.Slug)
+	appOrgSlugs.Store(appName, org.Slug)
+	return true, auth.DenyNone
+}
+
+// authorizeMacaroon checks a Fly macaroon token, such as an org or app scoped
+// deploy token. The Fly API verifies the token and enforces its caveats, so
+// the app is only visible if the token grants access to it. The token's
+// organization caveat has to name the app's organization as well, which has
+// to be the builder's.
+func authorizeMacaroon(ctx context.Context, api flyAPI, appName, authToken string) (bool, auth.DenyReason) {
+	l := requestLogger(ctx)
+	orgIDs, err := macaroonOrgIDs(authToken)
+	if err != nil {
+		l.Warnf("Could not decode macaroon token for app %s: %v", appName, err)
+		return false, auth.DenyBadCredentials
+	}
+	org, err := api.AppOrg(ctx, appName)
+	if org == nil || err != nil {
+		l.Warnf("Error fetching app %s with macaroon token: %v", appName, err)
+		return false, apiDenyReason(err, auth.DenyAppNotFound)
+	}
+	if !org.limitedTo(orgIDs) {
+		l.Warnf("Macaroon token for app %s isn't limited to its %s org", appName, org.Slug)
+		return false, auth.DenyOrgMismatch
 	}
 
-	if app.Organization.ID != builderApp.Organization.ID {
-		log.Warnf("App %s does not belong to org %s (builder app: '%s' builder org: '%s')", app.Name, appOrg.Slug, builderAppName, builderOrg.Slug)
-		return false
+	// local dev only, see authorizeRequest
+	if noAppName {
+		l.Warnf("Skipping organization check for app %s on builder", appName)
+		return true, auth.DenyNone
+	}
+
+	if len(allowedOrgSlugs.Get()) > 0 {
+		return authorizeOrg(ctx, appName, org.Slug)
 	}
 
-	return true
+	builderAppName, ok := os.LookupEnv("FLY_APP_NAME")
+	if !ok {
+		l.Warn("FLY_APP_NAME env var is not set!")
+		return false, auth.DenyMisconfigured
+	}
+	// usually known from startup, see resolveBuilderOrg
+	builderOrg := knownBuilderOrg.Load()
+	if builderOrg == nil {
+		var err error
+		builderOrg, err = api.AppOrg(ctx, builderAppName)
+		switch {
+		case builderOrg != nil && err == nil:
+			knownBuilderOrg.Store(builderOrg)
+		case apiDenyReason(err, auth.DenyOrgMismatch).Definitive():
+			// an app scoped token can't see the builder app
+			l.Warnf("Token for app %s can't see builder app %s and the builder's org isn't known yet", appName, builderAppName)
+			return false, auth.DenyOrgMismatch
+		default:
+			l.Warnf("Error fetching builder app %s: %v", builderAppName, err)
+			return false, auth.DenyAPIError
+		}
+	}
+
+	if !org.same(builderOrg) {
+		l.Warnf("App %s is in %s org, and builder %s is in %s org", appName, org.Slug, builderAppName, builderOrg.Slug)
+		return false, auth.DenyOrgMismatch
+	}
+	metricAuthorizedOrgs.inc(org.Slug)
+	appOrgSlugs.Store(appName, org.Slug)
+	return true, auth.DenyNone
+}
+
+// appOrgSlugs maps the apps authorized so far to their organization, for
+// the access log.
+var appOrgSlugs sync.Map
+
+// authorizeOrg lets appName in if its organization is one of ALLOW_ORG_SLUG.
+func authorizeOrg(ctx context.Context, appName, orgSlug string) (bool, auth.DenyReason) {
+	l := requestLogger(ctx)
+	for _, slug := range allowedOrgSlugs.Get() {
+		if slug == orgSlug {
+			l.WithFields(logrus.Fields{"app": appName, "org": orgSlug}).Info("authorized app from allowed org")
+			metricAuthorizedOrgs.inc(orgSlug)
+			appOrgSlugs.Store(appName, orgSlug)
+			return true, auth.DenyNone
+		}
+	}
+	l.Warnf("App %s is in %s org, which is not allowed on this builder", appName, orgSlug)
+	return false, auth.DenyOrgMismatch
 }
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+	fly "github.com/superfly/fly-go"
+	"github.com/superfly/graphql"
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/flyio"
+	"github.com/superfly/macaroon/resset"
+	"github.com/superfly/rchab/dockerproxy/internal/auth"
+)
+
+func TestAuthFailureLimit(t *testing.T) {
+	defer func(limit int, failures *cache.Cache) {
+		authFailureLimit, authFailures = limit, failures
+	}(authFailureLimit, authFailures)
+	authFailureLimit = 3
+	authFailures = cache.New(time.Minute, time.Minute)
+
+	for i := 0; i < authFailureLimit-1; i++ {
+		recordAuthFailure("1.2.3.4")
+	}
+	if authFailuresExceeded("1.2.3.4") {
+		t.Fatal("expected source to be allowed below the limit")
+	}
+
+	recordAuthFailure("1.2.3.4")
+	if !authFailuresExceeded("1.2.3.4") {
+		t.Fatal("expected source to be blocked at the limit")
+	}
+	if authFailuresExceeded("5.6.7.8") {
+		t.Fatal("expected other sources to be unaffected")
+	}
+
+	_, expires, _ := authFailures.GetWithExpiration("1.2.3.4")
+	if remaining := time.Until(expires); remaining <= authFailureWindow {
+		t.Errorf("expected the block to last for the cooldown, but it expires in %s", remaining)
+	}
+}
+
+func TestAuthFailureLimitDisabled(t *testing.T) {
+	defer func(limit int, failures *cache.Cache) {
+		authFailureLimit, authFailures = limit, failures
+	}(authFailureLimit, authFailures)
+	authFailureLimit = 0
+	authFailures = cache.New(time.Minute, time.Minute)
+
+	for i := 0; i < 100; i++ {
+		recordAuthFailure("1.2.3.4")
+	}
+	if authFailuresExceeded("1.2.3.4") {
+		t.Fatal("expected no limit when AUTH_FAILURE_LIMIT is 0")
+	}
+}
+
+func TestRequestSource(t *testing.T) {
+	defer func(trust bool) { trustFlyClientIP = trust }(trustFlyClientIP)
+
+	r := httptest.NewRequest(http.MethodGet, "/_ping", nil)
+	r.RemoteAddr = "10.0.0.1:5555"
+	r.Header.Set("Fly-Client-IP", "1.2.3.4")
+
+	trustFlyClientIP = false
+	if got := requestSource(r); got != "10.0.0.1" {
+		t.Errorf("expected the peer address, but got %q", got)
+	}
+
+	trustFlyClientIP = true
+	if got := requestSource(r); got != "1.2.3.4" {
+		t.Errorf("expected Fly-Client-IP, but got %q", got)
+	}
+}
+
+func TestAPIDenyReason(t *testing.T) {
+	notFound := &graphql.GraphQLError{Message: "Could not find App"}
+	notFound.Extensions.Code = "NOT_FOUND"
+	unauthorized := &graphql.GraphQLError{Message: "You must be authenticated"}
+	unauthorized.Extensions.Code = "UNAUTHORIZED"
+
+	cases := []struct {
+		name     string
+		err      error
+		expected auth.DenyReason
+	}{
+		{"no error", nil, auth.DenyAppNotFound},
+		{"graphql not found", notFound, auth.DenyAppNotFound},
+		{"wrapped graphql not found", fmt.Errorf("lookup: %w", notFound), auth.DenyAppNotFound},
+		{"graphql unauthorized", unauthorized, auth.DenyBadCredentials},
+		{"graphql other", &graphql.GraphQLError{Message: "boom"}, auth.DenyAPIError},
+		{"http not found", &fly.ApiError{Status: http.StatusNotFound}, auth.DenyAppNotFound},
+		{"http unauthorized", &fly.ApiError{Status: http.StatusUnauthorized}, auth.DenyBadCredentials},
+		{"http server error", &fly.ApiError{Status: http.StatusBadGateway}, auth.DenyAPIError},
+		// a message alone doesn't make it a not found
+		{"transport", errors.New("could not find host api.fly.io"), auth.DenyAPIError},
+	}
+
+	for _, tc := range cases {
+		if got := apiDenyReason(tc.err, auth.DenyAppNotFound); got != tc.expected {
+			t.Errorf("%s: expected %s, but got %s", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestAuthorizeRequestWithCacheHit(t *testing.T) {
+	defer func(mode string, c *cache.Cache) { authMode, authCache = mode, c }(authMode, authCache)
+	authMode = authModeFly
+	authCache = cache.New(time.Minute, time.Minute)
+
+	// cached answers never reach the Fly API
+	authCache.Set(authCacheKey("my-app", "token"), auth.DenyOrgMismatch, 0)
+	authCache.Set(authCacheKey("other-app", "token"), auth.DenyNone, 0)
+
+	authorized, reason := authorizeRequestWithCache(context.Background(), "my-app", "token")
+	if authorized || reason != auth.DenyOrgMismatch {
+		t.Errorf("expected the cached %s, but got %v, %s", auth.DenyOrgMismatch, authorized, reason)
+	}
+
+	authorized, reason = authorizeRequestWithCache(context.Background(), "other-app", "token")
+	if !authorized || reason != auth.DenyNone {
+		t.Errorf("expected a cached approval, but got %v, %s", authorized, reason)
+	}
+
+	authorized, reason = authorizeRequestWithCache(context.Background(), "", "token")
+	if authorized || reason != auth.DenyBadCredentials {
+		t.Errorf("expected %s without an app name, but got %v, %s", auth.DenyBadCredentials, authorized, reason)
+	}
+}
+
+func TestAuthCacheKey(t *testing.T) {
+	cases := [][2][2]string{
+		// the separator moves between the fields
+		{{"a:b", "c"}, {"a", "b:c"}},
+		{{"app:", "token"}, {"app", ":token"}},
+		{{"", "app:token"}, {"app", "token"}},
+		// the app name runs into the token
+		{{"app1", "23"}, {"app", "123"}},
+	}
+	for _, tc := range cases {
+		a := authCacheKey(tc[0][0], tc[0][1])
+		b := authCacheKey(tc[1][0], tc[1][1])
+		if a == b {
+			t.Errorf("%q and %q share the cache key %s", tc[0], tc[1], a)
+		}
+	}
+
+	key := authCacheKey("my-app", "secret-token")
+	if strings.Contains(key, "secret-token") || strings.Contains(key, "my-app") {
+		t.Errorf("expected the key to hide its inputs, but got %s", key)
+	}
+	if !strings.HasPrefix(key, authCacheAppPrefix("my-app")) {
+		t.Error("expected the key to start with the app's prefix")
+	}
+	if strings.HasPrefix(authCacheKey("my-app-2", "secret-token"), authCacheAppPrefix("my-app")) {
+		t.Error("expected another app's key not to share the prefix")
+	}
+}
+
+// fakeFlyAPI answers app lookups for the apps in orgs, keyed by the
+// Authorization header that can see them. Its macaroons are limited to the
+// builder's organization when they see it, or else to the one their apps
+// are in.
+func fakeFlyAPI(t *testing.T, visible map[string]map[string]string) {
+	t.Helper()
+	origOrgIDs := macaroonOrgIDs
+	t.Cleanup(func() { macaroonOrgIDs = origOrgIDs })
+	macaroonOrgIDs = func(token string) ([]uint64, error) {
+		apps := visible[flyAuthorizationHeader(token)]
+		org, ok := apps["builder"]
+		if !ok {
+			for _, appOrg := range apps {
+				org, ok = appOrg, true
+			}
+		}
+		if !ok {
+			return nil, nil
+		}
+		return []uint64{testOrgID(org)}, nil
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Variables map[string]string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		org, ok := visible[r.Header.Get("Authorization")][body.Variables["appName"]]
+		if !ok {
+			fmt.Fprint(w, `{"data":{"app":null},"errors":[{"message":"Could not find App","extensions":{"code":"NOT_FOUND"}}]}`)
+			return
+		}
+		fmt.Fprintf(w, `{"data":{"app":{"organization":{"id":%q,"slug":%q,"internalNumericId":"%d"}}}}`, org, org, testOrgID(org))
+	}))
+	t.Cleanup(server.Close)
+
+	orig := flyGraphQLURL
+	t.Cleanup(func() { flyGraphQLURL = orig })
+	flyGraphQLURL = server.URL
+}
+
+// testOrgID is the internal numeric ID of the organization with slug.
+func testOrgID(slug string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(slug))
+	return h.Sum64()
+}
+
+func TestAuthorizeMacaroon(t *testing.T) {
+	t.Setenv("FLY_APP_NAME", "builder")
+	defer knownBuilderOrg.Store(nil)
+
+	fakeFlyAPI(t, map[string]map[string]string{
+		"FlyV1 fm2_org":   {"my-app": "acme", "builder": "acme", "other-app": "other"},
+		"FlyV1 fm2_myapp": {"my-app": "acme"},
+	})
+
+	tests := []struct {
+		name       string
+		app, token string
+		known      *appOrg
+		want       auth.DenyReason
+	}{
+		{"org token", "my-app", "FlyV1 fm2_org", nil, auth.DenyNone},
+		{"without scheme", "my-app", "fm2_org", nil, auth.DenyNone},
+		{"app in another org", "other-app", "FlyV1 fm2_org", nil, auth.DenyOrgMismatch},
+		{"app token, builder org unknown", "my-app", "FlyV1 fm2_myapp", nil, auth.DenyOrgMismatch},
+		{"app token, builder org known", "my-app", "FlyV1 fm2_myapp", &appOrg{ID: "acme"}, auth.DenyNone},
+		{"app token for another app", "other-app", "FlyV1 fm2_myapp", &appOrg{ID: "acme"}, auth.DenyAppNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			knownBuilderOrg.Store(tt.known)
+			authorized, reason := authorizeRequest(context.Background(), tt.app, tt.token)
+			if reason != tt.want || authorized != (tt.want == auth.DenyNone) {
+				t.Errorf("expected %s, but got %s (authorized %v)", tt.want, reason, authorized)
+			}
+		})
+	}
+}
+
+func TestAuthorizeMacaroonOrgCaveat(t *testing.T) {
+	t.Setenv("FLY_APP_NAME", "builder")
+	defer knownBuilderOrg.Store(nil)
+	fakeFlyAPI(t, map[string]map[string]string{
+		"FlyV1 fm2_org": {"my-app": "acme", "builder": "acme"},
+	})
+
+	tests := []struct {
+		name   string
+		orgIDs []uint64
+		err    error
+		want   auth.DenyReason
+	}{
+		{"app's org", []uint64{testOrgID("acme")}, nil, auth.DenyNone},
+		{"another org", []uint64{testOrgID("other")}, nil, auth.DenyOrgMismatch},
+		{"two orgs", []uint64{testOrgID("acme"), testOrgID("other")}, nil, auth.DenyOrgMismatch},
+		{"no org caveat", nil, nil, auth.DenyOrgMismatch},
+		{"not a macaroon", nil, errors.New("bad token"), auth.DenyBadCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			macaroonOrgIDs = func(string) ([]uint64, error) { return tt.orgIDs, tt.err }
+			authorized, reason := authorizeRequest(context.Background(), "my-app", "FlyV1 fm2_org")
+			if reason != tt.want || authorized != (tt.want == auth.DenyNone) {
+				t.Errorf("expected %s, but got %s (authorized %v)", tt.want, reason, authorized)
+			}
+		})
+	}
+}
+
+func TestMacaroonOrgIDs(t *testing.T) {
+	key := macaroon.NewSigningKey()
+	encode := func(location string, caveats ...macaroon.Caveat) []byte {
+		m, err := macaroon.New([]byte("kid"), location, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Add(caveats...); err != nil {
+			t.Fatal(err)
+		}
+		tok, err := m.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	header := macaroon.ToAuthorizationHeader(
+		encode(flyio.LocationPermission, &flyio.Organization{ID: 1234, Mask: resset.ActionAll}),
+		// discharges don't limit the token
+		encode(flyio.LocationAuthentication, &flyio.Organization{ID: 5678, Mask: resset.ActionAll}),
+	)
+
+	ids, err := macaroonOrgIDs(header)
+	if err != nil || len(ids) != 1 || ids[0] != 1234 {
+		t.Errorf("expected org 1234, but got %v, %v", ids, err)
+	}
+	if _, err := macaroonOrgIDs("FlyV1 fm2_org"); err == nil {
+		t.Error("expected an error for a token that isn't a macaroon")
+	}
+}
+
+func TestFlyAuthorizationHeader(t *testing.T) {
+	tests := map[string]string{
+		"personal":          "Bearer personal",
+		"fm2_abc":           "FlyV1 fm2_abc",
+		"FlyV1 fm2_a,fm2_b": "FlyV1 fm2_a,fm2_b",
+		"fm1r_abc":          "FlyV1 fm1r_abc",
+	}
+	for token, want := range tests {
+		if got := flyAuthorizationHeader(token); got != want {
+			t.Errorf("flyAuthorizationHeader(%q) = %q, want %q", token, got, want)
+		}
+	}
+}
+
+func TestAuthorizeAllowedOrgs(t *testing.T) {
+	t.Setenv("FLY_APP_NAME", "builder")
+	defer allowedOrgSlugs.Set(allowedOrgSlugs.Get())
+	allowedOrgSlugs.Set([]string{"acme", "acme-staging"})
+
+	// the app scoped token can't see the builder app, which doesn't matter
+	// once the allowed orgs are configured
+	fakeFlyAPI(t, map[string]map[string]string{
+		"FlyV1 fm2_myapp":    {"my-app": "acme"},
+		"FlyV1 fm2_staging":  {"staging-app": "acme-staging"},
+		"FlyV1 fm2_otherapp": {"other-app": "other"},
+	})
+
+	tests := []struct {
+		app, token string
+		want       auth.DenyReason
+	}{
+		{"my-app", "FlyV1 fm2_myapp", auth.DenyNone},
+		{"staging-app", "FlyV1 fm2_staging", auth.DenyNone},
+		{"other-app", "FlyV1 fm2_otherapp", auth.DenyOrgMismatch},
+	}
+	for _, tt := range tests {
+		if _, reason := authorizeRequest(context.Background(), tt.app, tt.token); reason != tt.want {
+			t.Errorf("%s: expected %s, but got %s", tt.app, tt.want, reason)
+		}
+	}
+}
+
+func TestAuthCacheTTLs(t *testing.T) {
+	t.Setenv("FLY_APP_NAME", "builder")
+	defer func(mode string, c *cache.Cache) { authMode, authCache = mode, c }(authMode, authCache)
+	authMode = authModeFly
+	authCache = cache.New(time.Minute, time.Minute)
+
+	fakeFlyAPI(t, map[string]map[string]string{
+		"FlyV1 fm2_org": {"my-app": "acme", "builder": "acme"},
+	})
+
+	authorizeRequestWithCache(context.Background(), "my-app", "FlyV1 fm2_org")
+	authorizeRequestWithCache(context.Background(), "other-app", "FlyV1 fm2_org")
+
+	_, allowedExpiry, _ := authCache.GetWithExpiration(authCacheKey("my-app", "FlyV1 fm2_org"))
+	_, deniedExpiry, ok := authCache.GetWithExpiration(authCacheKey("other-app", "FlyV1 fm2_org"))
+	if !ok {
+		t.Fatal("expected the denial to be cached")
+	}
+	if ttl := time.Until(allowedExpiry); ttl <= authNegativeTTL.Get() || ttl > authCacheTTL.Get() {
+		t.Errorf("expected the approval cached for %s, but it expires in %s", authCacheTTL.Get(), ttl)
+	}
+	if ttl := time.Until(deniedExpiry); ttl <= 0 || ttl > authNegativeTTL.Get() {
+		t.Errorf("expected the denial cached for %s, but it expires in %s", authNegativeTTL.Get(), ttl)
+	}
+
+	// an API outage isn't cached at all
+	defer func(retries int) { authAPIRetries = retries }(authAPIRetries)
+	authAPIRetries = 0
+	flyGraphQLURL = "http://127.0.0.1:1/graphql"
+	if _, reason := authorizeRequestWithCache(context.Background(), "down-app", "FlyV1 fm2_org"); reason != auth.DenyAPIError {
+		t.Fatalf("expected %s, but got %s", auth.DenyAPIError, reason)
+	}
+	if _, ok := authCache.Get(authCacheKey("down-app", "FlyV1 fm2_org")); ok {
+		t.Error("expected an API error not to be cached")
+	}
+}
+
+func TestAuthorizeFromAPIRetries(t *testing.T) {
+	t.Setenv("FLY_APP_NAME", "builder")
+	defer func(b *circuitBreaker, failOpen bool, retries int) {
+		flyAPIBreaker, authAPIFailOpen, authAPIRetries = b, failOpen, retries
+	}(flyAPIBreaker, authAPIFailOpen, authAPIRetries)
+	flyAPIBreaker = newCircuitBreaker(2, time.Hour)
+	authAPIRetries = 1
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		// the first lookup fails, then the API recovers
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, `{"data":{"app":{"organization":{"id":"acme","slug":"acme","internalNumericId":"1"}}}}`)
+	}))
+	defer server.Close()
+	defer func(url string) { flyGraphQLURL = url }(flyGraphQLURL)
+	flyGraphQLURL = server.URL
+	defer func(f func(string) ([]uint64, error)) { macaroonOrgIDs = f }(macaroonOrgIDs)
+	macaroonOrgIDs = func(string) ([]uint64, error) { return []uint64{1}, nil }
+
+	if authorized, reason := authorizeFromAPI(context.Background(), "my-app", "fm2_token"); !authorized {
+		t.Fatalf("expected a retry to get through, but got %s", reason)
+	}
+
+	// the API goes down for good and the breaker opens
+	server.Close()
+	for i := 0; i < 2; i++ {
+		authorizeFromAPI(context.Background(), "my-app", "fm2_token")
+	}
+	if flyAPIBreaker.allow() {
+		t.Fatal("expected the breaker to be open")
+	}
+	if authorized, reason := authorizeFromAPI(context.Background(), "my-app", "fm2_token"); authorized || reason != auth.DenyAPIError {
+		t.Errorf("expected to fail closed, but got %v, %s", authorized, reason)
+	}
+
+	authAPIFailOpen = true
+	if authorized, reason := authorizeFromAPI(context.Background(), "my-app", "fm2_token"); !authorized || reason.Definitive() {
+		t.Errorf("expected to fail open without a cacheable answer, but got %v, %s", authorized, reason)
+	}
+}
+
+func TestAuthStaleGrace(t *testing.T) {
+	t.Setenv("FLY_APP_NAME", "builder")
+	defer func(mode string, c, stale *cache.Cache, grace time.Duration, retries int) {
+		authMode, authCache, authStale, authStaleGrace, authAPIRetries = mode, c, stale, grace, retries
+	}(authMode, authCache, authStale, authStaleGrace, authAPIRetries)
+	authMode = authModeFly
+	authCache = cache.New(time.Minute, time.Minute)
+	authStale = cache.New(time.Minute, time.Minute)
+	authStaleGrace = time.Hour
+	authAPIRetries = 0
+
+	fakeFlyAPI(t, map[string]map[string]string{
+		"FlyV1 fm2_org": {"my-app": "acme", "builder": "acme"},
+	})
+	if authorized, _ := authorizeRequestWithCache(context.Background(), "my-app", "FlyV1 fm2_org"); !authorized {
+		t.Fatal("expected the app to be authorized")
+	}
+
+	// the cache entry expires while the API is down
+	authCache.Flush()
+	flyGraphQLURL = "http://127.0.0.1:1/graphql"
+
+	if authorized, _ := authorizeRequestWithCache(context.Background(), "my-app", "FlyV1 fm2_org"); !authorized {
+		t.Error("expected the expired approval to be used during the outage")
+	}
+	if _, ok := authCache.Get(authCacheKey("my-app", "FlyV1 fm2_org")); ok {
+		t.Error("expected the stale approval not to be cached again")
+	}
+	if authorized, _ := authorizeRequestWithCache(context.Background(), "other-app", "FlyV1 fm2_org"); authorized {
+		t.Error("expected an app never authorized before to be refused")
+	}
+
+	authStaleGrace = 0
+	if authorized, _ := authorizeRequestWithCache(context.Background(), "my-app", "FlyV1 fm2_org"); authorized {
+		t.Error("expected no fallback without a grace period")
+	}
+}
+
+// stubFlyAPI is a flyAPI answering from the apps and organizations it has.
+type stubFlyAPI struct {
+	apps map[string]string
+	orgs map[string]bool
+	err  error
+}
+
+func (s stubFlyAPI) AppOrg(ctx context.Context, appName string) (*appOrg, error) {
+	if org, ok := s.apps[appName]; ok {
+		return &appOrg{ID: org, Slug: org}, nil
+	}
+	return nil, s.err
+}
+
+func (s stubFlyAPI) Org(ctx context.Context, slug string) (*appOrg, error) {
+	if s.orgs[slug] {
+		return &appOrg{ID: slug, Slug: slug}, nil
+	}
+	return nil, s.err
+}
+
+func TestAuthorizePersonalToken(t *testing.T) {
+	t.Setenv("FLY_APP_NAME", "builder")
+	defer knownBuilderOrg.Store(nil)
+	defer func(f func(string, *logrus.Entry) flyAPI) { newFlyAPI = f }(newFlyAPI)
+	tokens := map[string]stubFlyAPI{
+		"member":   {apps: map[string]string{"my-app": "acme", "builder": "acme", "other-app": "other"}, orgs: map[string]bool{"acme": true, "other": true}},
+		"outsider": {apps: map[string]string{"other-app": "other"}, orgs: map[string]bool{"other": true}},
+		"down":     {err: errors.New("could not find host api.fly.io")},
+	}
+	newFlyAPI = func(authToken string, _ *logrus.Entry) flyAPI {
+		return tokens[authToken]
+	}
+
+	tests := []struct {
+		app, token string
+		want       auth.DenyReason
+	}{
+		{"my-app", "member", auth.DenyNone},
+		{"other-app", "member", auth.DenyOrgMismatch},
+		{"my-app", "outsider", auth.DenyAppNotFound},
+		{"other-app", "outsider", auth.DenyMisconfigured},
+		{"my-app", "down", auth.DenyAPIError},
+	}
+	for _, tt := range tests {
+		authorized, reason := authorizeRequest(context.Background(), tt.app, tt.token)
+		if reason != tt.want || authorized != (tt.want == auth.DenyNone) {
+			t.Errorf("%s with %s: expected %s, but got %s (authorized %v)", tt.app, tt.token, tt.want, reason, authorized)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/superfly/rchab/dockerproxy/internal/auth"
+)
+
+// authorizer checks every request's credentials, picked by AUTH_MODE in
+// main. See newAuthorizer.
+var authorizer auth.Authorizer = auth.AuthorizerFunc(authorizeRequestWithCache)
+
+// newAuthorizer returns the Authorizer for c's AUTH_MODE:
+//
+//   - fly checks the app is in the builder's organization with the Fly API
+//   - static accepts the tokens in STATIC_AUTH_TOKEN and STATIC_AUTH_TOKENS_FILE
+//   - jwt verifies the token is a JWT signed by JWT_ISSUER, see auth.JWT
+//   - none lets everyone in, credentials or not, for builders only reachable
+//     by trusted clients
+func newAuthorizer(c AuthConfig) (auth.Authorizer, error) {
+	switch c.Mode {
+	case authModeFly:
+		return auth.AuthorizerFunc(authorizeRequestWithCache), nil
+	case authModeStatic:
+		return auth.NewStatic(c.StaticToken, c.StaticTokensFile)
+	case authModeJWT:
+		return auth.NewJWT(c.JWTIssuer, c.JWTJWKSURL, c.JWTAudience, c.JWTAppClaim)
+	case authModeNone:
+		log.Warn("AUTH_MODE=none, every request is let in without checking credentials")
+		return allowAll{}, nil
+	}
+	return nil, fmt.Errorf("unknown AUTH_MODE %q, expected %q, %q, %q or %q", c.Mode, authModeFly, authModeStatic, authModeJWT, authModeNone)
+}
+
+// anonymousApp is the app of requests let in by AUTH_MODE=none without
+// naming one.
+const anonymousApp = "anonymous"
+
+// allowAll is AUTH_MODE=none's Authorizer. Requests get past it without
+// credentials too, see newAuthRequest.
+type allowAll struct{}
+
+func (allowAll) Authorize(ctx context.Context, appName, authToken string) (bool, auth.DenyReason) {
+	return true, auth.DenyNone
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/superfly/rchab/dockerproxy/internal/auth"
+)
+
+func TestNewAuthorizer(t *testing.T) {
+	if _, err := newAuthorizer(AuthConfig{Mode: "ldap"}); err == nil {
+		t.Error("expected an error for an unknown AUTH_MODE")
+	}
+	a, err := newAuthorizer(AuthConfig{Mode: authModeNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := a.Authorize(context.Background(), "", ""); !ok {
+		t.Error("expected AUTH_MODE=none to let everyone in")
+	}
+}
+
+func TestAuthModeNoneWithoutCredentials(t *testing.T) {
+	a, err := newAuthorizer(AuthConfig{Mode: authModeNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var appName string
+	h := accessLog(newAuthRequest(a, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		appName = requestInfoFromContext(r.Context()).appName
+	})))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_ping", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected a request without an Authorization header to be let in, but got status %d: %s", w.Code, w.Body)
+	}
+	if appName != anonymousApp {
+		t.Errorf("expected the request's app to be %q, but got %q", anonymousApp, appName)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/_ping", nil)
+	r.Header.Set(auth.AppNameHeader, "my-app")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if appName != "my-app" {
+		t.Errorf("expected the app named in %s, but got %q", auth.AppNameHeader, appName)
+	}
+}
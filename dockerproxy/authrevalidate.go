@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/superfly/rchab/dockerproxy/internal/auth"
+)
+
+// authRevalidate holds the credentials behind recently used approvals in the
+// auth cache, keyed like authCache, for revalidateAuth to check again. It's
+// only filled when AUTH_REVALIDATE_INTERVAL is set, as it keeps raw tokens.
+var authRevalidate = cache.New(authCacheTTL.Get(), 10*time.Minute)
+
+type authCredentials struct {
+	appName   string
+	authToken string
+}
+
+// rememberForRevalidation records the credentials of an approval that was
+// just used. Approvals nobody uses age out with the cache entry.
+func rememberForRevalidation(cacheKey, appName, authToken string) {
+	if authRevalidateInterval <= 0 {
+		return
+	}
+	authRevalidate.Set(cacheKey, authCredentials{appName, authToken}, authCacheTTL.Get())
+}
+
+// revalidateAuthCache runs revalidateAuth every interval until ctx is done.
+func revalidateAuthCache(ctx context.Context, interval time.Duration) {
+	if interval <= 0 || authCacheDisabled {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			revalidateAuth(ctx)
+		}
+	}
+}
+
+// revalidateAuth asks the Fly API again about the recently used approvals,
+// so a revoked token stops working within AUTH_REVALIDATE_INTERVAL rather
+// than when its cache entry expires. An approval the API now denies is
+// replaced with the denial. API errors leave approvals alone.
+func revalidateAuth(ctx context.Context) (revoked int) {
+	for key, item := range authRevalidate.Items() {
+		if ctx.Err() != nil {
+			return revoked
+		}
+		creds := item.Object.(authCredentials)
+		// flushed, expired or already replaced
+		if val, ok := authCache.Get(key); !ok || val != auth.DenyNone {
+			authRevalidate.Delete(key)
+			continue
+		}
+
+		authorized, reason := authorizeFromAPI(ctx, creds.appName, creds.authToken)
+		if authorized || !reason.Definitive() {
+			continue
+		}
+		authCache.Set(key, reason, authNegativeTTL.Get())
+		authStale.Delete(key)
+		authRevalidate.Delete(key)
+		metricAuthRevocations.inc()
+		log.WithField("app", creds.appName).Warnf("token no longer authorized (%s), dropped its cached approval", reason)
+		revoked++
+	}
+	return revoked
+}
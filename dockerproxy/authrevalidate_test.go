@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/superfly/rchab/dockerproxy/internal/auth"
+)
+
+func TestRevalidateAuth(t *testing.T) {
+	t.Setenv("FLY_APP_NAME", "builder")
+	defer func(mode string, c, r *cache.Cache, interval time.Duration) {
+		authMode, authCache, authRevalidate, authRevalidateInterval = mode, c, r, interval
+	}(authMode, authCache, authRevalidate, authRevalidateInterval)
+	authMode = authModeFly
+	authCache = cache.New(time.Minute, time.Minute)
+	authRevalidate = cache.New(time.Minute, time.Minute)
+	authRevalidateInterval = time.Minute
+
+	fakeFlyAPI(t, map[string]map[string]string{
+		"FlyV1 fm2_org":  {"my-app": "acme", "builder": "acme"},
+		"FlyV1 fm2_kept": {"my-app": "acme", "builder": "acme"},
+	})
+	for _, token := range []string{"FlyV1 fm2_org", "FlyV1 fm2_kept"} {
+		if ok, reason := authorizeRequestWithCache(context.Background(), "my-app", token); !ok {
+			t.Fatalf("expected %s to be authorized, but got %s", token, reason)
+		}
+	}
+
+	// the first token is revoked
+	fakeFlyAPI(t, map[string]map[string]string{
+		"FlyV1 fm2_kept": {"my-app": "acme", "builder": "acme"},
+	})
+	if revoked := revalidateAuth(context.Background()); revoked != 1 {
+		t.Fatalf("expected 1 approval revoked, but got %d", revoked)
+	}
+	if ok, _ := authorizeRequestWithCache(context.Background(), "my-app", "FlyV1 fm2_org"); ok {
+		t.Error("expected the revoked token to be denied")
+	}
+	if ok, _ := authorizeRequestWithCache(context.Background(), "my-app", "FlyV1 fm2_kept"); !ok {
+		t.Error("expected the other token to still be authorized")
+	}
+}
+
+func TestFlushAuthCacheRoute(t *testing.T) {
+	defer func(token string, c, r *cache.Cache) {
+		adminToken, authCache, authRevalidate = token, c, r
+	}(adminToken, authCache, authRevalidate)
+	adminToken = "admin-token"
+	authCache = cache.New(time.Minute, time.Minute)
+	authRevalidate = cache.New(time.Minute, time.Minute)
+
+	key := authCacheKey("my-app", "FlyV1 fm2_org")
+	authCache.Set(key, auth.DenyNone, time.Minute)
+	authRevalidate.Set(key, authCredentials{"my-app", "FlyV1 fm2_org"}, time.Minute)
+	authCache.Set(authCacheKey("other-app", "FlyV1 fm2_org"), auth.DenyNone, time.Minute)
+
+	mux := http.NewServeMux()
+	registerAdminRoutes(mux)
+	r := httptest.NewRequest(http.MethodPost, "/flyio/v1/flushAuthCache?app=my-app", nil)
+	r.Header.Set("Authorization", "Bearer admin-token")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, but got %d: %s", w.Code, w.Body)
+	}
+
+	if _, ok := authCache.Get(key); ok {
+		t.Error("expected my-app's approval to be flushed")
+	}
+	if _, ok := authRevalidate.Get(key); ok {
+		t.Error("expected my-app's credentials to be dropped from revalidation")
+	}
+	if authCache.ItemCount() != 1 {
+		t.Error("expected other apps' approvals to be kept")
+	}
+}
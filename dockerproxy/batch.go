@@ -0,0 +1,104 @@
+package main
+
+import "time"
+
+// batchSender hands queued items to send from one goroutine, in batches of
+// up to size, or once every interval for a batch that isn't full. Items are
+// dropped rather than holding callers up when send can't keep up. The audit
+// log sink, trace exporter and build webhook each have one.
+type batchSender[T any] struct {
+	// what's sent, for logs
+	name     string
+	size     int
+	interval time.Duration
+	send     func(batch []T)
+
+	queue chan T
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// newBatchSender queues up to queueLen items. With a zero interval batches
+// are sent as soon as there's something in them.
+func newBatchSender[T any](name string, size, queueLen int, interval time.Duration, send func([]T)) *batchSender[T] {
+	return &batchSender[T]{
+		name:     name,
+		size:     size,
+		interval: interval,
+		send:     send,
+		queue:    make(chan T, queueLen),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// add queues item, returning false if it was dropped.
+func (b *batchSender[T]) add(item T) bool {
+	select {
+	case b.queue <- item:
+		return true
+	default:
+		return false
+	}
+}
+
+// run sends batches until close is called, then sends what's left.
+func (b *batchSender[T]) run() {
+	defer close(b.done)
+	var tick <-chan time.Time
+	if b.interval > 0 {
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var batch []T
+	flush := func() {
+		if len(batch) > 0 {
+			b.send(batch)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case item := <-b.queue:
+			batch = append(batch, item)
+			if b.interval > 0 && len(batch) < b.size {
+				continue
+			}
+			for len(batch) < b.size && len(b.queue) > 0 {
+				batch = append(batch, <-b.queue)
+			}
+		case <-tick:
+		case <-b.stop:
+			for {
+				select {
+				case item := <-b.queue:
+					batch = append(batch, item)
+					if len(batch) == b.size {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+		flush()
+	}
+}
+
+// stopping is closed once close is called, for send to stop retrying.
+func (b *batchSender[T]) stopping() <-chan struct{} {
+	return b.stop
+}
+
+// close sends what's queued, giving up after timeout.
+func (b *batchSender[T]) close(timeout time.Duration) {
+	close(b.stop)
+	select {
+	case <-b.done:
+	case <-time.After(timeout):
+		log.Warnf("gave up sending %s after %s", b.name, timeout)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBatchSender(t *testing.T) {
+	var batches [][]int
+	b := newBatchSender("numbers", 2, 10, time.Hour, func(batch []int) {
+		batches = append(batches, batch)
+	})
+	for i := range 5 {
+		if !b.add(i) {
+			t.Fatalf("expected %d to be queued", i)
+		}
+	}
+	go b.run()
+	b.close(5 * time.Second)
+
+	sent := 0
+	for _, batch := range batches {
+		if len(batch) > 2 {
+			t.Errorf("expected batches of at most 2, but got %v", batch)
+		}
+		sent += len(batch)
+	}
+	if sent != 5 {
+		t.Errorf("expected everything queued to be sent on close, but got %v", batches)
+	}
+}
+
+func TestBatchSenderDrops(t *testing.T) {
+	b := newBatchSender("numbers", 1, 1, 0, func([]int) {})
+	b.add(1)
+	if b.add(2) {
+		t.Error("expected a full queue to drop")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/superfly/rchab/dockerproxy/internal/daemon"
+)
+
+// binfmtStatus is what tonistiigi/binfmt prints after installing emulators.
+type binfmtStatus struct {
+	Supported []string `json:"supported"`
+	Emulators []string `json:"emulators"`
+}
+
+// installBinfmt registers QEMU emulators for platforms, e.g. arm64 or all,
+// with the kernel's binfmt_misc, so buildkit can build for them on this
+// machine's architecture. It has to run before dockerd starts, buildkit only
+// looks for emulators then. It returns the platforms the builder supports
+// afterwards.
+func installBinfmt(platforms []string) ([]string, error) {
+	var stdout bytes.Buffer
+	cmd := exec.Command("binfmt", "--install", strings.Join(platforms, ","))
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := daemon.RunChild(cmd); err != nil {
+		return nil, errors.Wrap(err, "could not install binfmt emulators")
+	}
+
+	status, err := parseBinfmtStatus(stdout.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return status.Supported, nil
+}
+
+// parseBinfmtStatus reads binfmt's JSON output, skipping anything it logs
+// before it.
+func parseBinfmtStatus(out []byte) (binfmtStatus, error) {
+	var status binfmtStatus
+	if i := bytes.IndexByte(out, '{'); i >= 0 {
+		out = out[i:]
+	}
+	if err := json.Unmarshal(out, &status); err != nil {
+		return status, errors.Wrap(err, "could not parse binfmt output")
+	}
+	return status, nil
+}
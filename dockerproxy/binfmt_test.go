@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBinfmtStatus(t *testing.T) {
+	out := `installing: arm64 OK
+{
+  "supported": [
+    "linux/amd64",
+    "linux/arm64",
+    "linux/386"
+  ],
+  "emulators": [
+    "qemu-aarch64"
+  ]
+}`
+	status, err := parseBinfmtStatus([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"linux/amd64", "linux/arm64", "linux/386"}; !reflect.DeepEqual(status.Supported, want) {
+		t.Errorf("expected supported platforms %v, but got %v", want, status.Supported)
+	}
+
+	if _, err := parseBinfmtStatus([]byte("installing: arm64 cannot register")); err == nil {
+		t.Error("expected an error without a status")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// bodyTooLargeMessage tells the client why its request was refused, and for
+// builds what to do about it.
+func bodyTooLargeMessage(r *http.Request, limit int64) string {
+	if buildPath.MatchString(r.URL.Path) {
+		return fmt.Sprintf("build context is over this builder's limit of %.2fGB, exclude what the build doesn't need with .dockerignore", float64(limit)/float64(gb))
+	}
+	return fmt.Sprintf("request body is over this builder's limit of %.2fGB", float64(limit)/float64(gb))
+}
+
+// limitRequestBody refuses requests whose body is declared over
+// MAX_REQUEST_BODY_GB with a 413, and cuts off chunked ones that turn out to
+// be once they get there. gRPC calls aren't limited, like the /grpc
+// connections they stand in for, their sessions carry whole build contexts.
+func limitRequestBody(w http.ResponseWriter, r *http.Request) bool {
+	if maxRequestBody <= 0 || r.Body == nil || r.Body == http.NoBody || isGRPCRequest(r) {
+		return true
+	}
+	if r.ContentLength > maxRequestBody {
+		requestLogger(r.Context()).Warnf("refused request with a %d byte body path=%s", r.ContentLength, r.URL.Path)
+		writeDockerError(w, http.StatusRequestEntityTooLarge, bodyTooLargeMessage(r, maxRequestBody))
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBody)
+	return true
+}
+
+// spoolBuildContext reads a build's context to a file on the volume before
+// the build goes to dockerd, and has the build read it from there. An upload
+// over the size limit is then refused before a build starts, rather than
+// failing it partway, and the context doesn't sit in memory while a slow
+// client uploads it. The returned func removes the file.
+func spoolBuildContext(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	done := func() {}
+	if !spoolBuildContexts || r.Body == nil || r.Body == http.NoBody {
+		return done, true
+	}
+	l := requestLogger(r.Context())
+
+	if err := os.MkdirAll(buildContextSpoolDir, 0o700); err != nil {
+		l.Errorf("could not create the build context spool: %v", err)
+		writeDockerError(w, http.StatusInternalServerError, "could not store the build context on the builder")
+		return done, false
+	}
+	f, err := os.CreateTemp(buildContextSpoolDir, "context-*")
+	if err != nil {
+		l.Errorf("could not create a build context spool file: %v", err)
+		writeDockerError(w, http.StatusInternalServerError, "could not store the build context on the builder")
+		return done, false
+	}
+	done = func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	n, err := io.Copy(f, r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			l.Warnf("refused build, context over %d bytes", tooLarge.Limit)
+			writeDockerError(w, http.StatusRequestEntityTooLarge, bodyTooLargeMessage(r, tooLarge.Limit))
+		case r.Context().Err() != nil:
+			l.Infof("client went away while uploading the build context")
+		default:
+			l.Errorf("could not spool the build context after %d bytes: %v", n, err)
+			writeDockerError(w, http.StatusInternalServerError, "could not store the build context on the builder")
+		}
+		return done, false
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		l.Errorf("could not rewind the build context spool file: %v", err)
+		writeDockerError(w, http.StatusInternalServerError, "could not store the build context on the builder")
+		return done, false
+	}
+	l.Debugf("spooled %d byte build context to %s", n, f.Name())
+
+	r.Body = io.NopCloser(f)
+	r.ContentLength = n
+	r.TransferEncoding = nil
+	r.Header.Set("Content-Length", strconv.FormatInt(n, 10))
+	return done, true
+}
+
+// clearBuildContextSpool removes contexts left behind by a builder that
+// didn't get to clean up.
+func clearBuildContextSpool() {
+	if err := os.RemoveAll(buildContextSpoolDir); err != nil {
+		log.Warnf("could not clear %s: %v", buildContextSpoolDir, err)
+	}
+}
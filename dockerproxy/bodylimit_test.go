@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/superfly/rchab/dockerproxy/internal/harness"
+)
+
+// chunked hides a body's length, the way docker streams build contexts.
+type chunked struct{ io.Reader }
+
+func TestRequestPipelineBodyLimit(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	defer func(limit int64, spool bool, dir string) {
+		maxRequestBody, spoolBuildContexts, buildContextSpoolDir = limit, spool, dir
+	}(maxRequestBody, spoolBuildContexts, buildContextSpoolDir)
+	maxRequestBody, spoolBuildContexts, buildContextSpoolDir = 10, true, t.TempDir()
+
+	var builds atomic.Int32
+	var received string
+	var contentLength int64
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		builds.Add(1)
+		b, _ := io.ReadAll(r.Body)
+		received, contentLength = string(b), r.ContentLength
+		io.WriteString(w, `{"stream":"Successfully built abc"}`+"\n")
+	}))
+	h := accessLog(newAuthRequest(fakeAuthorizer, newDockerProxy(dockerd)))
+
+	serve := func(body io.Reader, length int64) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1.41/build", body)
+		r.ContentLength = length
+		r.SetBasicAuth("my-app", "good-token")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// declared too large, refused without reading it
+	assertDockerError(t, serve(strings.NewReader("0123456789abc"), 13), http.StatusRequestEntityTooLarge)
+	// too large once read, refused before the build starts
+	w := serve(chunked{strings.NewReader("0123456789abc")}, -1)
+	if !strings.Contains(w.Body.String(), ".dockerignore") {
+		t.Errorf("expected the error to point at .dockerignore, but got %s", w.Body)
+	}
+	assertDockerError(t, w, http.StatusRequestEntityTooLarge)
+	if n := builds.Load(); n != 0 {
+		t.Fatalf("expected no build to reach dockerd, but %d did", n)
+	}
+
+	// within the limit, dockerd gets the spooled context with its length
+	if w := serve(chunked{strings.NewReader("context")}, -1); w.Code != http.StatusOK {
+		t.Fatalf("expected the build through, but got %d: %s", w.Code, w.Body)
+	}
+	if received != "context" || contentLength != 7 {
+		t.Errorf("expected dockerd to get the 7 byte context, but got %q with length %d", received, contentLength)
+	}
+	if entries, _ := os.ReadDir(buildContextSpoolDir); len(entries) != 0 {
+		t.Errorf("expected spooled contexts to be removed, but found %d", len(entries))
+	}
+}
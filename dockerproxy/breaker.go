@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// circuitBreaker stops calling a dependency after threshold consecutive
+// failures, for cooldown. After that calls go through again, and the next
+// failure opens it right back up until one succeeds.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a call may go ahead.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.threshold <= 0 || time.Now().After(b.openUntil)
+}
+
+func (b *circuitBreaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ok {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.threshold > 0 && b.failures >= b.threshold {
+		if time.Now().After(b.openUntil) {
+			log.Warnf("%d failures in a row, not trying again for %s", b.failures, b.cooldown)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// jitteredBackoff is the delay before retry n, counting from zero: base
+// doubled for each earlier retry, give or take half.
+func jitteredBackoff(base time.Duration, n int) time.Duration {
+	d := base << n
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+// sleepCtx waits for d, or returns false early when ctx is done.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(2, time.Hour)
+
+	b.record(false)
+	if !b.allow() {
+		t.Fatal("expected calls to go through below the threshold")
+	}
+	b.record(true)
+	b.record(false)
+	if !b.allow() {
+		t.Fatal("expected a success to reset the failure count")
+	}
+	b.record(false)
+	if b.allow() {
+		t.Fatal("expected the breaker to open at the threshold")
+	}
+
+	// cooldown over, the next failure opens it again
+	b.openUntil = time.Now()
+	if !b.allow() {
+		t.Fatal("expected calls to go through after the cooldown")
+	}
+	b.record(false)
+	if b.allow() {
+		t.Error("expected a failure after the cooldown to open the breaker again")
+	}
+
+	disabled := newCircuitBreaker(0, time.Hour)
+	disabled.record(false)
+	if !disabled.allow() {
+		t.Error("expected a zero threshold to disable the breaker")
+	}
+}
+
+func TestJitteredBackoff(t *testing.T) {
+	for n := 0; n < 4; n++ {
+		base := 100 * time.Millisecond << n
+		for i := 0; i < 20; i++ {
+			if d := jitteredBackoff(100*time.Millisecond, n); d < base/2 || d >= base*3/2 {
+				t.Fatalf("jitteredBackoff(100ms, %d) = %s, want within [%s, %s)", n, d, base/2, base*3/2)
+			}
+		}
+	}
+}
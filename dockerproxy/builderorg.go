@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+const builderOrgRetryInterval = 5 * time.Second
+
+// builderOrgNeeded reports whether authorization compares apps' organization
+// with the builder's, so it has to be known before taking requests.
+func builderOrgNeeded() bool {
+	return authMode == authModeFly && !noAuth && !noAppName && !mockFlyAPI &&
+		len(allowedOrgSlugs.Get()) == 0 && os.Getenv("FLY_APP_NAME") != ""
+}
+
+// resolveBuilderOrg sets knownBuilderOrg before the builder takes requests,
+// so app scoped deploy tokens, which can't see the builder app, get in from
+// the first one. It's FLY_ORG when set, or else the organization of
+// FLY_APP_NAME as seen with FLY_API_TOKEN, retried until ctx is done.
+// /readyz fails until it's known.
+func resolveBuilderOrg(ctx context.Context) {
+	if !builderOrgNeeded() {
+		return
+	}
+	if builderOrgSlug != "" {
+		knownBuilderOrg.Store(&appOrg{Slug: builderOrgSlug})
+		log.Infof("builder is in org %s, from FLY_ORG", builderOrgSlug)
+		return
+	}
+
+	builderAppName := os.Getenv("FLY_APP_NAME")
+	l := log.WithField("app", builderAppName)
+	api := newFlyAPI(builderToken, l)
+	for {
+		callCtx, cancel := context.WithTimeout(ctx, authAPITimeout)
+		org, err := api.AppOrg(callCtx, builderAppName)
+		cancel()
+		if org != nil && err == nil {
+			knownBuilderOrg.Store(org)
+			l.Infof("builder is in org %s", org.Slug)
+			return
+		}
+		if org == nil && err == nil {
+			l.Errorf("FLY_API_TOKEN can't see builder app %s, retrying in %s", builderAppName, builderOrgRetryInterval)
+		} else {
+			l.Warnf("could not look up the builder's org, retrying in %s: %v", builderOrgRetryInterval, err)
+		}
+		if !sleepCtx(ctx, builderOrgRetryInterval) {
+			return
+		}
+	}
+}
+
+// builderOrgReady reports whether requests can be authorized, which needs
+// the builder's organization when builderOrgNeeded.
+func builderOrgReady() bool {
+	return !builderOrgNeeded() || knownBuilderOrg.Load() != nil
+}
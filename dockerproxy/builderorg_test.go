@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestResolveBuilderOrg(t *testing.T) {
+	t.Setenv("FLY_APP_NAME", "builder")
+	defer knownBuilderOrg.Store(nil)
+	defer func(mode, slug, token string) { authMode, builderOrgSlug, builderToken = mode, slug, token }(authMode, builderOrgSlug, builderToken)
+	defer func(f func(string, *logrus.Entry) flyAPI) { newFlyAPI = f }(newFlyAPI)
+	authMode = authModeFly
+
+	knownBuilderOrg.Store(nil)
+	if builderOrgReady() {
+		t.Error("expected the builder not to be ready before its org is known")
+	}
+
+	builderOrgSlug = "acme"
+	resolveBuilderOrg(context.Background())
+	if org := knownBuilderOrg.Load(); org == nil || !org.same(&appOrg{ID: "id-acme", Slug: "acme"}) {
+		t.Errorf("expected FLY_ORG to be the builder's org, but got %+v", org)
+	}
+
+	knownBuilderOrg.Store(nil)
+	builderOrgSlug, builderToken = "", "builder-token"
+	newFlyAPI = func(authToken string, _ *logrus.Entry) flyAPI {
+		if authToken != "builder-token" {
+			t.Errorf("expected the builder's own token, but got %q", authToken)
+		}
+		return stubFlyAPI{apps: map[string]string{"builder": "acme"}}
+	}
+	resolveBuilderOrg(context.Background())
+	if org := knownBuilderOrg.Load(); org == nil || org.ID != "acme" {
+		t.Errorf("expected the builder app's org, but got %+v", org)
+	}
+	if !builderOrgReady() {
+		t.Error("expected the builder to be ready once its org is known")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/rchab/dockerproxy/internal/daemon"
+	"github.com/superfly/rchab/dockerproxy/internal/proxy"
+)
+
+const buildkitdSocket = "/run/buildkit/buildkitd.sock"
+
+// dialBuildkitd connects to the buildkitd run in BUILDKITD_ONLY mode.
+func dialBuildkitd(ctx context.Context) (net.Conn, error) {
+	return (&net.Dialer{}).DialContext(ctx, "unix", buildkitdSocket)
+}
+
+// buildkitdCommand is the buildkitd run in BUILDKITD_ONLY mode, keeping its
+// state under DATA_DIR and configured by BUILDKITD_CONFIG or the GC policy.
+// BUILDKITD_ROOTLESS runs it through rootlesskit as BUILDKITD_ROOTLESS_UID,
+// which needs the image's rootless buildkit bits.
+func buildkitdCommand() (*exec.Cmd, error) {
+	root := filepath.Join(dataDir, "buildkit")
+	args := []string{"--addr", "unix://" + buildkitdSocket, "--root", root}
+	extraArgs, err := splitArgs(os.Getenv("BUILDKITD_EXTRA_ARGS"))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse BUILDKITD_EXTRA_ARGS")
+	}
+
+	// a config of one's own wins over the one generated for the GC policy
+	config := os.Getenv("BUILDKITD_CONFIG")
+	if config == "" {
+		gc, err := buildkitGCFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		if gc != nil {
+			if config, err = writeBuildkitdConfig(gc); err != nil {
+				return nil, errors.Wrap(err, "could not write buildkitd config")
+			}
+		}
+	}
+	if config != "" {
+		args = append(args, "--config", config)
+	}
+
+	for _, dir := range []string{root, filepath.Dir(buildkitdSocket)} {
+		if err := os.MkdirAll(dir, 0o711); err != nil {
+			return nil, err
+		}
+	}
+	// a crashed buildkitd leaves its socket behind
+	os.Remove(buildkitdSocket)
+
+	if !buildkitdRootless {
+		return exec.Command("buildkitd", append(args, extraArgs...)...), nil
+	}
+
+	uid := getEnvInt("BUILDKITD_ROOTLESS_UID", 1000)
+	for _, dir := range []string{root, filepath.Dir(buildkitdSocket)} {
+		if err := os.Chown(dir, uid, uid); err != nil {
+			return nil, err
+		}
+	}
+	args = append(append([]string{"buildkitd"}, args...), "--oci-worker-no-process-sandbox")
+	cmd := exec.Command("rootlesskit", append(args, extraArgs...)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(uid)}}
+	cmd.Env = append(os.Environ(), "HOME="+root, "XDG_RUNTIME_DIR="+filepath.Dir(buildkitdSocket), "USER="+strconv.Itoa(uid))
+	return cmd, nil
+}
+
+// runBuildkitd starts buildkitd in place of dockerd and returns once it
+// answers on its socket. Like dockerd it's restarted if it exits, up to
+// DOCKERD_MAX_RESTARTS times in a row, after which giveUp is called.
+func runBuildkitd(c DockerdConfig, giveUp func()) (func() error, error) {
+	logger := log.WithField("component", "buildkitd")
+	output := logger.WriterLevel(logrus.InfoLevel)
+
+	start := func() (*daemonProcess, error) {
+		p := &daemonProcess{done: make(chan struct{}), oomBefore: daemon.OOMKills()}
+		cmd, err := buildkitdCommand()
+		if err != nil {
+			return nil, err
+		}
+		cmd.Stdout = output
+		cmd.Stderr = output
+		logger.Infof("starting buildkitd with args: %q", cmd.Args)
+		if err := daemon.StartChild(cmd); err != nil {
+			return nil, errors.Wrap(err, "could not start buildkitd")
+		}
+		p.cmd = cmd
+		go func() {
+			if err := daemon.WaitChild(cmd); err != nil {
+				logger.Errorf("error waiting on buildkitd: %v", err)
+			}
+			close(p.done)
+		}()
+		return p, nil
+	}
+	ready := func(p *daemonProcess) error {
+		ctx, cancel := context.WithTimeout(context.Background(), c.StartTimeout)
+		defer cancel()
+		ping := func(ctx context.Context) error {
+			conn, err := dialBuildkitd(ctx)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}
+		return waitUntilReady(ctx, "buildkitd", p.done, ping)
+	}
+
+	s := &daemonSupervisor{
+		name:        "buildkitd",
+		logger:      logger,
+		maxRestarts: c.MaxRestarts,
+		start:       start,
+		ready:       ready,
+		stop: func(p *daemonProcess) error {
+			return p.cmd.Process.Signal(syscall.SIGTERM)
+		},
+		stopTimeout: c.StopTimeout,
+		giveUp:      giveUp,
+	}
+	stop, err := s.run()
+	if err != nil {
+		output.Close()
+		return nil, err
+	}
+	return func() error {
+		defer output.Close()
+		return stop()
+	}, nil
+}
+
+// newBuildkitdProxy serves the API in BUILDKITD_ONLY mode. Only buildkit's
+// gRPC API is passed on, to buildkitd's socket, through /grpc upgrades or as
+// gRPC calls over HTTP/2. There's no dockerd for the rest of the Docker API.
+func newBuildkitdProxy(dial func(context.Context) (net.Conn, error)) http.Handler {
+	grpcProxy := newGRPCProxy(dial)
+	return instrumentRequests(auditRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pendingRequests.Add(1)
+		defer func() {
+			lastRequestDone.Store(time.Now().UnixNano())
+			pendingRequests.Add(^uint64(0))
+		}()
+
+		grpcCall := isGRPCRequest(r)
+		if !grpcCall && (!grpcPath.MatchString(r.URL.Path) || !proxy.IsUpgrade(r)) {
+			writeDockerError(w, http.StatusNotFound, fmt.Sprintf("%s %s is not available, this builder only runs buildkit", r.Method, r.URL.Path))
+			return
+		}
+		if draining.Load() && startsBuild(r) {
+			writeDockerError(w, http.StatusServiceUnavailable, "builder is draining, retry to get a new one")
+			return
+		}
+		if !waitDockerReady(r.Context(), dockerdReadyWait) {
+			w.Header().Set("Retry-After", "2")
+			writeDockerError(w, http.StatusServiceUnavailable, "builder starting, retry shortly")
+			return
+		}
+		if !rateLimitAllowed(w, r) {
+			return
+		}
+		if !pressureAllowed(w, r) {
+			return
+		}
+		if !claimBuilder(w, r) {
+			return
+		}
+		if startsBuild(r) {
+			buildsRan.Store(true)
+		}
+
+		touchFromContext(r.Context())
+		defer touchFromContext(r.Context())
+
+		if grpcCall {
+			serveGRPC(grpcProxy, w, r)
+			return
+		}
+
+		release, err := acquireBuild(r)
+		if err != nil {
+			refuseBuild(w, r, err)
+			return
+		}
+		defer release()
+		r, stop := limitBuildTime(r)
+		defer stop()
+
+		l := requestLogger(r.Context())
+		backend, err := dial(r.Context())
+		if err != nil {
+			l.Errorf("could not reach buildkitd: %v", err)
+			writeDockerError(w, http.StatusBadGateway, "could not reach buildkit on the builder")
+			return
+		}
+		defer backend.Close()
+
+		conn, clientRW, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			l.Errorf("could not hijack connection path=%s: %v", r.URL.Path, err)
+			writeDockerError(w, http.StatusInternalServerError, "could not switch protocols")
+			return
+		}
+		defer conn.Close()
+		defer hijackedConns.Track(conn)()
+		conn.SetDeadline(time.Time{})
+
+		io.WriteString(clientRW, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: "+r.Header.Get("Upgrade")+"\r\n\r\n")
+		if err := clientRW.Flush(); err != nil {
+			l.Warnf("error writing upgrade response path=%s: %v", r.URL.Path, err)
+			return
+		}
+		proxy.Splice(r.Context(), conn, clientRW, backend, backend)
+	})))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuildkitdProxy(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+
+	// stands in for buildkitd's gRPC server, echoing
+	socketPath := filepath.Join(t.TempDir(), "buildkitd.sock")
+	buildkitd, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buildkitd.Close()
+	go func() {
+		for {
+			conn, err := buildkitd.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	dial := func(ctx context.Context) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+	}
+
+	proxy := httptest.NewServer(accessLog(newAuthRequest(fakeAuthorizer, newBuildkitdProxy(dial))))
+	defer proxy.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/v1.41/build", nil)
+	r.SetBasicAuth("my-app", "good-token")
+	w := httptest.NewRecorder()
+	newAuthRequest(fakeAuthorizer, newBuildkitdProxy(dial)).ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected the Docker API to be missing, but got status %d", w.Code)
+	}
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	r, _ = http.NewRequest(http.MethodPost, proxy.URL+"/grpc", nil)
+	r.SetBasicAuth("my-app", "good-token")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "h2c")
+	if err := r.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status %d, but got %d", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+
+	io.WriteString(conn, "PRI * HTTP/2.0\n")
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "PRI * HTTP/2.0\n" {
+		t.Errorf("expected the client's bytes to reach buildkitd and back, but got %q", line)
+	}
+}
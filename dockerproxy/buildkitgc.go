@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// generatedBuildkitdConfigFile is where the buildkitd.toml with the GC policy
+// is written in BUILDKITD_ONLY mode.
+const generatedBuildkitdConfigFile = "/var/run/rchab-buildkitd.toml"
+
+// buildkitGCPolicy bounds buildkit's build cache, which buildkit enforces by
+// itself as builds add to it, least recently used first. It complements
+// pruning, which only kicks in once the disk is nearly full.
+type buildkitGCPolicy struct {
+	// cache to keep in total
+	keepStorage int64
+	// cache unused for longer goes first
+	keepDuration time.Duration
+	// disk space buildkit always keeps, whatever the above. Needs Docker 27
+	// or buildkit 0.17, older ones ignore it.
+	reservedSpace int64
+}
+
+// buildkitGCFromEnv reads the GC policy from BUILDKIT_GC_*. It's nil when
+// none are set, leaving buildkit's defaults alone.
+func buildkitGCFromEnv() (*buildkitGCPolicy, error) {
+	p := &buildkitGCPolicy{
+		keepStorage:   int64(getEnvInt("BUILDKIT_GC_KEEP_STORAGE_GB", 0)) * gb,
+		keepDuration:  getEnvDuration("BUILDKIT_GC_KEEP_DURATION", 0),
+		reservedSpace: int64(getEnvInt("BUILDKIT_GC_RESERVED_SPACE_GB", 0)) * gb,
+	}
+	if p.keepStorage == 0 && p.keepDuration == 0 && p.reservedSpace == 0 {
+		return nil, nil
+	}
+	if p.keepStorage < 0 || p.keepDuration < 0 || p.reservedSpace < 0 {
+		return nil, fmt.Errorf("BUILDKIT_GC_* settings can't be negative")
+	}
+	if p.keepStorage == 0 {
+		return nil, fmt.Errorf("BUILDKIT_GC_KEEP_STORAGE_GB is needed with the other BUILDKIT_GC_* settings")
+	}
+	return p, nil
+}
+
+// daemonConfig is the policy as daemon.json's builder setting, for the
+// buildkit in dockerd.
+func (p *buildkitGCPolicy) daemonConfig() map[string]any {
+	keep := fmt.Sprintf("%dB", p.keepStorage)
+
+	var policies []map[string]any
+	if p.keepDuration > 0 {
+		policies = append(policies, map[string]any{
+			"keepStorage": keep,
+			"filter":      []string{"unused-for=" + p.keepDuration.String()},
+		})
+	}
+	policies = append(policies, map[string]any{"keepStorage": keep, "all": true})
+	if p.reservedSpace > 0 {
+		for _, policy := range policies {
+			policy["reservedSpace"] = fmt.Sprintf("%dB", p.reservedSpace)
+		}
+	}
+
+	return map[string]any{
+		"gc": map[string]any{
+			"enabled":            true,
+			"defaultKeepStorage": keep,
+			"policy":             policies,
+		},
+	}
+}
+
+// buildkitdTOML is the policy as buildkitd.toml, for BUILDKITD_ONLY mode.
+func (p *buildkitGCPolicy) buildkitdTOML() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[worker.oci]\n  gc = true\n  gckeepstorage = %d\n", p.keepStorage)
+
+	rule := func(extra string) {
+		fmt.Fprintf(&b, "\n  [[worker.oci.gcpolicy]]\n    keepBytes = %d\n%s", p.keepStorage, extra)
+		if p.reservedSpace > 0 {
+			fmt.Fprintf(&b, "    reservedSpace = %d\n", p.reservedSpace)
+		}
+	}
+	if p.keepDuration > 0 {
+		rule(fmt.Sprintf("    keepDuration = %q\n", p.keepDuration.String()))
+	}
+	rule("    all = true\n")
+	return b.String()
+}
+
+// writeBuildkitdConfig writes the buildkitd.toml for p and returns its path.
+func writeBuildkitdConfig(p *buildkitGCPolicy) (string, error) {
+	if err := os.WriteFile(generatedBuildkitdConfigFile, []byte(p.buildkitdTOML()), 0o644); err != nil {
+		return "", err
+	}
+	return generatedBuildkitdConfigFile, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestBuildkitGCFromEnv(t *testing.T) {
+	if p, err := buildkitGCFromEnv(); p != nil || err != nil {
+		t.Errorf("expected no policy without settings, but got %+v, %v", p, err)
+	}
+
+	t.Setenv("BUILDKIT_GC_KEEP_DURATION", "168h")
+	if _, err := buildkitGCFromEnv(); err == nil {
+		t.Error("expected an error without BUILDKIT_GC_KEEP_STORAGE_GB")
+	}
+
+	t.Setenv("BUILDKIT_GC_KEEP_STORAGE_GB", "20")
+	t.Setenv("BUILDKIT_GC_RESERVED_SPACE_GB", "5")
+	p, err := buildkitGCFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(p.daemonConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"gc":{"defaultKeepStorage":"20000000000B","enabled":true,"policy":[` +
+		`{"filter":["unused-for=168h0m0s"],"keepStorage":"20000000000B","reservedSpace":"5000000000B"},` +
+		`{"all":true,"keepStorage":"20000000000B","reservedSpace":"5000000000B"}]}}`
+	if string(b) != expected {
+		t.Errorf("expected daemon config %s, but got %s", expected, b)
+	}
+
+	toml := p.buildkitdTOML()
+	for _, want := range []string{
+		"gckeepstorage = 20000000000\n",
+		"keepBytes = 20000000000\n    keepDuration = \"168h0m0s\"\n    reservedSpace = 5000000000\n",
+		"keepBytes = 20000000000\n    all = true\n    reservedSpace = 5000000000\n",
+	} {
+		if !strings.Contains(toml, want) {
+			t.Errorf("expected %q in buildkitd.toml, but got:\n%s", want, toml)
+		}
+	}
+}
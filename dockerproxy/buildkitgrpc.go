@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/superfly/rchab/dockerproxy/internal/auth"
+	"github.com/superfly/rchab/dockerproxy/internal/proxy"
+)
+
+const buildkitHandshakeTimeout = 10 * time.Second
+
+// serveBuildkit exposes buildkit on l, for
+// `docker buildx create --driver remote` and buildctl. Those speak gRPC
+// straight to buildkitd and have no way to send Fly credentials, so clients
+// are authenticated by their TLS certificate instead, and its common name is
+// taken as their app name, authorized by authorizeBuildkitClient. Each
+// connection is passed on to buildkit's gRPC API through dial, and copied
+// through as is.
+func serveBuildkit(ctx context.Context, l net.Listener, dial func(context.Context) (net.Conn, error)) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Errorf("buildkit listener stopped: %v", err)
+			}
+			return
+		}
+		go serveBuildkitConn(ctx, conn.(*tls.Conn), dial)
+	}
+}
+
+func serveBuildkitConn(ctx context.Context, conn *tls.Conn, dial func(context.Context) (net.Conn, error)) {
+	defer conn.Close()
+
+	info := &requestInfo{id: newRequestID()}
+	ctx = context.WithValue(ctx, requestInfoKey, info)
+	l := requestLogger(ctx).WithField("remote", conn.RemoteAddr().String())
+
+	handshakeCtx, cancel := context.WithTimeout(ctx, buildkitHandshakeTimeout)
+	err := conn.HandshakeContext(handshakeCtx)
+	cancel()
+	if err != nil {
+		l.Warnf("buildkit client handshake failed: %v", err)
+		return
+	}
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		info.appName = certs[0].Subject.CommonName
+	}
+	l = l.WithField("app", info.appName)
+
+	// recorded like a /grpc upgrade through the API
+	status, connected := http.StatusSwitchingProtocols, time.Now()
+	source, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	defer func() {
+		entry := auditEntry{
+			Time:      connected,
+			RequestID: info.id,
+			App:       info.appName,
+			Source:    source,
+			Method:    "CONNECT",
+			Path:      "/grpc",
+			Status:    status,
+		}
+		if slug, ok := appOrgSlugs.Load(info.appName); ok {
+			entry.Org = slug.(string)
+		}
+		auditLog.record(entry)
+	}()
+
+	if authFailuresExceeded(source) {
+		l.Warnf("too many failed auth attempts from %s, refusing buildkit connection", source)
+		status = http.StatusTooManyRequests
+		return
+	}
+	if authorized, reason := authorizeBuildkitClient(ctx, info.appName); !authorized {
+		l.WithField("deny_reason", reason).Warn("denied buildkit connection")
+		if reason.Definitive() {
+			recordAuthFailure(source)
+		}
+		metricAuthFailures.inc(reason.String())
+		status = http.StatusUnauthorized
+		return
+	}
+	authFailures.Delete(source)
+	if !proxyPolicy.Load().Allowed("/grpc") {
+		l.Warn("denied buildkit connection, /grpc is not allowed on this builder")
+		status = http.StatusForbidden
+		return
+	}
+
+	pendingRequests.Add(1)
+	defer func() {
+		lastRequestDone.Store(time.Now().UnixNano())
+		pendingRequests.Add(^uint64(0))
+	}()
+	// like the /grpc path through the API, no new sessions while draining
+	if draining.Load() || !waitDockerReady(ctx, dockerdReadyWait) {
+		l.Info("refusing buildkit connection, the builder is draining or not ready")
+		status = http.StatusServiceUnavailable
+		return
+	}
+	if limit := buildRateLimit.Load(); limit != nil {
+		if ok, wait := limit.Take("app:" + info.appName); !ok {
+			l.Warnf("rate limited buildkit connection, retry in %s", wait.Round(time.Second))
+			metricRateLimited.inc(limit.Operation())
+			status = http.StatusTooManyRequests
+			return
+		}
+	}
+	if reason, high := pressureHigh(); high {
+		l.Warnf("refusing buildkit connection, %s", reason)
+		metricBuildsRefused.inc("pressure")
+		status = http.StatusTooManyRequests
+		return
+	}
+	// a session can run any number of builds, it holds a slot while it's open
+	release, err := buildSlots.acquire(ctx)
+	if err != nil {
+		if errors.Is(err, errBuildQueueFull) {
+			l.Warnf("refusing buildkit connection, %d builds running", len(activeBuilds.list()))
+		}
+		status = http.StatusTooManyRequests
+		return
+	}
+	defer release()
+	touchFromContext(ctx)
+	buildsRan.Store(true)
+
+	start := time.Now()
+	backend, err := dial(ctx)
+	if err != nil {
+		l.Errorf("could not reach buildkit: %v", err)
+		status = http.StatusBadGateway
+		return
+	}
+	defer backend.Close()
+	l.Info("buildkit client connected")
+
+	// the builder shutting down past the drain timeout ends the connection
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			backend.Close()
+		case <-done:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(backend, conn)
+		proxy.CloseWrite(backend)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, backend)
+		conn.CloseWrite()
+	}()
+	wg.Wait()
+	l.Infof("buildkit client disconnected after %s", time.Since(start).Round(time.Second))
+}
+
+// authorizeBuildkitClient checks the app a client certificate names. There's
+// no token of the client's to ask the Fly API with, so in fly mode the app is
+// looked up with FLY_API_TOKEN, which only sees the builder's organization,
+// and let in like a client with that token would be. ALLOW_ORG_SLUG applies
+// the same way. validateConfig refuses BUILDKIT_ADDR in modes that need a
+// token of the client's.
+func authorizeBuildkitClient(ctx context.Context, appName string) (bool, auth.DenyReason) {
+	if noAuth || authMode == authModeNone {
+		return true, auth.DenyNone
+	}
+	if appName == "" {
+		return false, auth.DenyBadCredentials
+	}
+	if authMode != authModeFly {
+		return false, auth.DenyMisconfigured
+	}
+	return authorizer.Authorize(ctx, appName, builderToken)
+}
+
+// dockerdBuildkitDialer reaches the buildkit embedded in the dockerd at
+// target, upgrading a connection at its /grpc endpoint the way buildx's
+// docker driver does.
+func dockerdBuildkitDialer(target *url.URL) func(context.Context) (net.Conn, error) {
+	dial := dockerDialer(target)
+	return func(ctx context.Context) (net.Conn, error) {
+		return dialBuildkit(ctx, dial)
+	}
+}
+
+// dialBuildkit opens a connection to dockerd and upgrades it to buildkit's
+// gRPC API.
+func dialBuildkit(ctx context.Context, dial func(context.Context) (net.Conn, error)) (net.Conn, error) {
+	backend, err := dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://docker/grpc", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "h2c")
+	backend.SetDeadline(time.Now().Add(buildkitHandshakeTimeout))
+	if err := req.Write(backend); err != nil {
+		backend.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(backend)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		backend.Close()
+		return nil, fmt.Errorf("dockerd answered %s to the upgrade", resp.Status)
+	}
+	backend.SetDeadline(time.Time{})
+
+	return &bufferedConn{Conn: backend, reader: reader}, nil
+}
+
+// bufferedConn reads what was buffered past the upgrade response first.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	proxy.CloseWrite(c.Conn)
+	return nil
+}
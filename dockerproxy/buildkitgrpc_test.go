@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/superfly/rchab/dockerproxy/internal/auth"
+	"github.com/superfly/rchab/dockerproxy/internal/harness"
+	"github.com/superfly/rchab/dockerproxy/internal/server"
+)
+
+func TestServeBuildkit(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	defer func(a auth.Authorizer, token string) { authorizer, builderToken = a, token }(authorizer, builderToken)
+	// the certificate's app is looked up with the builder's token
+	authorizer = auth.AuthorizerFunc(func(ctx context.Context, appName, authToken string) (bool, auth.DenyReason) {
+		if appName == "my-app" && authToken == "builder-token" {
+			return true, auth.DenyNone
+		}
+		return false, auth.DenyOrgMismatch
+	})
+	builderToken = "builder-token"
+	defer authFailures.Delete("127.0.0.1")
+
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/grpc") || r.Header.Get("Upgrade") != "h2c" {
+			t.Errorf("unexpected request to %s with headers %v", r.URL.Path, r.Header)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+		rw.Flush()
+		// stands in for buildkit's gRPC server
+		io.Copy(conn, rw)
+	}))
+
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	ca, caKey := harness.Cert(t, "ca", nil, nil)
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	serverCert, serverKey := harness.Cert(t, "builder", ca, caKey)
+	harness.WriteCert(t, certFile, keyFile, serverCert, serverKey, time.Now())
+	files, err := server.NewTLSFiles(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer l.Close()
+	go serveBuildkit(ctx, tls.NewListener(l, files.ServerConfig()), dockerdBuildkitDialer(dockerd))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientCert, clientKey := harness.Cert(t, "my-app", ca, caKey)
+	otherCert, otherKey := harness.Cert(t, "other-app", ca, caKey)
+	dial := func(cert *tls.Certificate) (*tls.Conn, error) {
+		config := &tls.Config{RootCAs: roots, NextProtos: []string{"h2"}}
+		if cert != nil {
+			config.Certificates = []tls.Certificate{*cert}
+		}
+		conn, err := tls.Dial("tcp", l.Addr().String(), config)
+		if err != nil {
+			return nil, err
+		}
+		// TLS 1.3 servers reject client certificates after the handshake,
+		// so have the first read tell
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, nil
+	}
+
+	conn, err := dial(&tls.Certificate{Certificate: [][]byte{clientCert.Raw}, PrivateKey: clientKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "PRI * HTTP/2.0"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("PRI * HTTP/2.0"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "PRI * HTTP/2.0" {
+		t.Errorf("expected the client's bytes to reach buildkit and back, but got %q", buf)
+	}
+
+	if conn, err := dial(nil); err == nil {
+		defer conn.Close()
+		io.WriteString(conn, "PRI * HTTP/2.0")
+		if _, err := conn.Read(buf); err == nil {
+			t.Error("expected a client without a certificate to be turned away")
+		}
+	}
+
+	// a certificate for an app outside the builder's organization
+	if conn, err := dial(&tls.Certificate{Certificate: [][]byte{otherCert.Raw}, PrivateKey: otherKey}); err == nil {
+		defer conn.Close()
+		io.WriteString(conn, "PRI * HTTP/2.0")
+		if _, err := conn.Read(buf); err == nil {
+			t.Error("expected a client whose app isn't authorized to be turned away")
+		}
+	}
+}
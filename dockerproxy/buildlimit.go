@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errBuildQueueFull = errors.New("too many builds")
+
+// buildLimiter caps how many builds run at once. Builds over the limit wait
+// up to queueTimeout for a slot, or are turned away right away without one.
+type buildLimiter struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+	queued       atomic.Int64
+}
+
+// newBuildLimiter returns nil, which never limits, when max isn't positive.
+func newBuildLimiter(max int, queueTimeout time.Duration) *buildLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &buildLimiter{slots: make(chan struct{}, max), queueTimeout: queueTimeout}
+}
+
+// acquire waits for a slot. The returned func gives it back.
+func (l *buildLimiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	release := func() { <-l.slots }
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if l.queueTimeout <= 0 {
+		return nil, errBuildQueueFull
+	}
+
+	l.queued.Add(1)
+	defer l.queued.Add(-1)
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, errBuildQueueFull
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// queueDepth is how many builds are waiting for a slot.
+func (l *buildLimiter) queueDepth() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.queued.Load()
+}
+
+const (
+	serializeBuildsWait   = "wait"
+	serializeBuildsReject = "reject"
+)
+
+var errAppBuildRunning = errors.New("a build for this app is already running")
+
+// appBuildLocks lets one build per app run at a time, so two deploys of the
+// same app don't interleave their cache writes. A second build waits for the
+// first, or is turned away if reject is set.
+type appBuildLocks struct {
+	reject bool
+
+	mu    sync.Mutex
+	locks map[string]chan struct{}
+}
+
+// newAppBuildLocks returns nil, which never serializes, unless mode is
+// SERIALIZE_APP_BUILDS=wait or reject.
+func newAppBuildLocks(mode string) *appBuildLocks {
+	switch mode {
+	case serializeBuildsWait, serializeBuildsReject:
+		return &appBuildLocks{reject: mode == serializeBuildsReject, locks: map[string]chan struct{}{}}
+	default:
+		return nil
+	}
+}
+
+// acquire takes appName's lock. The returned func gives it back.
+func (a *appBuildLocks) acquire(ctx context.Context, appName string) (func(), error) {
+	if a == nil || appName == "" {
+		return func() {}, nil
+	}
+
+	for {
+		a.mu.Lock()
+		held, ok := a.locks[appName]
+		if !ok {
+			done := make(chan struct{})
+			a.locks[appName] = done
+			a.mu.Unlock()
+			return func() {
+				a.mu.Lock()
+				delete(a.locks, appName)
+				a.mu.Unlock()
+				close(done)
+			}, nil
+		}
+		a.mu.Unlock()
+
+		if a.reject {
+			return nil, errAppBuildRunning
+		}
+		select {
+		case <-held:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// acquireBuild takes the app build lock and a build slot for r, which runs a
+// build: a /build, a /grpc upgrade buildx builds over, or a gRPC Solve call.
+// A /session doesn't, it goes along with a /build that holds them. The
+// returned func gives both back. The error is errAppBuildRunning or
+// errBuildQueueFull when r is turned away.
+func acquireBuild(r *http.Request) (func(), error) {
+	var appName string
+	if info := requestInfoFromContext(r.Context()); info != nil {
+		appName = info.appName
+	}
+	unlock, err := appBuilds.acquire(r.Context(), appName)
+	if err != nil {
+		return nil, err
+	}
+	release, err := buildSlots.acquire(r.Context())
+	if err != nil {
+		unlock()
+		if errors.Is(err, errBuildQueueFull) {
+			requestLogger(r.Context()).Warnf("refused build, %d builds running", len(activeBuilds.list()))
+		}
+		return nil, err
+	}
+	return func() {
+		release()
+		unlock()
+	}, nil
+}
+
+// refuseBuild answers a request acquireBuild turned away. Nothing's written
+// for a client that went away while it waited.
+func refuseBuild(w http.ResponseWriter, r *http.Request, err error) {
+	var appName string
+	if info := requestInfoFromContext(r.Context()); info != nil {
+		appName = info.appName
+	}
+	switch {
+	case errors.Is(err, errAppBuildRunning):
+		writeDockerError(w, http.StatusConflict, fmt.Sprintf("a build for app %s is already running on this builder, retry once it's done", appName))
+	case errors.Is(err, errBuildQueueFull):
+		w.Header().Set("Retry-After", "30")
+		writeDockerError(w, http.StatusTooManyRequests, "the builder is running as many builds as it can, retry shortly")
+	}
+}
+
+// limitBuildTime cancels r's context with errBuildTimeout once it has run
+// for BUILD_TIMEOUT, for builds that aren't served by serveBuild. The
+// returned func stops the timer.
+func limitBuildTime(r *http.Request) (*http.Request, func()) {
+	if buildTimeout <= 0 {
+		return r, func() {}
+	}
+	ctx, cancel := context.WithCancelCause(r.Context())
+	timer := time.AfterFunc(buildTimeout, func() { cancel(errBuildTimeout) })
+	return r.WithContext(ctx), func() {
+		if !timer.Stop() {
+			requestLogger(r.Context()).Warnf("build over %s timed out after %s", r.URL.Path, buildTimeout)
+		}
+		cancel(nil)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBuildLimiter(t *testing.T) {
+	var unlimited *buildLimiter
+	if _, err := unlimited.acquire(context.Background()); err != nil {
+		t.Fatalf("expected no limit without MAX_CONCURRENT_BUILDS, but got %v", err)
+	}
+
+	l := newBuildLimiter(1, 0)
+	release, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.acquire(context.Background()); !errors.Is(err, errBuildQueueFull) {
+		t.Fatalf("expected the second build to be turned away, but got %v", err)
+	}
+	release()
+	if _, err := l.acquire(context.Background()); err != nil {
+		t.Fatalf("expected a released slot to be reused, but got %v", err)
+	}
+}
+
+func TestBuildLimiterQueues(t *testing.T) {
+	l := newBuildLimiter(1, time.Minute)
+	release, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan error)
+	go func() {
+		_, err := l.acquire(context.Background())
+		acquired <- err
+	}()
+	for l.queueDepth() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	release()
+	if err := <-acquired; err != nil {
+		t.Fatalf("expected the queued build to get the slot, but got %v", err)
+	}
+	if depth := l.queueDepth(); depth != 0 {
+		t.Errorf("expected an empty queue, but got %d", depth)
+	}
+
+	l = newBuildLimiter(1, 10*time.Millisecond)
+	l.acquire(context.Background())
+	if _, err := l.acquire(context.Background()); !errors.Is(err, errBuildQueueFull) {
+		t.Errorf("expected the queue timeout to turn the build away, but got %v", err)
+	}
+}
+
+func TestAppBuildLocks(t *testing.T) {
+	reject := newAppBuildLocks(serializeBuildsReject)
+	unlock, err := reject.acquire(context.Background(), "my-app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reject.acquire(context.Background(), "my-app"); !errors.Is(err, errAppBuildRunning) {
+		t.Fatalf("expected a second build of my-app to be turned away, but got %v", err)
+	}
+	if _, err := reject.acquire(context.Background(), "other-app"); err != nil {
+		t.Fatalf("expected other apps to build alongside, but got %v", err)
+	}
+	unlock()
+	if _, err := reject.acquire(context.Background(), "my-app"); err != nil {
+		t.Fatalf("expected my-app to build again once the first finished, but got %v", err)
+	}
+
+	wait := newAppBuildLocks(serializeBuildsWait)
+	unlock, _ = wait.acquire(context.Background(), "my-app")
+	acquired := make(chan error)
+	go func() {
+		_, err := wait.acquire(context.Background(), "my-app")
+		acquired <- err
+	}()
+	select {
+	case err := <-acquired:
+		t.Fatalf("expected the second build to wait, but it got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	unlock()
+	if err := <-acquired; err != nil {
+		t.Fatalf("expected the second build to run after the first, but got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := wait.acquire(ctx, "my-app"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled wait to give up, but got %v", err)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/superfly/rchab/dockerproxy/internal/daemon"
+)
+
+var (
+	buildPath   = regexp.MustCompile("^(/v[0-9.]*)?/build$")
+	sessionPath = regexp.MustCompile("^(/v[0-9.]*)?/session$")
+	// buildx with the docker driver builds over a hijacked /grpc connection
+	grpcPath = regexp.MustCompile("^(/v[0-9.]*)?/grpc$")
+	// the gRPC call that runs a build, the rest are part of one
+	solvePath = regexp.MustCompile("^/moby.buildkit.v1.Control/Solve$")
+)
+
+// startsBuild reports whether r would start a build, rather than be part of
+// one already running.
+func startsBuild(r *http.Request) bool {
+	return buildPath.MatchString(r.URL.Path) || sessionPath.MatchString(r.URL.Path) || grpcPath.MatchString(r.URL.Path) || solvePath.MatchString(r.URL.Path)
+}
+
+const (
+	buildStatusOK        = "ok"
+	buildStatusError     = "error"
+	buildStatusCancelled = "cancelled"
+	buildStatusTimeout   = "timeout"
+)
+
+type buildOutcome struct {
+	Time            time.Time `json:"time"`
+	App             string    `json:"app"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Status          string    `json:"status"`
+
+	// for cancelling the build when its client goes away
+	buildID, session string
+}
+
+// errBuildTimeout is the cause of a build's context being cancelled after
+// BUILD_TIMEOUT.
+var errBuildTimeout = errors.New("build timed out")
+
+// serveBuild proxies a build and records how it went. dockerd answers builds
+// with 200 before they start, so failures only show up in the final message
+// of the JSON stream.
+//
+// Builds running past BUILD_TIMEOUT are cancelled: the proxied request, and
+// the buildkit job too through cancelBuild. So are builds whose client hung
+// up, like on Ctrl-C.
+func serveBuild(next http.Handler, cancelBuild buildCanceller, w http.ResponseWriter, r *http.Request) {
+	tail := &tailBuffer{size: 4096}
+	// only followed for webhooks, the trace messages are most of the stream
+	var stats *buildStats
+	if buildWebhook != nil {
+		stats = newBuildStats()
+	}
+	var code int
+	w = httpsnoop.Wrap(w, httpsnoop.Hooks{
+		WriteHeader: func(writeHeader httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+			return func(c int) {
+				if code == 0 {
+					code = c
+				}
+				writeHeader(c)
+			}
+		},
+		Write: func(write httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+			return func(b []byte) (int, error) {
+				if code == 0 {
+					code = http.StatusOK
+				}
+				tail.Write(b)
+				if stats != nil {
+					stats.Write(b)
+				}
+				return write(b)
+			}
+		},
+	})
+
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	if buildTimeout > 0 {
+		timer := time.AfterFunc(buildTimeout, func() { cancel(errBuildTimeout) })
+		defer timer.Stop()
+	}
+
+	outcome := &buildOutcome{
+		Time:    time.Now(),
+		buildID: r.URL.Query().Get("buildid"),
+		session: r.URL.Query().Get("session"),
+	}
+	if info := requestInfoFromContext(r.Context()); info != nil {
+		outcome.App = info.appName
+	}
+	activeBuilds.add(outcome)
+	buildWebhook.notify(buildEvent{Event: buildEventStarted, Time: outcome.Time, App: outcome.App})
+	appsUsage.add(outcome.App, func(c *usageCounters) { c.BuildsStarted++ })
+
+	// the proxy aborts the handler with a panic when the stream breaks, like
+	// when the client hangs up, so the build is recorded in a defer
+	defer func() {
+		rec := recover()
+		activeBuilds.remove(outcome)
+		duration := time.Since(outcome.Time)
+
+		timedOut := errors.Is(context.Cause(ctx), errBuildTimeout)
+		var exit *daemon.Exit
+		if timedOut {
+			requestLogger(r.Context()).Warnf("build for app %s timed out after %s", outcome.App, buildTimeout)
+		} else if r.Context().Err() != nil {
+			requestLogger(r.Context()).Infof("client of build for app %s went away, cancelling it", outcome.App)
+		} else if rec == http.ErrAbortHandler {
+			// the stream broke under a client that's still there, most likely
+			// because dockerd died
+			if exit = daemonExitSince(outcome.Time, daemonExitWait); exit != nil {
+				requestLogger(r.Context()).Errorf("build for app %s failed, %s", outcome.App, exit)
+			}
+		}
+		// dockerd doesn't always stop buildkit when the request goes away
+		if outcome.buildID != "" && (timedOut || r.Context().Err() != nil) {
+			cancelBuild(r.Context(), outcome.buildID)
+		}
+
+		outcome.DurationSeconds = duration.Seconds()
+		outcome.Status = buildStatus(code, r.Context().Err() != nil, tail.String())
+		if timedOut {
+			outcome.Status = buildStatusTimeout
+		} else if exit != nil {
+			outcome.Status = buildStatusError
+		}
+		recentBuilds.add(*outcome)
+		observeBuild(duration, outcome.Status)
+		appsUsage.add(outcome.App, func(c *usageCounters) {
+			if outcome.Status == buildStatusOK {
+				c.BuildsSucceeded++
+			} else {
+				c.BuildsFailed++
+			}
+			c.BuildSeconds += duration.Seconds()
+		})
+		if stats != nil {
+			notifyBuildDone(*outcome, stats)
+		}
+
+		if rec != nil {
+			// the client already has a 200, end the stream the way a failed build does
+			switch {
+			case rec == http.ErrAbortHandler && timedOut:
+				writeBuildError(w, fmt.Sprintf("build cancelled after BUILD_TIMEOUT of %s", buildTimeout))
+			case exit != nil:
+				writeBuildError(w, exit.Message())
+			default:
+				panic(rec)
+			}
+		}
+	}()
+
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// notifyBuildDone sends the webhook for a finished build.
+func notifyBuildDone(outcome buildOutcome, stats *buildStats) {
+	ev := buildEvent{
+		Event:           buildEventSucceeded,
+		Time:            time.Now(),
+		App:             outcome.App,
+		Status:          outcome.Status,
+		DurationSeconds: outcome.DurationSeconds,
+	}
+	if outcome.Status != buildStatusOK {
+		ev.Event = buildEventFailed
+	}
+	imageID, steps, cached := stats.result()
+	ev.ImageDigest = imageID
+	if steps > 0 {
+		ev.Cache = &buildEventCache{Steps: steps, Cached: cached}
+	}
+	buildWebhook.notify(ev)
+}
+
+// writeBuildError adds an error message to a build's JSON message stream.
+func writeBuildError(w http.ResponseWriter, message string) {
+	err := json.NewEncoder(w).Encode(map[string]any{
+		"errorDetail": map[string]string{"message": message},
+		"error":       message,
+	})
+	if err != nil {
+		log.Warnln("error writing build error", err)
+	}
+}
+
+// buildCanceller cancels the buildkit build with the given ID.
+type buildCanceller func(ctx context.Context, id string)
+
+// newBuildCanceller returns a buildCanceller calling dockerd at target.
+// Cancelling the proxied request alone leaves buildkit running steps that
+// were already scheduled.
+func newBuildCanceller(target *url.URL) buildCanceller {
+	target, transport := dockerTransport(target)
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+
+	return func(ctx context.Context, id string) {
+		l := requestLogger(ctx)
+		u := *target
+		u.Path = "/build/cancel"
+		u.RawQuery = url.Values{"id": {id}}.Encode()
+
+		// the request's own context is usually what's done by now
+		req, err := http.NewRequestWithContext(context.WithoutCancel(ctx), http.MethodPost, u.String(), nil)
+		if err != nil {
+			l.Warnf("could not cancel build %s: %v", id, err)
+			return
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			l.Warnf("could not cancel build %s: %v", id, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusBadRequest {
+			l.Warnf("could not cancel build %s: dockerd answered %s", id, resp.Status)
+			return
+		}
+		l.Infof("cancelled build %s", id)
+	}
+}
+
+// buildStatus classifies a finished build from its response code and the tail
+// of its JSON message stream.
+func buildStatus(code int, cancelled bool, tail string) string {
+	if cancelled {
+		return buildStatusCancelled
+	}
+	if code >= http.StatusBadRequest {
+		return buildStatusError
+	}
+
+	var last struct {
+		Error       string          `json:"error"`
+		ErrorDetail json.RawMessage `json:"errorDetail"`
+	}
+	// the tail may start mid-message, so decode from the last line that parses
+	lines := bytes.Split(bytes.TrimSpace([]byte(tail)), []byte("\n"))
+	for i := len(lines) - 1; i >= 0; i-- {
+		if json.Unmarshal(lines[i], &last) == nil {
+			break
+		}
+	}
+	if last.Error != "" || len(last.ErrorDetail) > 0 {
+		return buildStatusError
+	}
+	return buildStatusOK
+}
+
+// buildSet tracks the builds currently being proxied.
+type buildSet struct {
+	mu     sync.Mutex
+	builds map[*buildOutcome]struct{}
+}
+
+func newBuildSet() *buildSet {
+	return &buildSet{builds: map[*buildOutcome]struct{}{}}
+}
+
+func (s *buildSet) add(build *buildOutcome) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.builds[build] = struct{}{}
+}
+
+func (s *buildSet) remove(build *buildOutcome) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.builds, build)
+}
+
+// bySession returns the IDs of the builds in flight using a buildkit session.
+func (s *buildSet) bySession(session string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []string
+	for build := range s.builds {
+		if build.session == session && build.buildID != "" {
+			ids = append(ids, build.buildID)
+		}
+	}
+	return ids
+}
+
+// list returns the builds in flight, oldest first.
+func (s *buildSet) list() []buildOutcome {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]buildOutcome, 0, len(s.builds))
+	for build := range s.builds {
+		out = append(out, *build)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out
+}
+
+// buildHistory is a fixed size ring buffer of the most recent build outcomes.
+type buildHistory struct {
+	mu      sync.Mutex
+	entries []buildOutcome
+	next    int
+	full    bool
+}
+
+func newBuildHistory(size int) *buildHistory {
+	if size < 1 {
+		size = 1
+	}
+	return &buildHistory{entries: make([]buildOutcome, size)}
+}
+
+func (h *buildHistory) add(outcome buildOutcome) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.entries[h.next] = outcome
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// list returns the recorded outcomes, most recent first.
+func (h *buildHistory) list() []buildOutcome {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := h.next
+	if h.full {
+		n = len(h.entries)
+	}
+
+	out := make([]buildOutcome, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, h.entries[(h.next-i+len(h.entries))%len(h.entries)])
+	}
+	return out
+}
+
+func recentBuildsHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(recentBuilds.list()); err != nil {
+			log.Warnln("error writing recent builds response", err)
+		}
+	})
+}
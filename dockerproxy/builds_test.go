@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBuildHistory(t *testing.T) {
+	h := newBuildHistory(3)
+	if got := h.list(); len(got) != 0 {
+		t.Fatalf("expected an empty history, but got %d entries", len(got))
+	}
+
+	for _, app := range []string{"a", "b"} {
+		h.add(buildOutcome{App: app})
+	}
+	assertApps(t, h.list(), "b", "a")
+
+	// wrap around, dropping the oldest
+	for _, app := range []string{"c", "d", "e"} {
+		h.add(buildOutcome{App: app})
+	}
+	assertApps(t, h.list(), "e", "d", "c")
+}
+
+func TestBuildSet(t *testing.T) {
+	s := newBuildSet()
+	now := time.Now()
+	newer := &buildOutcome{App: "newer", Time: now}
+	older := &buildOutcome{App: "older", Time: now.Add(-time.Minute)}
+
+	s.add(newer)
+	s.add(older)
+	assertApps(t, s.list(), "older", "newer")
+
+	s.remove(older)
+	assertApps(t, s.list(), "newer")
+}
+
+func assertApps(t *testing.T, outcomes []buildOutcome, apps ...string) {
+	t.Helper()
+
+	if len(outcomes) != len(apps) {
+		t.Fatalf("expected %d entries, but got %d", len(apps), len(outcomes))
+	}
+	for i, app := range apps {
+		if outcomes[i].App != app {
+			t.Errorf("expected entry %d to be %q, but got %q", i, app, outcomes[i].App)
+		}
+	}
+}
+
+func TestBuildStatus(t *testing.T) {
+	cases := []struct {
+		name      string
+		code      int
+		cancelled bool
+		tail      string
+		expected  string
+	}{
+		{"ok", http.StatusOK, false, `{"stream":"Step 1/1"}` + "\n" + `{"stream":"Successfully built abc"}` + "\n", buildStatusOK},
+		{"empty", http.StatusOK, false, "", buildStatusOK},
+		{"error message", http.StatusOK, false, `{"stream":"Step 1/1"}` + "\n" + `{"errorDetail":{"message":"failed"},"error":"failed"}` + "\n", buildStatusError},
+		{"truncated head", http.StatusOK, false, `ep 1/1"}` + "\n" + `{"error":"failed"}`, buildStatusError},
+		{"error status", http.StatusInternalServerError, false, "", buildStatusError},
+		{"cancelled", http.StatusOK, true, `{"stream":"Step 1/1"}`, buildStatusCancelled},
+	}
+
+	for _, tc := range cases {
+		if got := buildStatus(tc.code, tc.cancelled, tc.tail); got != tc.expected {
+			t.Errorf("%s: expected %q, but got %q", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestBuildSetBySession(t *testing.T) {
+	s := newBuildSet()
+	s.add(&buildOutcome{buildID: "a", session: "s1"})
+	s.add(&buildOutcome{buildID: "b", session: "s2"})
+	s.add(&buildOutcome{session: "s1"})
+
+	if ids := s.bySession("s1"); len(ids) != 1 || ids[0] != "a" {
+		t.Errorf("expected build a for session s1, but got %v", ids)
+	}
+}
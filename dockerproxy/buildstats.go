@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// messageMaxLine bounds a message held while waiting for the rest of it,
+// longer ones aren't looked at
+const messageMaxLine = 1 << 20
+
+// buildStats follows a build's JSON message stream for the image it built
+// and how much of it came from cache.
+//
+// buildkit reports steps in moby.buildkit.trace messages, base64 encoded
+// StatusResponse protobufs, and a step is counted once it completes. The
+// legacy builder reports them in its output, as "Step n/m" and "Using cache".
+type buildStats struct {
+	mu      sync.Mutex
+	partial []byte
+	imageID string
+	// completed buildkit steps by digest, and whether they were cached
+	vertexes map[string]bool
+	// legacy builder steps
+	steps, cached int
+}
+
+func newBuildStats() *buildStats {
+	return &buildStats{vertexes: map[string]bool{}}
+}
+
+func (s *buildStats) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.partial = splitMessages(append(s.partial, p...), s.message)
+	return len(p), nil
+}
+
+// splitMessages calls fn with each complete line of a JSON message stream in
+// buf, and returns the rest of it for when more arrives.
+func splitMessages(buf []byte, fn func([]byte)) []byte {
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		fn(bytes.TrimSpace(buf[:i]))
+		buf = buf[i+1:]
+	}
+	if len(buf) > messageMaxLine {
+		return nil
+	}
+	return buf
+}
+
+func (s *buildStats) message(line []byte) {
+	var msg struct {
+		ID     string          `json:"id"`
+		Stream string          `json:"stream"`
+		Aux    json.RawMessage `json:"aux"`
+	}
+	if len(line) == 0 || json.Unmarshal(line, &msg) != nil {
+		return
+	}
+
+	switch {
+	case msg.ID == "moby.buildkit.trace":
+		var trace []byte
+		if json.Unmarshal(msg.Aux, &trace) == nil {
+			s.trace(trace)
+		}
+	case len(msg.Aux) > 0:
+		var image struct {
+			ID string `json:"ID"`
+		}
+		if json.Unmarshal(msg.Aux, &image) == nil && image.ID != "" {
+			s.imageID = image.ID
+		}
+	case strings.HasPrefix(msg.Stream, "Step "):
+		s.steps++
+	case strings.Contains(msg.Stream, "Using cache"):
+		s.cached++
+	}
+}
+
+// trace reads the vertexes, field 1, of a StatusResponse. Of a Vertex it
+// needs the digest, 1, whether it was cached, 4, and when it completed, 6.
+func (s *buildStats) trace(b []byte) {
+	eachField(b, func(num protowire.Number, typ protowire.Type, val []byte, _ uint64) {
+		if num != 1 || typ != protowire.BytesType {
+			return
+		}
+		var (
+			digest            string
+			cached, completed bool
+		)
+		eachField(val, func(num protowire.Number, typ protowire.Type, val []byte, v uint64) {
+			switch {
+			case num == 1 && typ == protowire.BytesType:
+				digest = string(val)
+			case num == 4 && typ == protowire.VarintType:
+				cached = v != 0
+			case num == 6 && typ == protowire.BytesType:
+				completed = true
+			}
+		})
+		if digest != "" && completed {
+			s.vertexes[digest] = cached
+		}
+	})
+}
+
+// eachField calls fn with each field of the protobuf message in b, with the
+// value of varints in v and of everything else in val. It stops at anything
+// malformed.
+func eachField(b []byte, fn func(num protowire.Number, typ protowire.Type, val []byte, v uint64)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return
+		}
+		b = b[n:]
+		var (
+			val []byte
+			v   uint64
+		)
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			val, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return
+		}
+		b = b[n:]
+		fn(num, typ, val, v)
+	}
+}
+
+// result returns the ID of the image built, if any, and how many of its
+// steps there were and came from cache.
+func (s *buildStats) result() (imageID string, steps, cached int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	steps, cached = s.steps, s.cached
+	for _, c := range s.vertexes {
+		steps++
+		if c {
+			cached++
+		}
+	}
+	return s.imageID, steps, cached
+}
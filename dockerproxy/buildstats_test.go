@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// traceMessage encodes a moby.buildkit.trace message with one vertex.
+func traceMessage(digest string, cached, completed bool) string {
+	var vertex []byte
+	vertex = protowire.AppendTag(vertex, 1, protowire.BytesType)
+	vertex = protowire.AppendString(vertex, digest)
+	vertex = protowire.AppendTag(vertex, 3, protowire.BytesType)
+	vertex = protowire.AppendString(vertex, "[1/2] FROM alpine")
+	if cached {
+		vertex = protowire.AppendTag(vertex, 4, protowire.VarintType)
+		vertex = protowire.AppendVarint(vertex, 1)
+	}
+	if completed {
+		vertex = protowire.AppendTag(vertex, 6, protowire.BytesType)
+		vertex = protowire.AppendBytes(vertex, []byte{0x08, 0x01})
+	}
+	var status []byte
+	status = protowire.AppendTag(status, 1, protowire.BytesType)
+	status = protowire.AppendBytes(status, vertex)
+	return fmt.Sprintf(`{"id":"moby.buildkit.trace","aux":%q}`+"\r\n", base64.StdEncoding.EncodeToString(status))
+}
+
+func TestBuildStatsBuildkit(t *testing.T) {
+	s := newBuildStats()
+	stream := traceMessage("sha256:a", false, false) +
+		traceMessage("sha256:a", true, true) +
+		traceMessage("sha256:b", false, true) +
+		traceMessage("sha256:c", false, false) +
+		`{"id":"moby.image.id","aux":{"ID":"sha256:1234"}}` + "\r\n"
+
+	// split mid-message, the way the proxy writes it
+	s.Write([]byte(stream[:50]))
+	s.Write([]byte(stream[50:]))
+
+	imageID, steps, cached := s.result()
+	if imageID != "sha256:1234" || steps != 2 || cached != 1 {
+		t.Errorf("expected sha256:1234 with 1 of 2 steps cached, but got %q with %d of %d", imageID, cached, steps)
+	}
+}
+
+func TestBuildStatsLegacy(t *testing.T) {
+	s := newBuildStats()
+	s.Write([]byte(`{"stream":"Step 1/3 : FROM alpine"}` + "\r\n" +
+		`{"stream":" ---> 1234\n"}` + "\r\n" +
+		`{"stream":"Step 2/3 : RUN true"}` + "\r\n" +
+		`{"stream":" ---> Using cache\n"}` + "\r\n" +
+		`{"stream":"Step 3/3 : RUN false"}` + "\r\n" +
+		`{"aux":{"ID":"sha256:5678"}}` + "\r\n" +
+		`not json` + "\r\n"))
+
+	imageID, steps, cached := s.result()
+	if imageID != "sha256:5678" || steps != 3 || cached != 1 {
+		t.Errorf("expected sha256:5678 with 1 of 3 steps cached, but got %q with %d of %d", imageID, cached, steps)
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/superfly/rchab/dockerproxy/internal/server"
+)
+
+// Config is how the builder's server, dockerd supervisor and authorization
+// are set up. Each setting can come from the config file of KEY=VALUE lines,
+// the environment or a flag, in increasing order of precedence, see
+// loadConfig. It reaches the rest of the builder through the globals apply
+// sets, not as an argument.
+//
+// Settings that aren't in Config yet are still read from the environment
+// when the process starts, before the file and flags are. Only the
+// reloadable ones among them pick up a value from the file or a flag.
+type Config struct {
+	Server  ServerConfig
+	Dockerd DockerdConfig
+	Auth    AuthConfig
+
+	// the file the settings were read from, if any
+	File string
+	// the settings from the file and from flags, by environment variable
+	fileSettings, flagSettings map[string]string
+	// the settings Config is made of
+	known map[string]bool
+}
+
+// ServerConfig is where and how the builder API is served.
+type ServerConfig struct {
+	ListenAddrs  []server.ListenAddr
+	AdminAddr    string
+	AdminToken   string
+	MetricsAddr  string
+	DebugAddr    string
+	BuildkitAddr string
+
+	TLSCertFile       string
+	TLSKeyFile        string
+	TLSClientCAFile   string
+	TLSReloadInterval time.Duration
+
+	NoHTTPS bool
+	NoH2C   bool
+
+	ReadHeaderTimeout time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	PathTimeouts      []pathTimeout
+}
+
+// DockerdConfig is how dockerd is reached and looked after.
+type DockerdConfig struct {
+	Host     string
+	Disabled bool
+	DataDir  string
+
+	ExtraArgs    string
+	StartTimeout time.Duration
+	StopTimeout  time.Duration
+	MaxRestarts  int
+	DialTimeout  time.Duration
+	ReadyWait    time.Duration
+}
+
+// AuthConfig is how clients are authorized, see newAuthorizer.
+type AuthConfig struct {
+	Mode      string
+	Disabled  bool
+	NoAppName bool
+
+	AllowedOrgSlugs []string
+	OperatorApps    []string
+	OperatorToken   string
+	BuilderToken    string
+	BuilderOrg      string
+	FlyAPIURL       string
+	MockFlyAPI      bool
+	MockFlyAPIFile  string
+
+	StaticToken      string
+	StaticTokensFile string
+
+	JWTIssuer   string
+	JWTJWKSURL  string
+	JWTAudience string
+	JWTAppClaim string
+
+	CacheDisabled      bool
+	StaleGrace         time.Duration
+	RevalidateInterval time.Duration
+	APITimeout         time.Duration
+	APIRetries         int
+	APIFailOpen        bool
+}
+
+// defaultConfig is the configuration without any settings, which the
+// globals Config.apply sets start out as. Without settings it can't fail.
+var defaultConfig, _ = loadConfig(nil, nil)
+
+// configFlags are the flags for the settings most often changed per run.
+// Secrets have none, flags show up in ps. Any other setting can be given
+// with -set KEY=VALUE.
+var configFlags = []struct{ name, key, usage string }{
+	{"listen", "LISTEN_ADDRS", "comma separated addresses to serve the builder API on"},
+	{"admin-addr", "ADMIN_ADDR", "address to serve admin routes on, instead of the API's"},
+	{"metrics-addr", "METRICS_ADDR", "address to serve /metrics on"},
+	{"debug-addr", "DEBUG_ADDR", "address to serve pprof and expvar on"},
+	{"buildkit-addr", "BUILDKIT_ADDR", "address to serve buildkit's gRPC API on"},
+	{"tls-cert", "TLS_CERT_FILE", "TLS certificate to serve the API with"},
+	{"tls-key", "TLS_KEY_FILE", "TLS key to serve the API with"},
+	{"tls-client-ca", "TLS_CLIENT_CA_FILE", "CAs client certificates have to be signed by"},
+	{"docker-host", "DOCKER_HOST", "where dockerd is reached, unix://, tcp:// or ssh://"},
+	{"data-dir", "DATA_DIR", "the volume holding dockerd's data"},
+	{"auth-mode", "AUTH_MODE", "how clients are authorized: fly, static, jwt or none"},
+	{"allow-org-slug", "ALLOW_ORG_SLUG", "comma separated organizations whose apps may use the builder"},
+	{"fly-api-url", "FLY_API_URL", "the Fly API apps and tokens are checked against"},
+}
+
+// loadConfig reads the settings from the file named by -config or
+// CONFIG_FILE, then environ, then the flags in args, each overriding the
+// one before. An empty value counts as unset. Invalid values are errors,
+// rather than falling back to defaults.
+func loadConfig(args, environ []string) (*Config, error) {
+	fs := flag.NewFlagSet("dockerproxy", flag.ContinueOnError)
+	configFile := fs.String("config", "", "file of KEY=VALUE settings, instead of CONFIG_FILE")
+	flagValues := map[string]*string{}
+	for _, f := range configFlags {
+		flagValues[f.key] = fs.String(f.name, "", f.usage+", or "+f.key)
+	}
+	flagSettings := map[string]string{}
+	fs.Func("set", "a setting as KEY=VALUE, can be repeated", func(s string) error {
+		key, val, ok := strings.Cut(s, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("%q is not KEY=VALUE", s)
+		}
+		flagSettings[key] = val
+		return nil
+	})
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		for _, cf := range configFlags {
+			if cf.name == f.Name {
+				flagSettings[cf.key] = *flagValues[cf.key]
+			}
+		}
+	})
+
+	env := map[string]string{}
+	for _, kv := range environ {
+		if key, val, ok := strings.Cut(kv, "="); ok {
+			env[key] = val
+		}
+	}
+
+	s := &settingSources{env: env, flags: flagSettings, used: map[string]bool{}}
+	c := &Config{File: *configFile}
+	if c.File == "" {
+		c.File = env["CONFIG_FILE"]
+	}
+	if c.File != "" {
+		var err error
+		if s.file, err = readSettingsFile(c.File); err != nil {
+			return nil, err
+		}
+	}
+
+	c.Server = ServerConfig{
+		ListenAddrs:       parseListenAddrs(s.str("LISTEN_ADDRS", ":8080")),
+		AdminAddr:         s.str("ADMIN_ADDR", ""),
+		AdminToken:        s.str("ADMIN_TOKEN", ""),
+		MetricsAddr:       s.str("METRICS_ADDR", ""),
+		DebugAddr:         s.str("DEBUG_ADDR", ""),
+		BuildkitAddr:      s.str("BUILDKIT_ADDR", ""),
+		TLSCertFile:       s.str("TLS_CERT_FILE", ""),
+		TLSKeyFile:        s.str("TLS_KEY_FILE", ""),
+		TLSClientCAFile:   s.str("TLS_CLIENT_CA_FILE", ""),
+		TLSReloadInterval: s.positiveDuration("TLS_RELOAD_INTERVAL", time.Minute),
+		NoHTTPS:           s.flag("NO_HTTPS"),
+		NoH2C:             s.flag("NO_H2C"),
+		ReadHeaderTimeout: s.positiveDuration("READ_HEADER_TIMEOUT", 10*time.Second),
+		IdleTimeout:       s.positiveDuration("IDLE_TIMEOUT", 2*time.Minute),
+		MaxHeaderBytes:    s.positiveInteger("MAX_HEADER_BYTES", 1<<20),
+		ReadTimeout:       s.duration("READ_TIMEOUT", 15*time.Minute),
+		WriteTimeout:      s.duration("WRITE_TIMEOUT", 15*time.Minute),
+		PathTimeouts:      s.pathTimeouts("PATH_TIMEOUTS"),
+	}
+	c.Dockerd = DockerdConfig{
+		Host:         s.str("DOCKER_HOST", "tcp://127.0.0.1:2376"),
+		Disabled:     s.flag("NO_DOCKERD"),
+		DataDir:      s.str("DATA_DIR", "/data"),
+		ExtraArgs:    s.str("DOCKERD_EXTRA_ARGS", ""),
+		StartTimeout: s.positiveDuration("DOCKERD_START_TIMEOUT", time.Minute),
+		StopTimeout:  s.positiveDuration("DOCKERD_STOP_TIMEOUT", 30*time.Second),
+		MaxRestarts:  s.integer("DOCKERD_MAX_RESTARTS", 5),
+		DialTimeout:  s.duration("DOCKERD_DIAL_TIMEOUT", 5*time.Second),
+		ReadyWait:    s.duration("DOCKERD_READY_WAIT", 30*time.Second),
+	}
+	c.Auth = AuthConfig{
+		Mode:               s.str("AUTH_MODE", authModeFly),
+		Disabled:           s.flag("NO_AUTH"),
+		NoAppName:          s.flag("NO_APP_NAME"),
+		AllowedOrgSlugs:    splitList(s.str("ALLOW_ORG_SLUG", "")),
+		OperatorApps:       splitList(s.str("OPERATOR_APPS", "")),
+		OperatorToken:      s.str("OPERATOR_TOKEN", ""),
+		BuilderToken:       s.str("FLY_API_TOKEN", ""),
+		BuilderOrg:         s.str("FLY_ORG", ""),
+		FlyAPIURL:          strings.TrimSuffix(s.str("FLY_API_URL", "https://api.fly.io"), "/"),
+		MockFlyAPI:         s.flag("MOCK_FLY_API"),
+		MockFlyAPIFile:     s.str("MOCK_FLY_API_FILE", ""),
+		StaticToken:        s.str("STATIC_AUTH_TOKEN", ""),
+		StaticTokensFile:   s.str("STATIC_AUTH_TOKENS_FILE", ""),
+		JWTIssuer:          s.str("JWT_ISSUER", ""),
+		JWTJWKSURL:         s.str("JWT_JWKS_URL", ""),
+		JWTAudience:        s.str("JWT_AUDIENCE", ""),
+		JWTAppClaim:        s.str("JWT_APP_CLAIM", "app"),
+		CacheDisabled:      s.flag("AUTH_CACHE_DISABLED"),
+		StaleGrace:         s.duration("AUTH_STALE_GRACE", 0),
+		RevalidateInterval: s.duration("AUTH_REVALIDATE_INTERVAL", 0),
+		APITimeout:         s.positiveDuration("AUTH_API_TIMEOUT", 10*time.Second),
+		APIRetries:         s.integer("AUTH_API_RETRIES", 2),
+		APIFailOpen:        s.str("AUTH_API_FAILURE_MODE", "") == "open",
+	}
+	if err := errors.Join(s.errs...); err != nil {
+		return nil, err
+	}
+
+	c.fileSettings, c.flagSettings, c.known = s.file, s.flags, s.used
+	return c, nil
+}
+
+// apply makes c the configuration in use. It also exports the settings from
+// the file and flags that the environment doesn't override, for the code
+// still reading the environment, like the reloadable settings.
+func (c *Config) apply() {
+	adminAddr = c.Server.AdminAddr
+	adminToken = c.Server.AdminToken
+	noHttps = c.Server.NoHTTPS
+	trustFlyClientIP = os.Getenv("FLY_APP_NAME") != "" && c.Server.TLSCertFile == ""
+
+	dockerHost = c.Dockerd.Host
+	noDockerd = c.Dockerd.Disabled
+	dataDir = c.Dockerd.DataDir
+	buildContextSpoolDir = filepath.Join(dataDir, "context-spool")
+	dockerdDialTimeout = c.Dockerd.DialTimeout
+	dockerdReadyWait = c.Dockerd.ReadyWait
+
+	authMode = c.Auth.Mode
+	noAuth = c.Auth.Disabled
+	noAppName = c.Auth.NoAppName
+	allowedOrgSlugs.Set(c.Auth.AllowedOrgSlugs)
+	operatorApps.Set(c.Auth.OperatorApps)
+	operatorToken = c.Auth.OperatorToken
+	builderToken = c.Auth.BuilderToken
+	builderOrgSlug = c.Auth.BuilderOrg
+	setFlyAPIURL(c.Auth.FlyAPIURL)
+	mockFlyAPI = c.Auth.MockFlyAPI
+	staticAuthToken = c.Auth.StaticToken
+	authCacheDisabled = c.Auth.CacheDisabled
+	authStaleGrace = c.Auth.StaleGrace
+	authRevalidateInterval = c.Auth.RevalidateInterval
+	authAPITimeout = c.Auth.APITimeout
+	authAPIRetries = c.Auth.APIRetries
+	authAPIFailOpen = c.Auth.APIFailOpen
+
+	if c.File != "" {
+		// so SIGHUP re-reads the same file
+		os.Setenv("CONFIG_FILE", c.File)
+	}
+	export := func(key, val string) {
+		if os.Getenv(key) == val {
+			return
+		}
+		os.Setenv(key, val)
+		if !c.known[key] && slices.Contains(restartOnlySettings, key) {
+			log.Warnf("%s is only read from the environment so far, ignoring the value from the config file or flags", key)
+		}
+	}
+	settingsOverFile = map[string]bool{}
+	for key := range c.flagSettings {
+		settingsOverFile[key] = true
+	}
+	for _, kv := range os.Environ() {
+		if key, val, _ := strings.Cut(kv, "="); val != "" {
+			settingsOverFile[key] = true
+		}
+	}
+	settingsFromFile = map[string]bool{}
+	for key, val := range c.fileSettings {
+		if os.Getenv(key) == "" {
+			export(key, val)
+		}
+		if !settingsOverFile[key] {
+			settingsFromFile[key] = true
+		}
+	}
+	for key, val := range c.flagSettings {
+		export(key, val)
+	}
+	startupSettings = lookupSettings(restartOnlySettings)
+}
+
+// settingSources looks settings up in flags, then the environment, then the
+// config file, collecting the errors of invalid values.
+type settingSources struct {
+	file, env, flags map[string]string
+	used             map[string]bool
+	errs             []error
+}
+
+func (s *settingSources) lookup(key string) (string, bool) {
+	s.used[key] = true
+	for _, source := range []map[string]string{s.flags, s.env, s.file} {
+		if val := source[key]; val != "" {
+			return val, true
+		}
+	}
+	return "", false
+}
+
+func (s *settingSources) str(key, fallback string) string {
+	if val, ok := s.lookup(key); ok {
+		return val
+	}
+	return fallback
+}
+
+// flag is a setting that's on when it's 1.
+func (s *settingSources) flag(key string) bool {
+	val, _ := s.lookup(key)
+	return val == "1"
+}
+
+func (s *settingSources) integer(key string, fallback int) int {
+	val, ok := s.lookup(key)
+	if !ok {
+		return fallback
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		s.errs = append(s.errs, fmt.Errorf("invalid %s %q, expected a number", key, val))
+	}
+	return i
+}
+
+func (s *settingSources) positiveInteger(key string, fallback int) int {
+	i := s.integer(key, fallback)
+	if i <= 0 {
+		s.errs = append(s.errs, fmt.Errorf("%s must be positive", key))
+	}
+	return i
+}
+
+func (s *settingSources) duration(key string, fallback time.Duration) time.Duration {
+	val, ok := s.lookup(key)
+	if !ok {
+		return fallback
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		s.errs = append(s.errs, fmt.Errorf("invalid %s %q, expected a duration like 30s", key, val))
+	}
+	return d
+}
+
+func (s *settingSources) positiveDuration(key string, fallback time.Duration) time.Duration {
+	d := s.duration(key, fallback)
+	if d <= 0 {
+		s.errs = append(s.errs, fmt.Errorf("%s must be positive", key))
+	}
+	return d
+}
+
+func (s *settingSources) pathTimeouts(key string) []pathTimeout {
+	val, _ := s.lookup(key)
+	timeouts, err := parsePathTimeouts(val)
+	if err != nil {
+		s.errs = append(s.errs, err)
+	}
+	return timeouts
+}
+
+func parseListenAddrs(s string) []server.ListenAddr {
+	var addrs []server.ListenAddr
+	for _, addr := range splitList(s) {
+		addrs = append(addrs, server.ListenAddr(addr))
+	}
+	return addrs
+}
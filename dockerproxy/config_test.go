@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/superfly/rchab/dockerproxy/internal/server"
+)
+
+func TestLoadConfigDefaults(t *testing.T) {
+	c, err := loadConfig(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c.Server.ListenAddrs, []server.ListenAddr{":8080"}) {
+		t.Errorf("expected to listen on :8080, but got %v", c.Server.ListenAddrs)
+	}
+	if c.Dockerd.Host != "tcp://127.0.0.1:2376" || c.Dockerd.MaxRestarts != 5 || c.Dockerd.StartTimeout != time.Minute {
+		t.Errorf("expected the default dockerd settings, but got %+v", c.Dockerd)
+	}
+	if c.Auth.Mode != authModeFly || c.Auth.FlyAPIURL != "https://api.fly.io" || c.Auth.JWTAppClaim != "app" {
+		t.Errorf("expected the default auth settings, but got %+v", c.Auth)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rchab.env")
+	contents := "LISTEN_ADDRS=:9000\nDOCKER_HOST=unix:///file.sock\nAUTH_MODE=static\nDOCKERD_MAX_RESTARTS=7\n"
+	if err := os.WriteFile(file, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	environ := []string{"DOCKER_HOST=unix:///env.sock", "AUTH_MODE=jwt", "AUTH_API_RETRIES=4", "DATA_DIR="}
+	args := []string{"-config", file, "-auth-mode", "none", "-set", "AUTH_API_TIMEOUT=3s"}
+	c, err := loadConfig(args, environ)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		setting   string
+		got, want any
+	}{
+		{"LISTEN_ADDRS from the file", c.Server.ListenAddrs, []server.ListenAddr{":9000"}},
+		{"DOCKERD_MAX_RESTARTS from the file", c.Dockerd.MaxRestarts, 7},
+		{"DOCKER_HOST from the environment over the file", c.Dockerd.Host, "unix:///env.sock"},
+		{"AUTH_API_RETRIES from the environment", c.Auth.APIRetries, 4},
+		{"AUTH_MODE from a flag over both", c.Auth.Mode, authModeNone},
+		{"AUTH_API_TIMEOUT from -set", c.Auth.APITimeout, 3 * time.Second},
+		{"an empty DATA_DIR is unset", c.Dockerd.DataDir, "/data"},
+	} {
+		if !reflect.DeepEqual(tc.got, tc.want) {
+			t.Errorf("%s: expected %v, but got %v", tc.setting, tc.want, tc.got)
+		}
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	_, err := loadConfig(nil, []string{"DOCKERD_MAX_RESTARTS=lots", "AUTH_API_TIMEOUT=0s"})
+	if err == nil {
+		t.Fatal("expected an error for invalid values")
+	}
+	for _, key := range []string{"DOCKERD_MAX_RESTARTS", "AUTH_API_TIMEOUT"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("expected the error to name %s, but got %v", key, err)
+		}
+	}
+
+	if _, err := loadConfig([]string{"-set", "no-equals"}, nil); err == nil {
+		t.Error("expected an error for -set without KEY=VALUE")
+	}
+	if _, err := loadConfig([]string{"-config", filepath.Join(t.TempDir(), "missing")}, nil); err == nil {
+		t.Error("expected an error for a missing config file")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsAllowedHeaders covers what docker API clients send, including the
+// Basic-Auth credentials authRequest checks.
+const corsAllowedHeaders = "Authorization, Content-Type, X-Registry-Auth, X-Registry-Config, X-Request-Id, traceparent"
+
+// corsRequest lets browsers on CORS_ALLOWED_ORIGINS call the builder. Preflight
+// requests are answered here, before auth and without touching the idle
+// deadline. It does nothing when no origins are configured.
+func corsRequest(next http.Handler) http.Handler {
+	if len(corsAllowedOrigins) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed, listed := corsOriginAllowed(origin)
+		if origin == "" || !allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if listed {
+			// only explicitly listed origins may send credentials
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Allow-Credentials", "true")
+		} else {
+			h.Set("Access-Control-Allow-Origin", "*")
+		}
+		h.Set("Access-Control-Expose-Headers", "X-Request-Id, Api-Version, Docker-Experimental, Ostype")
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE, OPTIONS")
+			h.Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsOriginAllowed reports whether origin may call the builder, and whether
+// it was listed by name rather than matched by "*".
+func corsOriginAllowed(origin string) (allowed, listed bool) {
+	for _, o := range corsAllowedOrigins {
+		if strings.EqualFold(o, origin) {
+			return true, true
+		}
+		if o == "*" {
+			allowed = true
+		}
+	}
+	return allowed, false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCorsRequest(t *testing.T) {
+	defer func(origins []string) { corsAllowedOrigins = origins }(corsAllowedOrigins)
+	corsAllowedOrigins = []string{"https://ui.example.com"}
+
+	var reached bool
+	h := corsRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+
+	r := httptest.NewRequest(http.MethodOptions, "/build", nil)
+	r.Header.Set("Origin", "https://ui.example.com")
+	r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if reached {
+		t.Error("expected preflight to be answered without calling the next handler")
+	}
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected status %d, but got %d", http.StatusNoContent, w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://ui.example.com" {
+		t.Errorf("unexpected Access-Control-Allow-Origin %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("expected credentials to be allowed, but got %q", got)
+	}
+
+	reached = false
+	r = httptest.NewRequest(http.MethodOptions, "/build", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+	r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if !reached || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Error("expected other origins to be passed through without CORS headers")
+	}
+}
+
+func TestCorsRequestDisabled(t *testing.T) {
+	defer func(origins []string) { corsAllowedOrigins = origins }(corsAllowedOrigins)
+	corsAllowedOrigins = nil
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	r := httptest.NewRequest(http.MethodOptions, "/build", nil)
+	r.Header.Set("Origin", "https://ui.example.com")
+	w := httptest.NewRecorder()
+	corsRequest(next).ServeHTTP(w, r)
+
+	if len(w.Header()) != 0 {
+		t.Errorf("expected no headers, but got %v", w.Header())
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/superfly/rchab/dockerproxy/internal/auth"
+)
+
+func TestAuthRequestBearer(t *testing.T) {
+	var gotAuth, gotApp string
+	handler := newAuthRequest(fakeAuthorizer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth, gotApp = r.Header.Get("Authorization"), r.Header.Get(auth.AppNameHeader)
+	}))
+
+	r := httptest.NewRequest("GET", "/_ping", nil)
+	r.Header.Set("Authorization", "Bearer good-token")
+	r.Header.Set(auth.AppNameHeader, "my-app")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected a Bearer token with the app header to be let in, but got %d: %s", w.Code, w.Body)
+	}
+	if gotAuth != "" || gotApp != "" {
+		t.Errorf("expected the credentials not to be passed on, but got %q and %q", gotAuth, gotApp)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// daemonConfigOverrides reads the daemon.json settings that can be set from
+// the environment, so customizing dockerd doesn't take a new image.
+func daemonConfigOverrides() (map[string]any, error) {
+	overrides := map[string]any{}
+
+	if root := os.Getenv("DOCKER_DATA_ROOT"); root != "" {
+		overrides["data-root"] = root
+	}
+	if mirrors := splitList(os.Getenv("DOCKERD_REGISTRY_MIRRORS")); len(mirrors) > 0 {
+		overrides["registry-mirrors"] = mirrors
+	}
+	if registries := splitList(os.Getenv("DOCKERD_INSECURE_REGISTRIES")); len(registries) > 0 {
+		overrides["insecure-registries"] = registries
+	}
+	if driver := os.Getenv("DOCKERD_LOG_DRIVER"); driver != "" {
+		overrides["log-driver"] = driver
+	}
+
+	for key, name := range map[string]string{
+		"max-concurrent-downloads": "DOCKERD_MAX_CONCURRENT_DOWNLOADS",
+		"max-concurrent-uploads":   "DOCKERD_MAX_CONCURRENT_UPLOADS",
+	} {
+		val := os.Getenv(name)
+		if val == "" {
+			continue
+		}
+		n, err := strconv.Atoi(val)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid %s %q, expected a positive number", name, val)
+		}
+		overrides[key] = n
+	}
+
+	if val := os.Getenv("DOCKERD_FEATURES"); val != "" {
+		features := map[string]any{}
+		for _, feature := range splitList(val) {
+			name, enabled, ok := strings.Cut(feature, "=")
+			if !ok {
+				enabled = "true"
+			}
+			b, err := strconv.ParseBool(enabled)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DOCKERD_FEATURES entry %q, expected name or name=true|false", feature)
+			}
+			features[strings.TrimSpace(name)] = b
+		}
+		overrides["features"] = features
+	}
+
+	gc, err := buildkitGCFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if gc != nil {
+		overrides["builder"] = gc.daemonConfig()
+	}
+
+	return overrides, nil
+}
+
+// writeDaemonConfig copies the daemon.json at src to dst with overrides
+// applied, and the registry cache if enabled. Features are merged with the
+// ones in src, everything else replaces the setting. dockerd refuses to
+// start when a flag and the config file both set something, so flags can't
+// be used to override the image's daemon.json.
+func writeDaemonConfig(src, dst string, overrides map[string]any) error {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	var config map[string]any
+	if err := json.Unmarshal(b, &config); err != nil {
+		return errors.Wrapf(err, "could not parse %s", src)
+	}
+
+	for key, val := range overrides {
+		features, ok := val.(map[string]any)
+		existing, hasExisting := config[key].(map[string]any)
+		if key == "features" && ok && hasExisting {
+			for name, enabled := range features {
+				existing[name] = enabled
+			}
+			continue
+		}
+		config[key] = val
+	}
+
+	// the registry cache goes ahead of whichever mirrors are configured
+	if registryCacheEnabled {
+		mirrors := []any{registryCacheMirror}
+		switch existing := config["registry-mirrors"].(type) {
+		case []any:
+			mirrors = append(mirrors, existing...)
+		case []string:
+			for _, mirror := range existing {
+				mirrors = append(mirrors, mirror)
+			}
+		}
+		config["registry-mirrors"] = mirrors
+	}
+
+	b, err = json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, b, 0o644)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDaemonConfigOverrides(t *testing.T) {
+	t.Setenv("DOCKER_DATA_ROOT", "/mnt/docker")
+	t.Setenv("DOCKERD_REGISTRY_MIRRORS", "https://mirror.example.com, https://other.example.com")
+	t.Setenv("DOCKERD_MAX_CONCURRENT_DOWNLOADS", "3")
+	t.Setenv("DOCKERD_FEATURES", "containerd-snapshotter,buildkit=false")
+
+	overrides, err := daemonConfigOverrides()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]any{
+		"data-root":                "/mnt/docker",
+		"registry-mirrors":         []string{"https://mirror.example.com", "https://other.example.com"},
+		"max-concurrent-downloads": 3,
+		"features":                 map[string]any{"containerd-snapshotter": true, "buildkit": false},
+	}
+	if !reflect.DeepEqual(overrides, expected) {
+		t.Errorf("expected %v, but got %v", expected, overrides)
+	}
+
+	t.Setenv("DOCKERD_MAX_CONCURRENT_UPLOADS", "lots")
+	if _, err := daemonConfigOverrides(); err == nil {
+		t.Error("expected an invalid number to be an error")
+	}
+}
+
+func TestWriteDaemonConfig(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "daemon.json"), filepath.Join(dir, "generated.json")
+	err := os.WriteFile(src, []byte(`{"data-root": "/data/docker", "mtu": 1400, "features": {"buildkit": true}}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writeDaemonConfig(src, dst, map[string]any{
+		"data-root": "/mnt/docker",
+		"features":  map[string]any{"containerd-snapshotter": true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config map[string]any
+	if err := json.Unmarshal(b, &config); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]any{
+		"data-root": "/mnt/docker",
+		"mtu":       float64(1400),
+		"features":  map[string]any{"buildkit": true, "containerd-snapshotter": true},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("expected %v, but got %v", expected, config)
+	}
+}
+
+func TestWriteDaemonConfigRegistryCache(t *testing.T) {
+	defer func(enabled bool) { registryCacheEnabled = enabled }(registryCacheEnabled)
+	registryCacheEnabled = true
+
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "daemon.json"), filepath.Join(dir, "generated.json")
+	if err := os.WriteFile(src, []byte(`{"registry-mirrors": ["https://mirror.example.com"]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeDaemonConfig(src, dst, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config struct {
+		Mirrors []string `json:"registry-mirrors"`
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{registryCacheMirror, "https://mirror.example.com"}
+	if !reflect.DeepEqual(config.Mirrors, expected) {
+		t.Errorf("expected mirrors %v, but got %v", expected, config.Mirrors)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/superfly/rchab/dockerproxy/internal/daemon"
+)
+
+// how long a build whose stream broke waits to hear whether the daemon
+// under it died, the connection usually drops before it's reaped
+const daemonExitWait = 2 * time.Second
+
+// lastDaemonExit is the last time dockerd or buildkitd went away without
+// being asked to.
+var lastDaemonExit atomic.Pointer[daemon.Exit]
+
+// recordDaemonExit logs and counts an unexpected exit, and keeps it for
+// requests broken by it.
+func recordDaemonExit(e *daemon.Exit) {
+	log.Errorf("%s", e)
+	metricDaemonExits.inc(e.Daemon, e.Reason)
+	lastDaemonExit.Store(e)
+}
+
+// daemonExitSince returns the daemon exit after since, waiting up to wait
+// for one to be recorded. nil if there wasn't one.
+func daemonExitSince(since time.Time, wait time.Duration) *daemon.Exit {
+	deadline := time.Now().Add(wait)
+	for {
+		if e := lastDaemonExit.Load(); e != nil && e.Time.After(since) {
+			return e
+		}
+		if time.Now().After(deadline) {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
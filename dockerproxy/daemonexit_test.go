@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/superfly/rchab/dockerproxy/internal/daemon"
+	"github.com/superfly/rchab/dockerproxy/internal/harness"
+)
+
+func TestBuildDaemonDied(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	defer lastDaemonExit.Store(nil)
+
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"stream":"Step 1/2 : FROM alpine"}`+"\n")
+		w.(http.Flusher).Flush()
+		// dockerd is OOM killed mid-build
+		recordDaemonExit(&daemon.Exit{Daemon: "dockerd", Reason: daemon.ExitOOM, Detail: "ran out of memory and was killed by the kernel", Time: time.Now()})
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	proxy := httptest.NewServer(newDockerProxy(dockerd))
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/v1.41/build", "application/x-tar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `"errorDetail"`) || !strings.Contains(string(body), "ran out of memory") {
+		t.Fatalf("expected the build to end with an error saying dockerd ran out of memory, but got %s", body)
+	}
+
+	if last := recentBuilds.list()[0]; last.Status != buildStatusError {
+		t.Errorf("expected the build to be recorded as failed, but got %s", last.Status)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+	expvar.Publish("pending_requests", expvar.Func(func() any { return pendingRequests.Load() }))
+	expvar.Publish("active_builds", expvar.Func(func() any { return len(activeBuilds.list()) }))
+	expvar.Publish("draining", expvar.Func(func() any { return draining.Load() }))
+}
+
+// debugHandler serves pprof profiles under /debug/pprof/ and expvar at
+// /debug/vars, for looking into a misbehaving builder without restarting
+// it. Like /metrics it isn't authenticated, and profiles expose memory
+// contents, so it must only be reachable privately.
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
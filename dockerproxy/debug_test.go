@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDebugHandler(t *testing.T) {
+	h := debugHandler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, but got %d", http.StatusOK, w.Code)
+	}
+	var vars map[string]json.RawMessage
+	if err := json.NewDecoder(w.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"goroutines", "pending_requests", "active_builds", "draining", "memstats"} {
+		if _, ok := vars[name]; !ok {
+			t.Errorf("expected %s in /debug/vars", name)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/pprof/goroutine?debug=1", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d for the goroutine profile, but got %d", http.StatusOK, w.Code)
+	}
+}
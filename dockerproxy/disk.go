@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minio/pkg/disk"
+)
+
+// lastDiskInfo is the most recent usage of /data seen by monitorDisk.
+var lastDiskInfo atomic.Pointer[disk.Info]
+
+// monitorDisk stats /data every interval until ctx is done.
+func monitorDisk(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkDisk()
+		}
+	}
+}
+
+// checkDisk records the usage of /data, logging when free space crosses
+// DISK_MIN_FREE_GB in either direction.
+func checkDisk() {
+	di, err := disk.GetInfo(dataDir)
+	if err != nil {
+		log.Errorf("could not get disk usage: %v", err)
+		return
+	}
+
+	wasLow := false
+	if prev := lastDiskInfo.Swap(&di); prev != nil {
+		wasLow = isDiskLow(*prev)
+	}
+	switch low := isDiskLow(di); {
+	case low && !wasLow:
+		log.Warnf("only %.2fGB free on /data, refusing new builds", float64(di.Free)/float64(gb))
+	case !low && wasLow:
+		log.Infof("%.2fGB free on /data, accepting builds again", float64(di.Free)/float64(gb))
+	}
+}
+
+func isDiskLow(di disk.Info) bool {
+	return di.Total > 0 && di.Free < uint64(diskMinFree)
+}
+
+// diskLow reports whether the last check found too little space for new
+// builds. Builds are let through until the first check.
+func diskLow() (disk.Info, bool) {
+	di := lastDiskInfo.Load()
+	if di == nil {
+		return disk.Info{}, false
+	}
+	return *di, isDiskLow(*di)
+}
@@ -1,106 +1,342 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 	"github.com/mitchellh/go-ps"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/rchab/dockerproxy/internal/daemon"
 )
 
 const (
-	healthCheckTimeout = 10 * time.Second
-)
+	readinessMinBackoff = 200 * time.Millisecond
+	readinessMaxBackoff = 5 * time.Second
 
-func runDockerd() (func() error, *client.Client, error) {
-	// noop
-	if noDockerd {
-		client, err := client.NewClientWithOpts(client.FromEnv)
-		if err != nil {
-			return nil, nil, err
-		}
-		return func() error { return nil }, client, nil
-	}
+	dockerdMaxRestartBackoff = 30 * time.Second
+	// how long dockerd has to stay up for its restart count to start over
+	dockerdStableAfter = 5 * time.Minute
 
-	// just to be sure, because machines now reuse snapshots
+	daemonConfigFile = "/etc/docker/daemon.json"
+	// where the daemon.json with our overrides is written
+	generatedDaemonConfigFile = "/var/run/rchab-daemon.json"
+)
+
+// startDockerd launches dockerd with args. done is closed once it exits.
+func startDockerd(args []string) (*daemonProcess, error) {
+	// just to be sure, because machines now reuse snapshots, and a crashed
+	// dockerd leaves its pid file behind
 	err := os.RemoveAll("/var/run/docker.pid")
 	if err != nil && !errors.Is(err, fs.ErrNotExist) {
-		return nil, nil, errors.Wrap(err, "could not delete previous docker pid")
+		return nil, errors.Wrap(err, "could not delete previous docker pid")
 	}
 
-	// Launch `dockerd`
-	dockerd := exec.Command("dockerd", "-p", "/var/run/docker.pid")
-	dockerd.Stdout = os.Stderr
-	dockerd.Stderr = os.Stderr
-
-	if err := dockerd.Start(); err != nil {
-		return nil, nil, errors.Wrap(err, "could not start dockerd")
+	log.Infof("starting dockerd with args: %q", args)
+	p := &daemonProcess{
+		done:       make(chan struct{}),
+		stderrTail: &tailBuffer{size: 4096},
+		oomBefore:  daemon.OOMKills(),
 	}
+	logWriter := &dockerdLogWriter{}
+	output := io.MultiWriter(logWriter, p.stderrTail)
+	p.cmd = exec.Command("dockerd", args...)
+	p.cmd.Stdout = output
+	p.cmd.Stderr = output
 
-	cmd := exec.Command("docker", "buildx", "inspect", "--bootstrap")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		log.Warnln("Error bootstrapping buildx builder:", err)
-		return nil, nil, err
+	if err := daemon.StartChild(p.cmd); err != nil {
+		return nil, errors.Wrap(err, "could not start dockerd")
 	}
 
-	dockerDone := make(chan struct{})
-
 	go func() {
-		if err := dockerd.Wait(); err != nil {
+		err := daemon.WaitChild(p.cmd)
+		logWriter.Flush()
+		if err != nil {
 			log.Errorf("error waiting on docker: %v", err)
 		}
-		close(dockerDone)
+		close(p.done)
 	}()
 
-	healthCtx, healthCancel := context.WithTimeout(context.Background(), healthCheckTimeout)
-	defer healthCancel()
+	return p, nil
+}
+
+// waitDockerdReady returns once dockerd answers dockerClient and the buildx
+// builder is bootstrapped, giving up after timeout.
+func waitDockerdReady(p *daemonProcess, dockerClient *client.Client, timeout time.Duration) error {
+	// dockerd starting is no guarantee it works (missing binaries, bad mounts),
+	// so don't report success until it answers a ping and buildx is up.
+	readyCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ping := func(ctx context.Context) error {
+		_, err := dockerClient.Ping(ctx)
+		return err
+	}
+	if err := waitUntilReady(readyCtx, "dockerd", p.done, ping); err != nil {
+		return fmt.Errorf("%w, dockerd stderr:\n%s", err, p.stderrTail)
+	}
+	if err := waitUntilReady(readyCtx, "buildx builder", p.done, bootstrapBuildx); err != nil {
+		return fmt.Errorf("%w, dockerd stderr:\n%s", err, p.stderrTail)
+	}
+	return nil
+}
+
+// runDockerd starts dockerd and returns once it's ready. If dockerd exits
+// afterwards it is restarted, with requests getting 503 until it's back.
+// After c.MaxRestarts restarts giveUp is called instead.
+func runDockerd(c DockerdConfig, dockerClient *client.Client, giveUp func()) (func() error, error) {
+	// noop
+	if c.Disabled {
+		return func() error { return nil }, nil
+	}
 
-	dockerClient, err := client.NewClientWithOpts(client.FromEnv)
+	args := []string{"-p", "/var/run/docker.pid"}
+	extraArgs, err := splitArgs(c.ExtraArgs)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to setup docker clinet")
+		return nil, errors.Wrap(err, "could not parse DOCKERD_EXTRA_ARGS")
 	}
+	args = append(args, extraArgs...)
 
-	stopFn := func() error {
-		if dockerd.Process == nil {
-			return nil
+	overrides, err := daemonConfigOverrides()
+	if err != nil {
+		return nil, err
+	}
+	if len(overrides) > 0 || registryCacheEnabled {
+		if err := writeDaemonConfig(daemonConfigFile, generatedDaemonConfigFile, overrides); err != nil {
+			return nil, errors.Wrap(err, "could not write daemon config")
 		}
+		args = append(args, "--config-file", generatedDaemonConfigFile)
+	}
 
-		tryPrune(context.Background(), dockerClient)
-		if err := dockerd.Process.Signal(os.Interrupt); err != nil {
-			return err
-		}
-		<-dockerDone
-		log.Info("dockerd has exited")
-		return nil
+	s := &daemonSupervisor{
+		name:        "dockerd",
+		logger:      log,
+		maxRestarts: c.MaxRestarts,
+		start:       func() (*daemonProcess, error) { return startDockerd(args) },
+		ready: func(p *daemonProcess) error {
+			return waitDockerdReady(p, dockerClient, c.StartTimeout)
+		},
+		stop: func(p *daemonProcess) error {
+			tryPrune(context.Background(), dockerClient)
+			return p.cmd.Process.Signal(os.Interrupt)
+		},
+		stopTimeout: c.StopTimeout,
+		giveUp:      giveUp,
 	}
+	return s.run()
+}
 
+// dockerdRestartBackoff is how long to wait before restart number n, counting
+// from zero.
+func dockerdRestartBackoff(n int) time.Duration {
+	backoff := time.Second
+	for i := 0; i < n && backoff < dockerdMaxRestartBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, dockerdMaxRestartBackoff)
+}
+
+// waitUntilReady calls check until it succeeds, backing off exponentially
+// between attempts. It gives up once ctx is done or dockerd exits.
+func waitUntilReady(ctx context.Context, what string, dockerDone <-chan struct{}, check func(context.Context) error) error {
+	start := time.Now()
+	backoff := readinessMinBackoff
 	for {
-		log.Info("pinging dockerd")
-		_, err := dockerClient.Ping(healthCtx)
+		err := check(ctx)
+		if err == nil {
+			log.Infof("%s ready after %s", what, time.Since(start).Round(time.Millisecond))
+			return nil
+		}
+		log.Warnf("%s not ready, retrying in %s: %v", what, backoff, err)
 
 		select {
-		case <-healthCtx.Done():
-			return nil, nil, fmt.Errorf("dockerd failed to boot after %s", healthCheckTimeout)
+		case <-ctx.Done():
+			return fmt.Errorf("%s not ready after %s: %v", what, time.Since(start).Round(time.Second), err)
 		case <-dockerDone:
-			return nil, nil, fmt.Errorf("dockerd exited before we could ascertain its healthyness")
-		default:
-			if err != nil {
-				log.Errorf("failed to ping dockerd: %v", err)
-				time.Sleep(200 * time.Millisecond)
-				continue
+			return fmt.Errorf("dockerd exited before %s was ready", what)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, readinessMaxBackoff)
+	}
+}
+
+func bootstrapBuildx(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, "docker", "buildx", "inspect", "--bootstrap")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return daemon.RunChild(cmd)
+}
+
+// splitArgs splits s into words the way a POSIX shell would, honoring single
+// quotes, double quotes and backslash escapes.
+func splitArgs(s string) ([]string, error) {
+	var (
+		args    []string
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+
+	for _, c := range s {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case unicode.IsSpace(c):
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
 			}
-			return stopFn, dockerClient, nil
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash in %q", s)
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in %q", quote, s)
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+
+	return args, nil
+}
+
+var dockerdLevelPattern = regexp.MustCompile(`level=(\w+)`)
+
+// maxDockerdLine caps how much of an unterminated line dockerdLogWriter holds
+// on to before logging it anyway.
+const maxDockerdLine = 64 * 1024
+
+// dockerdLogWriter re-emits dockerd's output line by line through our own
+// logger, so it gets the same formatting and level filtering.
+type dockerdLogWriter struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *dockerdLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		logDockerdLine(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	for len(w.buf) >= maxDockerdLine {
+		logDockerdLine(string(w.buf[:maxDockerdLine]))
+		w.buf = w.buf[maxDockerdLine:]
+	}
+	return len(p), nil
+}
 
+// Flush logs whatever is left of a last line without a trailing newline.
+func (w *dockerdLogWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	logDockerdLine(string(w.buf))
+	w.buf = nil
+}
+
+func logDockerdLine(line string) {
+	line = strings.TrimRight(line, "\r")
+	if line == "" {
+		return
+	}
+
+	level := logrus.InfoLevel
+	if m := dockerdLevelPattern.FindStringSubmatch(line); m != nil {
+		if parsed, err := logrus.ParseLevel(m[1]); err == nil {
+			level = parsed
+		}
+	}
+	// logging at fatal or panic would take us down with dockerd
+	if level < logrus.ErrorLevel {
+		level = logrus.ErrorLevel
+	}
+
+	log.WithField("component", "dockerd").Log(level, line)
+}
+
+// tailBuffer keeps the last size bytes written to it.
+type tailBuffer struct {
+	mu   sync.Mutex
+	buf  []byte
+	size int
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.size {
+		t.buf = t.buf[len(t.buf)-t.size:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.buf)
+}
+
+// prepullImages pulls images in the background so the first builds on a cold
+// builder don't have to. Pulls go straight to dockerd rather than through the
+// proxy, so they don't count as activity and don't hold the builder up.
+func prepullImages(ctx context.Context, dockerClient *client.Client, images []string) {
+	for _, image := range images {
+		start := time.Now()
+		rc, err := dockerClient.ImagePull(ctx, image, types.ImagePullOptions{})
+		if err != nil {
+			log.Warnf("failed to prepull %s: %v", image, err)
+			continue
+		}
+		_, err = io.Copy(io.Discard, rc)
+		rc.Close()
+		if err != nil {
+			log.Warnf("failed to prepull %s: %v", image, err)
+			continue
 		}
+		log.Infof("prepulled %s in %s", image, time.Since(start))
 	}
 }
 
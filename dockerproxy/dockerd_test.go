@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+		err  bool
+	}{
+		{in: "", want: nil},
+		{in: "  --mtu 1400  ", want: []string{"--mtu", "1400"}},
+		{in: `--data-root "/data/my docker"`, want: []string{"--data-root", "/data/my docker"}},
+		{in: `--label 'a "b"'`, want: []string{"--label", `a "b"`}},
+		{in: `--label a\ b`, want: []string{"--label", "a b"}},
+		{in: `--bip ""`, want: []string{"--bip", ""}},
+		{in: `--label "unterminated`, err: true},
+		{in: `--label trailing\`, err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := splitArgs(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("splitArgs(%q) expected error, got %q", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("splitArgs(%q) unexpected error: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitArgs(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDockerdLogWriter(t *testing.T) {
+	var out bytes.Buffer
+	defer log.SetOutput(log.Out)
+	log.SetOutput(&out)
+
+	w := &dockerdLogWriter{}
+	w.Write([]byte("level=info msg=\"first\"\nlevel=info msg=\"sec"))
+	if !strings.Contains(out.String(), "first") || strings.Contains(out.String(), "sec") {
+		t.Fatalf("expected only the complete line to be logged, got %q", out.String())
+	}
+
+	w.Write([]byte(strings.Repeat("x", maxDockerdLine)))
+	if len(w.buf) >= maxDockerdLine {
+		t.Errorf("expected the buffer to be capped, but it holds %d bytes", len(w.buf))
+	}
+
+	out.Reset()
+	w.Write([]byte("level=warning msg=\"last words\""))
+	w.Flush()
+	if !strings.Contains(out.String(), "last words") {
+		t.Errorf("expected Flush to log the unterminated line, got %q", out.String())
+	}
+	if len(w.buf) != 0 {
+		t.Errorf("expected an empty buffer after Flush, but it holds %d bytes", len(w.buf))
+	}
+}
+
+func TestWaitUntilReady(t *testing.T) {
+	attempts := 0
+	check := func(context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("not yet")
+		}
+		return nil
+	}
+	if err := waitUntilReady(context.Background(), "test", nil, check); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, but got %d", attempts)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	never := func(context.Context) error { return errors.New("down") }
+	if err := waitUntilReady(ctx, "test", nil, never); err == nil {
+		t.Error("expected an error once the context is done")
+	}
+
+	dockerDone := make(chan struct{})
+	close(dockerDone)
+	if err := waitUntilReady(context.Background(), "test", dockerDone, never); err == nil {
+		t.Error("expected an error once dockerd exited")
+	}
+}
+
+func TestDockerdRestartBackoff(t *testing.T) {
+	for n, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second} {
+		if got := dockerdRestartBackoff(n); got != want {
+			t.Errorf("dockerdRestartBackoff(%d) = %s, want %s", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	dockerDialMinBackoff = 50 * time.Millisecond
+	dockerDialMaxBackoff = time.Second
+	// how often a held request looks whether dockerd is back
+	dockerReadyPollInterval = 100 * time.Millisecond
+)
+
+// dockerdDown reports whether a dial failed because nothing is listening on
+// dockerd's socket yet, as while it starts or restarts.
+func dockerdDown(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENOENT)
+}
+
+// retryDial retries dial with backoff while dockerd isn't listening, for up to
+// timeout. Other errors are returned right away.
+func retryDial(dial func(ctx context.Context) (net.Conn, error), timeout time.Duration) func(ctx context.Context) (net.Conn, error) {
+	if timeout <= 0 {
+		return dial
+	}
+	return func(ctx context.Context) (net.Conn, error) {
+		deadline := time.Now().Add(timeout)
+		backoff := dockerDialMinBackoff
+		for attempt := 1; ; attempt++ {
+			conn, err := dial(ctx)
+			if err == nil || !dockerdDown(err) || time.Now().Add(backoff).After(deadline) {
+				if err == nil && attempt > 1 {
+					requestLogger(ctx).Debugf("reached dockerd after %d attempts", attempt)
+				}
+				return conn, err
+			}
+			select {
+			case <-ctx.Done():
+				return nil, err
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, dockerDialMaxBackoff)
+		}
+	}
+}
+
+// waitDockerReady holds a request while dockerd starts or restarts, for up to
+// wait, rather than refusing it straight away. It returns false if dockerd
+// isn't ready by then, or the client went away.
+func waitDockerReady(ctx context.Context, wait time.Duration) bool {
+	if dockerReady.Load() {
+		return true
+	}
+	if wait <= 0 {
+		return false
+	}
+	l := requestLogger(ctx)
+	l.Infof("holding request up to %s until the builder is ready", wait)
+	start := time.Now()
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	ticker := time.NewTicker(dockerReadyPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timeout.C:
+			l.Warnf("builder not ready after holding request for %s", wait)
+			return false
+		case <-ticker.C:
+			if dockerReady.Load() {
+				l.Infof("builder ready after holding request for %s", time.Since(start).Round(time.Millisecond))
+				return true
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/superfly/rchab/dockerproxy/internal/harness"
+)
+
+func TestRetryDialUntilListening(t *testing.T) {
+	// grab a free port, and only start listening on it after a while
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "OK")
+		})}
+		go server.Serve(l)
+		t.Cleanup(func() { server.Close() })
+	}()
+
+	dial := retryDial(func(ctx context.Context) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}, 5*time.Second)
+	conn, err := dial(context.Background())
+	if err != nil {
+		t.Fatalf("expected the dial to be retried until dockerd listened, but got %v", err)
+	}
+	conn.Close()
+}
+
+func TestRetryDialGivesUp(t *testing.T) {
+	attempts := 0
+	dial := retryDial(func(ctx context.Context) (net.Conn, error) {
+		attempts++
+		return (&net.Dialer{}).DialContext(ctx, "unix", "/nonexistent/docker.sock")
+	}, 300*time.Millisecond)
+
+	start := time.Now()
+	if _, err := dial(context.Background()); err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+	if attempts < 2 {
+		t.Errorf("expected the dial to be retried, but it was attempted %d times", attempts)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the dial to give up after its timeout, but it took %s", elapsed)
+	}
+}
+
+func TestDockerProxyHeldUntilReady(t *testing.T) {
+	defer dockerReady.Store(false)
+	defer func(d time.Duration) { dockerdReadyWait = d }(dockerdReadyWait)
+	dockerdReadyWait = 5 * time.Second
+
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "OK")
+	}))
+	proxy := newDockerProxy(dockerd)
+	time.AfterFunc(200*time.Millisecond, func() { dockerReady.Store(true) })
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_ping", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the request through once dockerd was ready, but got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestDockerProxyHeldTooLong(t *testing.T) {
+	defer func(d time.Duration) { dockerdReadyWait = d }(dockerdReadyWait)
+	dockerdReadyWait = 200 * time.Millisecond
+
+	proxy := newDockerProxy(&url.URL{Scheme: "http", Host: "127.0.0.1:0"})
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_ping", nil))
+	assertDockerError(t, w, http.StatusServiceUnavailable)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/superfly/rchab/dockerproxy/internal/daemon"
+)
+
+// dockerTarget is the dockerd requests are proxied to, from DOCKER_HOST
+var dockerTarget *url.URL
+
+// parseDockerHost reads a DOCKER_HOST style address: unix:///path/to.sock,
+// tcp://host:port or ssh://[user@]host[:port].
+func parseDockerHost(host string) (*url.URL, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DOCKER_HOST %q: %w", host, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid DOCKER_HOST %q, expected a socket path like unix:///var/run/docker.sock", host)
+		}
+	case "tcp", "http":
+		if u.Port() == "" {
+			return nil, fmt.Errorf("invalid DOCKER_HOST %q, expected a host and port like tcp://10.0.0.2:2376", host)
+		}
+	case "ssh":
+		if u.Hostname() == "" {
+			return nil, fmt.Errorf("invalid DOCKER_HOST %q, expected a host like ssh://user@10.0.0.2", host)
+		}
+	default:
+		return nil, fmt.Errorf("invalid DOCKER_HOST %q, expected a unix://, tcp:// or ssh:// address", host)
+	}
+	return u, nil
+}
+
+// newDockerClient returns a Docker API client for the dockerd at target,
+// dialing it the same way the proxy does. The API version still comes from
+// DOCKER_API_VERSION.
+func newDockerClient(target *url.URL) (*client.Client, error) {
+	dial := dockerDialer(target)
+	return client.NewClientWithOpts(
+		client.WithHost("http://docker"),
+		client.WithDialContext(func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dial(ctx)
+		}),
+		client.WithVersion(getEnvDefault("DOCKER_API_VERSION", "")),
+	)
+}
+
+// dialSSH reaches the dockerd on the other end of an ssh:// target through
+// `docker system dial-stdio`, the way the docker CLI does. The remote host
+// needs the docker CLI, and ssh here needs a key it can log in with.
+func dialSSH(ctx context.Context, target *url.URL) (net.Conn, error) {
+	args := []string{"-o", "BatchMode=yes"}
+	if target.User != nil {
+		args = append(args, "-l", target.User.Username())
+	}
+	if target.Port() != "" {
+		args = append(args, "-p", target.Port())
+	}
+	args = append(args, "--", target.Hostname(), "docker", "system", "dial-stdio")
+	return dialCommand(ctx, "ssh", args...)
+}
+
+// dialCommand runs a command and returns a connection over its stdin and
+// stdout. It's started with daemon.StartChild, so the reaper leaves it to
+// Close to wait for.
+func dialCommand(ctx context.Context, name string, args ...string) (net.Conn, error) {
+	// not tied to ctx, the connection can outlive the request that dialed it
+	cmd := exec.Command(name, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	c := &commandConn{cmd: cmd, stdin: stdin, stdout: stdout, stderr: &tailBuffer{size: 4096}}
+	cmd.Stderr = c.stderr
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := daemon.StartChild(cmd); err != nil {
+		return nil, fmt.Errorf("could not run %s: %w", name, err)
+	}
+	return c, nil
+}
+
+// commandConn is a connection over a command's stdin and stdout. A pipe has
+// no deadlines of its own, so once one passes the connection is closed, and
+// reads and writes fail with os.ErrDeadlineExceeded.
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr *tailBuffer
+
+	mu                    sync.Mutex
+	readTimer, writeTimer *time.Timer
+	expired               atomic.Bool
+
+	closeOnce sync.Once
+}
+
+func (c *commandConn) Read(p []byte) (int, error) {
+	n, err := c.stdout.Read(p)
+	if err != nil && c.expired.Load() {
+		return n, os.ErrDeadlineExceeded
+	}
+	if err == io.EOF && n == 0 {
+		if stderr := c.stderr.String(); stderr != "" {
+			log.Debugf("connection to dockerd over %s ended, stderr:\n%s", c.cmd.Path, stderr)
+		}
+	}
+	return n, err
+}
+
+func (c *commandConn) Write(p []byte) (int, error) {
+	n, err := c.stdin.Write(p)
+	if err != nil && c.expired.Load() {
+		return n, os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (c *commandConn) CloseWrite() error {
+	return c.stdin.Close()
+}
+
+func (c *commandConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		for _, timer := range []*time.Timer{c.readTimer, c.writeTimer} {
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+		c.mu.Unlock()
+		c.stdin.Close()
+		c.cmd.Process.Kill()
+		daemon.WaitChild(c.cmd)
+	})
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr  { return commandAddr{} }
+func (c *commandConn) RemoteAddr() net.Addr { return commandAddr{} }
+
+func (c *commandConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *commandConn) SetReadDeadline(t time.Time) error {
+	c.setDeadline(&c.readTimer, t)
+	return nil
+}
+
+func (c *commandConn) SetWriteDeadline(t time.Time) error {
+	c.setDeadline(&c.writeTimer, t)
+	return nil
+}
+
+// setDeadline replaces timer with one closing the connection at t, or none
+// when t is zero.
+func (c *commandConn) setDeadline(timer **time.Timer, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	if t.IsZero() {
+		return
+	}
+	*timer = time.AfterFunc(time.Until(t), func() {
+		c.expired.Store(true)
+		c.Close()
+	})
+}
+
+type commandAddr struct{}
+
+func (commandAddr) Network() string { return "command" }
+func (commandAddr) String() string  { return "command" }
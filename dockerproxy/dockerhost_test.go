@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/superfly/rchab/dockerproxy/internal/harness"
+)
+
+func TestParseDockerHost(t *testing.T) {
+	for _, host := range []string{
+		"unix:///var/run/docker.sock",
+		"tcp://127.0.0.1:2376",
+		"tcp://[fdaa::3]:2376",
+		"ssh://docker@10.0.0.2",
+		"ssh://10.0.0.2:2222",
+	} {
+		if _, err := parseDockerHost(host); err != nil {
+			t.Errorf("expected %s to parse, but got %v", host, err)
+		}
+	}
+	for _, host := range []string{
+		"",
+		"unix://",
+		"tcp://127.0.0.1",
+		"ssh://",
+		"npipe:////./pipe/docker_engine",
+		"/var/run/docker.sock",
+	} {
+		if _, err := parseDockerHost(host); err == nil {
+			t.Errorf("expected %q to be refused", host)
+		}
+	}
+}
+
+func TestDockerProxyTCPHost(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+
+	dockerd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "OK")
+	}))
+	defer dockerd.Close()
+	target, err := parseDockerHost("tcp://" + dockerd.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/_ping", nil)
+	w := httptest.NewRecorder()
+	newDockerProxy(target).ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "OK" {
+		t.Fatalf("expected dockerd's answer, but got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestNewDockerClient(t *testing.T) {
+	var path string
+	target := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.Header().Set("API-Version", "1.41")
+		io.WriteString(w, "OK")
+	}))
+	c, err := newDockerClient(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Ping(context.Background()); err != nil {
+		t.Fatalf("expected to reach dockerd, but got %v", err)
+	}
+	if path != "/_ping" {
+		t.Errorf("expected a ping, but dockerd got %s", path)
+	}
+}
+
+func TestDialCommand(t *testing.T) {
+	conn, err := dialCommand(context.Background(), "cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, "GET /_ping HTTP/1.1\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	conn.(interface{ CloseWrite() error }).CloseWrite()
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "GET /_ping HTTP/1.1\r\n" {
+		t.Errorf("expected what was written back, but got %q", b)
+	}
+}
+
+func TestDialCommandDeadline(t *testing.T) {
+	conn, err := dialCommand(context.Background(), "cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("expected the read to pass its deadline, but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the read to end at its deadline")
+	}
+}
+
+func TestDockerTransportTarget(t *testing.T) {
+	for host, want := range map[string]string{
+		"unix:///var/run/docker.sock": "http://docker",
+		"ssh://docker@10.0.0.2":       "http://docker",
+		"tcp://10.0.0.2:2376":         "http://10.0.0.2:2376",
+	} {
+		target, err := url.Parse(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := dockerTransport(target); got.String() != want {
+			t.Errorf("expected %s to be reached as %s, but got %s", host, want, got)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// drainRequested wakes the liveness loop to shut down once in-flight
+// requests finish. It's buffered so a drain asked for before dockerd is
+// ready isn't lost.
+var drainRequested = make(chan struct{}, 1)
+
+// drainHandler puts the builder in draining mode, like MAX_LIFETIME does:
+// new builds get a 503 while in-flight ones finish, then it exits.
+// Orchestrators use it to rotate builders without failing deploys, so it's
+// an admin route: app credentials would let any app shut a shared builder
+// down.
+func drainHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !draining.Swap(true) {
+			// ADMIN_TOKEN doesn't say who's asking, the Basic-Auth username
+			// does when the orchestrator sends its app's name
+			app, _, _ := r.BasicAuth()
+			requestLogger(r.Context()).Infof("drain requested by app %q from %s with user agent: %s", app, r.RemoteAddr, r.UserAgent())
+		}
+		select {
+		case drainRequested <- struct{}{}:
+		default:
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		err := json.NewEncoder(w).Encode(map[string]any{
+			"draining":         true,
+			"pending_requests": pendingRequests.Load(),
+		})
+		if err != nil {
+			log.Warnln("error writing drain response", err)
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDrainHandler(t *testing.T) {
+	defer draining.Store(false)
+	defer func() {
+		select {
+		case <-drainRequested:
+		default:
+		}
+	}()
+
+	h := drainHandler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/flyio/v1/drain", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, but got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+	if draining.Load() {
+		t.Error("expected a GET not to start draining")
+	}
+
+	// asking twice is fine, e.g. when the orchestrator retries
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/flyio/v1/drain", nil))
+		if w.Code != http.StatusAccepted {
+			t.Errorf("expected status %d, but got %d", http.StatusAccepted, w.Code)
+		}
+		var body struct {
+			Draining bool `json:"draining"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if !body.Draining {
+			t.Error("expected the response to say the builder is draining")
+		}
+	}
+
+	if !draining.Load() {
+		t.Error("expected the builder to be draining")
+	}
+	select {
+	case <-drainRequested:
+	default:
+		t.Error("expected the liveness loop to be told to drain")
+	}
+}
+
+func TestDrainRouteNeedsAdminToken(t *testing.T) {
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "admin-token"
+	defer draining.Store(false)
+	defer func() {
+		select {
+		case <-drainRequested:
+		default:
+		}
+	}()
+
+	mux := http.NewServeMux()
+	registerAdminRoutes(mux)
+
+	// an app's own credentials don't make it an orchestrator
+	r := httptest.NewRequest(http.MethodPost, "/flyio/v1/drain", nil)
+	r.SetBasicAuth("my-app", "good-token")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected an app credential to get 401, but got %d", w.Code)
+	}
+	if draining.Load() {
+		t.Fatal("expected an app credential not to start draining")
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/flyio/v1/drain", nil)
+	r.SetBasicAuth("orchestrator", "admin-token")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusAccepted || !draining.Load() {
+		t.Errorf("expected ADMIN_TOKEN to drain the builder, but got %d", w.Code)
+	}
+}
@@ -1,10 +1,49 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+
 	"github.com/minio/minio/pkg/disk"
+	"github.com/superfly/rchab/dockerproxy/internal/auth"
 )
 
+const defaultUnauthorizedMessage = "You are not authorized to use this builder: {{.Reason}}"
+
+// unauthorizedMessage renders the 401 message, overridable with
+// UNAUTHORIZED_MESSAGE to e.g. point users at internal docs. The template can
+// use {{.App}} and {{.Reason}}.
+var unauthorizedMessage = template.Must(template.New("unauthorized").Parse(defaultUnauthorizedMessage))
+
+// writeDockerError responds with the error envelope the Docker daemon uses, so
+// docker clients show the message instead of a generic failure.
+func writeDockerError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(map[string]string{
+		"message": message,
+	})
+	if err != nil {
+		log.Warnln("error writing response", err)
+	}
+}
+
+func renderUnauthorizedMessage(appName string, reason auth.DenyReason) string {
+	var b strings.Builder
+	err := unauthorizedMessage.Execute(&b, struct {
+		App    string
+		Reason string
+	}{appName, reason.PublicMessage()})
+	if err != nil {
+		log.Warnln("error rendering unauthorized message", err)
+		return "You are not authorized to use this builder"
+	}
+	return b.String()
+}
+
 func newInsufficientStorageError(di disk.Info) error {
 	if di.Free <= uint64(1*gb) {
 		free := float64(di.Free) / float64(gb)
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/minio/minio/pkg/disk"
+	"github.com/superfly/rchab/dockerproxy/internal/auth"
 )
 
 func TestError(t *testing.T) {
@@ -17,3 +21,24 @@ func TestError(t *testing.T) {
 		t.Errorf("expected nil, but got %v", err)
 	}
 }
+
+func TestWriteDockerError(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeDockerError(w, http.StatusUnauthorized, renderUnauthorizedMessage("my-app", auth.DenyBadCredentials))
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d, but got %d", http.StatusUnauthorized, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected application/json content type, but got %q", ct)
+	}
+
+	var body map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	expected := "You are not authorized to use this builder: missing or invalid credentials"
+	if body["message"] != expected {
+		t.Errorf("expected message %q, but got %q", expected, body["message"])
+	}
+}
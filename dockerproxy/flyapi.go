@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	fly "github.com/superfly/fly-go"
+	"github.com/superfly/graphql"
+	"github.com/superfly/macaroon"
+	"github.com/superfly/macaroon/flyio"
+)
+
+// flyGraphQLURL is where our own GraphQL queries go.
+var flyGraphQLURL = flyAPIURL + "/graphql"
+
+// setFlyAPIURL points both our own queries and the fly-go client at the Fly
+// API at url.
+func setFlyAPIURL(url string) {
+	flyAPIURL = url
+	flyGraphQLURL = url + "/graphql"
+	fly.SetBaseURL(url)
+}
+
+// flyAPI is what authorization needs from the Fly API, as seen by one token.
+// Both return nil, and no error, for what the token can't see.
+type flyAPI interface {
+	// AppOrg returns the organization appName belongs to.
+	AppOrg(ctx context.Context, appName string) (*appOrg, error)
+	// Org returns the organization with slug.
+	Org(ctx context.Context, slug string) (*appOrg, error)
+}
+
+// newFlyAPI returns the Fly API client for authToken. Macaroons are sent
+// with our own GraphQL queries, which hand their FlyV1 header on as the
+// client sent it, discharges included. Tests swap it for a fake.
+var newFlyAPI = func(authToken string, l *logrus.Entry) flyAPI {
+	if isMacaroonToken(authToken) {
+		return graphqlFlyAPI{authToken: authToken}
+	}
+	return flyGoAPI{fly.NewClientFromOptions(fly.ClientOptions{
+		AccessToken: authToken,
+		Name:        "superfly/rchab",
+		Version:     gitSha,
+		Logger:      l,
+	})}
+}
+
+// flyGoAPI is the Fly API through the fly-go client.
+type flyGoAPI struct {
+	client *fly.Client
+}
+
+func (f flyGoAPI) AppOrg(ctx context.Context, appName string) (*appOrg, error) {
+	app, err := f.client.GetAppCompact(ctx, appName)
+	if app == nil || app.Organization == nil || err != nil {
+		return nil, err
+	}
+	return &appOrg{ID: app.Organization.ID, Slug: app.Organization.Slug}, nil
+}
+
+func (f flyGoAPI) Org(ctx context.Context, slug string) (*appOrg, error) {
+	org, err := f.client.GetOrganizationBySlug(ctx, slug)
+	if org == nil || err != nil {
+		return nil, err
+	}
+	return &appOrg{ID: org.ID, Slug: org.Slug}, nil
+}
+
+// graphqlFlyAPI is the Fly API through GraphQL queries of our own, at
+// flyGraphQLURL.
+type graphqlFlyAPI struct {
+	authToken string
+}
+
+func (f graphqlFlyAPI) AppOrg(ctx context.Context, appName string) (*appOrg, error) {
+	return fetchAppOrg(ctx, f.authToken, appName)
+}
+
+const orgQuery = `query($slug: String!) { organization(slug: $slug) { id slug } }`
+
+func (f graphqlFlyAPI) Org(ctx context.Context, slug string) (*appOrg, error) {
+	var resp struct {
+		Organization *appOrg
+	}
+	if err := runFlyQuery(ctx, f.authToken, orgQuery, map[string]any{"slug": slug}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Organization, nil
+}
+
+// knownBuilderOrg is the builder's organization, set by resolveBuilderOrg,
+// or by any client that could look it up. App scoped deploy tokens can't
+// see the builder app themselves.
+var knownBuilderOrg atomic.Pointer[appOrg]
+
+type appOrg struct {
+	ID   string
+	Slug string
+	// InternalNumericID is the ID organization caveats of macaroons name,
+	// only looked up with them.
+	InternalNumericID json.Number
+}
+
+// same reports whether o and other are the same organization. FLY_ORG only
+// gives the builder's slug, so that's compared when either has no ID.
+func (o *appOrg) same(other *appOrg) bool {
+	if o.ID != "" && other.ID != "" {
+		return o.ID == other.ID
+	}
+	return o.Slug == other.Slug
+}
+
+// isMacaroonToken reports whether token is a Fly macaroon, like the deploy
+// tokens from `fly tokens create`, rather than a personal access token.
+func isMacaroonToken(token string) bool {
+	token = strings.TrimPrefix(token, "FlyV1 ")
+	return strings.HasPrefix(token, "fm1r_") || strings.HasPrefix(token, "fm1a_") || strings.HasPrefix(token, "fm2_")
+}
+
+// macaroonOrgIDs returns the organizations named by the organization caveats
+// of a macaroon token's permission macaroons, leaving out discharges. It
+// doesn't verify the token, the Fly API does that. Tests swap it, their
+// tokens aren't real macaroons.
+var macaroonOrgIDs = func(token string) ([]uint64, error) {
+	toks, err := macaroon.Parse(strings.TrimPrefix(token, "FlyV1 "))
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, tok := range toks {
+		m, err := macaroon.Decode(tok)
+		if err != nil {
+			return nil, err
+		}
+		if m.Location != flyio.LocationPermission {
+			continue
+		}
+		for _, c := range m.UnsafeCaveats.Caveats {
+			if org, ok := c.(*flyio.Organization); ok {
+				ids = append(ids, org.ID)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// limitedTo reports whether every organization caveat in ids names o, with
+// at least one of them. Caveats all have to hold, so a token naming two
+// organizations is good for neither.
+func (o *appOrg) limitedTo(ids []uint64) bool {
+	id, err := strconv.ParseUint(o.InternalNumericID.String(), 10, 64)
+	if err != nil || len(ids) == 0 {
+		return false
+	}
+	for _, caveat := range ids {
+		if caveat != id {
+			return false
+		}
+	}
+	return true
+}
+
+// flyAuthorizationHeader is the Authorization header the Fly API expects for
+// token, for our own queries. Macaroons use the FlyV1 scheme, everything
+// else is a Bearer token.
+func flyAuthorizationHeader(token string) string {
+	if !isMacaroonToken(token) {
+		return "Bearer " + token
+	}
+	if strings.HasPrefix(token, "FlyV1 ") {
+		return token
+	}
+	return "FlyV1 " + token
+}
+
+const appOrgQuery = `query($appName: String!) { app(name: $appName) { organization { id slug internalNumericId } } }`
+
+// fetchAppOrg looks up the organization appName belongs to, as seen by
+// authToken. It returns nil if the app isn't visible.
+func fetchAppOrg(ctx context.Context, authToken, appName string) (*appOrg, error) {
+	var resp struct {
+		App *struct {
+			Organization appOrg
+		}
+	}
+	if err := runFlyQuery(ctx, authToken, appOrgQuery, map[string]any{"appName": appName}, &resp); err != nil {
+		return nil, err
+	}
+	if resp.App == nil {
+		return nil, nil
+	}
+	return &resp.App.Organization, nil
+}
+
+// runFlyQuery sends a GraphQL query to the Fly API as authToken.
+func runFlyQuery(ctx context.Context, authToken, query string, vars map[string]any, resp any) error {
+	client := graphql.NewClient(flyGraphQLURL)
+
+	req := graphql.NewRequest(query)
+	for k, v := range vars {
+		req.Var(k, v)
+	}
+	req.Header.Set("Authorization", flyAuthorizationHeader(authToken))
+	req.Header.Set("User-Agent", fmt.Sprintf("superfly/rchab/%s", gitSha))
+	return client.Run(ctx, req, resp)
+}
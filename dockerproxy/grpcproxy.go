@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// isGRPCRequest reports whether r is a gRPC call made straight over HTTP/2,
+// the way newer buildx clients reach buildkit, rather than through a /grpc
+// upgrade.
+func isGRPCRequest(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// serverProtocols are what the API is served with: HTTP/1 and HTTP/2, which
+// TLS listeners negotiate, and with h2c HTTP/2 without TLS too, for clients
+// that know to use it from the start. h2c upgrades of HTTP/1 requests aren't
+// taken over, buildx's /grpc upgrade is passed on to dockerd as is.
+func serverProtocols(h2c bool) *http.Protocols {
+	p := &http.Protocols{}
+	p.SetHTTP1(true)
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(h2c)
+	return p
+}
+
+// newGRPCProxy passes gRPC calls on to buildkit's gRPC API, over connections
+// from dial. Calls from every client are multiplexed over the same
+// connections, as HTTP/2 streams.
+func newGRPCProxy(dial func(context.Context) (net.Conn, error)) http.Handler {
+	// buildkit's API is plain HTTP/2 on its socket, or on a connection
+	// upgraded by dockerd
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	transport := &http.Transport{
+		Protocols: protocols,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dial(ctx)
+		},
+	}
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = "buildkit"
+			r.Out.Host = "buildkit"
+		},
+		Transport:     transport,
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(context.Cause(r.Context()), errBuildTimeout) {
+				writeGRPCError(w, grpcDeadlineExceeded, fmt.Sprintf("build cancelled after BUILD_TIMEOUT of %s", buildTimeout))
+				return
+			}
+			requestLogger(r.Context()).Errorf("error proxying gRPC call path=%s: %v", r.URL.Path, err)
+			writeGRPCError(w, grpcUnavailable, "could not reach buildkit on the builder")
+		},
+	}
+}
+
+// gRPC status codes, for calls answered here rather than by buildkit
+const (
+	grpcDeadlineExceeded  = "4"
+	grpcResourceExhausted = "8"
+	grpcAborted           = "10"
+	grpcUnavailable       = "14"
+)
+
+// writeGRPCError answers a gRPC call with code. gRPC clients look for the
+// status in the headers when there's no body.
+func writeGRPCError(w http.ResponseWriter, code, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", code)
+	w.Header().Set("Grpc-Message", message)
+	w.WriteHeader(http.StatusOK)
+}
+
+// serveGRPC passes a gRPC call on to buildkit. A Solve runs a build, so it
+// takes the app build lock and a build slot like a /build does, and is
+// cancelled after BUILD_TIMEOUT.
+func serveGRPC(grpcProxy http.Handler, w http.ResponseWriter, r *http.Request) {
+	if !solvePath.MatchString(r.URL.Path) {
+		grpcProxy.ServeHTTP(w, r)
+		return
+	}
+
+	release, err := acquireBuild(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, errAppBuildRunning):
+			writeGRPCError(w, grpcAborted, "a build for this app is already running on this builder, retry once it's done")
+		case errors.Is(err, errBuildQueueFull):
+			writeGRPCError(w, grpcResourceExhausted, "the builder is running as many builds as it can, retry shortly")
+		}
+		return
+	}
+	defer release()
+	r, stop := limitBuildTime(r)
+	defer stop()
+	grpcProxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeBuildkitGRPC stands in for buildkit's gRPC API on a unix socket,
+// echoing each call's request back with an OK status. It returns a dial for
+// it and a count of the connections it accepted.
+func fakeBuildkitGRPC(t *testing.T) (func(context.Context) (net.Conn, error), *atomic.Int32) {
+	t.Helper()
+
+	return serveFakeBuildkitGRPC(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		io.Copy(w, r.Body)
+		w.Header().Set("Grpc-Status", "0")
+	}))
+}
+
+// serveFakeBuildkitGRPC serves h as buildkit's gRPC API on a unix socket,
+// like fakeBuildkitGRPC.
+func serveFakeBuildkitGRPC(t *testing.T, h http.Handler) (func(context.Context) (net.Conn, error), *atomic.Int32) {
+	t.Helper()
+
+	socketPath := filepath.Join(t.TempDir(), "buildkitd.sock")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns atomic.Int32
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{
+		Protocols: protocols,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ProtoMajor != 2 {
+				t.Errorf("expected buildkit to be called over HTTP/2, but got %s", r.Proto)
+			}
+			h.ServeHTTP(w, r)
+		}),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				conns.Add(1)
+			}
+		},
+	}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+
+	return func(ctx context.Context) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+	}, &conns
+}
+
+// h2cClient speaks HTTP/2 without TLS from the start, like buildx does.
+func h2cClient() *http.Client {
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: &http.Transport{Protocols: protocols}}
+}
+
+func grpcCall(t *testing.T, client *http.Client, url, body string) *http.Response {
+	t.Helper()
+
+	r, _ := http.NewRequest(http.MethodPost, url+"/moby.buildkit.v1.Control/Solve", strings.NewReader(body))
+	r.SetBasicAuth("my-app", "good-token")
+	r.Header.Set("Content-Type", "application/grpc")
+	r.Header.Set("TE", "trailers")
+	resp, err := client.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestGRPCProxy(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+
+	dial, conns := fakeBuildkitGRPC(t)
+	api := httptest.NewUnstartedServer(accessLog(newAuthRequest(fakeAuthorizer, newBuildkitdProxy(dial))))
+	api.Config.Protocols = serverProtocols(true)
+	api.Start()
+	defer api.Close()
+
+	client := h2cClient()
+	for _, msg := range []string{"first", "second"} {
+		resp := grpcCall(t, client, api.URL, msg)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 || string(body) != msg {
+			t.Errorf("expected %q back over HTTP/2, but got %q over %s", msg, body, resp.Proto)
+		}
+		if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+			t.Errorf("expected buildkit's status in the trailers, but got %q", got)
+		}
+	}
+	if got := conns.Load(); got != 1 {
+		t.Errorf("expected the calls to share one connection to buildkit, but it got %d", got)
+	}
+}
+
+func TestGRPCProxyUnavailable(t *testing.T) {
+	dial := func(context.Context) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Err: io.EOF}
+	}
+	api := httptest.NewUnstartedServer(newGRPCProxy(dial))
+	api.Config.Protocols = serverProtocols(true)
+	api.Start()
+	defer api.Close()
+
+	resp := grpcCall(t, h2cClient(), api.URL, "")
+	resp.Body.Close()
+	if got := resp.Header.Get("Grpc-Status"); got != "14" {
+		t.Errorf("expected an UNAVAILABLE status, but got %q", got)
+	}
+}
+
+func TestGRPCProxyBuildTimeout(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	defer func(timeout time.Duration) { buildTimeout = timeout }(buildTimeout)
+	buildTimeout = 50 * time.Millisecond
+
+	// a Solve that never finishes
+	dial, _ := serveFakeBuildkitGRPC(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	api := httptest.NewUnstartedServer(accessLog(newAuthRequest(fakeAuthorizer, newBuildkitdProxy(dial))))
+	api.Config.Protocols = serverProtocols(true)
+	api.Start()
+	defer api.Close()
+
+	client := h2cClient()
+	client.Timeout = 5 * time.Second
+	resp := grpcCall(t, client, api.URL, "")
+	resp.Body.Close()
+	if got := resp.Header.Get("Grpc-Status"); got != grpcDeadlineExceeded {
+		t.Errorf("expected a DEADLINE_EXCEEDED status after BUILD_TIMEOUT, but got %q", got)
+	}
+}
+
+func TestServerProtocolsH2C(t *testing.T) {
+	for _, h2c := range []bool{true, false} {
+		api := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Proto)
+		}))
+		api.Config.Protocols = serverProtocols(h2c)
+		api.Start()
+
+		resp, err := h2cClient().Get(api.URL)
+		if h2c {
+			if err != nil {
+				t.Errorf("expected h2c to be served, but got %v", err)
+			} else {
+				resp.Body.Close()
+			}
+		} else if err == nil {
+			resp.Body.Close()
+			t.Error("expected HTTP/2 without TLS to be refused with NO_H2C")
+		}
+
+		// HTTP/1 works either way
+		if resp, err := http.Get(api.URL); err != nil || resp.ProtoMajor != 1 {
+			t.Errorf("expected HTTP/1 to be served, but got %v", err)
+		} else {
+			resp.Body.Close()
+		}
+		api.Close()
+	}
+}
+
+func TestGRPCStartsBuild(t *testing.T) {
+	for path, want := range map[string]bool{
+		"/moby.buildkit.v1.Control/Solve":     true,
+		"/moby.buildkit.v1.Control/Status":    false,
+		"/moby.filesync.v1.FileSync/DiffCopy": false,
+	} {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r.ProtoMajor = 2
+		r.Header.Set("Content-Type", "application/grpc")
+		if got := startsBuild(r); got != want {
+			t.Errorf("%s: expected starting a build %v, but got %v", path, want, got)
+		}
+	}
+}
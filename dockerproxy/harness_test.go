@@ -0,0 +1,644 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio/pkg/disk"
+	"github.com/superfly/rchab/dockerproxy/internal/auth"
+	"github.com/superfly/rchab/dockerproxy/internal/harness"
+	"github.com/superfly/rchab/dockerproxy/internal/proxy"
+)
+
+// fakeAuthorizer lets "my-app" in with "good-token" and no one else.
+var fakeAuthorizer = auth.AuthorizerFunc(func(ctx context.Context, appName, authToken string) (bool, auth.DenyReason) {
+	if appName == "my-app" && authToken == "good-token" {
+		return true, auth.DenyNone
+	}
+	return false, auth.DenyOrgMismatch
+})
+
+func TestRequestPipeline(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	defer func(d time.Duration) { dockerdDialTimeout = d }(dockerdDialTimeout)
+	dockerdDialTimeout = 0
+	defer func(perApp bool, history *buildHistory) {
+		perAppIdle, recentBuilds = perApp, history
+	}(perAppIdle, recentBuilds)
+	perAppIdle = true
+
+	var pendingDuringBuild uint64
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/_ping":
+			io.WriteString(w, "OK")
+		case buildPath.MatchString(r.URL.Path):
+			pendingDuringBuild = pendingRequests.Load()
+			io.WriteString(w, `{"stream":"Successfully built abc"}`+"\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	missing := &url.URL{Scheme: "unix", Path: filepath.Join(t.TempDir(), "missing.sock")}
+
+	cases := []struct {
+		name     string
+		upstream *url.URL
+		method   string
+		path     string
+		app      string
+		token    string
+		status   int
+		body     string
+	}{
+		{"authorized request proxies through", dockerd, http.MethodGet, "/_ping", "my-app", "good-token", http.StatusOK, "OK"},
+		{"wrong token is refused", dockerd, http.MethodGet, "/_ping", "my-app", "bad-token", http.StatusUnauthorized, ""},
+		{"missing credentials are refused", dockerd, http.MethodGet, "/_ping", "", "", http.StatusUnauthorized, ""},
+		{"build is proxied", dockerd, http.MethodPost, "/v1.41/build", "my-app", "good-token", http.StatusOK, "Successfully built"},
+		{"container endpoints are refused", dockerd, http.MethodPost, "/v1.41/containers/create", "my-app", "good-token", http.StatusForbidden, ""},
+		{"backend down", missing, http.MethodGet, "/_ping", "my-app", "good-token", http.StatusBadGateway, ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			recentBuilds = newBuildHistory(10)
+			appsLastSeen = newAppActivity()
+
+			h := accessLog(newAuthRequest(fakeAuthorizer, newDockerProxy(tc.upstream)))
+
+			r := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.app != "" {
+				r.SetBasicAuth(tc.app, tc.token)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tc.status {
+				t.Fatalf("expected status %d, but got %d: %s", tc.status, w.Code, w.Body)
+			}
+			if tc.status >= http.StatusBadRequest {
+				var body map[string]string
+				if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body["message"] == "" {
+					t.Fatalf("expected a JSON error message, got %v", err)
+				}
+				return
+			}
+			if !strings.Contains(w.Body.String(), tc.body) {
+				t.Errorf("expected the body to contain %q, but got %q", tc.body, w.Body)
+			}
+			if _, ok := appsLastSeen.snapshot()[tc.app]; !ok {
+				t.Errorf("expected activity to be recorded for %s", tc.app)
+			}
+		})
+	}
+
+	if pendingDuringBuild == 0 {
+		t.Error("expected the build to hold off the idle deadline while it ran")
+	}
+}
+
+func TestRequestPipelineRecordsBuild(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	defer func(history *buildHistory) { recentBuilds = history }(recentBuilds)
+	recentBuilds = newBuildHistory(10)
+
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"errorDetail":{"message":"RUN false"},"error":"RUN false"}`+"\n")
+	}))
+
+	h := accessLog(newAuthRequest(fakeAuthorizer, newDockerProxy(dockerd)))
+	r := httptest.NewRequest(http.MethodPost, "/build", nil)
+	r.SetBasicAuth("my-app", "good-token")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	builds := recentBuilds.list()
+	if len(builds) != 1 || builds[0].App != "my-app" || builds[0].Status != buildStatusError {
+		t.Errorf("expected one failed build for my-app, but got %+v", builds)
+	}
+}
+
+// TestRequestPipelineUpgrade runs a hijacked stream, like docker exec -it or
+// buildkit's /session, through the proxy.
+func TestRequestPipelineUpgrade(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	defer proxyPolicy.Store(proxyPolicy.Load())
+	policy, _ := proxy.NewPathPolicy(false, []string{"^/v[0-9.]+/exec/"}, nil)
+	proxyPolicy.Store(policy)
+
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "tcp" {
+			http.Error(w, "expected an upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+		// echo until the client hangs up
+		io.Copy(conn, rw)
+	}))
+
+	proxy := httptest.NewServer(accessLog(newAuthRequest(fakeAuthorizer, newDockerProxy(dockerd))))
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	r, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1.41/exec/abc/start", nil)
+	r.SetBasicAuth("my-app", "good-token")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "tcp")
+	if err := r.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status %d, but got %d", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+
+	for _, msg := range []string{"hello\n", "again\n"} {
+		io.WriteString(conn, msg)
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != msg {
+			t.Errorf("expected %q echoed back, but got %q", msg, line)
+		}
+	}
+
+	// like stdin ending: dockerd still gets to finish its output
+	io.WriteString(conn, "last\n")
+	conn.(*net.TCPConn).CloseWrite()
+	rest, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "last\n" {
+		t.Errorf("expected the output after the half-close, but got %q", rest)
+	}
+}
+
+// TestRequestPipelineOperatorExec runs docker exec -it through the proxy:
+// creating the exec, starting it on a hijacked connection and resizing its
+// TTY. Only OPERATOR_APPS with OPERATOR_TOKEN get to.
+func TestRequestPipelineOperatorExec(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	defer operatorApps.Set(operatorApps.Get())
+	defer func(token string) { operatorToken = token }(operatorToken)
+	operatorToken = "operator-token"
+
+	dockerd := harness.NewDockerd(t)
+	api := httptest.NewServer(accessLog(newAuthRequest(fakeAuthorizer, newDockerProxy(dockerd.URL))))
+	defer api.Close()
+
+	token := "operator-token"
+	post := func(path string) *http.Response {
+		r, _ := http.NewRequest(http.MethodPost, api.URL+path, strings.NewReader(`{"Cmd":["sh"],"Tty":true}`))
+		r.SetBasicAuth("my-app", "good-token")
+		r.Header.Set(operatorTokenHeader, token)
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	operatorApps.Set(nil)
+	if resp := post("/v1.41/containers/abc/exec"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected exec to be refused to other apps, but got %d", resp.StatusCode)
+	}
+
+	// the app's own credentials aren't enough, any deploy token has those
+	operatorApps.Set([]string{"my-app"})
+	token = ""
+	if resp := post("/v1.41/containers/abc/exec"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected exec to be refused without OPERATOR_TOKEN, but got %d", resp.StatusCode)
+	}
+	token = "wrong-token"
+	if resp := post("/v1.41/containers/abc/exec"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected exec to be refused with the wrong operator token, but got %d", resp.StatusCode)
+	}
+
+	token = "operator-token"
+	if resp := post("/v1.41/containers/abc/exec"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected the exec to be created, but got %d", resp.StatusCode)
+	}
+
+	conn, err := net.Dial("tcp", api.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	r, _ := http.NewRequest(http.MethodPost, api.URL+"/v1.41/exec/exec-abc/start", strings.NewReader(`{"Tty":true}`))
+	r.SetBasicAuth("my-app", "good-token")
+	r.Header.Set(operatorTokenHeader, token)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "tcp")
+	if err := r.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the exec session to start, but got %d", resp.StatusCode)
+	}
+
+	// the CLI resizes the TTY once the session is up, and on every resize of
+	// the terminal after
+	if resp := post("/v1.41/exec/exec-abc/resize?h=40&w=120"); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the TTY to be resized, but got %d", resp.StatusCode)
+	}
+
+	io.WriteString(conn, "ls\n")
+	if line, err := br.ReadString('\n'); err != nil || line != "ls\n" {
+		t.Errorf("expected stdin echoed back, but got %q, %v", line, err)
+	}
+	io.WriteString(conn, "exit\n")
+	conn.(*net.TCPConn).CloseWrite()
+	if rest, err := io.ReadAll(br); err != nil || string(rest) != "exit\n" {
+		t.Errorf("expected the output after stdin ended, but got %q, %v", rest, err)
+	}
+
+	want := []string{"POST /containers/abc/exec", "POST /exec/exec-abc/start", "POST /exec/exec-abc/resize"}
+	if got := dockerd.Requests(); !slices.Equal(got, want) {
+		t.Errorf("expected dockerd to get %v, but got %v", want, got)
+	}
+}
+
+// TestRequestPipelineStreams checks build output reaches the client as
+// dockerd writes it, not once the build is done.
+func TestRequestPipelineStreams(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+
+	received := make(chan struct{})
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "64")
+		io.WriteString(w, `{"stream":"Step 1/2"}`+"\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+		}
+	}))
+
+	proxy := httptest.NewServer(accessLog(newAuthRequest(fakeAuthorizer, newDockerProxy(dockerd))))
+	defer proxy.Close()
+
+	r, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1.41/build", nil)
+	r.SetBasicAuth("my-app", "good-token")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	close(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(line, "Step 1/2") {
+		t.Errorf("expected the first progress line, but got %q", line)
+	}
+}
+
+func TestRequestPipelinePropagatesRequestID(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+
+	var out bytes.Buffer
+	defer log.SetOutput(log.Out)
+	log.SetOutput(&out)
+
+	var forwarded string
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get("X-Request-Id")
+	}))
+	h := accessLog(newAuthRequest(fakeAuthorizer, newDockerProxy(dockerd)))
+
+	r := httptest.NewRequest(http.MethodGet, "/_ping", nil)
+	r.SetBasicAuth("my-app", "good-token")
+	r.Header.Set("X-Request-Id", "build-123")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if forwarded != "build-123" {
+		t.Errorf("expected dockerd to get request ID build-123, but got %q", forwarded)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/_ping", nil)
+	r.SetBasicAuth("my-app", "bad-token")
+	r.Header.Set("X-Request-Id", "denied-456")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if strings.Contains(line, "denied request") && !strings.Contains(line, "request_id=denied-456") {
+			t.Errorf("expected the denial to be logged with its request ID, but got %q", line)
+		}
+	}
+	if !strings.Contains(out.String(), "denied request") {
+		t.Error("expected the denial to be logged")
+	}
+}
+
+func TestRequestPipelineRefusesBuildsWhenDiskLow(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	defer lastDiskInfo.Store(lastDiskInfo.Load())
+	lastDiskInfo.Store(&disk.Info{Total: 100 * gb, Free: gb / 2})
+
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "OK")
+	}))
+	h := accessLog(newAuthRequest(fakeAuthorizer, newDockerProxy(dockerd)))
+
+	for path, want := range map[string]int{
+		"/v1.41/build": http.StatusInsufficientStorage,
+		"/_ping":       http.StatusOK,
+	} {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r.SetBasicAuth("my-app", "good-token")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("expected %s to get status %d, but got %d: %s", path, want, w.Code, w.Body)
+		}
+	}
+}
+
+func TestRequestPipelineBuildTimeout(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	defer func(timeout time.Duration, history *buildHistory) {
+		buildTimeout, recentBuilds = timeout, history
+	}(buildTimeout, recentBuilds)
+	buildTimeout = 50 * time.Millisecond
+	recentBuilds = newBuildHistory(10)
+
+	cancelled := make(chan string, 1)
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/build/cancel") {
+			cancelled <- r.URL.Query().Get("id")
+			return
+		}
+		io.WriteString(w, `{"stream":"Step 1/2 : RUN sleep infinity"}`+"\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+
+	proxy := httptest.NewServer(accessLog(newAuthRequest(fakeAuthorizer, newDockerProxy(dockerd))))
+	defer proxy.Close()
+
+	r, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1.41/build?buildid=abc123", nil)
+	r.SetBasicAuth("my-app", "good-token")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if !strings.Contains(string(body), "BUILD_TIMEOUT") {
+		t.Errorf("expected the stream to end with the timeout, but got %q", body)
+	}
+	select {
+	case id := <-cancelled:
+		if id != "abc123" {
+			t.Errorf("expected build abc123 to be cancelled, but got %q", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the build to be cancelled in dockerd")
+	}
+	if builds := recentBuilds.list(); len(builds) != 1 || builds[0].Status != buildStatusTimeout {
+		t.Errorf("expected one timed out build, but got %+v", builds)
+	}
+}
+
+func TestRequestPipelineCancelsAbandonedBuild(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+
+	cancelled := make(chan string, 1)
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/build/cancel") {
+			cancelled <- r.URL.Query().Get("id")
+			return
+		}
+		io.WriteString(w, `{"stream":"Step 1/2 : RUN make"}`+"\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+
+	proxy := httptest.NewServer(accessLog(newAuthRequest(fakeAuthorizer, newDockerProxy(dockerd))))
+	defer proxy.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, _ := http.NewRequestWithContext(ctx, http.MethodPost, proxy.URL+"/v1.41/build?buildid=abc123", nil)
+	r.SetBasicAuth("my-app", "good-token")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bufio.NewReader(resp.Body).ReadString('\n')
+	// like Ctrl-C on docker build
+	cancel()
+	resp.Body.Close()
+
+	select {
+	case id := <-cancelled:
+		if id != "abc123" {
+			t.Errorf("expected build abc123 to be cancelled, but got %q", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the abandoned build to be cancelled in dockerd")
+	}
+}
+
+func TestRequestPipelineDraining(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	defer draining.Store(false)
+	draining.Store(true)
+
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "OK")
+	}))
+	h := accessLog(newAuthRequest(fakeAuthorizer, newDockerProxy(dockerd)))
+
+	for path, want := range map[string]int{
+		"/v1.41/build": http.StatusServiceUnavailable,
+		"/grpc":        http.StatusServiceUnavailable,
+		"/v1.41/images/registry.fly.io/my-app/push": http.StatusOK,
+		"/_ping": http.StatusOK,
+	} {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r.SetBasicAuth("my-app", "good-token")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("expected %s to get status %d while draining, but got %d: %s", path, want, w.Code, w.Body)
+		}
+	}
+}
+
+// TestRequestPipelineGRPCUpgradeHoldsBuild builds over a /grpc upgrade, the
+// way buildx's docker driver does: the connection holds the app's build
+// lock while it's open, and is closed after BUILD_TIMEOUT.
+func TestRequestPipelineGRPCUpgradeHoldsBuild(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	defer func(locks *appBuildLocks, timeout time.Duration) {
+		appBuilds, buildTimeout = locks, timeout
+	}(appBuilds, buildTimeout)
+	appBuilds = newAppBuildLocks(serializeBuildsReject)
+	buildTimeout = 500 * time.Millisecond
+
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !grpcPath.MatchString(r.URL.Path) {
+			io.WriteString(w, `{"stream":"Successfully built abc"}`+"\n")
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+		io.Copy(conn, rw)
+	}))
+
+	proxy := httptest.NewServer(accessLog(newAuthRequest(fakeAuthorizer, newDockerProxy(dockerd))))
+	defer proxy.Close()
+	build := func() int {
+		r, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1.41/build", nil)
+		r.SetBasicAuth("my-app", "good-token")
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	r, _ := http.NewRequest(http.MethodPost, proxy.URL+"/grpc", nil)
+	r.SetBasicAuth("my-app", "good-token")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "h2c")
+	if err := r.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status %d, but got %d", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+
+	if code := build(); code != http.StatusConflict {
+		t.Errorf("expected a build of the same app to get status %d while the connection is open, but got %d", http.StatusConflict, code)
+	}
+
+	if _, err := io.ReadAll(br); err != nil {
+		t.Fatalf("expected the connection to be closed after BUILD_TIMEOUT, but got %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for build() != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the app's builds to go through once the connection closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestRequestPipelineGRPCSolveHoldsBuild makes buildkit calls over HTTP/2.
+// A Solve runs a build, so it's refused while the app's build lock or the
+// build slots are taken. The rest of the calls aren't.
+func TestRequestPipelineGRPCSolveHoldsBuild(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	defer func(d time.Duration) { dockerdDialTimeout = d }(dockerdDialTimeout)
+	dockerdDialTimeout = 0
+	defer func(locks *appBuildLocks, slots *buildLimiter) {
+		appBuilds, buildSlots = locks, slots
+	}(appBuilds, buildSlots)
+
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no buildkit here", http.StatusNotFound)
+	}))
+	api := httptest.NewUnstartedServer(accessLog(newAuthRequest(fakeAuthorizer, newDockerProxy(dockerd))))
+	api.Config.Protocols = serverProtocols(true)
+	api.Start()
+	defer api.Close()
+
+	call := func(method string) string {
+		r, _ := http.NewRequest(http.MethodPost, api.URL+"/moby.buildkit.v1.Control/"+method, nil)
+		r.SetBasicAuth("my-app", "good-token")
+		r.Header.Set("Content-Type", "application/grpc")
+		resp, err := h2cClient().Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get("Grpc-Status")
+	}
+
+	appBuilds = newAppBuildLocks(serializeBuildsReject)
+	unlock, _ := appBuilds.acquire(context.Background(), "my-app")
+	if got := call("Solve"); got != grpcAborted {
+		t.Errorf("expected a Solve to be aborted while the app has a build running, but got status %q", got)
+	}
+	if got := call("Status"); got == grpcAborted {
+		t.Error("expected other calls to go through while the app has a build running")
+	}
+	unlock()
+
+	buildSlots = newBuildLimiter(1, 0)
+	release, _ := buildSlots.acquire(context.Background())
+	defer release()
+	if got := call("Solve"); got != grpcResourceExhausted {
+		t.Errorf("expected a Solve to be refused with every build slot taken, but got status %q", got)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const healthPingTimeout = 2 * time.Second
+
+// pingFunc checks that dockerd answers on its socket.
+type pingFunc func(ctx context.Context) error
+
+// healthzHandler reports whether dockerd is alive. Health checks carry no
+// credentials, so this is served without auth and reveals nothing else.
+func healthzHandler(ping pingFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), healthPingTimeout)
+		defer cancel()
+
+		if err := ping(ctx); err != nil {
+			log.Warnf("health check failed to ping dockerd: %v", err)
+			writeHealth(w, http.StatusServiceUnavailable, "dockerd unreachable")
+			return
+		}
+		writeHealth(w, http.StatusOK, "ok")
+	})
+}
+
+// readyzHandler reports whether builds would succeed right now: dockerd and
+// the buildx builder are up, the builder's organization is known, and the
+// builder isn't draining.
+func readyzHandler(ping pingFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case draining.Load():
+			writeHealth(w, http.StatusServiceUnavailable, "draining")
+			return
+		case !dockerReady.Load():
+			writeHealth(w, http.StatusServiceUnavailable, "starting")
+			return
+		case !builderOrgReady():
+			writeHealth(w, http.StatusServiceUnavailable, "builder organization unknown")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), healthPingTimeout)
+		defer cancel()
+
+		if err := ping(ctx); err != nil {
+			log.Warnf("readiness check failed to ping dockerd: %v", err)
+			writeHealth(w, http.StatusServiceUnavailable, "dockerd unreachable")
+			return
+		}
+		writeHealth(w, http.StatusOK, "ok")
+	})
+}
+
+func writeHealth(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]string{"status": msg}); err != nil {
+		log.Warnln("error writing health response", err)
+	}
+}
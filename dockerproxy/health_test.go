@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	up := func(context.Context) error { return nil }
+	down := func(context.Context) error { return errors.New("connection refused") }
+
+	w := httptest.NewRecorder()
+	healthzHandler(up).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d, but got %d", http.StatusOK, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	healthzHandler(down).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, but got %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	defer dockerReady.Store(dockerReady.Load())
+	defer draining.Store(draining.Load())
+
+	up := func(context.Context) error { return nil }
+	down := func(context.Context) error { return errors.New("connection refused") }
+
+	tests := []struct {
+		name     string
+		ready    bool
+		draining bool
+		ping     pingFunc
+		want     int
+	}{
+		{"ready", true, false, up, http.StatusOK},
+		{"starting", false, false, up, http.StatusServiceUnavailable},
+		{"draining", true, true, up, http.StatusServiceUnavailable},
+		{"dockerd down", true, false, down, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dockerReady.Store(tt.ready)
+			draining.Store(tt.draining)
+
+			w := httptest.NewRecorder()
+			readyzHandler(tt.ping).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if w.Code != tt.want {
+				t.Errorf("expected status %d, but got %d", tt.want, w.Code)
+			}
+		})
+	}
+}
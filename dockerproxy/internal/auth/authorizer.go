@@ -0,0 +1,19 @@
+// Package auth decides who may use the builder: the reasons a request is
+// turned down, the Authorizer backends that don't need the Fly API, and how
+// credentials are read off a request.
+package auth
+
+import "context"
+
+// Authorizer decides whether an app may use the builder with the token it
+// presented, and if not, why.
+type Authorizer interface {
+	Authorize(ctx context.Context, appName, authToken string) (bool, DenyReason)
+}
+
+// AuthorizerFunc adapts a function to an Authorizer.
+type AuthorizerFunc func(ctx context.Context, appName, authToken string) (bool, DenyReason)
+
+func (f AuthorizerFunc) Authorize(ctx context.Context, appName, authToken string) (bool, DenyReason) {
+	return f(ctx, appName, authToken)
+}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	// AppNameHeader names the app for clients that can't send it as the Basic
+	// auth user, like ones sending a Bearer token.
+	AppNameHeader = "Fly-App"
+	// AccessTokenUser is the Basic auth user registry-style clients send
+	// with a token as the password.
+	AccessTokenUser = "x-access-token"
+)
+
+// AppScoper is an Authorizer that can tell which app a token is for, so
+// clients sending only the token don't have to name the app.
+type AppScoper interface {
+	TokenApp(token string) string
+}
+
+// RequestCredentials returns the app and token r authenticates with. Clients
+// send either Basic auth with the app as the user, or a token on its own:
+// as a Bearer token or as the password of x-access-token. The app for a
+// token on its own comes from the Fly-App header, or from the token's scope
+// when authz can read it.
+func RequestCredentials(r *http.Request, authz Authorizer) (appName, authToken string, ok bool) {
+	user, password, basic := r.BasicAuth()
+	switch {
+	case basic && user != AccessTokenUser:
+		return user, password, true
+	case basic:
+		authToken = password
+	default:
+		scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") {
+			return "", "", false
+		}
+		authToken = strings.TrimSpace(token)
+	}
+
+	appName = r.Header.Get(AppNameHeader)
+	if scoper, isScoper := authz.(AppScoper); isScoper && appName == "" {
+		appName = scoper.TokenApp(authToken)
+	}
+	return appName, authToken, authToken != ""
+}
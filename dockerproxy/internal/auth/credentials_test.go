@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fake lets "my-app" in with "good-token" and no one else.
+var fake = AuthorizerFunc(func(ctx context.Context, appName, authToken string) (bool, DenyReason) {
+	if appName == "my-app" && authToken == "good-token" {
+		return true, DenyNone
+	}
+	return false, DenyOrgMismatch
+})
+
+func TestRequestCredentials(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwt := signJWT(t, key, "ec", map[string]any{"app": []string{"scoped-app"}, "exp": time.Now().Add(time.Hour).Unix()})
+	jwtAuthz, err := NewJWT("https://issuer.example", "", "rchab", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		authz         Authorizer
+		user, pass    string
+		authorization string
+		appHeader     string
+		app, token    string
+		ok            bool
+	}{
+		{name: "basic", authz: fake, user: "my-app", pass: "good-token", app: "my-app", token: "good-token", ok: true},
+		{name: "basic ignores header", authz: fake, user: "my-app", pass: "good-token", appHeader: "other-app", app: "my-app", token: "good-token", ok: true},
+		{name: "x-access-token", authz: fake, user: "x-access-token", pass: "good-token", appHeader: "my-app", app: "my-app", token: "good-token", ok: true},
+		{name: "bearer", authz: fake, authorization: "Bearer good-token", appHeader: "my-app", app: "my-app", token: "good-token", ok: true},
+		{name: "bearer lowercase", authz: fake, authorization: "bearer good-token", appHeader: "my-app", app: "my-app", token: "good-token", ok: true},
+		{name: "bearer without app", authz: fake, authorization: "Bearer good-token", token: "good-token", ok: true},
+		{name: "bearer scoped by JWT", authz: jwtAuthz, authorization: "Bearer " + jwt, app: "scoped-app", token: jwt, ok: true},
+		{name: "header over JWT scope", authz: jwtAuthz, authorization: "Bearer " + jwt, appHeader: "my-app", app: "my-app", token: jwt, ok: true},
+		{name: "empty bearer", authz: fake, authorization: "Bearer ", ok: false},
+		{name: "other scheme", authz: fake, authorization: "Digest abc", ok: false},
+		{name: "none", authz: fake, ok: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/_ping", nil)
+			if tc.user != "" {
+				r.SetBasicAuth(tc.user, tc.pass)
+			}
+			if tc.authorization != "" {
+				r.Header.Set("Authorization", tc.authorization)
+			}
+			if tc.appHeader != "" {
+				r.Header.Set(AppNameHeader, tc.appHeader)
+			}
+			app, token, ok := RequestCredentials(r, tc.authz)
+			if app != tc.app || token != tc.token || ok != tc.ok {
+				t.Errorf("expected %q, %q, %v, but got %q, %q, %v", tc.app, tc.token, tc.ok, app, token, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"context"
+	"sync"
+)
+
+// FlightGroup collapses concurrent authorizations of the same app and
+// token into one Fly API lookup. buildx opens several connections at once,
+// each of which would otherwise miss the cache and ask the API on its own.
+type FlightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	done       chan struct{}
+	authorized bool
+	reason     DenyReason
+}
+
+// NewFlightGroup returns a FlightGroup with nothing in flight.
+func NewFlightGroup() *FlightGroup {
+	return &FlightGroup{calls: map[string]*flight{}}
+}
+
+// Do runs fn once for all callers asking for key at the same time, and
+// reports whether the answer came from another caller's lookup. fn doesn't
+// get cancelled with ctx, since others may be waiting on it, but a caller
+// whose ctx ends stops waiting.
+func (g *FlightGroup) Do(ctx context.Context, key string, fn func(ctx context.Context) (bool, DenyReason)) (authorized bool, reason DenyReason, shared bool) {
+	g.mu.Lock()
+	if f, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.authorized, f.reason, true
+		case <-ctx.Done():
+			return false, DenyAPIError, true
+		}
+	}
+	f := &flight{done: make(chan struct{})}
+	g.calls[key] = f
+	g.mu.Unlock()
+
+	f.authorized, f.reason = fn(context.WithoutCancel(ctx))
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(f.done)
+
+	return f.authorized, f.reason, false
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAuthFlightGroup(t *testing.T) {
+	g := NewFlightGroup()
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func(context.Context) (bool, DenyReason) {
+		calls.Add(1)
+		<-release
+		return true, DenyNone
+	}
+
+	var wg sync.WaitGroup
+	var shared atomic.Int32
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			authorized, _, s := g.Do(context.Background(), "key", fn)
+			if !authorized {
+				t.Error("expected every caller to get the answer")
+			}
+			if s {
+				shared.Add(1)
+			}
+		}()
+	}
+	// let the callers pile up behind the first
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected one lookup, but got %d", n)
+	}
+	if n := shared.Load(); n != 4 {
+		t.Errorf("expected 4 callers to share the lookup, but got %d", n)
+	}
+
+	// done, so the next caller looks up again
+	g.Do(context.Background(), "key", func(context.Context) (bool, DenyReason) { calls.Add(1); return true, DenyNone })
+	if n := calls.Load(); n != 2 {
+		t.Errorf("expected a fresh lookup once the first finished, but got %d lookups", n)
+	}
+}
+
+func TestAuthFlightGroupCancelledWaiter(t *testing.T) {
+	g := NewFlightGroup()
+
+	release := make(chan struct{})
+	defer close(release)
+	go g.Do(context.Background(), "key", func(context.Context) (bool, DenyReason) {
+		<-release
+		return true, DenyNone
+	})
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if authorized, reason, _ := g.Do(ctx, "key", nil); authorized || reason != DenyAPIError {
+		t.Errorf("expected a cancelled waiter to give up, but got %v, %s", authorized, reason)
+	}
+}
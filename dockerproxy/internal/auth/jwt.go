@@ -0,0 +1,357 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/superfly/rchab/dockerproxy/internal/logging"
+)
+
+const (
+	// clock skew allowed when checking exp and nbf
+	jwtLeeway = time.Minute
+	// an unknown key ID refetches the keys at most this often
+	jwksMinRefresh = time.Minute
+)
+
+// errJWKSUnavailable means the issuer's keys couldn't be fetched, which
+// says nothing about the token.
+var errJWKSUnavailable = errors.New("could not fetch the JWT signing keys")
+
+// JWT accepts JWTs signed by an OIDC issuer, like a company's SSO, with
+// RS256 or ES256. The issuer's keys come from its JWKS, found through its
+// OpenID configuration unless JWT_JWKS_URL is set.
+//
+// The token has to be current, from the issuer, for the audience, and name
+// the app in its app claim: a string, a list of them, or "*" for any app.
+// Issuer and audience are both required, an issuer minting tokens for
+// others too would otherwise let all of them in.
+type JWT struct {
+	issuer   string
+	jwksURL  string
+	audience string
+	appClaim string
+	client   *http.Client
+	now      func() time.Time
+
+	// fetchMu lets one request at a time fetch the keys, mu guards them.
+	// Requests with known keys never wait for a fetch.
+	fetchMu sync.Mutex
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// NewJWT accepts tokens from issuer for audience whose appClaim names the
+// app. jwksURL overrides where the keys come from.
+func NewJWT(issuer, jwksURL, audience, appClaim string) (*JWT, error) {
+	if issuer == "" || audience == "" {
+		return nil, fmt.Errorf("AUTH_MODE=jwt requires JWT_ISSUER and JWT_AUDIENCE to be set")
+	}
+	return &JWT{
+		issuer:   strings.TrimSuffix(issuer, "/"),
+		jwksURL:  jwksURL,
+		audience: audience,
+		appClaim: appClaim,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		now:      time.Now,
+	}, nil
+}
+
+func (a *JWT) Authorize(ctx context.Context, appName, authToken string) (bool, DenyReason) {
+	l := logging.Logger(ctx)
+	claims, err := a.verify(ctx, authToken)
+	if errors.Is(err, errJWKSUnavailable) {
+		l.Errorf("could not check JWT: %v", err)
+		return false, DenyAPIError
+	}
+	if err != nil {
+		l.Warnf("invalid JWT for app %s: %v", appName, err)
+		return false, DenyBadCredentials
+	}
+	if !claimAllowsApp(claims[a.appClaim], appName) {
+		l.Warnf("JWT for %v doesn't grant app %s", claims["sub"], appName)
+		return false, DenyAppNotFound
+	}
+	return true, DenyNone
+}
+
+// TokenApp returns the app a JWT is for when its app claim names just one.
+// The token isn't verified here, Authorize does that.
+func (a *JWT) TokenApp(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	var claims map[string]any
+	if decodeJWTPart(parts[1], &claims) != nil {
+		return ""
+	}
+	switch v := claims[a.appClaim].(type) {
+	case string:
+		if v != "*" {
+			return v
+		}
+	case []any:
+		if len(v) != 1 {
+			return ""
+		}
+		if app, ok := v[0].(string); ok && app != "*" {
+			return app
+		}
+	}
+	return ""
+}
+
+// claimAllowsApp reports whether an app claim, a string or a list of them,
+// names appName or is "*".
+func claimAllowsApp(claim any, appName string) bool {
+	switch v := claim.(type) {
+	case string:
+		return v == "*" || (v == appName && appName != "")
+	case []any:
+		for _, app := range v {
+			if claimAllowsApp(app, appName) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verify checks token's signature and standard claims, and returns all of
+// its claims.
+func (a *JWT) verify(ctx context.Context, token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("bad header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("bad signature: %w", err)
+	}
+
+	key, err := a.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errors.New("signature doesn't verify")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 {
+			return nil, errors.New("signature doesn't verify")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return nil, errors.New("signature doesn't verify")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key for %s", header.Alg)
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("bad claims: %w", err)
+	}
+	now := a.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, errors.New("expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("not valid yet")
+	}
+	if strings.TrimSuffix(fmt.Sprint(claims["iss"]), "/") != a.issuer {
+		return nil, fmt.Errorf("issued by %v", claims["iss"])
+	}
+	if !claimAllowsAudience(claims["aud"], a.audience) {
+		return nil, fmt.Errorf("for audience %v", claims["aud"])
+	}
+	return claims, nil
+}
+
+func claimAllowsAudience(claim any, audience string) bool {
+	switch v := claim.(type) {
+	case string:
+		return v == audience
+	case []any:
+		for _, aud := range v {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// key returns the issuer's key with ID kid, fetching the keys when it
+// doesn't know it yet. The fetch happens without holding mu, so a token with
+// an unknown key doesn't hold up every other one while the issuer answers.
+func (a *JWT) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	key, fresh := a.knownKey(kid)
+	if key == nil && !fresh {
+		a.fetchMu.Lock()
+		defer a.fetchMu.Unlock()
+		// another request may have fetched them while this one waited
+		if key, fresh = a.knownKey(kid); key == nil && !fresh {
+			keys, err := a.fetchKeys(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", errJWKSUnavailable, err)
+			}
+			a.mu.Lock()
+			a.keys, a.fetched = keys, a.now()
+			a.mu.Unlock()
+			key = keys[kid]
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// knownKey returns the key with ID kid if it's known, and whether the keys
+// were fetched too recently to fetch them again.
+func (a *JWT) knownKey(kid string) (key crypto.PublicKey, fresh bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.keys[kid], a.keys != nil && a.now().Sub(a.fetched) < jwksMinRefresh
+}
+
+func (a *JWT) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	jwksURL := a.jwksURL
+	if jwksURL == "" {
+		var config struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := a.getJSON(ctx, a.issuer+"/.well-known/openid-configuration", &config); err != nil {
+			return nil, err
+		}
+		if config.JWKSURI == "" {
+			return nil, fmt.Errorf("%s has no jwks_uri", a.issuer)
+		}
+		jwksURL = config.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := a.getJSON(ctx, jwksURL, &jwks); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			logging.Logger(ctx).Debugf("skipping JWT signing key %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (a *JWT) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// jwk is an RSA or P-256 key from a JWKS.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	if k.Use != "" && k.Use != "sig" {
+		return nil, fmt.Errorf("key for %s", k.Use)
+	}
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
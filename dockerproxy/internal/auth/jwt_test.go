@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+// signJWT signs claims with key, RS256 for RSA keys and ES256 for EC ones.
+func signJWT(t *testing.T, key crypto.Signer, kid string, claims map[string]any) string {
+	t.Helper()
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + b64(sig)
+}
+
+// fakeIssuer serves an OpenID configuration and JWKS with keys.
+func fakeIssuer(t *testing.T, keys map[string]crypto.Signer) *httptest.Server {
+	t.Helper()
+	var jwks []map[string]string
+	for kid, key := range keys {
+		switch k := key.Public().(type) {
+		case *rsa.PublicKey:
+			jwks = append(jwks, map[string]string{"kty": "RSA", "kid": kid, "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())})
+		case *ecdsa.PublicKey:
+			jwks = append(jwks, map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(k.X.FillBytes(make([]byte, 32))), "y": b64(k.Y.FillBytes(make([]byte, 32)))})
+		}
+	}
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": srv.URL, "jwks_uri": srv.URL + "/jwks"})
+		case "/jwks":
+			json.NewEncoder(w).Encode(map[string]any{"keys": jwks})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := fakeIssuer(t, map[string]crypto.Signer{"rsa": rsaKey, "ec": ecKey})
+
+	a, err := NewJWT(issuer.URL, "", "rchab", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{
+			"iss": issuer.URL,
+			"aud": "rchab",
+			"sub": "repo:superfly/my-app",
+			"app": "my-app",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range changes {
+			c[k] = v
+		}
+		return c
+	}
+
+	for _, tc := range []struct {
+		name   string
+		token  string
+		ok     bool
+		reason DenyReason
+	}{
+		{"RS256", signJWT(t, rsaKey, "rsa", claims(nil)), true, DenyNone},
+		{"ES256", signJWT(t, ecKey, "ec", claims(nil)), true, DenyNone},
+		{"app list", signJWT(t, ecKey, "ec", claims(map[string]any{"app": []string{"other-app", "my-app"}})), true, DenyNone},
+		{"any app", signJWT(t, ecKey, "ec", claims(map[string]any{"app": "*"})), true, DenyNone},
+		{"audience list", signJWT(t, ecKey, "ec", claims(map[string]any{"aud": []string{"other", "rchab"}})), true, DenyNone},
+		{"other app", signJWT(t, ecKey, "ec", claims(map[string]any{"app": "other-app"})), false, DenyAppNotFound},
+		{"expired", signJWT(t, ecKey, "ec", claims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()})), false, DenyBadCredentials},
+		{"not yet valid", signJWT(t, ecKey, "ec", claims(map[string]any{"nbf": time.Now().Add(time.Hour).Unix()})), false, DenyBadCredentials},
+		{"other issuer", signJWT(t, ecKey, "ec", claims(map[string]any{"iss": "https://evil.example"})), false, DenyBadCredentials},
+		{"other audience", signJWT(t, ecKey, "ec", claims(map[string]any{"aud": "other"})), false, DenyBadCredentials},
+		{"no audience", signJWT(t, ecKey, "ec", claims(map[string]any{"aud": nil})), false, DenyBadCredentials},
+		{"no issuer", signJWT(t, ecKey, "ec", claims(map[string]any{"iss": nil})), false, DenyBadCredentials},
+		{"wrong key", signJWT(t, otherKey, "ec", claims(nil)), false, DenyBadCredentials},
+		{"unknown key", signJWT(t, otherKey, "other", claims(nil)), false, DenyBadCredentials},
+		{"not a JWT", "fo1_token", false, DenyBadCredentials},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ok, reason := a.Authorize(context.Background(), "my-app", tc.token)
+			if ok != tc.ok || reason != tc.reason {
+				t.Errorf("expected %v, %v, but got %v, %v", tc.ok, tc.reason, ok, reason)
+			}
+		})
+	}
+}
+
+func TestJWTIssuerDown(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer issuer.Close()
+
+	a, err := NewJWT(issuer.URL, "", "rchab", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signJWT(t, key, "ec", map[string]any{"iss": issuer.URL, "aud": "rchab", "app": "my-app", "exp": time.Now().Add(time.Hour).Unix()})
+	if ok, reason := a.Authorize(context.Background(), "my-app", token); ok || reason != DenyAPIError {
+		t.Errorf("expected the request to be refused as an API error while the issuer is down, but got %v, %v", ok, reason)
+	}
+}
+
+func TestNewJWTRequiresIssuerAndAudience(t *testing.T) {
+	for _, tc := range []struct{ issuer, jwksURL, audience string }{
+		{"", "https://issuer.example/jwks", "rchab"},
+		{"https://issuer.example", "", ""},
+		{"", "", ""},
+	} {
+		if _, err := NewJWT(tc.issuer, tc.jwksURL, tc.audience, "app"); err == nil {
+			t.Errorf("expected an error for issuer %q and audience %q", tc.issuer, tc.audience)
+		}
+	}
+}
+
+func TestJWTKeyFetchDoesntBlockKnownKeys(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := fakeIssuer(t, map[string]crypto.Signer{"ec": key})
+	fetching, release := make(chan struct{}), make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetching <- struct{}{}
+		<-release
+		http.Error(w, "too slow", http.StatusGatewayTimeout)
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	a, err := NewJWT(issuer.URL, issuer.URL+"/jwks", "rchab", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]any{"iss": issuer.URL, "aud": "rchab", "app": "my-app", "exp": time.Now().Add(time.Hour).Unix()}
+	known := signJWT(t, key, "ec", claims)
+	if ok, _ := a.Authorize(context.Background(), "my-app", known); !ok {
+		t.Fatal("expected the token to be authorized")
+	}
+
+	// a token with an unknown key refetches the keys, from a slow issuer
+	now := time.Now().Add(2 * jwksMinRefresh)
+	a.now = func() time.Time { return now }
+	a.jwksURL = slow.URL
+	go a.Authorize(context.Background(), "my-app", signJWT(t, key, "rotated", claims))
+	<-fetching
+
+	done := make(chan bool)
+	go func() {
+		ok, _ := a.Authorize(context.Background(), "my-app", known)
+		done <- ok
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("expected the token with a known key to still be authorized")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("expected a token with a known key not to wait for the fetch")
+	}
+}
@@ -0,0 +1,62 @@
+package auth
+
+// DenyReason says why an Authorizer turned a request down.
+type DenyReason int
+
+const (
+	DenyNone DenyReason = iota
+	DenyBadCredentials
+	DenyAppNotFound
+	DenyOrgNotFound
+	DenyOrgMismatch
+	DenyAPIError
+	DenyMisconfigured
+)
+
+func (r DenyReason) String() string {
+	switch r {
+	case DenyNone:
+		return "none"
+	case DenyBadCredentials:
+		return "bad_credentials"
+	case DenyAppNotFound:
+		return "app_not_found"
+	case DenyOrgNotFound:
+		return "org_not_found"
+	case DenyOrgMismatch:
+		return "org_mismatch"
+	case DenyAPIError:
+		return "api_error"
+	case DenyMisconfigured:
+		return "misconfigured"
+	default:
+		return "unknown"
+	}
+}
+
+// PublicMessage describes the reason to the client without revealing whether
+// an app it can't access exists.
+func (r DenyReason) PublicMessage() string {
+	switch r {
+	case DenyBadCredentials:
+		return "missing or invalid credentials"
+	case DenyAppNotFound, DenyOrgNotFound, DenyOrgMismatch:
+		return "the app is not accessible from this builder's organization"
+	case DenyAPIError:
+		return "could not reach the Fly API, try again shortly"
+	default:
+		return "the builder could not verify your credentials"
+	}
+}
+
+// Definitive reports whether the Fly API actually answered. Only those
+// answers are cached and count toward the auth failure limit, an API outage
+// shouldn't lock clients out.
+func (r DenyReason) Definitive() bool {
+	switch r {
+	case DenyNone, DenyBadCredentials, DenyAppNotFound, DenyOrgNotFound, DenyOrgMismatch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,16 @@
+package auth
+
+import "testing"
+
+func TestDenyReasonDefinitive(t *testing.T) {
+	for _, reason := range []DenyReason{DenyNone, DenyBadCredentials, DenyAppNotFound, DenyOrgNotFound, DenyOrgMismatch} {
+		if !reason.Definitive() {
+			t.Errorf("expected %s to be definitive", reason)
+		}
+	}
+	for _, reason := range []DenyReason{DenyAPIError, DenyMisconfigured} {
+		if reason.Definitive() {
+			t.Errorf("expected %s not to be definitive", reason)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Static accepts a fixed set of tokens, each for one app or for any app.
+type Static struct {
+	tokens []staticToken
+}
+
+type staticToken struct {
+	// "*" for any app
+	app   string
+	token string
+}
+
+// NewStatic accepts token for any app, and the tokens in file, one app:token
+// per line. An app of * accepts the token for any app. Blank lines and lines
+// starting with # are skipped.
+func NewStatic(token, file string) (*Static, error) {
+	a := &Static{}
+	if token != "" {
+		a.tokens = append(a.tokens, staticToken{app: "*", token: token})
+	}
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read STATIC_AUTH_TOKENS_FILE: %w", err)
+		}
+		defer f.Close()
+
+		s := bufio.NewScanner(f)
+		for n := 1; s.Scan(); n++ {
+			line := strings.TrimSpace(s.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			app, token, ok := strings.Cut(line, ":")
+			if !ok || app == "" || token == "" {
+				return nil, fmt.Errorf("invalid line %d in STATIC_AUTH_TOKENS_FILE, expected app:token", n)
+			}
+			a.tokens = append(a.tokens, staticToken{app: app, token: token})
+		}
+		if err := s.Err(); err != nil {
+			return nil, fmt.Errorf("could not read STATIC_AUTH_TOKENS_FILE: %w", err)
+		}
+	}
+	if len(a.tokens) == 0 {
+		return nil, fmt.Errorf("AUTH_MODE=static requires STATIC_AUTH_TOKEN or STATIC_AUTH_TOKENS_FILE to be set")
+	}
+	return a, nil
+}
+
+func (a *Static) Authorize(ctx context.Context, appName, authToken string) (bool, DenyReason) {
+	if authToken == "" {
+		return false, DenyBadCredentials
+	}
+	// every token is compared, so timing doesn't give away which one was close
+	authorized := false
+	for _, t := range a.tokens {
+		match := subtle.ConstantTimeCompare([]byte(authToken), []byte(t.token)) == 1
+		if match && (t.app == "*" || t.app == appName) {
+			authorized = true
+		}
+	}
+	if !authorized {
+		return false, DenyBadCredentials
+	}
+	return true, DenyNone
+}
@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStatic(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens")
+	tokens := "# CI\nmy-app:app-token\n\n*:ops-token\n"
+	if err := os.WriteFile(file, []byte(tokens), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewStatic("shared-token", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		app, token string
+		ok         bool
+	}{
+		{"my-app", "app-token", true},
+		{"other-app", "app-token", false},
+		{"other-app", "ops-token", true},
+		{"other-app", "shared-token", true},
+		{"my-app", "bad-token", false},
+		{"my-app", "", false},
+	} {
+		if ok, _ := a.Authorize(context.Background(), tc.app, tc.token); ok != tc.ok {
+			t.Errorf("app %s with token %q: expected authorized to be %v", tc.app, tc.token, tc.ok)
+		}
+	}
+
+	if _, err := NewStatic("", ""); err == nil {
+		t.Error("expected an error without any tokens")
+	}
+	os.WriteFile(file, []byte("no-colon\n"), 0o600)
+	if _, err := NewStatic("", file); err == nil {
+		t.Error("expected an error for a line without app:token")
+	}
+}
@@ -0,0 +1,68 @@
+// Package daemon starts and looks after the builder's child processes:
+// dockerd, buildkitd and the commands run alongside them. It reaps the
+// orphans they leave behind and works out why a daemon went away.
+package daemon
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// children are the processes started through StartChild, which their
+// exec.Cmd waits on. The reaper leaves them alone, it only collects orphans
+// re-parented to us.
+var children = struct {
+	sync.Mutex
+	pids map[int]bool
+}{pids: map[int]bool{}}
+
+// StartChild starts cmd, keeping the reaper from collecting it before
+// cmd.Wait can.
+func StartChild(cmd *exec.Cmd) error {
+	children.Lock()
+	defer children.Unlock()
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	children.pids[cmd.Process.Pid] = true
+	return nil
+}
+
+// WaitChild waits for a command started with StartChild.
+func WaitChild(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	children.Lock()
+	delete(children.pids, cmd.Process.Pid)
+	children.Unlock()
+	return err
+}
+
+// RunChild is cmd.Run for commands the reaper should leave alone.
+func RunChild(cmd *exec.Cmd) error {
+	if err := StartChild(cmd); err != nil {
+		return err
+	}
+	return WaitChild(cmd)
+}
+
+// parseProcStat reads the parent pid and state from a /proc/<pid>/stat line,
+// "pid (comm) state ppid ...". comm may itself contain spaces and parens.
+func parseProcStat(stat string) (ppid int, state byte, err error) {
+	i := strings.LastIndexByte(stat, ')')
+	if i < 0 {
+		return 0, 0, fmt.Errorf("malformed stat %q", stat)
+	}
+	fields := strings.Fields(stat[i+1:])
+	if len(fields) < 2 || len(fields[0]) != 1 {
+		return 0, 0, fmt.Errorf("malformed stat %q", stat)
+	}
+	ppid, err = strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed stat %q", stat)
+	}
+	return ppid, fields[0][0], nil
+}
@@ -0,0 +1,28 @@
+package daemon
+
+import "testing"
+
+func TestParseProcStat(t *testing.T) {
+	cases := []struct {
+		stat  string
+		ppid  int
+		state byte
+		err   bool
+	}{
+		{"1234 (dockerd) S 1 1234 1234 0 -1", 1, 'S', false},
+		{"99 (containerd-shim) Z 42 99 99 0 -1", 42, 'Z', false},
+		{"7 (we ird) (name)) R 3 7 7", 3, 'R', false},
+		{"garbage", 0, 0, true},
+		{"7 (x) S", 0, 0, true},
+	}
+	for _, tc := range cases {
+		ppid, state, err := parseProcStat(tc.stat)
+		if (err != nil) != tc.err {
+			t.Errorf("%q: expected error %v, but got %v", tc.stat, tc.err, err)
+			continue
+		}
+		if ppid != tc.ppid || state != tc.state {
+			t.Errorf("%q: expected ppid %d state %c, but got %d %c", tc.stat, tc.ppid, tc.state, ppid, state)
+		}
+	}
+}
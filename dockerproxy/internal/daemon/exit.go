@@ -0,0 +1,88 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// why a daemon went away, see ClassifyExit
+const (
+	ExitOOM    = "oom"
+	ExitSignal = "signal"
+	ExitError  = "exit"
+)
+
+// oomEventFiles are where the kernel counts OOM kills: the cgroup's
+// memory.events with cgroup v2, otherwise /proc/vmstat for the whole machine.
+var oomEventFiles = []string{"/sys/fs/cgroup/memory.events", "/proc/vmstat"}
+
+// Exit says how dockerd or buildkitd went away.
+type Exit struct {
+	Daemon string
+	// ExitOOM, ExitSignal or ExitError
+	Reason string
+	Detail string
+	Time   time.Time
+}
+
+func (e *Exit) String() string {
+	return e.Daemon + " " + e.Detail
+}
+
+// Message is what clients whose requests it broke are told.
+func (e *Exit) Message() string {
+	if e.Reason == ExitOOM {
+		return fmt.Sprintf("%s on the builder ran out of memory and was killed by the kernel, it's being restarted. Retry the build, and if it keeps happening give the builder more memory or reduce the build's parallelism", e.Daemon)
+	}
+	return fmt.Sprintf("%s on the builder %s, it's being restarted. Retry the build", e.Daemon, e.Detail)
+}
+
+// OOMKills returns how many processes the kernel has killed for running out
+// of memory, or -1 when it can't tell.
+func OOMKills() int64 {
+	for _, path := range oomEventFiles {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		s := bufio.NewScanner(bytes.NewReader(b))
+		for s.Scan() {
+			key, val, ok := bytes.Cut(s.Bytes(), []byte(" "))
+			if !ok || string(key) != "oom_kill" {
+				continue
+			}
+			if n, err := strconv.ParseInt(string(bytes.TrimSpace(val)), 10, 64); err == nil {
+				return n
+			}
+		}
+	}
+	return -1
+}
+
+// ClassifyExit works out why daemon exited. It's taken for an OOM kill when
+// it was killed and the kernel's OOM kill count went up since oomBefore.
+func ClassifyExit(daemon string, state *os.ProcessState, oomBefore int64) *Exit {
+	e := &Exit{Daemon: daemon, Reason: ExitError, Time: time.Now()}
+	if state == nil {
+		e.Detail = "exited"
+		return e
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	switch {
+	case ok && status.Signaled():
+		e.Reason = ExitSignal
+		e.Detail = fmt.Sprintf("was killed by signal %s", status.Signal())
+		if status.Signal() == syscall.SIGKILL && oomBefore >= 0 && OOMKills() > oomBefore {
+			e.Reason = ExitOOM
+			e.Detail = "ran out of memory and was killed by the kernel"
+		}
+	default:
+		e.Detail = fmt.Sprintf("exited with code %d", state.ExitCode())
+	}
+	return e
+}
@@ -0,0 +1,60 @@
+package daemon
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func setOOMKills(t *testing.T, path string, n int) {
+	t.Helper()
+	events := "low 0\nhigh 0\nmax 3\noom 1\noom_kill " + strconv.Itoa(n) + "\n"
+	if err := os.WriteFile(path, []byte(events), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOOMKills(t *testing.T) {
+	defer func(files []string) { oomEventFiles = files }(oomEventFiles)
+	events := filepath.Join(t.TempDir(), "memory.events")
+	oomEventFiles = []string{filepath.Join(t.TempDir(), "missing"), events}
+
+	if n := OOMKills(); n != -1 {
+		t.Errorf("expected -1 without any OOM counts, but got %d", n)
+	}
+	setOOMKills(t, events, 2)
+	if n := OOMKills(); n != 2 {
+		t.Errorf("expected 2 OOM kills, but got %d", n)
+	}
+}
+
+func TestClassifyExit(t *testing.T) {
+	defer func(files []string) { oomEventFiles = files }(oomEventFiles)
+	events := filepath.Join(t.TempDir(), "memory.events")
+	oomEventFiles = []string{events}
+	setOOMKills(t, events, 1)
+
+	run := func(script string) *os.ProcessState {
+		cmd := exec.Command("sh", "-c", script)
+		cmd.Run()
+		return cmd.ProcessState
+	}
+
+	if e := ClassifyExit("dockerd", run("exit 3"), 1); e.Reason != ExitError || e.Detail != "exited with code 3" {
+		t.Errorf("expected an exit with code 3, but got %s: %s", e.Reason, e.Detail)
+	}
+	if e := ClassifyExit("dockerd", run("kill -9 $$"), 1); e.Reason != ExitSignal {
+		t.Errorf("expected a kill without an OOM kill to be a signal, but got %s: %s", e.Reason, e.Detail)
+	}
+	setOOMKills(t, events, 2)
+	e := ClassifyExit("dockerd", run("kill -9 $$"), 1)
+	if e.Reason != ExitOOM {
+		t.Errorf("expected a kill with an OOM kill to be an OOM, but got %s: %s", e.Reason, e.Detail)
+	}
+	if !strings.Contains(e.Message(), "ran out of memory") {
+		t.Errorf("expected the message to say dockerd ran out of memory, but got %q", e.Message())
+	}
+}
@@ -0,0 +1,119 @@
+package daemon
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/superfly/rchab/dockerproxy/internal/logging"
+)
+
+const prSetChildSubreaper = 36
+
+// ReapChildren makes us the subreaper of everything we start, so processes
+// orphaned by dockerd, shims and docker CLI calls are re-parented to us
+// rather than to a PID 1 that may not collect them, and reaps them until ctx
+// is done.
+func ReapChildren(ctx context.Context) {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+		logging.Logger(context.Background()).Warnf("could not become a subreaper: %v", errno)
+	}
+
+	sigchld := make(chan os.Signal, 1)
+	signal.Notify(sigchld, syscall.SIGCHLD)
+	defer signal.Stop(sigchld)
+
+	// SIGCHLDs coalesce, so look now and then regardless
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigchld:
+		case <-ticker.C:
+		}
+		reapOrphans()
+	}
+}
+
+// reapOrphans collects exited children that nothing else waits on.
+func reapOrphans() {
+	children.Lock()
+	defer children.Unlock()
+
+	for _, pid := range orphans() {
+		var status syscall.WaitStatus
+		if reaped, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); err == nil && reaped == pid {
+			logging.Logger(context.Background()).Debugf("reaped orphaned process %d, exit status %d", pid, status.ExitStatus())
+		}
+	}
+}
+
+// orphans lists our children not started through StartChild, zombies or
+// not. Callers must hold children's lock.
+func orphans() []int {
+	self := os.Getpid()
+	stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+
+	var pids []int
+	for _, path := range stats {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			// exited since
+			continue
+		}
+		ppid, _, err := parseProcStat(string(b))
+		if err != nil || ppid != self {
+			continue
+		}
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(path)))
+		if err != nil || children.pids[pid] {
+			continue
+		}
+		pids = append(pids, pid)
+	}
+	return pids
+}
+
+// StopOrphans passes SIGTERM on to the orphans still running at shutdown,
+// and kills whatever is left after timeout.
+func StopOrphans(timeout time.Duration) {
+	children.Lock()
+	pids := orphans()
+	children.Unlock()
+	if len(pids) == 0 {
+		return
+	}
+
+	logging.Logger(context.Background()).Infof("stopping %d orphaned processes", len(pids))
+	for _, pid := range pids {
+		syscall.Kill(pid, syscall.SIGTERM)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		reapOrphans()
+		children.Lock()
+		left := orphans()
+		children.Unlock()
+		if len(left) == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	children.Lock()
+	defer children.Unlock()
+	for _, pid := range orphans() {
+		logging.Logger(context.Background()).Warnf("killing orphaned process %d", pid)
+		syscall.Kill(pid, syscall.SIGKILL)
+		var status syscall.WaitStatus
+		syscall.Wait4(pid, &status, 0, nil)
+	}
+}
@@ -0,0 +1,29 @@
+package daemon
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestReapOrphans(t *testing.T) {
+	tracked := exec.Command("true")
+	if err := StartChild(tracked); err != nil {
+		t.Fatal(err)
+	}
+	orphan := exec.Command("true")
+	if err := orphan.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// both have exited by now, but nothing has waited on them
+	time.Sleep(100 * time.Millisecond)
+
+	reapOrphans()
+
+	if err := WaitChild(tracked); err != nil {
+		t.Errorf("expected the tracked child to be left for its own Wait, but got %v", err)
+	}
+	if err := orphan.Wait(); err == nil {
+		t.Error("expected the untracked child to have been reaped already")
+	}
+}
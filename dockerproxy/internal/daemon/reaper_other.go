@@ -0,0 +1,14 @@
+//go:build !linux
+
+package daemon
+
+import (
+	"context"
+	"time"
+)
+
+// ReapChildren is a no-op outside of Linux, where the builder only runs for
+// local development.
+func ReapChildren(ctx context.Context) {}
+
+func StopOrphans(timeout time.Duration) {}
@@ -0,0 +1,175 @@
+// Package flymock stands in for the Fly API's GraphQL endpoint, answering
+// the app and organization lookups authorization makes from a fixture of
+// apps, organizations and tokens. It's for local dev and CI, where there
+// are no real tokens to check.
+package flymock
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Fixture is what the mock API knows about.
+type Fixture struct {
+	// Orgs maps organization slugs to the apps in them.
+	Orgs map[string][]string `json:"orgs"`
+	// Tokens maps the tokens the API accepts to the organizations they can
+	// see, like the personal access token of a member of each.
+	Tokens map[string][]string `json:"tokens"`
+	// FailingApps are apps whose lookups fail with a 502, like during an
+	// API outage.
+	FailingApps []string `json:"failing_apps"`
+}
+
+// DefaultFixture has my-app and builderApp in the personal organization, and
+// other-app in other. mock-token sees both organizations, so other-app is
+// found but turned away by the organization check. Lookups of failing-app
+// fail.
+func DefaultFixture(builderApp string) Fixture {
+	return Fixture{
+		Orgs: map[string][]string{
+			"personal": {"my-app", builderApp},
+			"other":    {"other-app"},
+		},
+		Tokens: map[string][]string{
+			"mock-token": {"personal", "other"},
+		},
+		FailingApps: []string{"failing-app"},
+	}
+}
+
+// LoadFixture reads a Fixture from the JSON file at path.
+func LoadFixture(path string) (Fixture, error) {
+	var f Fixture
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return f, err
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// Server answers GraphQL queries from a Fixture. It only looks at what
+// authorization asks for: the app named by an appName variable, or the
+// organization named by a slug variable.
+type Server struct {
+	fixture Fixture
+
+	mu      sync.Mutex
+	lookups int
+}
+
+// New returns a Server answering from fixture.
+func New(fixture Fixture) *Server {
+	return &Server{fixture: fixture}
+}
+
+// Lookups is how many queries the server answered, cached authorizations
+// don't add to it.
+func (s *Server) Lookups() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lookups
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/graphql" {
+		http.NotFound(w, r)
+		return
+	}
+	var req struct {
+		Query     string
+		Variables map[string]any
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.lookups++
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	orgs, ok := s.fixture.Tokens[token(r.Header.Get("Authorization"))]
+	if !ok {
+		writeError(w, "UNAUTHORIZED", "You must be authenticated to view this.")
+		return
+	}
+
+	if appName, ok := req.Variables["appName"].(string); ok {
+		if slices.Contains(s.fixture.FailingApps, appName) {
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+		slug := s.appOrg(appName)
+		if slug == "" || !slices.Contains(orgs, slug) {
+			writeError(w, "NOT_FOUND", "Could not find App")
+			return
+		}
+		// the fly-go client asks for it as appcompact
+		field := "app"
+		if strings.Contains(req.Query, "appcompact:") {
+			field = "appcompact"
+		}
+		writeData(w, map[string]any{field: map[string]any{
+			"id":           appName,
+			"name":         appName,
+			"organization": organization(slug),
+		}})
+		return
+	}
+
+	if slug, ok := req.Variables["slug"].(string); ok {
+		if _, exists := s.fixture.Orgs[slug]; !exists || !slices.Contains(orgs, slug) {
+			writeError(w, "NOT_FOUND", "Could not find Organization")
+			return
+		}
+		writeData(w, map[string]any{"organization": organization(slug)})
+		return
+	}
+
+	writeError(w, "BAD_REQUEST", "the mock Fly API only looks up apps and organizations")
+}
+
+func (s *Server) appOrg(appName string) string {
+	for slug, apps := range s.fixture.Orgs {
+		if slices.Contains(apps, appName) {
+			return slug
+		}
+	}
+	return ""
+}
+
+// token takes the token out of an Authorization header, sent as a Bearer
+// token by the fly-go client, or with the FlyV1 scheme for macaroons.
+func token(header string) string {
+	if t, ok := strings.CutPrefix(header, "Bearer "); ok {
+		return t
+	}
+	return strings.TrimPrefix(header, "FlyV1 ")
+}
+
+// organization is an organization the way the API returns it, IDs are the
+// slugs.
+func organization(slug string) map[string]any {
+	return map[string]any{"id": slug, "slug": slug, "name": slug}
+}
+
+func writeData(w http.ResponseWriter, data any) {
+	json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+// writeError answers the way the API reports errors, in a 200 response.
+func writeError(w http.ResponseWriter, code, message string) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"data":   nil,
+		"errors": []any{map[string]any{"message": message, "extensions": map[string]any{"code": code}}},
+	})
+}
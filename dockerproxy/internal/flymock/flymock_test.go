@@ -0,0 +1,107 @@
+package flymock
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func query(t *testing.T, url, authorization, q string, vars map[string]any) (int, map[string]any) {
+	t.Helper()
+
+	body, _ := json.Marshal(map[string]any{"query": q, "variables": vars})
+	req, _ := http.NewRequest(http.MethodPost, url+"/graphql", strings.NewReader(string(body)))
+	req.Header.Set("Authorization", authorization)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out map[string]any
+	json.NewDecoder(resp.Body).Decode(&out)
+	return resp.StatusCode, out
+}
+
+func errorCode(resp map[string]any) string {
+	errs, _ := resp["errors"].([]any)
+	if len(errs) == 0 {
+		return ""
+	}
+	ext, _ := errs[0].(map[string]any)["extensions"].(map[string]any)
+	code, _ := ext["code"].(string)
+	return code
+}
+
+func TestServer(t *testing.T) {
+	mock := New(Fixture{
+		Orgs:        map[string][]string{"acme": {"my-app"}, "other": {"other-app"}},
+		Tokens:      map[string][]string{"acme-token": {"acme"}},
+		FailingApps: []string{"failing-app"},
+	})
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	const appQuery = `query($appName: String!) { app(name: $appName) { organization { id slug } } }`
+	status, resp := query(t, server.URL, "Bearer acme-token", appQuery, map[string]any{"appName": "my-app"})
+	want := map[string]any{"app": map[string]any{"id": "my-app", "name": "my-app", "organization": map[string]any{"id": "acme", "slug": "acme", "name": "acme"}}}
+	if status != http.StatusOK || !reflect.DeepEqual(resp["data"], want) {
+		t.Errorf("expected my-app in acme, but got %d %v", status, resp)
+	}
+
+	// the fly-go client asks for the app under an alias
+	_, resp = query(t, server.URL, "FlyV1 acme-token", `query($appName: String!) { appcompact:app(name: $appName) { id } }`, map[string]any{"appName": "my-app"})
+	if data, _ := resp["data"].(map[string]any); data["appcompact"] == nil {
+		t.Errorf("expected the app as appcompact, but got %v", resp)
+	}
+
+	_, resp = query(t, server.URL, "Bearer acme-token", `query($slug: String!) { organization(slug: $slug) { id slug } }`, map[string]any{"slug": "acme"})
+	if data, _ := resp["data"].(map[string]any); data["organization"] == nil {
+		t.Errorf("expected the acme organization, but got %v", resp)
+	}
+
+	for _, tc := range []struct {
+		name, authorization string
+		vars                map[string]any
+		code                string
+	}{
+		{"app in an org the token can't see", "Bearer acme-token", map[string]any{"appName": "other-app"}, "NOT_FOUND"},
+		{"missing app", "Bearer acme-token", map[string]any{"appName": "nope"}, "NOT_FOUND"},
+		{"org the token can't see", "Bearer acme-token", map[string]any{"slug": "other"}, "NOT_FOUND"},
+		{"unknown token", "Bearer nope", map[string]any{"appName": "my-app"}, "UNAUTHORIZED"},
+	} {
+		if _, resp := query(t, server.URL, tc.authorization, appQuery, tc.vars); errorCode(resp) != tc.code {
+			t.Errorf("%s: expected %s, but got %v", tc.name, tc.code, resp)
+		}
+	}
+
+	if status, _ := query(t, server.URL, "Bearer acme-token", appQuery, map[string]any{"appName": "failing-app"}); status != http.StatusBadGateway {
+		t.Errorf("expected a failing app's lookup to fail with %d, but got %d", http.StatusBadGateway, status)
+	}
+	if got := mock.Lookups(); got != 8 {
+		t.Errorf("expected 8 lookups, but got %d", got)
+	}
+}
+
+func TestLoadFixture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fly.json")
+	os.WriteFile(path, []byte(`{"orgs":{"acme":["my-app"]},"tokens":{"t":["acme"]},"failing_apps":["down"]}`), 0o600)
+
+	got, err := LoadFixture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Fixture{Orgs: map[string][]string{"acme": {"my-app"}}, Tokens: map[string][]string{"t": {"acme"}}, FailingApps: []string{"down"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v, but got %+v", want, got)
+	}
+
+	os.WriteFile(path, []byte(`{`), 0o600)
+	if _, err := LoadFixture(path); err == nil {
+		t.Error("expected invalid JSON to be an error")
+	}
+}
@@ -0,0 +1,115 @@
+package harness
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+// APIVersion is the Docker API version the fake dockerd reports.
+const APIVersion = "1.41"
+
+var (
+	versionPrefix = regexp.MustCompile("^/v[0-9.]+")
+	pushPath      = regexp.MustCompile("^/images/(.+)/push$")
+	execPath      = regexp.MustCompile("^/containers/([^/]+)/exec$")
+	resizePath    = regexp.MustCompile("^/(containers|exec)/[^/]+/resize$")
+	hijackPath    = regexp.MustCompile("^/(containers/[^/]+/attach|exec/[^/]+/start)$")
+)
+
+// Dockerd is a fake Docker API: enough of it for the builder's own calls,
+// for a build, push and pull to go through the proxy end to end, and for an
+// interactive exec, whose session echoes stdin back.
+type Dockerd struct {
+	// URL is the unix socket it listens on.
+	URL *url.URL
+
+	mu       sync.Mutex
+	requests []string
+}
+
+// NewDockerd starts a fake dockerd for the rest of the test.
+func NewDockerd(t testing.TB) *Dockerd {
+	t.Helper()
+
+	d := &Dockerd{}
+	d.URL = ServeUnix(t, d)
+	return d
+}
+
+// Requests lists the requests dockerd got so far as "METHOD /path", with
+// the API version taken off the path.
+func (d *Dockerd) Requests() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.requests...)
+}
+
+func (d *Dockerd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := versionPrefix.ReplaceAllString(r.URL.Path, "")
+	d.mu.Lock()
+	d.requests = append(d.requests, r.Method+" "+path)
+	d.mu.Unlock()
+
+	w.Header().Set("Api-Version", APIVersion)
+	switch {
+	case path == "/_ping":
+		io.WriteString(w, "OK")
+	case path == "/version":
+		json.NewEncoder(w).Encode(map[string]string{"Version": "24.0.0", "ApiVersion": APIVersion, "MinAPIVersion": "1.12"})
+	case path == "/info":
+		json.NewEncoder(w).Encode(map[string]any{"ID": "fake", "Containers": 0, "Images": 0})
+	case path == "/build" && r.Method == http.MethodPost:
+		io.Copy(io.Discard, r.Body)
+		stream(w, `{"stream":"Step 1/1 : FROM scratch"}`, `{"stream":"Successfully built abc123"}`)
+	case path == "/images/create" && r.Method == http.MethodPost:
+		image := r.URL.Query().Get("fromImage")
+		stream(w, fmt.Sprintf(`{"status":"Pulling from %s"}`, image), `{"status":"Download complete"}`)
+	case pushPath.MatchString(path) && r.Method == http.MethodPost:
+		image := pushPath.FindStringSubmatch(path)[1]
+		stream(w, fmt.Sprintf(`{"status":"The push refers to repository [%s]"}`, image), `{"status":"latest: digest: sha256:abc123 size: 528"}`)
+	case execPath.MatchString(path) && r.Method == http.MethodPost:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"Id":"exec-%s"}`+"\n", execPath.FindStringSubmatch(path)[1])
+	case resizePath.MatchString(path) && r.Method == http.MethodPost:
+		if r.URL.Query().Get("h") == "" || r.URL.Query().Get("w") == "" {
+			http.Error(w, "resize needs h and w", http.StatusBadRequest)
+		}
+	case hijackPath.MatchString(path) && r.Method == http.MethodPost && r.Header.Get("Upgrade") == "tcp":
+		echo(w, r)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"message":"page not found"}`+"\n")
+	}
+}
+
+// stream writes a JSON message stream the way dockerd does, flushing after
+// every line.
+func stream(w http.ResponseWriter, lines ...string) {
+	w.Header().Set("Content-Type", "application/json")
+	for _, line := range lines {
+		io.WriteString(w, line+"\n")
+		w.(http.Flusher).Flush()
+	}
+}
+
+// echo takes over the connection the way dockerd does for attach and exec
+// with a TTY, and echoes what it reads until the client stops writing. The
+// request's body is the exec's options, not stdin.
+func echo(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	io.WriteString(conn, "HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	io.Copy(conn, rw)
+}
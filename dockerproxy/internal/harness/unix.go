@@ -0,0 +1,29 @@
+// Package harness has the fakes the builder's tests run against: dockerd on
+// a unix socket, and certificates for the TLS listeners.
+package harness
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+// ServeUnix serves handler on a unix socket until the test ends, and
+// returns the socket as a DOCKER_HOST would name it.
+func ServeUnix(t testing.TB, handler http.Handler) *url.URL {
+	t.Helper()
+
+	socketPath := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{Handler: handler}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+
+	return &url.URL{Scheme: "unix", Path: socketPath}
+}
@@ -0,0 +1,15 @@
+// Package logging is where the internal packages get their logger, so they
+// log through the builder's own once it points Logger at it.
+package logging
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Logger returns the logger for work done on behalf of ctx. The builder
+// points it at its own, which tags lines with the request ID.
+var Logger = func(ctx context.Context) *logrus.Entry {
+	return logrus.NewEntry(logrus.StandardLogger())
+}
@@ -0,0 +1,4 @@
+// Package proxy holds the parts of proxying the Docker API that don't depend
+// on the builder's state: which paths may be proxied, rate limits, and
+// passing hijacked connections through and keeping track of them.
+package proxy
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// HijackedConns tracks connections taken over from the HTTP server, like
+// docker exec sessions and upgraded build streams. http.Server.Shutdown
+// forgets about connections once they're hijacked, so shutting down waits
+// for these separately. The zero value is ready to use.
+type HijackedConns struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// Track adds conn until the returned func is called, once the connection is
+// done with.
+func (h *HijackedConns) Track(conn net.Conn) (done func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conns == nil {
+		h.conns = map[net.Conn]struct{}{}
+	}
+	h.conns[conn] = struct{}{}
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.conns, conn)
+	}
+}
+
+// Len is how many hijacked connections are open.
+func (h *HijackedConns) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.conns)
+}
+
+// hijackedPollInterval is how often Wait checks for connections still open,
+// the way http.Server.Shutdown polls for idle ones.
+const hijackedPollInterval = 100 * time.Millisecond
+
+// Wait waits for every tracked connection to be done, or for ctx to be,
+// returning its error then.
+func (h *HijackedConns) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(hijackedPollInterval)
+	defer ticker.Stop()
+	for h.Len() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHijackedConnsWait(t *testing.T) {
+	var h HijackedConns
+	if err := h.Wait(context.Background()); err != nil {
+		t.Fatalf("expected no wait without connections, but got %v", err)
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	doneA, doneB := h.Track(a), h.Track(b)
+	if n := h.Len(); n != 2 {
+		t.Fatalf("expected 2 connections, but got %d", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := h.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected open connections to outlast the wait, but got %v", err)
+	}
+
+	doneA()
+	time.AfterFunc(50*time.Millisecond, doneB)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.Wait(ctx); err != nil {
+		t.Errorf("expected the wait to end with the last connection, but got %v", err)
+	}
+}
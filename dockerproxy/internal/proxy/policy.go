@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// DefaultAllowedPaths is the Docker API surface builds need: building,
+// pulling and pushing images, buildkit sessions, and the calls clients make
+// to look around first. Anything that runs containers is left out.
+var DefaultAllowedPaths = []string{
+	"^/flyio/.*$",
+	"^/grpc$",
+	"^(/v[0-9.]*)?/_ping$",
+	"^(/v[0-9.]*)?/version$",
+	"^(/v[0-9.]*)?/info$",
+	"^(/v[0-9.]*)?/session$",
+	"^(/v[0-9.]*)?/build(/prune|/cancel)?$",
+	"^(/v[0-9.]*)?/images/.*$",
+	"^(/v[0-9.]*)?/distribution/.*/json$",
+	"^(/v[0-9.]*)?/volumes/.*$",
+}
+
+// OperatorAllowedPaths are allowed on top of the allowlist for operators, to
+// debug the builder with docker run -it and docker exec -it: running,
+// attaching to and resizing containers and exec sessions, their logs, and
+// dockerd's events.
+var OperatorAllowedPaths = []string{
+	"^(/v[0-9.]*)?/containers/.*$",
+	"^(/v[0-9.]*)?/exec/.*$",
+	"^(/v[0-9.]*)?/events$",
+}
+
+// PathPolicy decides which Docker API paths the proxy passes on to dockerd.
+// A path is allowed when it matches an allow pattern and no deny pattern.
+type PathPolicy struct {
+	allowAll bool
+	allow    []*regexp.Regexp
+	operator []*regexp.Regexp
+	deny     []*regexp.Regexp
+}
+
+// NewPathPolicy adds extraAllow to the default allowlist. deny takes
+// precedence over both, even when allowAll lifts the allowlist.
+func NewPathPolicy(allowAll bool, extraAllow, deny []string) (*PathPolicy, error) {
+	p := &PathPolicy{allowAll: allowAll}
+
+	var err error
+	if p.allow, err = compilePatterns(append(append([]string{}, DefaultAllowedPaths...), extraAllow...)); err != nil {
+		return nil, err
+	}
+	if p.operator, err = compilePatterns(OperatorAllowedPaths); err != nil {
+		return nil, err
+	}
+	if p.deny, err = compilePatterns(deny); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+func (p *PathPolicy) Allowed(path string) bool {
+	if matchAny(p.deny, path) {
+		return false
+	}
+	return p.allowAll || matchAny(p.allow, path)
+}
+
+// AllowedForOperator is Allowed with OperatorAllowedPaths allowed too. The
+// deny patterns still take precedence.
+func (p *PathPolicy) AllowedForOperator(path string) bool {
+	return p.Allowed(path) || (!matchAny(p.deny, path) && matchAny(p.operator, path))
+}
+
+func matchAny(patterns []*regexp.Regexp, path string) bool {
+	for _, re := range patterns {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
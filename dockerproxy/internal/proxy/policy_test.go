@@ -0,0 +1,64 @@
+package proxy
+
+import "testing"
+
+func TestPathPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		allowAll bool
+		allow    []string
+		deny     []string
+		path     string
+		want     bool
+	}{
+		{"ping", false, nil, nil, "/_ping", true},
+		{"versioned build", false, nil, nil, "/v1.41/build", true},
+		{"build cache prune", false, nil, nil, "/v1.41/build/prune", true},
+		{"session", false, nil, nil, "/v1.41/session", true},
+		{"image push", false, nil, nil, "/v1.41/images/registry.fly.io/app/push", true},
+		{"container create", false, nil, nil, "/v1.41/containers/create", false},
+		{"exec", false, nil, nil, "/v1.41/exec/abc/start", false},
+		{"plugins", false, nil, nil, "/v1.41/plugins", false},
+		{"extra allow", false, []string{"^/v[0-9.]+/containers/"}, nil, "/v1.41/containers/create", true},
+		{"allow all", true, nil, nil, "/v1.41/plugins", true},
+		{"deny beats allow all", true, nil, []string{"/plugins"}, "/v1.41/plugins", false},
+		{"deny beats default", false, nil, []string{"^/v[0-9.]+/images/.*/push$"}, "/v1.41/images/app/push", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPathPolicy(tt.allowAll, tt.allow, tt.deny)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.Allowed(tt.path); got != tt.want {
+				t.Errorf("allowed(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := NewPathPolicy(false, []string{"("}, nil); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+}
+
+func TestPathPolicyOperator(t *testing.T) {
+	p, err := NewPathPolicy(false, nil, []string{"/containers/.*/archive$"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]bool{
+		"/v1.41/build":                  true,
+		"/v1.41/containers/create":      true,
+		"/v1.41/containers/abc/attach":  true,
+		"/v1.41/containers/abc/resize":  true,
+		"/v1.41/exec/abc/start":         true,
+		"/v1.41/exec/abc/resize":        true,
+		"/v1.41/events":                 true,
+		"/v1.41/containers/abc/archive": false,
+		"/v1.41/plugins":                false,
+	} {
+		if got := p.AllowedForOperator(path); got != want {
+			t.Errorf("allowed for operator(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
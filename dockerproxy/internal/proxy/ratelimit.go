@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// RateLimiter hands out n operations per period to each app and each token,
+// from token buckets refilling steadily over the period. A CI job looping on
+// builds then only exhausts its own buckets, not the builder.
+type RateLimiter struct {
+	operation string
+	n         float64
+	per       time.Duration
+
+	mu sync.Mutex
+	// a bucket left alone for per is full again, so it may as well expire
+	buckets *cache.Cache
+	now     func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter parses a limit like "10/1h". It's nil, limiting nothing,
+// when spec is empty.
+func NewRateLimiter(operation, spec string) (*RateLimiter, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	count, period, ok := strings.Cut(spec, "/")
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if !ok || err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid rate limit %q for %s, expected a count and a duration like 10/1h", spec, operation)
+	}
+	per, err := time.ParseDuration(strings.TrimSpace(period))
+	if err != nil || per <= 0 {
+		return nil, fmt.Errorf("invalid rate limit %q for %s, expected a count and a duration like 10/1h", spec, operation)
+	}
+	return &RateLimiter{
+		operation: operation,
+		n:         float64(n),
+		per:       per,
+		buckets:   cache.New(per, 10*time.Minute),
+		now:       time.Now,
+	}, nil
+}
+
+// Operation is what the limiter limits, like "builds".
+func (l *RateLimiter) Operation() string { return l.operation }
+
+// Spec is the limit, like 10/1h0m0s. Limiters with the same spec limit the
+// same way.
+func (l *RateLimiter) Spec() string {
+	return fmt.Sprintf("%d/%s", int(l.n), l.per)
+}
+
+// Take takes an operation from each of the buckets for keys, if they all
+// have one to give. Otherwise it returns how long until they do.
+func (l *RateLimiter) Take(keys ...string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	rate := l.n / l.per.Seconds()
+	buckets := make([]*tokenBucket, len(keys))
+	var wait time.Duration
+	for i, key := range keys {
+		b := &tokenBucket{tokens: l.n, last: now}
+		if v, ok := l.buckets.Get(key); ok {
+			b = v.(*tokenBucket)
+			b.tokens = math.Min(l.n, b.tokens+now.Sub(b.last).Seconds()*rate)
+			b.last = now
+		}
+		buckets[i] = b
+		if b.tokens < 1 {
+			if w := time.Duration((1 - b.tokens) / rate * float64(time.Second)); w > wait {
+				wait = w
+			}
+		}
+	}
+	for i, b := range buckets {
+		if wait == 0 {
+			b.tokens--
+		}
+		l.buckets.SetDefault(keys[i], b)
+	}
+	return wait == 0, wait
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+	if l, err := NewRateLimiter("builds", ""); l != nil || err != nil {
+		t.Errorf("expected no limiter without a limit, but got %v, %v", l, err)
+	}
+	for _, spec := range []string{"10", "0/1h", "ten/1h", "10/soon", "10/-1h"} {
+		if _, err := NewRateLimiter("builds", spec); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
+
+func TestRateLimiterTake(t *testing.T) {
+	l, err := NewRateLimiter("builds", "2/1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Take("app:a", "token:x"); !ok {
+			t.Fatalf("expected take %d to be allowed", i)
+		}
+	}
+	ok, wait := l.Take("app:a", "token:x")
+	if ok || wait != 30*time.Second {
+		t.Errorf("expected to wait 30s for the next token, but got %v, %s", ok, wait)
+	}
+	// the token is used up through app a, even for another app
+	if ok, _ := l.Take("app:b", "token:x"); ok {
+		t.Error("expected the token's limit to apply across apps")
+	}
+	if ok, _ := l.Take("app:b", "token:y"); !ok {
+		t.Error("expected another app and token to be unaffected")
+	}
+
+	now = now.Add(30 * time.Second)
+	if ok, _ := l.Take("app:a", "token:x"); !ok {
+		t.Error("expected a token to have refilled after 30s")
+	}
+}
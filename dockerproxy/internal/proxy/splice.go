@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// IsUpgrade reports whether r asks to take over the connection, which the
+// docker CLI does for exec, attach and buildkit sessions.
+func IsUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, token := range strings.Split(r.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// Splice copies between a hijacked client connection and backend
+// until both sides are done, passing half-closes through. backendReader may
+// hold bytes already read from backend.
+func Splice(ctx context.Context, conn net.Conn, clientRW *bufio.ReadWriter, backend net.Conn, backendReader io.Reader) {
+	// shutting down past the drain timeout cancels the context, end the
+	// stream then rather than leaving it open under a stopped dockerd
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			backend.Close()
+		case <-done:
+		}
+	}()
+
+	// only take what the server already buffered from clientRW, reading
+	// through it hits the server's connection reader, which cancels the
+	// request context on EOF and would cut the stream at the half-close
+	clientReader := io.MultiReader(io.LimitReader(clientRW, int64(clientRW.Reader.Buffered())), conn)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(backend, clientReader)
+		CloseWrite(backend)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, backendReader)
+		CloseWrite(conn)
+	}()
+	wg.Wait()
+}
+
+// CloseWrite signals EOF to the other end while still reading from it.
+func CloseWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
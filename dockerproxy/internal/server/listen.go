@@ -0,0 +1,103 @@
+// Package server binds the builder's listeners and keeps its TLS certificate
+// current.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/superfly/rchab/dockerproxy/internal/logging"
+)
+
+const unixAddrPrefix = "unix:"
+
+// ListenAddr is one of LISTEN_ADDRS: a TCP host:port, which may be a name
+// like fly-local-6pn:8080, or a unix socket as unix:/path/to.sock.
+type ListenAddr string
+
+func (a ListenAddr) unixPath() (string, bool) {
+	path, ok := strings.CutPrefix(string(a), unixAddrPrefix)
+	if !ok {
+		return "", false
+	}
+	// unix:///path, the way DOCKER_HOST writes it, works too
+	return "/" + strings.TrimLeft(path, "/"), true
+}
+
+// listen binds addr. A stale socket left by a previous run is replaced, and
+// the new one is only accessible to its owner and group.
+func (a ListenAddr) listen() (net.Listener, error) {
+	path, ok := a.unixPath()
+	if !ok {
+		return net.Listen("tcp", string(a))
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("could not remove stale socket: %w", err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// ServeListeners binds every addr up front, so a bad address stops startup,
+// and serves server on each. TCP listeners use TLS when the server has a
+// TLSConfig, unix sockets are only reachable locally and never do.
+func ServeListeners(server *http.Server, addrs []ListenAddr) error {
+	log := logging.Logger(context.Background())
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		l, err := addr.listen()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("could not listen on %s: %w", addr, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	// read before serving, which sets up HTTP/2 in TLSConfig
+	hasTLS := server.TLSConfig != nil
+	for i, l := range listeners {
+		addr := addrs[i]
+		_, isUnix := addr.unixPath()
+		useTLS := hasTLS && !isUnix
+
+		go func(l net.Listener) {
+			var err error
+			if useTLS {
+				log.Infof("Listening on %s with TLS enabled", addr)
+				err = server.ServeTLS(l, "", "")
+			} else {
+				log.Infof("Listening on %s", addr)
+				err = server.Serve(l)
+			}
+			if err != http.ErrServerClosed {
+				log.Fatalf("failed to serve on %s: %v", addr, err)
+			}
+		}(l)
+	}
+	return nil
+}
+
+// JoinListenAddrs names the server by its addresses in logs.
+func JoinListenAddrs(addrs []ListenAddr) string {
+	s := make([]string, len(addrs))
+	for i, addr := range addrs {
+		s[i] = string(addr)
+	}
+	return strings.Join(s, ",")
+}
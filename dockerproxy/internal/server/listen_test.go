@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenAddrUnixPath(t *testing.T) {
+	for addr, want := range map[ListenAddr]string{
+		"unix:/run/rchab.sock":   "/run/rchab.sock",
+		"unix:///run/rchab.sock": "/run/rchab.sock",
+		":8080":                  "",
+		"fly-local-6pn:8080":     "",
+	} {
+		if got, _ := addr.unixPath(); got != want {
+			t.Errorf("%s: expected socket path %q, but got %q", addr, want, got)
+		}
+	}
+}
+
+func TestServeListeners(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "rchab.sock")
+	// left over from a previous run
+	if err := os.WriteFile(socketPath, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// find a free port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpAddr := l.Addr().String()
+	l.Close()
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "OK")
+	})}
+	if err := ServeListeners(server, []ListenAddr{ListenAddr(tcpAddr), ListenAddr("unix://" + socketPath)}); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown(context.Background())
+
+	if fi, err := os.Stat(socketPath); err != nil || fi.Mode().Perm() != 0o660 {
+		t.Errorf("expected a socket only its owner and group can use, but got %v, %v", fi.Mode(), err)
+	}
+
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	for name, get := range map[string]func() (*http.Response, error){
+		"tcp":  func() (*http.Response, error) { return http.Get("http://" + tcpAddr) },
+		"unix": func() (*http.Response, error) { return unixClient.Get("http://rchab") },
+	} {
+		resp, err := get()
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: expected status %d, but got %d", name, http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	// a bad address fails up front
+	if err := ServeListeners(server, []ListenAddr{ListenAddr("unix:" + filepath.Join(t.TempDir(), "missing", "rchab.sock"))}); err == nil {
+		t.Error("expected an error listening in a missing directory")
+	}
+}
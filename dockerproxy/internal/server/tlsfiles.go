@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/superfly/rchab/dockerproxy/internal/logging"
+)
+
+// TLSFiles serves the certificate in TLS_CERT_FILE and TLS_KEY_FILE, and
+// when TLS_CLIENT_CA_FILE is set only lets in clients with a certificate it
+// signed. The files are read again when they change, so renewed certificates
+// and CAs are picked up without restarting the builder and its builds.
+type TLSFiles struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mu      sync.RWMutex
+	config  *tls.Config
+	modTime time.Time
+}
+
+func NewTLSFiles(certFile, keyFile, clientCAFile string) (*TLSFiles, error) {
+	t := &TLSFiles{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ServerConfig is the tls.Config for the listener. Each handshake gets
+// whatever was loaded last.
+func (t *TLSFiles) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			t.mu.RLock()
+			defer t.mu.RUnlock()
+			return t.config, nil
+		},
+	}
+}
+
+func (t *TLSFiles) load() error {
+	modTime, err := t.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load the TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if t.clientCAFile != "" {
+		pem, err := os.ReadFile(t.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("could not read TLS_CLIENT_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in TLS_CLIENT_CA_FILE")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	t.mu.Lock()
+	t.config = config
+	t.modTime = modTime
+	t.mu.Unlock()
+	return nil
+}
+
+// reload loads the files again if any changed since they were last loaded.
+// On error the previous certificate stays in use.
+func (t *TLSFiles) reload() {
+	modTime, err := t.latestModTime()
+	if err != nil {
+		logging.Logger(context.Background()).Errorf("could not check TLS files, keeping the current certificate: %v", err)
+		return
+	}
+	t.mu.RLock()
+	changed := !modTime.Equal(t.modTime)
+	t.mu.RUnlock()
+	if !changed {
+		return
+	}
+
+	if err := t.load(); err != nil {
+		logging.Logger(context.Background()).Errorf("keeping the current certificate: %v", err)
+		return
+	}
+	logging.Logger(context.Background()).Info("reloaded TLS certificate")
+}
+
+// Watch reloads the files every interval until ctx is done.
+func (t *TLSFiles) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.reload()
+		}
+	}
+}
+
+func (t *TLSFiles) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{t.certFile, t.keyFile, t.clientCAFile} {
+		if path == "" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/superfly/rchab/dockerproxy/internal/harness"
+)
+
+func TestTLSFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	caFile := filepath.Join(dir, "ca.crt")
+
+	ca, caKey := harness.Cert(t, "ca", nil, nil)
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	serverCert, serverKey := harness.Cert(t, "builder", ca, caKey)
+	harness.WriteCert(t, certFile, keyFile, serverCert, serverKey, time.Now().Add(-time.Minute))
+
+	files, err := NewTLSFiles(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = files.ServerConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientCert, clientKey := harness.Cert(t, "client", ca, caKey)
+	get := func(withCert bool) (*x509.Certificate, error) {
+		config := &tls.Config{RootCAs: roots}
+		if withCert {
+			config.Certificates = []tls.Certificate{{Certificate: [][]byte{clientCert.Raw}, PrivateKey: clientKey}}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0], nil
+	}
+
+	if _, err := get(false); err == nil {
+		t.Error("expected a client without a certificate to be turned away")
+	}
+	got, err := get(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(serverCert) {
+		t.Errorf("expected the certificate from TLS_CERT_FILE, but got %s", got.Subject)
+	}
+
+	renewed, renewedKey := harness.Cert(t, "builder", ca, caKey)
+	harness.WriteCert(t, certFile, keyFile, renewed, renewedKey, time.Now())
+	files.reload()
+	if got, err = get(true); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(renewed) {
+		t.Errorf("expected the renewed certificate after a reload, but got serial %s", got.SerialNumber)
+	}
+
+	// a broken renewal keeps the working certificate in use
+	os.WriteFile(keyFile, []byte("garbage"), 0o600)
+	files.reload()
+	if got, err = get(true); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(renewed) {
+		t.Errorf("expected the previous certificate after a failed reload, but got serial %s", got.SerialNumber)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestKeepAliveHandler(t *testing.T) {
+	defer func(interval time.Duration) { keepAliveMinInterval = interval }(keepAliveMinInterval)
+	keepAliveMinInterval = time.Minute
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-keepAlive:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	h := keepAliveHandler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/keepalive", nil))
+	if w.Code != http.StatusAccepted {
+		t.Errorf("expected status %d, but got %d", http.StatusAccepted, w.Code)
+	}
+	var body map[string]time.Time
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if until := time.Until(body["deadline"]); until <= 0 || until > maxIdleDuration.Get() {
+		t.Errorf("expected the new deadline within the idle duration, but it's %s away", until)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/keepalive", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, but got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("expected Retry-After 60, but got %q", got)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/keepalive", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, but got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+func TestKeepAliveHandlerShuttingDown(t *testing.T) {
+	defer func(interval time.Duration) { keepAliveMinInterval = interval }(keepAliveMinInterval)
+	keepAliveMinInterval = 0
+
+	// nothing reads keepAlive, as when the liveness loop has already returned
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	w := httptest.NewRecorder()
+	keepAliveHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/keepalive", nil).WithContext(ctx))
+
+	assertDockerError(t, w, http.StatusServiceUnavailable)
+}
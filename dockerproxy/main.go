@@ -2,78 +2,221 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/signal"
-	"regexp"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/docker/docker/client"
-	"github.com/gorilla/handlers"
 	"github.com/minio/minio/pkg/disk"
 	"github.com/patrickmn/go-cache"
 	"github.com/sirupsen/logrus"
-	"github.com/superfly/flyctl/api"
+	"github.com/superfly/rchab/dockerproxy/internal/auth"
+	"github.com/superfly/rchab/dockerproxy/internal/daemon"
+	"github.com/superfly/rchab/dockerproxy/internal/proxy"
+	"github.com/superfly/rchab/dockerproxy/internal/server"
 )
 
 const gb = 1000 * 1000 * 1000
 
 var (
-	log             = logrus.New()
-	maxIdleDuration = 10 * time.Minute
-	jobDeadline     = time.NewTimer(maxIdleDuration)
+	log             = newLogger()
+	maxIdleDuration = newDurationVar(getIdleDuration())
+	jobDeadline     = time.NewTimer(maxIdleDuration.Get())
+	jobDeadlineAt   atomic.Int64 // unix nanos, see resetJobDeadline
 	pendingRequests atomic.Uint64
-	authCache       = cache.New(5*time.Minute, 10*time.Minute)
+	hijackedConns   = &proxy.HijackedConns{}
+	lastRequestDone atomic.Int64 // unix nanos
 	keepAlive       = make(chan struct{})
 
+	// lifecycle
+	dockerReady atomic.Bool
+	draining    atomic.Bool
+	maxLifetime = getEnvDuration("MAX_LIFETIME", 0)
+	// how long in-flight builds get once MAX_LIFETIME is reached
+	maxLifetimeGrace     = getEnvPositiveDuration("MAX_LIFETIME_GRACE", time.Hour)
+	forceKillGrace       = getEnvDuration("FORCE_KILL_GRACE", 0)
+	keepAliveMinInterval = getEnvDuration("KEEPALIVE_MIN_INTERVAL", 30*time.Second)
+	drainTimeout         = getEnvPositiveDuration("DRAIN_TIMEOUT", 30*time.Second)
+	hijackDrainTimeout   = getEnvPositiveDuration("HIJACK_DRAIN_TIMEOUT", drainTimeout)
+	perAppIdle           = os.Getenv("PER_APP_IDLE") == "1"
+	appsLastSeen         = newAppActivity()
+	appsUsage            = newAppUsage()
+
+	// per app usage is posted here every USAGE_REPORT_INTERVAL, see reportUsage
+	usageReportURL      = os.Getenv("USAGE_REPORT_URL")
+	usageReportToken    = os.Getenv("USAGE_REPORT_TOKEN")
+	usageReportInterval = getEnvPositiveDuration("USAGE_REPORT_INTERVAL", 5*time.Minute)
+
+	// auth
+	authCacheTTL = newDurationVar(getEnvPositiveDuration("AUTH_CACHE_DEFAULT_TTL", 5*time.Minute))
+	// denials expire sooner, so a fixed token or org move takes effect quickly
+	authNegativeTTL = newDurationVar(getEnvPositiveDuration("AUTH_CACHE_NEGATIVE_TTL", 15*time.Second))
+	authCache       = cache.New(
+		authCacheTTL.Get(),
+		getEnvPositiveDuration("AUTH_CACHE_CLEANUP_INTERVAL", 10*time.Minute),
+	)
+	authCacheDisabled = defaultConfig.Auth.CacheDisabled
+	authFlights       = auth.NewFlightGroup()
+	// approvals are kept around this much longer, to fall back on while the
+	// Fly API is down. Disabled when zero.
+	authStaleGrace  = defaultConfig.Auth.StaleGrace
+	authStale       = cache.New(authStaleGrace, 10*time.Minute)
+	authMode        = defaultConfig.Auth.Mode
+	staticAuthToken = defaultConfig.Auth.StaticToken
+
+	// recently used approvals are checked with the Fly API again this often,
+	// see revalidateAuth. Disabled when zero.
+	authRevalidateInterval = defaultConfig.Auth.RevalidateInterval
+
+	// failed auth attempts per source, see recordAuthFailure
+	authFailureLimit    = getEnvInt("AUTH_FAILURE_LIMIT", 30)
+	authFailureWindow   = getEnvPositiveDuration("AUTH_FAILURE_WINDOW", time.Minute)
+	authFailureCooldown = getEnvPositiveDuration("AUTH_FAILURE_COOLDOWN", 2*time.Minute)
+	authFailures        = cache.New(authFailureWindow, time.Minute)
+
+	// Fly API calls made to authorize requests
+	authAPITimeout  = defaultConfig.Auth.APITimeout
+	authAPIRetries  = defaultConfig.Auth.APIRetries
+	authAPIFailOpen = defaultConfig.Auth.APIFailOpen
+	flyAPIBreaker   = newCircuitBreaker(getEnvInt("AUTH_API_BREAKER_THRESHOLD", 5), getEnvPositiveDuration("AUTH_API_BREAKER_COOLDOWN", 30*time.Second))
+
+	// organizations whose apps may use the builder, instead of the builder's own
+	allowedOrgSlugs = newListVar(defaultConfig.Auth.AllowedOrgSlugs)
+	// apps that may also run and exec into containers, with OPERATOR_TOKEN
+	operatorApps  = newListVar(defaultConfig.Auth.OperatorApps)
+	operatorToken = defaultConfig.Auth.OperatorToken
+	// the builder's own Fly API token, to look up apps without a client's
+	builderToken = defaultConfig.Auth.BuilderToken
+	// the builder's organization, instead of looking it up, see resolveBuilderOrg
+	builderOrgSlug = defaultConfig.Auth.BuilderOrg
+
+	// Fly's proxy terminates TLS and sets Fly-Client-IP, anyone else could
+	// forge it. Set by Config.apply.
+	trustFlyClientIP bool
+
+	// log pushes and builds into registry.fly.io with the client's own token
+	injectFlyRegistryAuth = os.Getenv("FLY_REGISTRY_AUTH") == "1"
+
+	// refuse pushes into other apps' registry.fly.io repositories, see pushTargetAllowed
+	enforcePushTargets = os.Getenv("ALLOW_ANY_PUSH_TARGET") != "1"
+
+	// admin
+	adminAddr    = defaultConfig.Server.AdminAddr
+	adminToken   = defaultConfig.Server.AdminToken
+	recentBuilds = newBuildHistory(getEnvInt("BUILD_HISTORY_SIZE", 50))
+	activeBuilds = newBuildSet()
+
+	// builds over MAX_CONCURRENT_BUILDS wait up to BUILD_QUEUE_TIMEOUT, or get a 429 right away
+	buildSlots = newBuildLimiter(getEnvInt("MAX_CONCURRENT_BUILDS", 0), getEnvDuration("BUILD_QUEUE_TIMEOUT", 0))
+	// builds running longer are cancelled, unlimited when 0
+	buildTimeout = getEnvDuration("BUILD_TIMEOUT", 0)
+	// one build per app at a time, see appBuildLocks
+	appBuilds = newAppBuildLocks(os.Getenv("SERIALIZE_APP_BUILDS"))
+	// builds, pushes and pulls per app and per token, see proxy.RateLimiter
+	buildRateLimit, pushRateLimit, pullRateLimit atomic.Pointer[proxy.RateLimiter]
+
+	// dials to dockerd are retried while it isn't listening, and requests
+	// are held while it starts or restarts, see waitDockerReady
+	dockerdDialTimeout = defaultConfig.Dockerd.DialTimeout
+	dockerdReadyWait   = defaultConfig.Dockerd.ReadyWait
+
+	// how often proxied responses are flushed to the client, negative flushes
+	// after every write. Streams without a Content-Length always flush right away.
+	proxyFlushInterval = getEnvDuration("PROXY_FLUSH_INTERVAL", -1)
+
+	// Docker API paths clients may use, see proxy.PathPolicy. Set by
+	// reloadableConfig.apply.
+	proxyPolicy atomic.Pointer[proxy.PathPolicy]
+
+	// docker API versions clients may use, unrestricted when empty
+	minAPIVersion = os.Getenv("MIN_API_VERSION")
+	maxAPIVersion = os.Getenv("MAX_API_VERSION")
+
+	// browser origins allowed to call the builder, see corsRequest
+	corsAllowedOrigins = splitList(os.Getenv("CORS_ALLOWED_ORIGINS"))
+
+	// the volume holding dockerd's data, whose free space is watched
+	dataDir = defaultConfig.Dockerd.DataDir
+
+	// give the builder to one organization at a time, see orgOwner
+	orgIsolation = os.Getenv("ORG_ISOLATION") == "1"
+
+	// requests with bigger bodies get a 413, unlimited when 0
+	maxRequestBody = int64(getEnvInt("MAX_REQUEST_BODY_GB", 0)) * gb
+	// build contexts are read to the volume before the build starts, see spoolBuildContext
+	spoolBuildContexts   = os.Getenv("SPOOL_BUILD_CONTEXTS") != "0"
+	buildContextSpoolDir = filepath.Join(dataDir, "context-spool")
+
+	// pull-through cache of Docker Hub on the volume, see startRegistryCache
+	registryCacheEnabled = os.Getenv("REGISTRY_CACHE") == "1"
+
 	//prune
-	pruneThresholdUsedPercent = 0.8
+	pruneThresholdUsedPercent = float64(getEnvInt("PRUNE_HIGH_WATER_PERCENT", 80)) / 100
 	pruneThresholdFreeBytes   = 15 * 1000 * 1000 * 1000
+	// how often disk usage is checked against the high-water mark, 0 disables
+	pruneInterval = getEnvDuration("PRUNE_INTERVAL", 5*time.Minute)
+	// new builds are refused with less than this free on /data
+	diskMinFree       = int64(getEnvInt("DISK_MIN_FREE_GB", 1)) * gb
+	diskCheckInterval = getEnvPositiveDuration("DISK_CHECK_INTERVAL", 30*time.Second)
+	// new builds are refused while memory or CPU pressure, the percent of the
+	// last 10s tasks stalled on it, is over these. 0 doesn't check.
+	memoryPressureMax     = float64(getEnvInt("MEMORY_PRESSURE_MAX", 0))
+	cpuPressureMax        = float64(getEnvInt("CPU_PRESSURE_MAX", 0))
+	pressureCheckInterval = getEnvPositiveDuration("PRESSURE_CHECK_INTERVAL", 5*time.Second)
+	// most recently used build cache to keep when pruning
+	pruneKeepStorage = int64(getEnvInt("PRUNE_KEEP_CACHE_GB", 0)) * gb
+
+	// platforms to install QEMU emulators for at startup, see installBinfmt
+	binfmtPlatforms = splitList(os.Getenv("BINFMT_PLATFORMS"))
+
+	// run buildkitd alone, without dockerd, see runBuildkitd
+	buildkitdOnly     = os.Getenv("BUILDKITD_ONLY") == "1"
+	buildkitdRootless = os.Getenv("BUILDKITD_ROOTLESS") == "1"
+
+	// where dockerd is reached, DOCKER_HOST style. The local dockerd listens
+	// here, set NO_DOCKERD=1 as well when it's on another machine.
+	dockerHost = defaultConfig.Dockerd.Host
+
+	// the Fly API apps and tokens are checked against, e.g. a staging one
+	flyAPIURL = defaultConfig.Auth.FlyAPIURL
 
 	// dev and testing
-	noDockerd = os.Getenv("NO_DOCKERD") == "1"
-	noAuth    = os.Getenv("NO_AUTH") == "1"
-	noAppName = os.Getenv("NO_APP_NAME") == "1"
-	noHttps   = os.Getenv("NO_HTTPS") == "1"
-	noFilter  = true
+	noDockerd = defaultConfig.Dockerd.Disabled
+	noAuth    = defaultConfig.Auth.Disabled
+	noAppName = defaultConfig.Auth.NoAppName
+	// authorize against an embedded mock Fly API, see startMockFlyAPI
+	mockFlyAPI = defaultConfig.Auth.MockFlyAPI
+	noHttps    = defaultConfig.Server.NoHTTPS
+	noFilter   = os.Getenv("NO_FILTER") == "1"
 
 	// build variables
 	gitSha    string
 	buildTime string
 )
 
-const (
-	DOCKER_LISTENER = "localhost:2376"
-	DOCKER_SCHEME   = "http"
-	FLY_API_URL     = "https://api.fly.io"
-)
-
-var allowedPaths = []*regexp.Regexp{
-	regexp.MustCompile("^/flyio/.*$"),
-	regexp.MustCompile("^/grpc$"),
-	regexp.MustCompile("^/_ping$"),
-	regexp.MustCompile("^(/v[0-9.]*)?/version$"),
-	regexp.MustCompile("^(/v[0-9.]*)?/volumes/.*$"),
-	regexp.MustCompile("^(/v[0-9.]*)?/info$"),
-	regexp.MustCompile("^(/v[0-9.]*)?/images/.*$"),
-}
-
-func init() {
-	api.SetBaseURL(FLY_API_URL)
-}
-
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	shutdownChan := make(chan os.Signal, 1)
-	signal.Notify(shutdownChan, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT)
+	signal.Notify(shutdownChan, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT)
+
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
 
 	sigursChan := make(chan os.Signal, 1)
 	signal.Notify(sigursChan, syscall.SIGUSR1)
@@ -85,77 +228,217 @@ func main() {
 		}
 	}()
 
-	lvl, err := logrus.ParseLevel(os.Getenv("LOG_LEVEL"))
+	// reaping carries on through shutdown, until we exit
+	go daemon.ReapChildren(context.Background())
+
+	formatter, err := logFormatter(os.Getenv("LOG_FORMAT"))
 	if err != nil {
-		lvl = logrus.InfoLevel
+		log.Fatalln(err)
+	}
+	log.SetFormatter(formatter)
+	cfg, err := loadConfig(os.Args[1:], os.Environ())
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	cfg.apply()
+	reloadable, err := readReloadableConfig()
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	reloadable.apply()
+
+	if traceExporter != nil {
+		log.Infof("exporting traces to %s", traceExporter.url)
+		go traceExporter.run()
+	}
+	if buildWebhook != nil {
+		if len(buildWebhook.secret) == 0 {
+			log.Fatalln("WEBHOOK_URL needs WEBHOOK_SECRET, for receivers to check events are the builder's")
+		}
+		log.Infof("sending build events to %s", buildWebhook.url)
+		go buildWebhook.run()
 	}
-	log.SetLevel(lvl)
-	log.SetFormatter(&logrus.TextFormatter{
-		TimestampFormat: "2006-01-02T15:04:05.000000000Z07:00",
-		FullTimestamp:   true,
-	})
 
 	go func() {
-		signal := <-shutdownChan
-		if signal == syscall.SIGINT {
-			log.Info("os.Kill - abruptly terminating...")
+		for range reloadChan {
+			log.Info("received SIGHUP, reloading config")
+			if _, err := reloadConfig(); err != nil {
+				log.Errorf("error reloading config: %v", err)
+			}
 		}
+	}()
+
+	go func() {
+		sig := <-shutdownChan
+		log.Infof("received %s, shutting down", sig)
 		cancel()
+
+		// a second SIGINT or SIGTERM means someone is done waiting for us
+		for sig := range shutdownChan {
+			if sig != syscall.SIGINT && sig != syscall.SIGTERM {
+				continue
+			}
+			log.Warnf("received second %s, abruptly terminating in %s", sig, forceKillGrace)
+			time.Sleep(forceKillGrace)
+			os.Exit(1)
+		}
 	}()
 
 	log.Infof("Build SHA:%s Time:%s", gitSha, buildTime)
 
-	stopDockerdFn, dockerClient, err := runDockerd()
+	if err := validateConfig(); err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	logEffectiveConfig()
+
+	if mockFlyAPI {
+		if _, err := startMockFlyAPI(cfg.Auth.MockFlyAPIFile); err != nil {
+			log.Fatalf("could not start the mock Fly API: %v", err)
+		}
+	}
+	if authorizer, err = newAuthorizer(cfg.Auth); err != nil {
+		log.Fatalln(err)
+	}
+	log.Infof("auth mode: %s", authMode)
+
+	if authAPIFailOpen {
+		log.Warn("AUTH_API_FAILURE_MODE=open, any app can use the builder while the Fly API is unavailable")
+	}
+
+	if authCacheDisabled {
+		log.Warn("auth cache disabled, every request will wait on the Fly API for authorization")
+	}
+
+	if err := checkAPIVersionRange(); err != nil {
+		log.Fatalln(err)
+	}
+
+	registryAuths, err = loadRegistryAuth()
 	if err != nil {
 		log.Fatalln(err)
 	}
+	if registryAuths != nil {
+		log.Infof("injecting registry credentials for %d registries into build and push requests", len(registryAuths))
+	}
 
-	tryPrune(context.Background(), dockerClient)
+	if msg := os.Getenv("UNAUTHORIZED_MESSAGE"); msg != "" {
+		tmpl, err := template.New("unauthorized").Parse(msg)
+		if err != nil {
+			log.Fatalf("invalid UNAUTHORIZED_MESSAGE: %v", err)
+		}
+		unauthorizedMessage = tmpl
+	}
 
-	keepAlive := make(chan struct{})
-	go watchDocker(ctx, dockerClient, keepAlive)
+	if (cfg.Server.TLSCertFile == "") != (cfg.Server.TLSKeyFile == "") {
+		log.Fatalln("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if cfg.Server.TLSClientCAFile != "" && cfg.Server.TLSCertFile == "" {
+		log.Fatalln("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	var serverTLS *server.TLSFiles
+	if cfg.Server.TLSCertFile != "" {
+		serverTLS, err = server.NewTLSFiles(cfg.Server.TLSCertFile, cfg.Server.TLSKeyFile, cfg.Server.TLSClientCAFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go serverTLS.Watch(ctx, cfg.Server.TLSReloadInterval)
+		if cfg.Server.TLSClientCAFile != "" {
+			log.Info("TLS clients need a certificate signed by TLS_CLIENT_CA_FILE")
+		}
+	}
 
-	httpMux := http.NewServeMux()
+	dockerTarget, err = parseDockerHost(dockerHost)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	dockerClient, err := newDockerClient(dockerTarget)
+	if err != nil {
+		log.Fatalf("failed to setup docker client: %v", err)
+	}
 
-	httpMux.Handle("/", wrapCommonMiddlewares(dockerProxy()))
-	httpMux.Handle("/flyio/v1/prune", wrapCommonMiddlewares(pruneHandler(dockerClient)))
-	httpMux.Handle("/flyio/v1/extendDeadline", wrapCommonMiddlewares((extendDeadline())))
-	httpMux.Handle("/flyio/v1/buildOverlaybdImage", wrapCommonMiddlewares(overlaybdImageHandler()))
-	httpMux.Handle("/flyio/v1/settings", wrapCommonMiddlewares(settingsHandler()))
+	if orgIsolation {
+		builderOwner = newOrgOwner(filepath.Join(dataDir, "rchab-org"), func(ctx context.Context) error {
+			return wipeDocker(ctx, dockerClient)
+		})
+	}
 
-	httpServer := &http.Server{
-		Addr:    ":8080",
-		Handler: httpMux,
-		BaseContext: func(_ net.Listener) context.Context {
-			return ctx
-		},
+	auditLog, err = newAuditLogger(os.Getenv("AUDIT_LOG_FILE"), os.Getenv("AUDIT_LOG_URL"), os.Getenv("AUDIT_LOG_TOKEN"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if auditLog != nil {
+		go auditLog.run()
+	}
+
+	clearBuildContextSpool()
 
-		// keep these as high as possible. shorter read/write timeouts can cause push operations
-		// for large images to hang midway with the error -> context.Cancelled.
-		ReadTimeout:  15 * time.Minute,
-		WriteTimeout: 15 * time.Minute,
+	httpMux := newAPIMux(dockerClient)
+
+	// admin routes share the main listener unless ADMIN_ADDR moves them to their own
+	adminMux := httpMux
+	if cfg.Server.AdminAddr != "" {
+		adminMux = http.NewServeMux()
 	}
+	registerAdminRoutes(adminMux)
+
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", metricsHandler())
+
+	// requests get a context of their own, so shutting down lets in-flight
+	// builds drain instead of cancelling them along with ctx
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	// no server wide read or write timeout, those would cut off long builds
+	// and pushes of large images midway, see requestDeadlines
+	httpServer := applyServerLimits(&http.Server{
+		Addr:    server.JoinListenAddrs(cfg.Server.ListenAddrs),
+		Handler: requestDeadlines(cfg.Server, httpMux),
+		BaseContext: func(_ net.Listener) context.Context {
+			return requestCtx
+		},
+	}, cfg.Server)
+	httpServer.Protocols = serverProtocols(!cfg.Server.NoH2C)
 	httpServer.RegisterOnShutdown(cancel)
+	if serverTLS != nil {
+		httpServer.TLSConfig = serverTLS.ServerConfig()
+	}
+	if err := server.ServeListeners(httpServer, cfg.Server.ListenAddrs); err != nil {
+		log.Fatalln(err)
+	}
 
-	go func() {
-		log.Infof("Listening on %s", httpServer.Addr)
-		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
-			log.Fatalf("failed to listenAndServe on %s: %v", httpServer.Addr, err)
+	var buildkitListener net.Listener
+	if cfg.Server.BuildkitAddr != "" {
+		if serverTLS == nil || cfg.Server.TLSClientCAFile == "" {
+			log.Fatalln("BUILDKIT_ADDR needs TLS_CERT_FILE, TLS_KEY_FILE and TLS_CLIENT_CA_FILE, buildkit clients authenticate with certificates")
 		}
-	}()
+		if builderOwner != nil {
+			log.Fatalln("BUILDKIT_ADDR can't be used with ORG_ISOLATION, certificates don't say which organization a client is in")
+		}
+		l, err := net.Listen("tcp", cfg.Server.BuildkitAddr)
+		if err != nil {
+			log.Fatalf("could not listen on %s: %v", cfg.Server.BuildkitAddr, err)
+		}
+		buildkitListener = tls.NewListener(l, serverTLS.ServerConfig())
+		log.Infof("Listening for buildkit clients on %s", cfg.Server.BuildkitAddr)
+		dial := dockerdBuildkitDialer(dockerTarget)
+		if buildkitdOnly {
+			dial = dialBuildkitd
+		}
+		go serveBuildkit(requestCtx, buildkitListener, dial)
+	}
 
-	httpServer2 := &http.Server{
+	httpServer2 := applyServerLimits(&http.Server{
 		Addr:    ":2375",
-		Handler: dockerProxy(),
+		Handler: requestDeadlines(cfg.Server, dockerProxy()),
 		BaseContext: func(_ net.Listener) context.Context {
-			return ctx
+			return requestCtx
 		},
-
-		// keep these as high as possible. shorter read/write timeouts can cause push operations
-		// for large images to hang midway with the error -> context.Cancelled.
-		ReadTimeout:  15 * time.Minute,
-		WriteTimeout: 15 * time.Minute,
-	}
+	}, cfg.Server)
+	httpServer2.Protocols = serverProtocols(!cfg.Server.NoH2C)
 	httpServer2.RegisterOnShutdown(cancel)
 
 	go func() {
@@ -165,54 +448,464 @@ func main() {
 		}
 	}()
 
+	var adminServer *http.Server
+	if cfg.Server.AdminAddr != "" {
+		adminServer = applyServerLimits(&http.Server{
+			Addr:    cfg.Server.AdminAddr,
+			Handler: adminMux,
+			BaseContext: func(_ net.Listener) context.Context {
+				return requestCtx
+			},
+			ReadTimeout:  time.Minute,
+			WriteTimeout: time.Minute,
+		}, cfg.Server)
+
+		go func() {
+			log.Infof("Listening for admin requests on %s", adminServer.Addr)
+			if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatalf("failed to listenAndServe on %s: %v", adminServer.Addr, err)
+			}
+		}()
+	}
+
+	var metricsServer *http.Server
+	// serves /metrics without auth, keep it off the public ports.
+	// dockerd's own metrics are on 9323.
+	if cfg.Server.MetricsAddr != "" {
+		metricsServer = applyServerLimits(&http.Server{
+			Addr:         cfg.Server.MetricsAddr,
+			Handler:      metricsMux,
+			ReadTimeout:  time.Minute,
+			WriteTimeout: time.Minute,
+		}, cfg.Server)
+
+		go func() {
+			log.Infof("Listening for metrics requests on %s", metricsServer.Addr)
+			if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatalf("failed to listenAndServe on %s: %v", metricsServer.Addr, err)
+			}
+		}()
+	}
+
+	var debugServer *http.Server
+	// serves pprof and expvar without auth, keep it off the public ports
+	if cfg.Server.DebugAddr != "" {
+		debugServer = applyServerLimits(&http.Server{
+			Addr:        cfg.Server.DebugAddr,
+			Handler:     debugHandler(),
+			ReadTimeout: time.Minute,
+			// long enough for CPU profiles and execution traces
+			WriteTimeout: 10 * time.Minute,
+		}, cfg.Server)
+
+		go func() {
+			log.Infof("Listening for debug requests on %s", debugServer.Addr)
+			if err := debugServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatalf("failed to listenAndServe on %s: %v", debugServer.Addr, err)
+			}
+		}()
+	}
+
+	if usageReportURL != "" {
+		log.Infof("reporting usage to %s every %s", usageReportURL, usageReportInterval)
+		go reportUsage(ctx, usageReportInterval)
+	}
+
+	stopRegistryCacheFn := func() {}
+	if registryCacheEnabled && !noDockerd && !buildkitdOnly {
+		stopRegistryCacheFn, err = startRegistryCache(ctx)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if len(binfmtPlatforms) > 0 && !noDockerd {
+		supported, err := installBinfmt(binfmtPlatforms)
+		if err != nil {
+			// native builds still work
+			log.Errorf("cross-platform builds unavailable: %v", err)
+		} else {
+			log.Infof("installed emulators, builds can target %s", strings.Join(supported, ", "))
+		}
+	}
+
+	buildCache, err := remoteCacheFromEnv()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if buildCache != nil && builderOwner != nil {
+		log.Fatalln("REMOTE_CACHE_BUCKET can't be used with ORG_ISOLATION, the cache would be handed to the next builder whatever its organization")
+	}
+	if buildCache != nil && os.Getenv("FLY_APP_NAME") != "" {
+		if stop := max(drainTimeout, hijackDrainTimeout) + cfg.Dockerd.StopTimeout + buildCache.timeout; stop > flyMaxKillTimeout {
+			log.Fatalf("DRAIN_TIMEOUT, DOCKERD_STOP_TIMEOUT and REMOTE_CACHE_TIMEOUT add up to %s, longer than the %s Fly gives a machine to stop", stop, flyMaxKillTimeout)
+		}
+	}
+	if buildCache != nil && !noDockerd {
+		restoreCtx, cancelRestore := context.WithTimeout(ctx, buildCache.timeout)
+		start := time.Now()
+		n, err := buildCache.restore(restoreCtx)
+		cancelRestore()
+		switch {
+		case errors.Is(err, errObjectNotFound):
+			log.Infof("no saved cache at %s yet, starting cold", buildCache.key)
+		case err != nil:
+			log.Errorf("could not restore the saved cache, starting cold: %v", err)
+		case n > 0:
+			log.Infof("restored %.2fGB of cache from %s in %s", float64(n)/float64(gb), buildCache.key, time.Since(start).Round(time.Second))
+		}
+	}
+
+	go resolveBuilderOrg(ctx)
+
+	// the listeners are already up, answering 503 until dockerd is ready
+	var stopDockerdFn func() error
+	if buildkitdOnly {
+		stopDockerdFn, err = runBuildkitd(cfg.Dockerd, cancel)
+	} else {
+		stopDockerdFn, err = runDockerd(cfg.Dockerd, dockerClient, cancel)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if !buildkitdOnly {
+		tryPrune(context.Background(), dockerClient)
+	}
+	checkDisk()
+	go monitorDisk(ctx, diskCheckInterval)
+	go monitorPressure(ctx, pressureCheckInterval)
+	go revalidateAuthCache(ctx, authRevalidateInterval)
+	dockerReady.Store(true)
+	log.Info("ready, accepting builds")
+
+	// the rest looks after dockerd, buildkitd handles its own cache GC
+	if !buildkitdOnly {
+		if images := splitList(os.Getenv("PREPULL_IMAGES")); len(images) > 0 {
+			go prepullImages(ctx, dockerClient, images)
+		}
+
+		go watchDocker(ctx, dockerClient, keepAlive)
+
+		if pruneInterval > 0 {
+			go schedulePrunes(ctx, dockerClient, pruneInterval)
+		}
+	}
+
 	go func() {
+		// the idle window starts once builds can actually run
+		resetJobDeadline(maxIdleDuration.Get())
+
+		var lifetimeC, drainCheckC, drainGraceC <-chan time.Time
+		if maxLifetime > 0 {
+			lifetimeC = time.After(maxLifetime)
+		}
+		// startDraining turns new builds away and shuts down once in-flight
+		// requests finish, or MAX_LIFETIME_GRACE after
+		var drainCheck *time.Ticker
+		defer func() {
+			if drainCheck != nil {
+				drainCheck.Stop()
+			}
+		}()
+		startDraining := func() {
+			draining.Store(true)
+			if drainCheck != nil {
+				return
+			}
+			drainCheck = time.NewTicker(time.Second)
+			drainCheckC = drainCheck.C
+			drainGraceC = time.After(maxLifetimeGrace)
+		}
+
 		for {
 			select {
 			case <-keepAlive:
 			case <-jobDeadline.C:
+				if n := pendingRequests.Load(); n > 0 {
+					log.Infof("can't shutdown yet, still have %d pending requests", n)
+					break
+				}
+				if wait := idleShutdownDelay(); wait > 0 {
+					log.Debugf("last request finished recently, postponing idle shutdown by %s", wait.Round(time.Second))
+					resetJobDeadline(wait)
+					continue
+				}
+				log.Info("deadline reached, no active builds, shutting down")
+				cancel()
+				return
+			case <-lifetimeC:
+				log.Infof("max lifetime of %s reached, shutting down once in-flight requests finish", maxLifetime)
+				startDraining()
+				continue
+			case <-drainRequested:
+				log.Info("drain requested, shutting down once in-flight requests finish")
+				startDraining()
+				continue
+			case <-drainCheckC:
 				if pendingRequests.Load() == 0 {
-					log.Info("deadline reached, no active builds, shutting down")
+					log.Info("draining, no active builds, shutting down")
 					cancel()
 					return
 				}
-				log.Infof("can't shutdown yet, still have %d pending requests", pendingRequests.Load())
+				continue
+			case <-drainGraceC:
+				log.Warnf("drain grace of %s over with %d requests still in flight, shutting down", maxLifetimeGrace, pendingRequests.Load())
+				cancel()
+				return
 			}
 			log.Debug("liveness loop caused deadline reset")
-			jobDeadline.Reset(maxIdleDuration)
+			resetJobDeadline(maxIdleDuration.Get())
 		}
 	}()
 
 	<-ctx.Done()
 
 	log.Info("init shutdown")
+	// fail readiness checks and turn new builds away while in-flight ones finish
+	draining.Store(true)
+	stopFollowStreams()
+	if buildkitListener != nil {
+		buildkitListener.Close()
+	}
 
-	gracefullCtx, cancelShutdown := context.WithTimeout(context.Background(), 30*time.Second)
+	gracefullCtx, cancelShutdown := context.WithTimeout(context.Background(), drainTimeout)
 	defer cancelShutdown()
+	hijackedCtx, cancelHijackedWait := context.WithTimeout(context.Background(), hijackDrainTimeout)
+	defer cancelHijackedWait()
+
+	drainDone := make(chan struct{})
+	go logDrainProgress(drainDone, 5*time.Second)
+
+	exitCode := 0
+	servers := []*http.Server{httpServer, httpServer2}
+	if adminServer != nil {
+		servers = append(servers, adminServer)
+	}
+	if metricsServer != nil {
+		servers = append(servers, metricsServer)
+	}
+	if debugServer != nil {
+		servers = append(servers, debugServer)
+	}
+	for _, srv := range servers {
+		log.Infof("shutting down %s", srv.Addr)
+		if err := srv.Shutdown(gracefullCtx); err != nil {
+			log.Warnf("shutdown error on %s: %v", srv.Addr, err)
+			exitCode = 1
+		}
+	}
+	// Shutdown doesn't wait for connections it no longer tracks, interactive
+	// sessions and upgraded build streams would be cut off with dockerd
+	if err := hijackedConns.Wait(hijackedCtx); err != nil {
+		log.Warnf("hijacked connection drain timed out after %s, closing %d connections", hijackDrainTimeout, hijackedConns.Len())
+		cancelRequests()
+	}
+	close(drainDone)
 
-	log.Info("shutting down proxy")
-	if err := httpServer.Shutdown(gracefullCtx); err != nil {
-		log.Warnf("shutdown error on %s: %v\n", httpServer.Addr, err)
-		os.Exit(1)
+	if gracefullCtx.Err() != nil {
+		// a wedged build shouldn't keep dockerd from being stopped cleanly
+		log.Warnf("drain timed out after %s, abandoning %d in-flight docker requests", drainTimeout, pendingRequests.Load())
+		for _, build := range activeBuilds.list() {
+			log.Warnf("abandoning build for app %q running since %s", build.App, build.Time.Format(time.RFC3339))
+		}
+		cancelRequests()
 	}
 
-	log.Info("shutting down proxy2")
-	if err := httpServer2.Shutdown(gracefullCtx); err != nil {
-		log.Warnf("shutdown error on %s: %v\n", httpServer2.Addr, err)
-		os.Exit(1)
+	// the builds that just finished would otherwise go unreported
+	if usageReportURL != "" && len(appsUsage.snapshot()) > 0 {
+		if err := sendUsageReport(context.Background()); err != nil {
+			log.Warnf("could not report usage: %v", err)
+		}
 	}
 
 	log.Info("shutting down docker")
 	stopDockerdFn()
+	stopRegistryCacheFn()
+
+	// dockerd is stopped, the data root won't change under tar
+	if buildCache != nil && !noDockerd && buildsRan.Load() {
+		saveCtx, cancelSave := context.WithTimeout(context.Background(), buildCache.timeout)
+		start := time.Now()
+		if n, err := buildCache.save(saveCtx); err != nil {
+			log.Errorf("could not save the cache to %s: %v", buildCache.key, err)
+		} else {
+			log.Infof("saved %.2fGB of cache to %s in %s", float64(n)/float64(gb), buildCache.key, time.Since(start).Round(time.Second))
+		}
+		cancelSave()
+	}
+
+	daemon.StopOrphans(5 * time.Second)
+
+	if traceExporter != nil {
+		traceExporter.close(5 * time.Second)
+	}
+	if buildWebhook != nil {
+		buildWebhook.close(5 * time.Second)
+	}
+	if auditLog != nil {
+		auditLog.close(5 * time.Second)
+	}
 
 	log.Info("shutdown complete")
-	os.Exit(0)
+	os.Exit(exitCode)
+}
+
+// logDrainProgress reports how many proxied docker requests are still in
+// flight every interval until done is closed.
+func logDrainProgress(done <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			log.Infof("waiting for %d in-flight docker requests to finish, %d on hijacked connections", pendingRequests.Load(), hijackedConns.Len())
+		}
+	}
+}
+
+const logTimestampFormat = "2006-01-02T15:04:05.000000000Z07:00"
+
+// logFormatter picks the log output format from LOG_FORMAT, text by default
+// or json for log pipelines.
+func logFormatter(format string) (logrus.Formatter, error) {
+	switch format {
+	case "", "text":
+		return &logrus.TextFormatter{
+			TimestampFormat: logTimestampFormat,
+			FullTimestamp:   true,
+		}, nil
+	case "json":
+		return &logrus.JSONFormatter{
+			TimestampFormat: logTimestampFormat,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown LOG_FORMAT %q, expected \"text\" or \"json\"", format)
+	}
+}
+
+func getEnvDefault(key, fallback string) string {
+	if val, ok := os.LookupEnv(key); ok && val != "" {
+		return val
+	}
+	return fallback
+}
+
+// splitList splits a comma-separated value, dropping empty entries.
+func splitList(val string) []string {
+	var items []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func getEnvInt(key string, fallback int) int {
+	val, ok := os.LookupEnv(key)
+	if !ok || val == "" {
+		return fallback
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		log.Warnf("invalid %s %q, using default %d: %v", key, val, fallback, err)
+		return fallback
+	}
+	return i
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	val, ok := os.LookupEnv(key)
+	if !ok || val == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		log.Warnf("invalid %s %q, using default %s: %v", key, val, fallback, err)
+		return fallback
+	}
+	return d
+}
+
+func getEnvPositiveDuration(key string, fallback time.Duration) time.Duration {
+	d := getEnvDuration(key, fallback)
+	if d <= 0 {
+		log.Warnf("%s must be positive, using default %s", key, fallback)
+		return fallback
+	}
+	return d
+}
+
+// resetJobDeadline is how the liveness loop moves the idle deadline, keeping
+// track of when it will fire.
+func resetJobDeadline(d time.Duration) {
+	jobDeadline.Reset(d)
+	jobDeadlineAt.Store(time.Now().Add(d).UnixNano())
+}
+
+// resetDeadline asks the liveness loop to push the idle deadline out again. It
+// gives up when ctx is done, e.g. because the loop already shut the builder down.
+func resetDeadline(ctx context.Context) bool {
+	touchFromContext(ctx)
+
+	select {
+	case keepAlive <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// writeDeadline tells the client when the builder will next consider itself
+// idle, after a reset.
+func writeDeadline(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	err := json.NewEncoder(w).Encode(map[string]time.Time{
+		"deadline": time.Now().Add(maxIdleDuration.Get()).UTC(),
+	})
+	if err != nil {
+		log.Warnln("error writing deadline response", err)
+	}
+}
+
+// keepAliveHandler resets the idle deadline like SIGUSR1 does, but at most
+// once per keepAliveMinInterval. Unlike /flyio/v1/extendDeadline it never
+// checks or prunes /data, so orchestrators can call it cheaply ahead of work.
+func keepAliveHandler() http.HandlerFunc {
+	var lastReset atomic.Int64
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		now := time.Now()
+		last := lastReset.Load()
+		if now.Sub(time.Unix(0, last)) < keepAliveMinInterval || !lastReset.CompareAndSwap(last, now.UnixNano()) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(keepAliveMinInterval.Seconds())))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		if !resetDeadline(r.Context()) {
+			writeDockerError(w, http.StatusServiceUnavailable, "builder is shutting down")
+			return
+		}
+		writeDeadline(w)
+	})
 }
 
 func extendDeadline() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Infof("extendDeadline called with user agent: %s", r.UserAgent())
 
-		before, err := disk.GetInfo("/data")
+		before, err := disk.GetInfo(dataDir)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			log.Errorf("failed to check /data: %s", err)
@@ -229,11 +922,13 @@ func extendDeadline() http.Handler {
 				return
 			}
 
-			prune(context.Background(), client, "1m")
+			pruneMu.Lock()
+			prune(context.Background(), client, "1m", "extend_deadline")
+			pruneMu.Unlock()
 		}
 
 		// return error if pruning is not enough.
-		after, err := disk.GetInfo("/data")
+		after, err := disk.GetInfo(dataDir)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			log.Errorf("failed to check /data: %s", err)
@@ -247,56 +942,257 @@ func extendDeadline() http.Handler {
 			return
 		}
 
-		defer func() {
-			jobDeadline.Reset(maxIdleDuration)
-
-		}()
-		w.WriteHeader(http.StatusAccepted)
+		if !resetDeadline(r.Context()) {
+			writeDockerError(w, http.StatusServiceUnavailable, "builder is shutting down")
+			return
+		}
+		writeDeadline(w)
 	})
 }
 
+// newAPIMux routes the builder's API: the Docker API proxied to dockerd, or
+// buildkitd alone with BUILDKITD_ONLY, the /flyio/v1 endpoints and the
+// health checks.
+func newAPIMux(dockerClient *client.Client) *http.ServeMux {
+	httpMux := http.NewServeMux()
+
+	if buildkitdOnly {
+		httpMux.Handle("/", wrapCommonMiddlewares(newBuildkitdProxy(dialBuildkitd)))
+	} else {
+		httpMux.Handle("/", wrapCommonMiddlewares(dockerProxy()))
+	}
+	httpMux.Handle("/flyio/v1/prune", wrapCommonMiddlewares(pruneHandler(dockerClient)))
+	httpMux.Handle("/flyio/v1/extendDeadline", wrapCommonMiddlewares((extendDeadline())))
+	httpMux.Handle("/flyio/v1/buildOverlaybdImage", wrapCommonMiddlewares(overlaybdImageHandler()))
+	httpMux.Handle("/flyio/v1/settings", wrapCommonMiddlewares(settingsHandler()))
+	httpMux.Handle("/flyio/v1/status", wrapCommonMiddlewares(statusHandler(dockerClient)))
+	httpMux.Handle("/flyio/v1/version", wrapCommonMiddlewares(versionHandler(dockerClient)))
+	httpMux.Handle("/keepalive", wrapCommonMiddlewares(keepAliveHandler()))
+
+	pingDockerd := func(ctx context.Context) error {
+		if buildkitdOnly {
+			conn, err := dialBuildkitd(ctx)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}
+		_, err := dockerClient.Ping(ctx)
+		return err
+	}
+	httpMux.Handle("/healthz", healthzHandler(pingDockerd))
+	httpMux.Handle("/readyz", readyzHandler(pingDockerd))
+
+	return httpMux
+}
+
 func dockerProxy() http.Handler {
-	reverseProxy := httputil.NewSingleHostReverseProxy(&url.URL{
-		Scheme: DOCKER_SCHEME,
-		Host:   DOCKER_LISTENER,
-	})
+	return newDockerProxy(dockerTarget)
+}
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		pendingRequests.Add(1)
+func newDockerProxy(target *url.URL) http.Handler {
+	reverseProxy := newReverseProxy(target)
+	upgradeProxy := newUpgradeProxy(target)
+	cancelBuild := newBuildCanceller(target)
+	grpcProxy := newGRPCProxy(dockerdBuildkitDialer(target))
+	// follow streams are flushed as dockerd writes, whatever
+	// PROXY_FLUSH_INTERVAL says
+	followProxy := newReverseProxy(target)
+	followProxy.FlushInterval = -1
 
-		defer func() {
-			pendingRequests.Add(^uint64(0))
-		}()
+	return instrumentRequests(auditRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// watching the builder doesn't keep it running
+		if !isFollowStream(r) {
+			pendingRequests.Add(1)
 
-		allowed := false
-		for _, allowedPath := range allowedPaths {
-			if allowedPath.MatchString(r.URL.Path) {
-				allowed = true
-				break
-			}
+			defer func() {
+				lastRequestDone.Store(time.Now().UnixNano())
+				pendingRequests.Add(^uint64(0))
+			}()
+		}
+
+		// checked after counting the request, so the liveness loop either sees
+		// it pending or it sees draining. Other requests still go through, an
+		// in-flight deploy may need to push what it built.
+		if draining.Load() && startsBuild(r) {
+			writeDockerError(w, http.StatusServiceUnavailable, "builder is draining, retry to get a new one")
+			return
+		}
+		if !waitDockerReady(r.Context(), dockerdReadyWait) {
+			w.Header().Set("Retry-After", "2")
+			writeDockerError(w, http.StatusServiceUnavailable, "builder starting, retry shortly")
+			return
+		}
+
+		// gRPC calls reach buildkit just like a /grpc upgrade does
+		policyPath := r.URL.Path
+		if isGRPCRequest(r) {
+			policyPath = "/grpc"
 		}
-		if !allowed {
-			log.Warnf("Invalid path path=%s agent=%q", r.URL, r.UserAgent())
-			if !noFilter {
-				http.Error(w, `{"message":"page not found"}`, http.StatusNotFound)
+		if !pathAllowed(r, policyPath) {
+			requestLogger(r.Context()).Warnf("denied path path=%s agent=%q", r.URL.Path, r.UserAgent())
+			writeDockerError(w, http.StatusForbidden, fmt.Sprintf("%s %s is not allowed on this builder", r.Method, r.URL.Path))
+			return
+		}
+
+		if !apiVersionAllowed(w, r) {
+			return
+		}
+		if !pushTargetAllowed(w, r) {
+			return
+		}
+		if !rateLimitAllowed(w, r) {
+			return
+		}
+		if !pressureAllowed(w, r) {
+			return
+		}
+		if !limitRequestBody(w, r) {
+			return
+		}
+
+		if !claimBuilder(w, r) {
+			return
+		}
+		if startsBuild(r) {
+			buildsRan.Store(true)
+		}
+
+		touchFromContext(r.Context())
+		defer touchFromContext(r.Context())
+
+		injectRegistryAuth(r)
+
+		if grpcPath.MatchString(r.URL.Path) && proxy.IsUpgrade(r) {
+			release, err := acquireBuild(r)
+			if err != nil {
+				refuseBuild(w, r, err)
 				return
 			}
+			defer release()
+			r, stop := limitBuildTime(r)
+			defer stop()
+			upgradeProxy.ServeHTTP(w, r)
+			return
+		}
+		if proxy.IsUpgrade(r) {
+			upgradeProxy.ServeHTTP(w, r)
+			// the client is gone along with its buildkit session, so are
+			// the builds still using it
+			if session := r.Header.Get("X-Docker-Expose-Session-Uuid"); session != "" && sessionPath.MatchString(r.URL.Path) {
+				for _, id := range activeBuilds.bySession(session) {
+					cancelBuild(r.Context(), id)
+				}
+			}
+			return
 		}
 
-		reverseProxy.ServeHTTP(w, r)
-	})
-}
+		if isGRPCRequest(r) {
+			serveGRPC(grpcProxy, w, r)
+			return
+		}
 
-func pruneHandler(client *client.Client) http.HandlerFunc {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		until := strings.TrimSpace(r.URL.Query().Get("since"))
-		if until == "" {
-			until = "1s"
+		if imagePushPath.MatchString(r.URL.Path) || imagePullPath.MatchString(r.URL.Path) {
+			serveTransfer(reverseProxy, w, r)
+			return
+		}
+		if isFollowStream(r) {
+			serveFollowStream(followProxy, w, r)
+			return
+		}
+		if !buildPath.MatchString(r.URL.Path) {
+			reverseProxy.ServeHTTP(w, r)
+			return
 		}
 
-		prune(r.Context(), client, until)
-		w.WriteHeader(http.StatusOK)
-	})
+		if di, low := diskLow(); low {
+			metricBuildsRefused.inc("disk")
+			requestLogger(r.Context()).Warnf("refused build, %d bytes free on /data", di.Free)
+			writeDockerError(w, http.StatusInsufficientStorage, fmt.Sprintf("not enough disk space on the builder (%.2fGB free), retry once it has been pruned", float64(di.Free)/float64(gb)))
+			return
+		}
+
+		cleanup, ok := spoolBuildContext(w, r)
+		defer cleanup()
+		if !ok {
+			return
+		}
+
+		release, err := acquireBuild(r)
+		if err != nil {
+			refuseBuild(w, r, err)
+			return
+		}
+		defer release()
+
+		serveBuild(reverseProxy, cancelBuild, w, r)
+	})))
+}
+
+// dockerTransport returns the URL and transport to reach dockerd at target
+// over HTTP, tracing requests and dials.
+func dockerTransport(target *url.URL) (*url.URL, http.RoundTripper) {
+	dial := dockerDialer(target)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dial(ctx)
+	}
+	switch target.Scheme {
+	case "unix", "ssh":
+		transport.Proxy = nil
+		target = &url.URL{Scheme: "http", Host: "docker"}
+	case "tcp":
+		target = &url.URL{Scheme: "http", Host: target.Host}
+	}
+	return target, tracedTransport{transport}
+}
+
+// newReverseProxy returns a proxy to dockerd. Upstream requests share the
+// incoming request's context, so a client hanging up (e.g. Ctrl-C on
+// `docker build`) also tears down the dockerd side.
+//
+// target is a DOCKER_HOST style address, see parseDockerHost.
+func newReverseProxy(target *url.URL) *httputil.ReverseProxy {
+	target, transport := dockerTransport(target)
+	reverseProxy := httputil.NewSingleHostReverseProxy(target)
+	reverseProxy.Transport = transport
+	// build progress, logs -f and events are long lived streams, the client
+	// should see each message as dockerd sends it
+	reverseProxy.FlushInterval = proxyFlushInterval
+	reverseProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		// the context is also cancelled when the builder shuts down under a
+		// client that is still connected, so always tell it what happened
+		if errors.Is(context.Cause(r.Context()), errBuildTimeout) {
+			writeDockerError(w, http.StatusGatewayTimeout, fmt.Sprintf("build cancelled after BUILD_TIMEOUT of %s", buildTimeout))
+			return
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			requestLogger(r.Context()).Warnf("cut off request body over %d bytes path=%s", tooLarge.Limit, r.URL.Path)
+			writeDockerError(w, http.StatusRequestEntityTooLarge, bodyTooLargeMessage(r, tooLarge.Limit))
+			return
+		}
+		if errors.Is(err, context.Canceled) {
+			requestLogger(r.Context()).Debugf("request cancelled before dockerd answered path=%s", r.URL.Path)
+			writeDockerError(w, http.StatusServiceUnavailable, "request was cancelled before the Docker daemon answered")
+			return
+		}
+		// dockerd dying under the request, rather than never being reached.
+		// When it isn't listening any more, its exit is already recorded.
+		wait := daemonExitWait
+		if dockerdDown(err) {
+			wait = 0
+		}
+		if exit := daemonExitSince(time.Now().Add(-daemonExitWait), wait); exit != nil {
+			requestLogger(r.Context()).Errorf("error proxying to dockerd path=%s, %s: %v", r.URL.Path, exit, err)
+			w.Header().Set("Retry-After", "5")
+			writeDockerError(w, http.StatusServiceUnavailable, exit.Message())
+			return
+		}
+		requestLogger(r.Context()).Errorf("error proxying to dockerd path=%s: %v", r.URL.Path, err)
+		writeDockerError(w, http.StatusBadGateway, "could not reach the Docker daemon on the builder")
+	}
+	return reverseProxy
 }
 
 func settingsHandler() http.HandlerFunc {
@@ -323,11 +1219,12 @@ func upgradeToHTTPs(h http.Handler) http.Handler {
 }
 
 func wrapCommonMiddlewares(h http.Handler) http.Handler {
-	return handlers.LoggingHandler(
-		log.Writer(),
-		upgradeToHTTPs(
-			authRequest(
-				h,
+	return accessLog(
+		corsRequest(
+			upgradeToHTTPs(
+				authRequest(
+					h,
+				),
 			),
 		),
 	)
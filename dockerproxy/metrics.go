@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+)
+
+// A tiny registry writing the Prometheus text format, which is all we need
+// to be scraped.
+
+var (
+	metricRequests        = newCounterVec("rchab_requests_total", "Proxied Docker API requests.", "path", "code")
+	metricRequestDuration = newHistogramVec("rchab_request_duration_seconds", "Duration of proxied Docker API requests.", []float64{.01, .05, .1, .5, 1, 5, 30, 120, 600}, "path")
+	metricAuthCache       = newCounterVec("rchab_auth_cache_total", "Auth cache lookups.", "result")
+	metricAuthFailures    = newCounterVec("rchab_auth_failures_total", "Denied requests by reason.", "reason")
+	metricAuthRevocations = newCounterVec("rchab_auth_revocations_total", "Cached approvals dropped because revalidation found the token no longer authorized.")
+	metricAuthorizedOrgs  = newCounterVec("rchab_auth_authorized_total", "Authorizations from the Fly API by the app's organization.", "org")
+	metricBuildDuration   = newHistogramVec("rchab_build_duration_seconds", "Duration of builds.", []float64{10, 30, 60, 120, 300, 600, 1200, 1800, 3600}, "status")
+	metricDockerdRestarts = newCounterVec("rchab_dockerd_restarts_total", "Times dockerd was restarted after exiting.")
+	metricDaemonExits     = newCounterVec("rchab_daemon_exits_total", "Unexpected exits of dockerd or buildkitd, by daemon and reason: oom, signal or exit.", "daemon", "reason")
+	metricPrunes          = newCounterVec("rchab_prunes_total", "Prunes of images, volumes and build cache by what triggered them.", "trigger")
+	metricPrunedBytes     = newCounterVec("rchab_pruned_bytes_total", "Disk space reclaimed by pruning.")
+	metricRateLimited     = newCounterVec("rchab_rate_limited_total", "Requests refused for being over a rate limit, by operation.", "operation")
+	metricBuildsRefused   = newCounterVec("rchab_builds_refused_total", "Builds refused for a lack of resources, by reason: disk or pressure.", "reason")
+
+	allMetrics = []metric{
+		metricRequests,
+		metricRequestDuration,
+		metricAuthCache,
+		metricAuthFailures,
+		metricAuthRevocations,
+		metricAuthorizedOrgs,
+		metricBuildDuration,
+		metricDockerdRestarts,
+		metricDaemonExits,
+		metricPrunes,
+		metricPrunedBytes,
+		metricRateLimited,
+		metricBuildsRefused,
+		&gaugeFunc{"rchab_active_builds", "Builds in flight.", func() float64 { return float64(len(activeBuilds.list())) }},
+		&gaugeFunc{"rchab_queued_builds", "Builds waiting for MAX_CONCURRENT_BUILDS.", func() float64 { return float64(buildSlots.queueDepth()) }},
+		&gaugeFunc{"rchab_pending_requests", "Docker API requests in flight.", func() float64 { return float64(pendingRequests.Load()) }},
+		&gaugeFunc{"rchab_disk_total_bytes", "Size of /data.", func() float64 { di, _ := diskLow(); return float64(di.Total) }},
+		&gaugeFunc{"rchab_disk_free_bytes", "Free space on /data.", func() float64 { di, _ := diskLow(); return float64(di.Free) }},
+		&gaugeFunc{"rchab_memory_pressure_percent", "Share of the last 10s tasks stalled on memory, when MEMORY_PRESSURE_MAX or CPU_PRESSURE_MAX is set.", func() float64 { return lastPressureInfo().Memory }},
+		&gaugeFunc{"rchab_cpu_pressure_percent", "Share of the last 10s tasks stalled on CPU, when MEMORY_PRESSURE_MAX or CPU_PRESSURE_MAX is set.", func() float64 { return lastPressureInfo().CPU }},
+	}
+)
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[formatLabels(c.labels, labelValues)] += v
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, labels := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labels, formatFloat(c.values[labels]))
+	}
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := formatLabels(h.labels, labelValues)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", formatFloat(le)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, s.count)
+	}
+}
+
+type gaugeFunc struct {
+	name, help string
+	value      func() float64
+}
+
+func (g *gaugeFunc) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.value()))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		var val string
+		if i < len(values) {
+			val = values[i]
+		}
+		pairs[i] = name + `="` + labelEscaper.Replace(val) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func withLabel(labels, name, value string) string {
+	pair := name + `="` + value + `"`
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metricsRoutes are the routes requests are counted and traced under: the
+// Docker API the builder serves, its own endpoints and buildkit's gRPC
+// calls. {name} stands for an image name, which can have slashes, or a
+// container or exec ID. The first match wins.
+var metricsRoutes = compileMetricsRoutes(
+	"/_ping", "/version", "/info", "/events", "/auth", "/system/df",
+	"/build", "/build/prune", "/build/cancel", "/session", "/grpc",
+	"/images/json", "/images/create", "/images/load", "/images/get", "/images/search", "/images/prune",
+	"/images/{name}/json", "/images/{name}/history", "/images/{name}/push", "/images/{name}/tag", "/images/{name}/get", "/images/{name}",
+	"/distribution/{name}/json",
+	"/containers/json", "/containers/create", "/containers/prune",
+	"/containers/{name}/json", "/containers/{name}/wait", "/containers/{name}/logs", "/containers/{name}/start",
+	"/containers/{name}/stop", "/containers/{name}/kill", "/containers/{name}/attach", "/containers/{name}/resize",
+	"/containers/{name}/exec", "/containers/{name}/archive", "/containers/{name}",
+	"/exec/{name}/start", "/exec/{name}/resize", "/exec/{name}/json",
+	"/flyio/v1/prune", "/flyio/v1/extendDeadline", "/flyio/v1/buildOverlaybdImage", "/flyio/v1/settings",
+	"/flyio/v1/status", "/flyio/v1/drain", "/flyio/v1/version", "/flyio/v1/flushAuthCache",
+	"/keepalive", "/healthz", "/readyz",
+	"/moby.buildkit.v1.Control/Solve", "/moby.buildkit.v1.Control/Status", "/moby.buildkit.v1.Control/Session",
+	"/moby.buildkit.v1.Control/DiskUsage", "/moby.buildkit.v1.Control/Prune", "/moby.buildkit.v1.Control/ListWorkers",
+	"/moby.buildkit.v1.Control/Info", "/moby.buildkit.v1.Control/ListenBuildHistory", "/moby.buildkit.v1.Control/UpdateBuildHistory",
+)
+
+// metricsOtherRoute is what requests for any other path are counted under,
+// so made up paths can't each become a time series.
+const metricsOtherRoute = "other"
+
+type metricsRoute struct {
+	route string
+	path  *regexp.Regexp
+}
+
+func compileMetricsRoutes(routes ...string) []metricsRoute {
+	compiled := make([]metricsRoute, len(routes))
+	for i, route := range routes {
+		name := "[^/]+"
+		if strings.HasPrefix(route, "/images/") || strings.HasPrefix(route, "/distribution/") {
+			name = ".+"
+		}
+		pattern := strings.ReplaceAll(regexp.QuoteMeta(route), regexp.QuoteMeta("{name}"), name)
+		compiled[i] = metricsRoute{route: route, path: regexp.MustCompile("^" + pattern + "$")}
+	}
+	return compiled
+}
+
+// metricsPath reduces a path to its route in metricsRoutes, so image names
+// and container IDs don't each become a time series:
+// /v1.41/images/registry.fly.io/app/push becomes /images/{name}/push. Paths
+// that aren't routes are metricsOtherRoute.
+func metricsPath(path string) string {
+	path = "/" + strings.TrimPrefix(apiVersionPrefix.ReplaceAllString(path, ""), "/")
+	for _, r := range metricsRoutes {
+		if r.path.MatchString(path) {
+			return r.route
+		}
+	}
+	return metricsOtherRoute
+}
+
+// instrumentRequests counts and times every proxied Docker API request.
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := httpsnoop.CaptureMetrics(next, w, r)
+		path := metricsPath(r.URL.Path)
+		metricRequests.inc(path, strconv.Itoa(m.Code))
+		metricRequestDuration.observe(m.Duration.Seconds(), path)
+	})
+}
+
+func metricsHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.WriteHeader(http.StatusOK)
+		for _, m := range allMetrics {
+			m.writeTo(w)
+		}
+	})
+}
+
+// observeBuild records a finished build in the build metrics.
+func observeBuild(duration time.Duration, status string) {
+	metricBuildDuration.observe(duration.Seconds(), status)
+}
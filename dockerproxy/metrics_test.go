@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsPath(t *testing.T) {
+	tests := map[string]string{
+		"/_ping":                                 "/_ping",
+		"/v1.41/build":                           "/build",
+		"/v1.41/images/create":                   "/images/create",
+		"/v1.41/images/ubuntu/json":              "/images/{name}/json",
+		"/v1.41/images/registry.fly.io/app/push": "/images/{name}/push",
+		"/v1.41/containers/0123456789ab":         "/containers/{name}",
+		"/v1.41/containers/0123456789ab/wait":    "/containers/{name}/wait",
+		"/v1.41/images/alpine":                   "/images/{name}",
+		"/v1.41/containers/web":                  "/containers/{name}",
+		"/v1.41/containers/json":                 "/containers/json",
+		"/v1.41/exec/abc/start":                  "/exec/{name}/start",
+		"/flyio/v1/status":                       "/flyio/v1/status",
+		"/moby.buildkit.v1.Control/Solve":        "/moby.buildkit.v1.Control/Solve",
+		"/v1.41/plugins":                         "other",
+		"/v1.41/containers/abc/def/ghi":          "other",
+		"/wp-login.php":                          "other",
+		"/v1.41/secrets/abc_def":                 "other",
+	}
+	for path, want := range tests {
+		if got := metricsPath(path); got != want {
+			t.Errorf("metricsPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestCounterVec(t *testing.T) {
+	c := newCounterVec("test_total", "Test counter.", "path", "code")
+	c.inc("/build", "200")
+	c.inc("/build", "200")
+	c.inc(`/a"b`, "500")
+
+	var b strings.Builder
+	c.writeTo(&b)
+	want := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{path="/a\"b",code="500"} 1
+test_total{path="/build",code="200"} 2
+`
+	if b.String() != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := newHistogramVec("test_seconds", "Test histogram.", []float64{1, 10}, "status")
+	h.observe(0.5, "ok")
+	h.observe(5, "ok")
+	h.observe(50, "ok")
+
+	var b strings.Builder
+	h.writeTo(&b)
+	for _, line := range []string{
+		`test_seconds_bucket{status="ok",le="1"} 1`,
+		`test_seconds_bucket{status="ok",le="10"} 2`,
+		`test_seconds_bucket{status="ok",le="+Inf"} 3`,
+		`test_seconds_sum{status="ok"} 55.5`,
+		`test_seconds_count{status="ok"} 3`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("expected %q in output:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("expected a text/plain content type, but got %q", ct)
+	}
+	for _, name := range []string{"rchab_requests_total", "rchab_active_builds", "rchab_pending_requests", "rchab_dockerd_restarts_total 0"} {
+		if !strings.Contains(rec.Body.String(), name) {
+			t.Errorf("expected %s in output", name)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/superfly/rchab/dockerproxy/internal/flymock"
+)
+
+// startMockFlyAPI serves a mock Fly API on a loopback port and points
+// authorization at it, for MOCK_FLY_API=1. Its apps, organizations and
+// tokens come from the JSON file at fixtureFile, or flymock.DefaultFixture
+// when there's none. Everything past the API, the auth cache, retries and
+// organization checks, runs as it would against the real one.
+func startMockFlyAPI(fixtureFile string) (*flymock.Server, error) {
+	builderApp := os.Getenv("FLY_APP_NAME")
+	if builderApp == "" {
+		builderApp = "builder"
+	}
+	fixture := flymock.DefaultFixture(builderApp)
+	if fixtureFile != "" {
+		var err error
+		if fixture, err = flymock.LoadFixture(fixtureFile); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	mock := flymock.New(fixture)
+	go http.Serve(l, mock)
+
+	setFlyAPIURL("http://" + l.Addr().String())
+	log.Warnf("MOCK_FLY_API=1, authorizing against a mock Fly API at %s", flyAPIURL)
+	return mock, nil
+}
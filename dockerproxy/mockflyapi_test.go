@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/superfly/rchab/dockerproxy/internal/auth"
+)
+
+// TestMockFlyAPI runs authorization against the mock Fly API, through the
+// fly-go client for personal access tokens and our own queries for
+// macaroons.
+func TestMockFlyAPI(t *testing.T) {
+	t.Setenv("FLY_APP_NAME", "builder")
+	defer setFlyAPIURL(flyAPIURL)
+	defer func(mode string, c *cache.Cache, retries int, b *circuitBreaker) {
+		authMode, authCache, authAPIRetries, flyAPIBreaker = mode, c, retries, b
+	}(authMode, authCache, authAPIRetries, flyAPIBreaker)
+	authMode = authModeFly
+	authCache = cache.New(time.Minute, time.Minute)
+	authAPIRetries = 0
+	flyAPIBreaker = newCircuitBreaker(100, time.Hour)
+	defer knownBuilderOrg.Store(nil)
+
+	mock, err := startMockFlyAPI("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, app, token string
+		want             auth.DenyReason
+	}{
+		{"app in the builder's org", "my-app", "mock-token", auth.DenyNone},
+		{"app in another org", "other-app", "mock-token", auth.DenyOrgMismatch},
+		{"missing app", "no-such-app", "mock-token", auth.DenyAppNotFound},
+		{"unknown token", "my-app", "wrong-token", auth.DenyBadCredentials},
+		{"API failure", "failing-app", "mock-token", auth.DenyAPIError},
+	}
+	for _, tt := range tests {
+		if _, reason := authorizeRequestWithCache(context.Background(), tt.app, tt.token); reason != tt.want {
+			t.Errorf("%s: expected %s, but got %s", tt.name, tt.want, reason)
+		}
+	}
+
+	lookups := mock.Lookups()
+	if authorized, _ := authorizeRequestWithCache(context.Background(), "my-app", "mock-token"); !authorized {
+		t.Fatal("expected my-app to stay authorized")
+	}
+	if mock.Lookups() != lookups {
+		t.Error("expected the second authorization to come from the cache")
+	}
+}
+
+func TestMockFlyAPIFixtureFile(t *testing.T) {
+	defer setFlyAPIURL(flyAPIURL)
+
+	if _, err := startMockFlyAPI("/nonexistent/fixture.json"); err == nil {
+		t.Error("expected a missing fixture file to be an error")
+	}
+}
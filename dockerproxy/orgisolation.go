@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// errOwnerBusy means another organization still has requests in flight.
+var errOwnerBusy = errors.New("builder is busy with another organization")
+
+// builderOwner is set with ORG_ISOLATION, nil otherwise.
+var builderOwner *orgOwner
+
+// orgOwner gives one organization at a time the builder. When another
+// organization shows up while the builder is idle, dockerd's containers,
+// images, volumes and build cache are wiped before it gets in, so no
+// organization can see or build on another's layers. The owner is kept in a
+// file on the volume, so it survives restarts along with the data.
+type orgOwner struct {
+	path string
+	wipe func(ctx context.Context) error
+
+	mu  sync.Mutex
+	org string
+}
+
+func newOrgOwner(path string, wipe func(ctx context.Context) error) *orgOwner {
+	o := &orgOwner{path: path, wipe: wipe}
+	if b, err := os.ReadFile(path); err == nil {
+		o.org = strings.TrimSpace(string(b))
+	}
+	return o
+}
+
+// claim hands the builder to org. busy reports whether anything besides the
+// calling request is still using it.
+func (o *orgOwner) claim(ctx context.Context, org string, busy func() bool) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.org == org {
+		return nil
+	}
+	if o.org != "" {
+		if busy() {
+			return errOwnerBusy
+		}
+		log.Infof("handing the builder from org %s to org %s, wiping its data", o.org, org)
+		if err := o.wipe(ctx); err != nil {
+			return err
+		}
+	}
+
+	if err := os.WriteFile(o.path, []byte(org+"\n"), 0o600); err != nil {
+		return err
+	}
+	o.org = org
+	return nil
+}
+
+// claimBuilder makes sure the builder belongs to the request's organization
+// before it reaches dockerd. With AUTH_MODE=static there are no
+// organizations to keep apart, so every request passes.
+func claimBuilder(w http.ResponseWriter, r *http.Request) bool {
+	info := requestInfoFromContext(r.Context())
+	if builderOwner == nil || info == nil || authMode != authModeFly {
+		return true
+	}
+	org, ok := appOrgSlugs.Load(info.appName)
+	if !ok {
+		// e.g. let in without asking while the Fly API is down
+		requestLogger(r.Context()).Warnf("org of app %s unknown, refusing it on an isolated builder", info.appName)
+		w.Header().Set("Retry-After", "30")
+		writeDockerError(w, http.StatusServiceUnavailable, "could not determine your organization, retry shortly")
+		return false
+	}
+
+	// the calling request is already counted as pending
+	busy := func() bool { return pendingRequests.Load() > 1 }
+	err := builderOwner.claim(r.Context(), org.(string), busy)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errOwnerBusy):
+		w.Header().Set("Retry-After", "30")
+		writeDockerError(w, http.StatusServiceUnavailable, "builder is busy with another organization, retry shortly or use another builder")
+	default:
+		requestLogger(r.Context()).Errorf("could not hand the builder to org %s: %v", org, err)
+		writeDockerError(w, http.StatusInternalServerError, "could not prepare the builder for your organization")
+	}
+	return false
+}
+
+// wipeDocker removes every container, image and volume, and all build
+// cache. Containers go first, so nothing they use is kept: the builder is
+// idle, so running ones are left over and removed too.
+func wipeDocker(ctx context.Context, dockerClient *client.Client) error {
+	metricPrunes.inc("org_switch")
+	if _, err := dockerClient.ContainersPrune(ctx, filters.NewArgs()); err != nil {
+		return err
+	}
+	running, err := dockerClient.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return err
+	}
+	for _, c := range running {
+		if err := dockerClient.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{Force: true, RemoveVolumes: true}); err != nil {
+			return err
+		}
+	}
+	if _, err := dockerClient.ImagesPrune(ctx, filters.NewArgs(filters.Arg("dangling", "false"))); err != nil {
+		return err
+	}
+	// named volumes too, since API 1.42 only anonymous ones are pruned
+	// without all
+	if _, err := dockerClient.VolumesPrune(ctx, filters.NewArgs(filters.Arg("all", "true"))); err != nil {
+		return err
+	}
+	_, err = dockerClient.BuildCachePrune(ctx, types.BuildCachePruneOptions{All: true})
+	return err
+}
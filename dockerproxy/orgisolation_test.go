@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/client"
+	"github.com/superfly/rchab/dockerproxy/internal/harness"
+)
+
+func TestOrgOwnerClaim(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rchab-org")
+	wipes := 0
+	owner := newOrgOwner(path, func(ctx context.Context) error {
+		wipes++
+		return nil
+	})
+	idle := func() bool { return false }
+	busy := func() bool { return true }
+
+	if err := owner.claim(context.Background(), "acme", busy); err != nil {
+		t.Fatalf("expected the first org to get the builder, but got %v", err)
+	}
+	if err := owner.claim(context.Background(), "acme", busy); err != nil {
+		t.Fatalf("expected the owner to share the builder with itself, but got %v", err)
+	}
+	if err := owner.claim(context.Background(), "other", busy); !errors.Is(err, errOwnerBusy) {
+		t.Fatalf("expected another org to wait while the builder is busy, but got %v", err)
+	}
+	if wipes != 0 {
+		t.Fatalf("expected no wipes yet, but got %d", wipes)
+	}
+	if err := owner.claim(context.Background(), "other", idle); err != nil {
+		t.Fatalf("expected another org to get an idle builder, but got %v", err)
+	}
+	if wipes != 1 {
+		t.Errorf("expected the builder to be wiped for the new org, but got %d wipes", wipes)
+	}
+
+	if b, _ := os.ReadFile(path); string(b) != "other\n" {
+		t.Errorf("expected the owner to be saved, but got %q", b)
+	}
+	if restarted := newOrgOwner(path, nil); restarted.org != "other" {
+		t.Errorf("expected the owner to survive a restart, but got %q", restarted.org)
+	}
+}
+
+func TestWipeDocker(t *testing.T) {
+	var calls []string
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := apiVersionPrefix.ReplaceAllString(r.URL.Path, "/")
+		calls = append(calls, r.Method+" "+path+" "+r.URL.RawQuery)
+		switch {
+		case path == "/containers/json":
+			io.WriteString(w, `[{"Id":"running1","State":"running"}]`)
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			io.WriteString(w, `{}`)
+		}
+	}))
+	dockerClient, err := client.NewClientWithOpts(client.WithHost("unix://" + dockerd.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wipeDocker(context.Background(), dockerClient); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"POST /containers/prune",
+		"GET /containers/json",
+		"DELETE /containers/running1 force=1&v=1",
+		"POST /images/prune",
+		"POST /volumes/prune",
+		"POST /build/prune",
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("expected %d calls to dockerd, but got %q", len(want), calls)
+	}
+	for i, call := range calls {
+		if !strings.HasPrefix(call, want[i]) {
+			t.Errorf("expected call %d to be %q, but got %q", i, want[i], call)
+		}
+	}
+	if volumes, _ := url.QueryUnescape(calls[4]); !strings.Contains(volumes, `"all":{"true":true}`) {
+		t.Errorf("expected named volumes to be pruned too, but got %q", calls[4])
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	otlpBatchSize     = 512
+	otlpFlushInterval = 5 * time.Second
+
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+	spanStatusError  = 2
+)
+
+// traceExporter sends the spans of sampled requests to an OpenTelemetry
+// collector. nil, exporting nothing, unless OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set.
+var traceExporter = newOTLPExporter()
+
+// otlpExporter batches spans and posts them to an OTLP/HTTP endpoint as
+// JSON.
+type otlpExporter struct {
+	*batchSender[otlpSpan]
+
+	url     string
+	headers http.Header
+	service string
+	client  *http.Client
+}
+
+func newOTLPExporter() *otlpExporter {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil
+		}
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+
+	e := &otlpExporter{
+		url:     endpoint,
+		headers: parseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")),
+		service: getEnvDefault("OTEL_SERVICE_NAME", "rchab"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	e.batchSender = newBatchSender("traces", otlpBatchSize, 4*otlpBatchSize, otlpFlushInterval, e.send)
+	return e
+}
+
+// parseOTLPHeaders reads OTEL_EXPORTER_OTLP_HEADERS, key=value pairs
+// separated by commas with URL-encoded values.
+func parseOTLPHeaders(s string) http.Header {
+	headers := http.Header{}
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		if v, err := url.QueryUnescape(strings.TrimSpace(value)); err == nil {
+			value = v
+		}
+		headers.Add(strings.TrimSpace(key), value)
+	}
+	return headers
+}
+
+// exportTrace queues the spans of a finished request, the request's own and
+// its phases', if the client's trace is sampled.
+func exportTrace(info *requestInfo, r *http.Request, start time.Time, status int) {
+	if traceExporter == nil || !info.trace.sampled() {
+		return
+	}
+
+	request := &span{
+		name:     r.Method + " " + metricsPath(r.URL.Path),
+		spanID:   info.trace.spanID,
+		parentID: info.trace.parentID,
+		start:    start,
+		end:      time.Now(),
+		attrs: map[string]any{
+			"http.method":      r.Method,
+			"http.path":        r.URL.Path,
+			"http.status_code": status,
+			"request_id":       info.id,
+			"app":              info.appName,
+		},
+	}
+	if status >= 500 {
+		request.err = http.StatusText(status)
+	}
+	traceExporter.add(info.trace.traceID, request, spanKindServer)
+
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	for _, s := range info.spans {
+		kind := spanKindInternal
+		if s.name == "dockerd.request" || s.name == "dockerd.dial" {
+			kind = spanKindClient
+		}
+		traceExporter.add(info.trace.traceID, s, kind)
+	}
+}
+
+func (e *otlpExporter) add(traceID string, s *span, kind int) {
+	out := otlpSpan{
+		TraceID:      traceID,
+		SpanID:       s.spanID,
+		ParentSpanID: s.parentID,
+		Name:         s.name,
+		Kind:         kind,
+		Start:        strconv.FormatInt(s.start.UnixNano(), 10),
+		End:          strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	keys := make([]string, 0, len(s.attrs))
+	for key := range s.attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		out.Attributes = append(out.Attributes, otlpAttribute(key, s.attrs[key]))
+	}
+	if s.err != "" {
+		out.Status = &otlpStatus{Code: spanStatusError, Message: s.err}
+	}
+
+	if !e.batchSender.add(out) {
+		log.Debugf("trace export queue full, dropping span %s", s.name)
+	}
+}
+
+func (e *otlpExporter) send(spans []otlpSpan) {
+	if err := e.post(spans); err != nil {
+		log.Warnf("could not export %d spans: %v", len(spans), err)
+	}
+}
+
+func (e *otlpExporter) post(spans []otlpSpan) error {
+	body, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			otlpAttribute("service.name", e.service),
+			otlpAttribute("service.version", gitSha),
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/superfly/rchab/dockerproxy"},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, values := range e.headers {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// The OTLP/HTTP JSON encoding of ExportTraceServiceRequest. IDs are hex and
+// 64 bit integers are strings.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID      string         `json:"traceId"`
+	SpanID       string         `json:"spanId"`
+	ParentSpanID string         `json:"parentSpanId,omitempty"`
+	Name         string         `json:"name"`
+	Kind         int            `json:"kind"`
+	Start        string         `json:"startTimeUnixNano"`
+	End          string         `json:"endTimeUnixNano"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	Status       *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func otlpAttribute(key string, value any) otlpKeyValue {
+	switch v := value.(type) {
+	case bool:
+		return otlpKeyValue{key, map[string]any{"boolValue": v}}
+	case int:
+		return otlpKeyValue{key, map[string]any{"intValue": strconv.Itoa(v)}}
+	case int64:
+		return otlpKeyValue{key, map[string]any{"intValue": strconv.FormatInt(v, 10)}}
+	default:
+		return otlpKeyValue{key, map[string]any{"stringValue": fmt.Sprint(v)}}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/superfly/rchab/dockerproxy/internal/harness"
+)
+
+func TestExportTrace(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+
+	var (
+		mu    sync.Mutex
+		spans []otlpSpan
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("unexpected export to %s with headers %v", r.URL.Path, r.Header)
+		}
+		var traces otlpTraces
+		if err := json.NewDecoder(r.Body).Decode(&traces); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range traces.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "Authorization=Bearer%20secret")
+	defer func(e *otlpExporter) { traceExporter = e }(traceExporter)
+	traceExporter = newOTLPExporter()
+	go traceExporter.run()
+
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "OK")
+	}))
+	h := accessLog(newAuthRequest(fakeAuthorizer, newDockerProxy(dockerd)))
+
+	for _, flags := range []string{"01", "00"} {
+		r := httptest.NewRequest(http.MethodGet, "/v1.41/images/json", nil)
+		r.SetBasicAuth("my-app", "good-token")
+		r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-"+flags)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d, but got %d: %s", http.StatusOK, w.Code, w.Body)
+		}
+	}
+	traceExporter.close(5 * time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	byName := map[string]otlpSpan{}
+	for _, s := range spans {
+		if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("expected span %s in the client's trace, but got %s", s.Name, s.TraceID)
+		}
+		byName[s.Name] = s
+	}
+	if len(spans) != 4 {
+		t.Errorf("expected the 4 spans of the sampled request only, but got %+v", spans)
+	}
+
+	request, ok := byName["GET /images/json"]
+	if !ok || request.ParentSpanID != "00f067aa0ba902b7" || request.Kind != spanKindServer {
+		t.Fatalf("expected a server span for the request under the client's, but got %+v", spans)
+	}
+	for name, parent := range map[string]string{
+		"auth":            request.SpanID,
+		"dockerd.request": request.SpanID,
+		"dockerd.dial":    byName["dockerd.request"].SpanID,
+	} {
+		if s, ok := byName[name]; !ok || s.ParentSpanID != parent {
+			t.Errorf("expected a %s span under %s, but got %+v", name, parent, s)
+		}
+	}
+}
+
+func TestParseOTLPHeaders(t *testing.T) {
+	headers := parseOTLPHeaders("api-key=abc%3D%3D, x-tenant = fly,bogus")
+	if got := headers.Get("Api-Key"); got != "abc==" {
+		t.Errorf("expected api-key abc==, but got %q", got)
+	}
+	if got := headers.Get("X-Tenant"); got != "fly" {
+		t.Errorf("expected x-tenant fly, but got %q", got)
+	}
+	if len(headers) != 2 {
+		t.Errorf("expected 2 headers, but got %v", headers)
+	}
+}
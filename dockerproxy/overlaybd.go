@@ -9,6 +9,8 @@ import (
 	"os/exec"
 	"regexp"
 	"strings"
+
+	"github.com/superfly/rchab/dockerproxy/internal/daemon"
 )
 
 const converterBin = "/opt/overlaybd/snapshotter/convertor"
@@ -36,7 +38,7 @@ func overlaybdImageHandler() http.HandlerFunc {
 		var output bytes.Buffer
 		cmd.Stdout = io.MultiWriter(os.Stdout, &output)
 		cmd.Stderr = io.MultiWriter(os.Stderr, &output)
-		if err := cmd.Run(); err != nil {
+		if err := daemon.RunChild(cmd); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write(output.Bytes())
 			return
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/superfly/rchab/dockerproxy/internal/proxy"
+)
+
+// the default allowlist until the config is read, see reloadableConfig
+func init() {
+	p, _ := proxy.NewPathPolicy(false, nil, nil)
+	proxyPolicy.Store(p)
+}
+
+// pathAllowed reports whether the policy lets r through to path. Operators
+// may also run and exec into containers.
+func pathAllowed(r *http.Request, path string) bool {
+	if info := requestInfoFromContext(r.Context()); info != nil && info.operator {
+		return proxyPolicy.Load().AllowedForOperator(path)
+	}
+	return proxyPolicy.Load().Allowed(path)
+}
+
+// loadPathPolicy builds the policy from NO_FILTER, PROXY_ALLOW_PATHS and
+// PROXY_DENY_PATHS, the latter two comma separated regular expressions.
+func loadPathPolicy() (*proxy.PathPolicy, error) {
+	return proxy.NewPathPolicy(noFilter, splitList(os.Getenv("PROXY_ALLOW_PATHS")), splitList(os.Getenv("PROXY_DENY_PATHS")))
+}
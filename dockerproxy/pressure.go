@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// pressureFiles are where the kernel reports how much of the time tasks
+// stall waiting for memory or CPU: the cgroup's, with cgroup v2, otherwise
+// the whole machine's.
+var pressureFiles = map[string][]string{
+	"memory": {"/sys/fs/cgroup/memory.pressure", "/proc/pressure/memory"},
+	"cpu":    {"/sys/fs/cgroup/cpu.pressure", "/proc/pressure/cpu"},
+}
+
+// pressureInfo is the share of the last 10s some task stalled on memory or
+// CPU, in percent.
+type pressureInfo struct {
+	Memory float64
+	CPU    float64
+}
+
+// lastPressure is the most recent pressure seen by monitorPressure.
+var lastPressure atomic.Pointer[pressureInfo]
+
+// monitorPressure reads memory and CPU pressure every interval until ctx is
+// done. It doesn't run when neither has a threshold.
+func monitorPressure(ctx context.Context, interval time.Duration) {
+	if memoryPressureMax <= 0 && cpuPressureMax <= 0 {
+		return
+	}
+	checkPressure()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkPressure()
+		}
+	}
+}
+
+// checkPressure records memory and CPU pressure, logging when the builder
+// starts or stops refusing builds over it.
+func checkPressure() {
+	var p pressureInfo
+	var err error
+	if p.Memory, err = readPressure("memory"); err != nil {
+		log.Errorf("could not read memory pressure: %v", err)
+		return
+	}
+	if p.CPU, err = readPressure("cpu"); err != nil {
+		log.Errorf("could not read CPU pressure: %v", err)
+		return
+	}
+
+	wasHigh := false
+	if prev := lastPressure.Swap(&p); prev != nil {
+		wasHigh = pressureReason(*prev) != ""
+	}
+	switch reason := pressureReason(p); {
+	case reason != "" && !wasHigh:
+		log.Warnf("%s, refusing new builds", reason)
+	case reason == "" && wasHigh:
+		log.Infof("memory pressure %.1f%%, CPU pressure %.1f%%, accepting builds again", p.Memory, p.CPU)
+	}
+}
+
+// readPressure returns the "some avg10" of resource's pressure file.
+func readPressure(resource string) (float64, error) {
+	var lastErr error
+	for _, path := range pressureFiles[resource] {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		s := bufio.NewScanner(bytes.NewReader(b))
+		for s.Scan() {
+			fields := bytes.Fields(s.Bytes())
+			if len(fields) < 2 || string(fields[0]) != "some" {
+				continue
+			}
+			val, ok := bytes.CutPrefix(fields[1], []byte("avg10="))
+			if !ok {
+				break
+			}
+			return strconv.ParseFloat(string(val), 64)
+		}
+		return 0, fmt.Errorf("no avg10 in %s", path)
+	}
+	return 0, lastErr
+}
+
+// pressureReason says why p is too much pressure for new builds, or is empty
+// when it isn't.
+func pressureReason(p pressureInfo) string {
+	switch {
+	case memoryPressureMax > 0 && p.Memory >= memoryPressureMax:
+		return fmt.Sprintf("memory pressure %.1f%% is over MEMORY_PRESSURE_MAX of %.0f%%", p.Memory, memoryPressureMax)
+	case cpuPressureMax > 0 && p.CPU >= cpuPressureMax:
+		return fmt.Sprintf("CPU pressure %.1f%% is over CPU_PRESSURE_MAX of %.0f%%", p.CPU, cpuPressureMax)
+	}
+	return ""
+}
+
+// lastPressureInfo is the last pressure seen, zero before the first check.
+func lastPressureInfo() pressureInfo {
+	if p := lastPressure.Load(); p != nil {
+		return *p
+	}
+	return pressureInfo{}
+}
+
+// pressureHigh reports why the last check found too much pressure for new
+// builds. Builds are let through until the first check.
+func pressureHigh() (string, bool) {
+	p := lastPressure.Load()
+	if p == nil {
+		return "", false
+	}
+	reason := pressureReason(*p)
+	return reason, reason != ""
+}
+
+// pressureAllowed refuses builds with a 429 while the builder is at
+// capacity, so one more build doesn't get dockerd OOM killed. Other requests
+// still go through.
+func pressureAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if !buildPath.MatchString(r.URL.Path) && !grpcPath.MatchString(r.URL.Path) && !solvePath.MatchString(r.URL.Path) {
+		return true
+	}
+	reason, high := pressureHigh()
+	if !high {
+		return true
+	}
+	metricBuildsRefused.inc("pressure")
+	requestLogger(r.Context()).Warnf("refused build, %s", reason)
+	w.Header().Set("Retry-After", "30")
+	writeDockerError(w, http.StatusTooManyRequests, fmt.Sprintf("builder at capacity: %s, retry shortly", reason))
+	return false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/superfly/rchab/dockerproxy/internal/harness"
+)
+
+func TestReadPressure(t *testing.T) {
+	defer func(files map[string][]string) { pressureFiles = files }(pressureFiles)
+	dir := t.TempDir()
+	memory := filepath.Join(dir, "memory")
+	os.WriteFile(memory, []byte("some avg10=42.50 avg60=10.00 avg300=2.00 total=123\nfull avg10=30.00 avg60=5.00 avg300=1.00 total=100\n"), 0o600)
+	// without cgroup v2 the machine's pressure is read
+	pressureFiles = map[string][]string{
+		"memory": {filepath.Join(dir, "missing"), memory},
+		"cpu":    {filepath.Join(dir, "missing")},
+	}
+
+	if p, err := readPressure("memory"); err != nil || p != 42.5 {
+		t.Errorf("expected memory pressure of 42.5, but got %v: %v", p, err)
+	}
+	if _, err := readPressure("cpu"); err == nil {
+		t.Error("expected an error without a CPU pressure file")
+	}
+}
+
+func TestCheckPressure(t *testing.T) {
+	defer func(files map[string][]string, memoryMax float64) {
+		pressureFiles, memoryPressureMax = files, memoryMax
+	}(pressureFiles, memoryPressureMax)
+	defer lastPressure.Store(lastPressure.Load())
+	dir := t.TempDir()
+	memory, cpu := filepath.Join(dir, "memory"), filepath.Join(dir, "cpu")
+	os.WriteFile(cpu, []byte("some avg10=90.00 avg60=0.00 avg300=0.00 total=0\n"), 0o600)
+	pressureFiles = map[string][]string{"memory": {memory}, "cpu": {cpu}}
+	memoryPressureMax = 50
+
+	os.WriteFile(memory, []byte("some avg10=60.00 avg60=0.00 avg300=0.00 total=0\n"), 0o600)
+	checkPressure()
+	if reason, high := pressureHigh(); !high || !strings.Contains(reason, "MEMORY_PRESSURE_MAX") {
+		t.Errorf("expected memory pressure over the maximum, but got %q", reason)
+	}
+
+	// CPU pressure isn't checked without CPU_PRESSURE_MAX
+	os.WriteFile(memory, []byte("some avg10=10.00 avg60=0.00 avg300=0.00 total=0\n"), 0o600)
+	checkPressure()
+	if reason, high := pressureHigh(); high {
+		t.Errorf("expected builds to be accepted again, but got %q", reason)
+	}
+}
+
+func TestRequestPipelineRefusesBuildsUnderPressure(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	defer func(cpuMax float64) { cpuPressureMax = cpuMax }(cpuPressureMax)
+	cpuPressureMax = 80
+	defer lastPressure.Store(lastPressure.Load())
+	lastPressure.Store(&pressureInfo{CPU: 95})
+
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "OK")
+	}))
+	h := accessLog(newAuthRequest(fakeAuthorizer, newDockerProxy(dockerd)))
+
+	for path, want := range map[string]int{
+		"/v1.41/build": http.StatusTooManyRequests,
+		"/grpc":        http.StatusTooManyRequests,
+		"/v1.41/images/registry.fly.io/my-app/push": http.StatusOK,
+		"/_ping": http.StatusOK,
+	} {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r.SetBasicAuth("my-app", "good-token")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("expected %s to get status %d, but got %d: %s", path, want, w.Code, w.Body)
+		}
+		if want == http.StatusTooManyRequests && !strings.Contains(w.Body.String(), "builder at capacity") {
+			t.Errorf("expected %s to be told the builder is at capacity, but got %s", path, w.Body)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDockerProxyBackendDown(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	defer func(d time.Duration) { dockerdDialTimeout = d }(dockerdDialTimeout)
+	dockerdDialTimeout = 200 * time.Millisecond
+
+	// grab a free port and close it again, so nothing is listening there
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	proxy := newDockerProxy(&url.URL{Scheme: "http", Host: addr})
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_ping", nil))
+
+	assertDockerError(t, w, http.StatusBadGateway)
+}
+
+func TestDockerProxyCancelledRequest(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+
+	upstreamStarted := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(upstreamStarted)
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	target, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := newDockerProxy(target)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-upstreamStarted:
+		case <-time.After(5 * time.Second):
+		}
+		cancel()
+	}()
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/_ping", nil).WithContext(ctx))
+
+	assertDockerError(t, w, http.StatusServiceUnavailable)
+}
+
+func TestDockerProxyDraining(t *testing.T) {
+	defer draining.Store(false)
+	draining.Store(true)
+
+	proxy := newDockerProxy(&url.URL{Scheme: "http", Host: "127.0.0.1:0"})
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/build", nil))
+
+	assertDockerError(t, w, http.StatusServiceUnavailable)
+	if n := pendingRequests.Load(); n != 0 {
+		t.Errorf("expected no pending requests, but got %d", n)
+	}
+}
+
+func TestDockerProxyStarting(t *testing.T) {
+	defer func(d time.Duration) { dockerdReadyWait = d }(dockerdReadyWait)
+	dockerdReadyWait = 0
+	proxy := newDockerProxy(&url.URL{Scheme: "http", Host: "127.0.0.1:0"})
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/build", nil))
+
+	assertDockerError(t, w, http.StatusServiceUnavailable)
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+}
+
+func assertDockerError(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+
+	if w.Code != status {
+		t.Errorf("expected status %d, but got %d", status, w.Code)
+	}
+
+	var body map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("expected a JSON error body: %v", err)
+	}
+	if body["message"] == "" {
+		t.Error("expected an error message")
+	}
+}
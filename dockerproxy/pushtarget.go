@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/superfly/rchab/dockerproxy/internal/auth"
+)
+
+var imageTagPath = regexp.MustCompile("^(/v[0-9.]*)?/images/(.+)/tag$")
+
+// pushTargetOrgs caches the organization of apps clients pushed to, keyed
+// like authCache.
+var pushTargetOrgs = cache.New(authCacheTTL.Get(), 10*time.Minute)
+
+// pushTargets returns the registry.fly.io apps a request would push or tag
+// images for.
+func pushTargets(r *http.Request) []string {
+	var images []string
+	switch {
+	case buildPath.MatchString(r.URL.Path):
+		images = r.URL.Query()["t"]
+	case imagePushPath.MatchString(r.URL.Path):
+		images = []string{imagePushPath.FindStringSubmatch(r.URL.Path)[2]}
+	case imageTagPath.MatchString(r.URL.Path):
+		images = []string{r.URL.Query().Get("repo")}
+	}
+
+	var apps []string
+	for _, image := range images {
+		if registryHost(imageRegistry(image)) != flyRegistryHost {
+			continue
+		}
+		repo := strings.TrimPrefix(imageRepository(image), flyRegistryHost+"/")
+		app, _, _ := strings.Cut(repo, "/")
+		apps = append(apps, app)
+	}
+	return apps
+}
+
+// pushTargetAllowed refuses pushes, tags and builds into another app's
+// registry.fly.io repository, unless that app is in the authenticated app's
+// organization or one of ALLOW_ORG_SLUG. The shared dockerd would otherwise
+// let any authorized client overwrite other apps' images.
+func pushTargetAllowed(w http.ResponseWriter, r *http.Request) bool {
+	info := requestInfoFromContext(r.Context())
+	if !enforcePushTargets || authMode != authModeFly || info == nil || info.appName == "" {
+		return true
+	}
+
+	for _, target := range pushTargets(r) {
+		if target == info.appName {
+			continue
+		}
+		allowed, err := sameOrgApp(r.Context(), info.appName, target, info.authToken)
+		if err != nil {
+			requestLogger(r.Context()).Warnf("could not look up push target %s: %v", target, err)
+			writeDockerError(w, http.StatusServiceUnavailable, "could not verify the push target with the Fly API, try again shortly")
+			return false
+		}
+		if !allowed {
+			requestLogger(r.Context()).Warnf("denied push from app %s to registry.fly.io/%s", info.appName, target)
+			writeDockerError(w, http.StatusForbidden, fmt.Sprintf("denied: app %s may not push to %s/%s", info.appName, flyRegistryHost, target))
+			return false
+		}
+	}
+	return true
+}
+
+// sameOrgApp reports whether target is in appName's organization, or one of
+// ALLOW_ORG_SLUG, as seen by authToken.
+func sameOrgApp(ctx context.Context, appName, target, authToken string) (bool, error) {
+	key := authCacheKey(target, authToken)
+	org, ok := pushTargetOrgs.Get(key)
+	if !ok {
+		found, err := fetchAppOrg(ctx, authToken, target)
+		if err != nil && !apiDenyReason(err, auth.DenyAppNotFound).Definitive() {
+			return false, err
+		}
+		if found == nil {
+			// not visible to the client, so not something it may push to
+			return false, nil
+		}
+		org = found.Slug
+		pushTargetOrgs.Set(key, org, cache.DefaultExpiration)
+	}
+
+	if appOrg, ok := appOrgSlugs.Load(appName); ok && appOrg == org {
+		return true, nil
+	}
+	for _, slug := range allowedOrgSlugs.Get() {
+		if slug == org {
+			return true, nil
+		}
+	}
+	return false, nil
+}
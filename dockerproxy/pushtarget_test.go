@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPushTargetAllowed(t *testing.T) {
+	fakeFlyAPI(t, map[string]map[string]string{
+		"Bearer token": {"my-app": "acme", "sibling": "acme", "partner": "friends", "stranger": "other"},
+	})
+	appOrgSlugs.Store("my-app", "acme")
+	defer appOrgSlugs.Delete("my-app")
+	defer allowedOrgSlugs.Set(allowedOrgSlugs.Get())
+	allowedOrgSlugs.Set([]string{"friends"})
+	pushTargetOrgs.Flush()
+
+	cases := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"push to own app", "/v1.41/images/registry.fly.io/my-app/push?tag=1", http.StatusOK},
+		{"push to an app in the same org", "/v1.41/images/registry.fly.io/sibling/push", http.StatusOK},
+		{"push to an app in an allowed org", "/v1.41/images/registry.fly.io/partner/push", http.StatusOK},
+		{"push to another org's app", "/v1.41/images/registry.fly.io/stranger/push", http.StatusForbidden},
+		{"push to an invisible app", "/v1.41/images/registry.fly.io/unknown/push", http.StatusForbidden},
+		{"push elsewhere", "/v1.41/images/ghcr.io/stranger/push", http.StatusOK},
+		{"tag into another org's app", "/v1.41/images/abc/tag?repo=registry.fly.io/stranger&tag=1", http.StatusForbidden},
+		{"build tagged for another org's app", "/v1.41/build?t=registry.fly.io/my-app:1&t=registry.fly.io/stranger:1", http.StatusForbidden},
+		{"build tagged for own app", "/v1.41/build?t=registry.fly.io/my-app:deployment-1", http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tc.target, nil)
+			info := &requestInfo{appName: "my-app", authToken: "token"}
+			r = r.WithContext(context.WithValue(r.Context(), requestInfoKey, info))
+
+			w := httptest.NewRecorder()
+			if pushTargetAllowed(w, r) {
+				w.WriteHeader(http.StatusOK)
+			}
+			if w.Code != tc.status {
+				t.Errorf("expected status %d, but got %d: %s", tc.status, w.Code, w.Body)
+			}
+		})
+	}
+}
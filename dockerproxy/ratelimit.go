@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/superfly/rchab/dockerproxy/internal/proxy"
+)
+
+// rateLimitAllowed refuses builds, pushes and pulls with a 429 once the
+// app or the token making them is over its limit. Requests without
+// credentials, like on the local port, aren't limited.
+func rateLimitAllowed(w http.ResponseWriter, r *http.Request) bool {
+	var l *proxy.RateLimiter
+	switch {
+	case buildPath.MatchString(r.URL.Path) || grpcPath.MatchString(r.URL.Path) || solvePath.MatchString(r.URL.Path):
+		l = buildRateLimit.Load()
+	case imagePushPath.MatchString(r.URL.Path):
+		l = pushRateLimit.Load()
+	case imagePullPath.MatchString(r.URL.Path):
+		l = pullRateLimit.Load()
+	}
+	info := requestInfoFromContext(r.Context())
+	if l == nil || info == nil || info.appName == "" {
+		return true
+	}
+
+	keys := []string{"app:" + info.appName}
+	if info.authToken != "" {
+		sum := sha256.Sum256([]byte(info.authToken))
+		keys = append(keys, "token:"+hex.EncodeToString(sum[:]))
+	}
+	ok, wait := l.Take(keys...)
+	if ok {
+		return true
+	}
+
+	metricRateLimited.inc(l.Operation())
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	requestLogger(r.Context()).Warnf("rate limited %s for app %s, retry in %ds", l.Operation(), info.appName, retryAfter)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeDockerError(w, http.StatusTooManyRequests, fmt.Sprintf("too many %s for app %s on this builder, retry in %ds", l.Operation(), info.appName, retryAfter))
+	return false
+}
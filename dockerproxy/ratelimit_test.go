@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/superfly/rchab/dockerproxy/internal/harness"
+	"github.com/superfly/rchab/dockerproxy/internal/proxy"
+)
+
+func TestRequestPipelineRateLimit(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	defer buildRateLimit.Store(buildRateLimit.Load())
+	limit, err := proxy.NewRateLimiter("builds", "1/1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buildRateLimit.Store(limit)
+
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"stream":"Successfully built abc"}`+"\n")
+	}))
+	h := accessLog(newAuthRequest(fakeAuthorizer, newDockerProxy(dockerd)))
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r.SetBasicAuth("my-app", "good-token")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	if w := serve("/v1.41/build"); w.Code != http.StatusOK {
+		t.Fatalf("expected the first build through, but got %d", w.Code)
+	}
+	w := serve("/v1.41/build")
+	assertDockerError(t, w, http.StatusTooManyRequests)
+	if w.Header().Get("Retry-After") != "3600" {
+		t.Errorf("expected Retry-After 3600, but got %q", w.Header().Get("Retry-After"))
+	}
+	// pushes have a limit of their own, unset here
+	if w := serve("/v1.41/images/registry.fly.io/my-app/push"); w.Code != http.StatusOK {
+		t.Errorf("expected pushes to be unaffected, but got %d", w.Code)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+const (
+	dockerHubAuthKey = "https://index.docker.io/v1/"
+	flyRegistryHost  = "registry.fly.io"
+)
+
+var imagePushPath = regexp.MustCompile("^(/v[0-9.]*)?/images/(.+)/push$")
+
+// registryAuths holds the credentials from REGISTRY_AUTH or REGISTRY_AUTH_FILE,
+// keyed by registry host. It's nil unless one of them is set.
+var registryAuths map[string]types.AuthConfig
+
+// loadRegistryAuth reads a docker config.json, either base64 encoded from
+// REGISTRY_AUTH or from the file at REGISTRY_AUTH_FILE.
+func loadRegistryAuth() (map[string]types.AuthConfig, error) {
+	var raw []byte
+	if encoded := os.Getenv("REGISTRY_AUTH"); encoded != "" {
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("REGISTRY_AUTH is not valid base64: %w", err)
+		}
+		raw = decoded
+	} else if path := os.Getenv("REGISTRY_AUTH_FILE"); path != "" {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read REGISTRY_AUTH_FILE: %w", err)
+		}
+		raw = contents
+	} else {
+		return nil, nil
+	}
+
+	var config struct {
+		Auths map[string]types.AuthConfig `json:"auths"`
+	}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		// don't wrap err, it may quote the credentials
+		return nil, fmt.Errorf("registry auth is not a valid docker config")
+	}
+
+	auths := make(map[string]types.AuthConfig, len(config.Auths))
+	for registry, auth := range config.Auths {
+		if auth.Auth != "" && auth.Username == "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("registry auth for %s is not valid base64", registry)
+			}
+			auth.Username, auth.Password, _ = strings.Cut(string(decoded), ":")
+			auth.Auth = ""
+		}
+		auth.ServerAddress = registry
+		auths[registryHost(registry)] = auth
+	}
+	return auths, nil
+}
+
+// injectRegistryAuth adds the configured registry credentials to requests that
+// need them, without overriding any the client sent itself:
+//
+//   - POST /build gets every configured registry merged into X-Registry-Config,
+//     which dockerd hands to buildkit for pulls and pushes during the build.
+//   - POST /images/{name}/push gets X-Registry-Auth for the image's registry.
+//
+// With FLY_REGISTRY_AUTH, registry.fly.io is added using the client's own Fly
+// token, but only for the authenticated app's repository.
+func injectRegistryAuth(r *http.Request) {
+	auths := registryAuths
+	if auth, ok := flyRegistryAuth(r); ok {
+		auths = maps.Clone(auths)
+		if auths == nil {
+			auths = map[string]types.AuthConfig{}
+		}
+		auths[flyRegistryHost] = auth
+	}
+	if auths == nil {
+		return
+	}
+
+	if buildPath.MatchString(r.URL.Path) {
+		// the docker CLI always sends this header, as e30= ("{}") when it has
+		// no credentials of its own
+		merged, err := decodeRegistryConfig(r.Header.Get("X-Registry-Config"))
+		if err != nil {
+			requestLogger(r.Context()).Warnf("ignoring undecodable X-Registry-Config: %v", err)
+			return
+		}
+
+		known := make(map[string]bool, len(merged))
+		for server := range merged {
+			known[registryHost(server)] = true
+		}
+		// dockerd expects these keyed like config.json is
+		for host, auth := range auths {
+			if !known[host] {
+				merged[auth.ServerAddress] = auth
+			}
+		}
+
+		if encoded, err := encodeRegistryAuth(merged); err == nil {
+			r.Header.Set("X-Registry-Config", encoded)
+		}
+		return
+	}
+
+	if m := imagePushPath.FindStringSubmatch(r.URL.Path); m != nil && !hasRegistryAuth(r) {
+		auth, ok := auths[registryHost(imageRegistry(m[2]))]
+		if !ok {
+			return
+		}
+		if encoded, err := encodeRegistryAuth(auth); err == nil {
+			r.Header.Set("X-Registry-Auth", encoded)
+		}
+	}
+}
+
+// flyRegistryAuth returns registry.fly.io credentials made from the request's
+// Fly token. Pushes only get them for the app's own repository, and builds
+// only if every registry.fly.io image they tag is the app's.
+func flyRegistryAuth(r *http.Request) (types.AuthConfig, bool) {
+	info := requestInfoFromContext(r.Context())
+	if !injectFlyRegistryAuth || info == nil || info.appName == "" || info.authToken == "" {
+		return types.AuthConfig{}, false
+	}
+
+	var images []string
+	switch {
+	case buildPath.MatchString(r.URL.Path):
+		images = r.URL.Query()["t"]
+	case imagePushPath.MatchString(r.URL.Path):
+		images = []string{imagePushPath.FindStringSubmatch(r.URL.Path)[2]}
+	default:
+		return types.AuthConfig{}, false
+	}
+	for _, image := range images {
+		if registryHost(imageRegistry(image)) == flyRegistryHost && imageRepository(image) != flyRegistryHost+"/"+info.appName {
+			return types.AuthConfig{}, false
+		}
+	}
+
+	return types.AuthConfig{
+		Username:      "x",
+		Password:      info.authToken,
+		ServerAddress: flyRegistryHost,
+	}, true
+}
+
+// imageRepository strips the tag or digest from an image reference.
+func imageRepository(image string) string {
+	image, _, _ = strings.Cut(image, "@")
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+// decodeRegistryConfig decodes an X-Registry-Config header the way dockerd
+// does, accepting either base64 alphabet.
+func decodeRegistryConfig(header string) (map[string]types.AuthConfig, error) {
+	config := map[string]types.AuthConfig{}
+	if header == "" {
+		return config, nil
+	}
+
+	raw, err := base64.URLEncoding.DecodeString(header)
+	if err != nil {
+		if raw, err = base64.StdEncoding.DecodeString(header); err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, fmt.Errorf("not a registry config")
+	}
+	return config, nil
+}
+
+func hasRegistryAuth(r *http.Request) bool {
+	auth := r.Header.Get("X-Registry-Auth")
+	// docker sends an empty object when it has no credentials
+	return auth != "" && auth != "e30=" && auth != "e30"
+}
+
+func encodeRegistryAuth(v interface{}) (string, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(buf), nil
+}
+
+// imageRegistry returns the registry an image reference points to.
+func imageRegistry(image string) string {
+	first, _, found := strings.Cut(image, "/")
+	if !found || (!strings.ContainsAny(first, ".:") && first != "localhost") {
+		return dockerHubAuthKey
+	}
+	return first
+}
+
+// registryHost normalizes config.json keys like "https://index.docker.io/v1/"
+// to a bare host.
+func registryHost(registry string) string {
+	registry = strings.TrimPrefix(registry, "https://")
+	registry = strings.TrimPrefix(registry, "http://")
+	host, _, _ := strings.Cut(registry, "/")
+	return host
+}
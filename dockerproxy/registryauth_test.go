@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+const testDockerConfig = `{"auths": {
+	"https://index.docker.io/v1/": {"auth": "aHViLXVzZXI6aHViLXBhc3M="},
+	"registry.fly.io": {"username": "x", "password": "fly-token"}
+}}`
+
+func TestLoadRegistryAuth(t *testing.T) {
+	t.Setenv("REGISTRY_AUTH", base64.StdEncoding.EncodeToString([]byte(testDockerConfig)))
+
+	auths, err := loadRegistryAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub, ok := auths["index.docker.io"]
+	if !ok {
+		t.Fatalf("expected docker hub credentials, got %v", auths)
+	}
+	if hub.Username != "hub-user" || hub.Password != "hub-pass" || hub.ServerAddress != dockerHubAuthKey {
+		t.Errorf("unexpected docker hub credentials %+v", hub)
+	}
+	if auths["registry.fly.io"].Password != "fly-token" {
+		t.Errorf("unexpected fly credentials %+v", auths["registry.fly.io"])
+	}
+}
+
+func TestLoadRegistryAuthFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(testDockerConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("REGISTRY_AUTH", "")
+	t.Setenv("REGISTRY_AUTH_FILE", path)
+
+	auths, err := loadRegistryAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(auths) != 2 {
+		t.Errorf("expected 2 registries, but got %d", len(auths))
+	}
+}
+
+func TestLoadRegistryAuthErrors(t *testing.T) {
+	t.Setenv("REGISTRY_AUTH", "not base64!")
+	if _, err := loadRegistryAuth(); err == nil {
+		t.Error("expected an error for invalid base64")
+	}
+
+	t.Setenv("REGISTRY_AUTH", base64.StdEncoding.EncodeToString([]byte("nope")))
+	if _, err := loadRegistryAuth(); err == nil {
+		t.Error("expected an error for an invalid config")
+	}
+
+	t.Setenv("REGISTRY_AUTH", "")
+	t.Setenv("REGISTRY_AUTH_FILE", "")
+	if auths, err := loadRegistryAuth(); auths != nil || err != nil {
+		t.Errorf("expected nothing when unset, but got %v, %v", auths, err)
+	}
+}
+
+func TestImageRegistry(t *testing.T) {
+	cases := map[string]string{
+		"alpine":                        dockerHubAuthKey,
+		"library/alpine":                dockerHubAuthKey,
+		"registry.fly.io/app:latest":    "registry.fly.io",
+		"localhost/app":                 "localhost",
+		"localhost:5000/app":            "localhost:5000",
+		"ghcr.io/superfly/rchab:latest": "ghcr.io",
+	}
+	for image, expected := range cases {
+		if got := imageRegistry(image); got != expected {
+			t.Errorf("%s: expected %q, but got %q", image, expected, got)
+		}
+	}
+}
+
+func TestRegistryHost(t *testing.T) {
+	cases := map[string]string{
+		dockerHubAuthKey:          "index.docker.io",
+		"registry.fly.io":         "registry.fly.io",
+		"http://localhost:5000/":  "localhost:5000",
+		"https://ghcr.io/v2/path": "ghcr.io",
+	}
+	for registry, expected := range cases {
+		if got := registryHost(registry); got != expected {
+			t.Errorf("%s: expected %q, but got %q", registry, expected, got)
+		}
+	}
+}
+
+func TestInjectRegistryAuthBuild(t *testing.T) {
+	defer func(auths map[string]types.AuthConfig) { registryAuths = auths }(registryAuths)
+	registryAuths = map[string]types.AuthConfig{
+		"index.docker.io": {Username: "hub-user", Password: "hub-pass", ServerAddress: dockerHubAuthKey},
+		"registry.fly.io": {Username: "x", Password: "fly-token", ServerAddress: "registry.fly.io"},
+	}
+
+	// what the docker CLI sends when it has no credentials
+	r := httptest.NewRequest(http.MethodPost, "/v1.41/build", nil)
+	r.Header.Set("X-Registry-Config", "e30=")
+	injectRegistryAuth(r)
+
+	config, err := decodeRegistryConfig(r.Header.Get("X-Registry-Config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config) != 2 || config[dockerHubAuthKey].Password != "hub-pass" {
+		t.Errorf("expected both registries to be injected, but got %+v", config)
+	}
+
+	// the client's own credentials win
+	own, _ := encodeRegistryAuth(map[string]types.AuthConfig{
+		"registry.fly.io": {Username: "x", Password: "client-token"},
+	})
+	r = httptest.NewRequest(http.MethodPost, "/build", nil)
+	r.Header.Set("X-Registry-Config", own)
+	injectRegistryAuth(r)
+
+	config, err = decodeRegistryConfig(r.Header.Get("X-Registry-Config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config["registry.fly.io"].Password != "client-token" {
+		t.Errorf("expected the client's credentials to be kept, but got %+v", config["registry.fly.io"])
+	}
+	if config[dockerHubAuthKey].Password != "hub-pass" {
+		t.Errorf("expected missing registries to be added, but got %+v", config)
+	}
+}
+
+func TestInjectRegistryAuthPush(t *testing.T) {
+	defer func(auths map[string]types.AuthConfig) { registryAuths = auths }(registryAuths)
+	registryAuths = map[string]types.AuthConfig{
+		"registry.fly.io": {Username: "x", Password: "fly-token", ServerAddress: "registry.fly.io"},
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/v1.41/images/registry.fly.io/app/push?tag=latest", nil)
+	r.Header.Set("X-Registry-Auth", "e30=")
+	injectRegistryAuth(r)
+	if !hasRegistryAuth(r) {
+		t.Error("expected push credentials to be injected")
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/images/ghcr.io/app/push", nil)
+	injectRegistryAuth(r)
+	if hasRegistryAuth(r) {
+		t.Error("expected no credentials for an unconfigured registry")
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/images/create?fromImage=registry.fly.io/app", nil)
+	injectRegistryAuth(r)
+	if r.Header.Get("X-Registry-Auth") != "" {
+		t.Error("expected pulls to be left alone")
+	}
+}
+
+func TestInjectFlyRegistryAuth(t *testing.T) {
+	defer func(inject bool) { injectFlyRegistryAuth = inject }(injectFlyRegistryAuth)
+	injectFlyRegistryAuth = true
+
+	request := func(method, target string) *http.Request {
+		r := httptest.NewRequest(method, target, nil)
+		info := &requestInfo{appName: "my-app", authToken: "fly-token"}
+		return r.WithContext(context.WithValue(r.Context(), requestInfoKey, info))
+	}
+
+	cases := []struct {
+		name   string
+		target string
+		inject bool
+	}{
+		{"push to the app's repository", "/v1.41/images/registry.fly.io/my-app/push?tag=deployment-1", true},
+		{"push to another app's repository", "/v1.41/images/registry.fly.io/other-app/push", false},
+		{"push to another registry", "/v1.41/images/ghcr.io/my-app/push", false},
+		{"build tagged for the app", "/v1.41/build?t=registry.fly.io/my-app:deployment-1", true},
+		{"build without tags", "/v1.41/build", true},
+		{"build tagged for another app", "/v1.41/build?t=registry.fly.io/my-app:1&t=registry.fly.io/other-app:1", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := request(http.MethodPost, tc.target)
+			injectRegistryAuth(r)
+
+			var password string
+			if buildPath.MatchString(r.URL.Path) {
+				config, err := decodeRegistryConfig(r.Header.Get("X-Registry-Config"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				password = config[flyRegistryHost].Password
+			} else if raw, err := base64.URLEncoding.DecodeString(r.Header.Get("X-Registry-Auth")); err == nil {
+				var auth types.AuthConfig
+				json.Unmarshal(raw, &auth)
+				password = auth.Password
+			}
+
+			if injected := password == "fly-token"; injected != tc.inject {
+				t.Errorf("expected the Fly token to be injected: %v, but got %v", tc.inject, injected)
+			}
+		})
+	}
+}
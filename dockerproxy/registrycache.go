@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/rchab/dockerproxy/internal/daemon"
+)
+
+const (
+	registryCacheAddr   = "127.0.0.1:5000"
+	registryCacheMirror = "http://" + registryCacheAddr
+	registryCacheConfig = "/etc/docker/registry/config.yml"
+)
+
+// startRegistryCache runs a registry in pull-through cache mode, storing
+// layers on the volume so warm builders don't pull base images from Docker
+// Hub again. dockerd uses it as its first mirror, falling back to the other
+// mirrors and Docker Hub if it's down. The returned func stops it.
+func startRegistryCache(ctx context.Context) (func(), error) {
+	root := getEnvDefault("REGISTRY_CACHE_DIR", filepath.Join(dataDir, "registry-cache"))
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, errors.Wrap(err, "could not create the registry cache directory")
+	}
+
+	logger := log.WithField("component", "registry-cache")
+	output := logger.WriterLevel(logrus.InfoLevel)
+
+	cmd := exec.Command("registry", "serve", registryCacheConfig)
+	cmd.Env = append(os.Environ(),
+		"REGISTRY_HTTP_ADDR="+registryCacheAddr,
+		"REGISTRY_STORAGE_FILESYSTEM_ROOTDIRECTORY="+root,
+		"REGISTRY_PROXY_REMOTEURL="+getEnvDefault("REGISTRY_CACHE_REMOTE", "https://registry-1.docker.io"),
+		"REGISTRY_PROXY_TTL="+getEnvDuration("REGISTRY_CACHE_TTL", 7*24*time.Hour).String(),
+	)
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	if err := daemon.StartChild(cmd); err != nil {
+		output.Close()
+		return nil, errors.Wrap(err, "could not start the registry cache")
+	}
+	logger.Infof("serving a pull-through cache on %s from %s", registryCacheAddr, root)
+
+	done := make(chan struct{})
+	go func() {
+		if err := daemon.WaitChild(cmd); err != nil && ctx.Err() == nil {
+			logger.Errorf("registry cache exited, pulls go to the next mirror: %v", err)
+		}
+		output.Close()
+		close(done)
+	}()
+
+	return func() {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if err := cmd.Process.Signal(os.Interrupt); err != nil {
+			logger.Warnf("could not stop the registry cache: %v", err)
+			return
+		}
+		<-done
+	}, nil
+}
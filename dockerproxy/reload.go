@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/rchab/dockerproxy/internal/proxy"
+)
+
+// restartOnlySettings are read once at startup. Changing them on reload is
+// logged and otherwise ignored.
+var restartOnlySettings = []string{
+	"ADMIN_ADDR",
+	"ALLOW_INSECURE_CONFIG",
+	"ALLOW_ANY_PUSH_TARGET",
+	"AUDIT_LOG_FILE",
+	"AUDIT_LOG_TOKEN",
+	"AUDIT_LOG_URL",
+	"AUTH_MODE",
+	"AUTH_REVALIDATE_INTERVAL",
+	"BINFMT_PLATFORMS",
+	"BUILDKIT_ADDR",
+	"BUILDKIT_GC_KEEP_DURATION",
+	"BUILDKIT_GC_KEEP_STORAGE_GB",
+	"BUILDKIT_GC_RESERVED_SPACE_GB",
+	"BUILDKITD_CONFIG",
+	"BUILDKITD_EXTRA_ARGS",
+	"BUILDKITD_ONLY",
+	"BUILDKITD_ROOTLESS",
+	"BUILDKITD_ROOTLESS_UID",
+	"CORS_ALLOWED_ORIGINS",
+	"CPU_PRESSURE_MAX",
+	"DATA_DIR",
+	"DEBUG_ADDR",
+	"DOCKER_DATA_ROOT",
+	"DOCKER_HOST",
+	"DOCKERD_DIAL_TIMEOUT",
+	"DOCKERD_EXTRA_ARGS",
+	"DOCKERD_FEATURES",
+	"DOCKERD_INSECURE_REGISTRIES",
+	"DOCKERD_LOG_DRIVER",
+	"DOCKERD_MAX_CONCURRENT_DOWNLOADS",
+	"DOCKERD_MAX_CONCURRENT_UPLOADS",
+	"DOCKERD_READY_WAIT",
+	"DOCKERD_REGISTRY_MIRRORS",
+	"FLY_API_TOKEN",
+	"FLY_API_URL",
+	"FLY_ORG",
+	"FLY_REGISTRY_AUTH",
+	"IDLE_TIMEOUT",
+	"JWT_APP_CLAIM",
+	"JWT_AUDIENCE",
+	"JWT_ISSUER",
+	"JWT_JWKS_URL",
+	"LISTEN_ADDRS",
+	"LOG_FORMAT",
+	"MAX_HEADER_BYTES",
+	"MAX_REQUEST_BODY_GB",
+	"MEMORY_PRESSURE_MAX",
+	"METRICS_ADDR",
+	"MOCK_FLY_API",
+	"MOCK_FLY_API_FILE",
+	"NO_FILTER",
+	"NO_H2C",
+	"OPERATOR_TOKEN",
+	"ORG_ISOLATION",
+	"PATH_TIMEOUTS",
+	"PRESSURE_CHECK_INTERVAL",
+	"READ_HEADER_TIMEOUT",
+	"READ_TIMEOUT",
+	"REGISTRY_AUTH",
+	"REGISTRY_AUTH_FILE",
+	"REGISTRY_CACHE",
+	"REGISTRY_CACHE_DIR",
+	"REGISTRY_CACHE_REMOTE",
+	"REGISTRY_CACHE_TTL",
+	"REMOTE_CACHE_BUCKET",
+	"REMOTE_CACHE_KEY",
+	"REMOTE_CACHE_TIMEOUT",
+	"SPOOL_BUILD_CONTEXTS",
+	"STATIC_AUTH_TOKEN",
+	"STATIC_AUTH_TOKENS_FILE",
+	"TLS_CERT_FILE",
+	"TLS_CLIENT_CA_FILE",
+	"TLS_KEY_FILE",
+	"TLS_RELOAD_INTERVAL",
+	"USAGE_REPORT_INTERVAL",
+	"USAGE_REPORT_TOKEN",
+	"USAGE_REPORT_URL",
+	"WEBHOOK_SECRET",
+	"WEBHOOK_URL",
+	"WRITE_TIMEOUT",
+}
+
+var startupSettings = lookupSettings(restartOnlySettings)
+
+// durationVar is a time.Duration that can be changed while in use.
+type durationVar struct {
+	v atomic.Int64
+}
+
+func newDurationVar(d time.Duration) *durationVar {
+	dv := &durationVar{}
+	dv.Set(d)
+	return dv
+}
+
+func (d *durationVar) Get() time.Duration  { return time.Duration(d.v.Load()) }
+func (d *durationVar) Set(v time.Duration) { d.v.Store(int64(v)) }
+
+// listVar is a list of strings that can be changed while in use.
+type listVar struct {
+	v atomic.Pointer[[]string]
+}
+
+func newListVar(l []string) *listVar {
+	lv := &listVar{}
+	lv.Set(l)
+	return lv
+}
+
+func (l *listVar) Get() []string  { return *l.v.Load() }
+func (l *listVar) Set(v []string) { l.v.Store(&v) }
+
+// reloadableConfig holds the settings that can be changed without a restart.
+type reloadableConfig struct {
+	logLevel        logrus.Level
+	maxIdleDuration time.Duration
+	authCacheTTL    time.Duration
+	authNegativeTTL time.Duration
+
+	allowedOrgSlugs []string
+	operatorApps    []string
+	proxyPolicy     *proxy.PathPolicy
+	buildRateLimit  *proxy.RateLimiter
+	pushRateLimit   *proxy.RateLimiter
+	pullRateLimit   *proxy.RateLimiter
+}
+
+// readReloadableConfig reads the reloadable settings from the environment.
+// Settings that can't be used as they are, like a path pattern that doesn't
+// compile, are errors, so a reload with a typo changes nothing.
+func readReloadableConfig() (reloadableConfig, error) {
+	c := reloadableConfig{
+		logLevel:        logrus.InfoLevel,
+		maxIdleDuration: getIdleDuration(),
+		authCacheTTL:    getEnvPositiveDuration("AUTH_CACHE_DEFAULT_TTL", 5*time.Minute),
+		authNegativeTTL: getEnvPositiveDuration("AUTH_CACHE_NEGATIVE_TTL", 15*time.Second),
+		allowedOrgSlugs: splitList(os.Getenv("ALLOW_ORG_SLUG")),
+		operatorApps:    splitList(os.Getenv("OPERATOR_APPS")),
+	}
+
+	var errs []error
+	var err error
+	if val := os.Getenv("LOG_LEVEL"); val != "" {
+		if c.logLevel, err = logrus.ParseLevel(val); err != nil {
+			errs = append(errs, fmt.Errorf("invalid LOG_LEVEL %q, expected e.g. debug, info or warn", val))
+		}
+	}
+	if val := os.Getenv("ALLOW_ORG_SLUG"); val != "" && len(c.allowedOrgSlugs) == 0 {
+		errs = append(errs, fmt.Errorf("ALLOW_ORG_SLUG is set to %q, which names no organization, unset it to accept the builder's own", val))
+	}
+	if c.proxyPolicy, err = loadPathPolicy(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, limit := range []struct {
+		l         **proxy.RateLimiter
+		operation string
+		env       string
+	}{
+		{&c.buildRateLimit, "builds", "RATE_LIMIT_BUILDS"},
+		{&c.pushRateLimit, "pushes", "RATE_LIMIT_PUSHES"},
+		{&c.pullRateLimit, "pulls", "RATE_LIMIT_PULLS"},
+	} {
+		if *limit.l, err = proxy.NewRateLimiter(limit.operation, os.Getenv(limit.env)); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %w", limit.env, err))
+		}
+	}
+	return c, errors.Join(errs...)
+}
+
+// bounds for MAX_IDLE_DURATION, so a typo can neither stop a builder before a
+// client gets to use it nor keep one around for days
+const (
+	minIdleDuration = time.Minute
+	maxIdleLimit    = 24 * time.Hour
+)
+
+func getIdleDuration() time.Duration {
+	d := getEnvPositiveDuration("MAX_IDLE_DURATION", 10*time.Minute)
+	switch {
+	case d < minIdleDuration:
+		log.Warnf("MAX_IDLE_DURATION %s is below the minimum, using %s", d, minIdleDuration)
+		return minIdleDuration
+	case d > maxIdleLimit:
+		log.Warnf("MAX_IDLE_DURATION %s is above the maximum, using %s", d, maxIdleLimit)
+		return maxIdleLimit
+	}
+	return d
+}
+
+func (c reloadableConfig) apply() {
+	log.SetLevel(c.logLevel)
+	maxIdleDuration.Set(c.maxIdleDuration)
+	authCacheTTL.Set(c.authCacheTTL)
+	authNegativeTTL.Set(c.authNegativeTTL)
+
+	// approvals were for the organizations allowed before
+	if !slices.Equal(c.allowedOrgSlugs, allowedOrgSlugs.Get()) {
+		allowedOrgSlugs.Set(c.allowedOrgSlugs)
+		if flushed := flushAuthCache(); flushed > 0 {
+			log.Infof("allowed organizations changed, flushed %d auth cache entries", flushed)
+		}
+	}
+	operatorApps.Set(c.operatorApps)
+	proxyPolicy.Store(c.proxyPolicy)
+	setRateLimiter(&buildRateLimit, c.buildRateLimit)
+	setRateLimiter(&pushRateLimit, c.pushRateLimit)
+	setRateLimiter(&pullRateLimit, c.pullRateLimit)
+}
+
+// setRateLimiter swaps in l, unless it's the limit already in use, which
+// keeps its buckets so a reload doesn't hand every app a fresh allowance.
+func setRateLimiter(v *atomic.Pointer[proxy.RateLimiter], l *proxy.RateLimiter) {
+	if cur := v.Load(); cur != nil && l != nil && cur.Spec() == l.Spec() {
+		return
+	}
+	v.Store(l)
+}
+
+// reloadMu keeps SIGHUP and the admin route from reloading at the same time.
+var reloadMu sync.Mutex
+
+// reloadConfig re-reads CONFIG_FILE, if set, and applies the reloadable
+// settings. A running process can't see changes to its environment, so the
+// file is how new values get in. It returns the settings that changed but
+// need a restart to take effect.
+func reloadConfig() ([]string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := loadConfigFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	var pending []string
+	for _, key := range restartOnlySettings {
+		if os.Getenv(key) != startupSettings[key] {
+			log.Warnf("%s changed, which requires a restart, ignoring", key)
+			pending = append(pending, key)
+		}
+	}
+
+	c, err := readReloadableConfig()
+	if err != nil {
+		return pending, err
+	}
+	c.apply()
+	log.Infof("reloaded config: log level %s, max idle duration %s, auth cache ttl %s, negative ttl %s, allowed orgs %v, operator apps %v", c.logLevel, c.maxIdleDuration, c.authCacheTTL, c.authNegativeTTL, c.allowedOrgSlugs, c.operatorApps)
+	return pending, nil
+}
+
+// settingsOverFile are the settings the environment or flags gave at
+// startup, which the config file doesn't override, see Config.apply.
+var settingsOverFile map[string]bool
+
+// settingsFromFile are the settings the environment has from the config
+// file, which a reload unsets once they're taken out of it.
+var settingsFromFile = map[string]bool{}
+
+// loadConfigFile sets the environment from a file of KEY=VALUE lines, see
+// readSettingsFile. Settings no longer in the file are unset, so deleting a
+// line goes back to the default rather than keeping the old value.
+func loadConfigFile(path string) error {
+	settings, err := readSettingsFile(path)
+	if err != nil {
+		return err
+	}
+	for key := range settingsFromFile {
+		if _, ok := settings[key]; !ok {
+			os.Unsetenv(key)
+			delete(settingsFromFile, key)
+		}
+	}
+	for key, val := range settings {
+		if settingsOverFile[key] {
+			if os.Getenv(key) != val {
+				log.Warnf("%s is set in the environment or by a flag, which takes precedence over CONFIG_FILE", key)
+			}
+			continue
+		}
+		os.Setenv(key, val)
+		settingsFromFile[key] = true
+	}
+	return nil
+}
+
+// readSettingsFile reads a file of KEY=VALUE lines, in the format docker's
+// --env-file uses.
+func readSettingsFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CONFIG_FILE: %w", err)
+	}
+	defer f.Close()
+
+	settings := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, val, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("CONFIG_FILE line %d is not KEY=VALUE", n)
+		}
+		settings[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	}
+	return settings, scanner.Err()
+}
+
+func lookupSettings(keys []string) map[string]string {
+	settings := make(map[string]string, len(keys))
+	for _, key := range keys {
+		settings[key] = os.Getenv(key)
+	}
+	return settings
+}
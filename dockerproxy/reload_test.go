@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/rchab/dockerproxy/internal/auth"
+)
+
+func TestReloadConfig(t *testing.T) {
+	restoreReloadable(t)
+
+	path := filepath.Join(t.TempDir(), "rchab.env")
+	contents := "# retuned\nLOG_LEVEL=debug\n\nMAX_IDLE_DURATION = 30m\nAUTH_CACHE_DEFAULT_TTL=1m\n"
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	for _, key := range []string{"LOG_LEVEL", "MAX_IDLE_DURATION", "AUTH_CACHE_DEFAULT_TTL"} {
+		t.Setenv(key, os.Getenv(key))
+	}
+
+	if _, err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if log.GetLevel() != logrus.DebugLevel {
+		t.Errorf("expected log level debug, but got %s", log.GetLevel())
+	}
+	if got := maxIdleDuration.Get(); got != 30*time.Minute {
+		t.Errorf("expected max idle duration 30m, but got %s", got)
+	}
+	if got := authCacheTTL.Get(); got != time.Minute {
+		t.Errorf("expected auth cache ttl 1m, but got %s", got)
+	}
+}
+
+// restoreReloadable puts back the settings reloadConfig changes.
+func restoreReloadable(t *testing.T) {
+	lvl, idle, ttl := log.GetLevel(), maxIdleDuration.Get(), authCacheTTL.Get()
+	slugs, policy := allowedOrgSlugs.Get(), proxyPolicy.Load()
+	builds, pushes, pulls := buildRateLimit.Load(), pushRateLimit.Load(), pullRateLimit.Load()
+	fromFile := settingsFromFile
+	settingsFromFile = map[string]bool{}
+	t.Cleanup(func() {
+		settingsFromFile = fromFile
+		log.SetLevel(lvl)
+		maxIdleDuration.Set(idle)
+		authCacheTTL.Set(ttl)
+		allowedOrgSlugs.Set(slugs)
+		proxyPolicy.Store(policy)
+		buildRateLimit.Store(builds)
+		pushRateLimit.Store(pushes)
+		pullRateLimit.Store(pulls)
+	})
+}
+
+func TestReloadAccessSettings(t *testing.T) {
+	restoreReloadable(t)
+	defer func(c *cache.Cache) { authCache = c }(authCache)
+	authCache = cache.New(time.Minute, time.Minute)
+	authCache.Set(authCacheKey("my-app", "token"), auth.DenyNone, time.Minute)
+
+	path := filepath.Join(t.TempDir(), "rchab.env")
+	contents := "ALLOW_ORG_SLUG=acme,friends\nPROXY_DENY_PATHS=^/v[0-9.]+/images/.*/push$\nRATE_LIMIT_BUILDS=10/1h\n"
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	for _, key := range []string{"ALLOW_ORG_SLUG", "PROXY_DENY_PATHS", "RATE_LIMIT_BUILDS", "PROXY_ALLOW_PATHS", "RATE_LIMIT_PUSHES", "RATE_LIMIT_PULLS"} {
+		t.Setenv(key, "")
+	}
+
+	if _, err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := allowedOrgSlugs.Get(); !slices.Equal(got, []string{"acme", "friends"}) {
+		t.Errorf("expected allowed orgs acme and friends, but got %v", got)
+	}
+	if authCache.ItemCount() != 0 {
+		t.Error("expected approvals to be flushed when the allowed orgs change")
+	}
+	if proxyPolicy.Load().Allowed("/v1.41/images/my-app/push") {
+		t.Error("expected pushes to be denied after the reload")
+	}
+	limit := buildRateLimit.Load()
+	if limit == nil || limit.Spec() != "10/1h0m0s" {
+		t.Fatalf("expected a build limit of 10, but got %+v", limit)
+	}
+
+	// the same limit keeps its buckets
+	if _, err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if buildRateLimit.Load() != limit {
+		t.Error("expected an unchanged rate limit to be kept")
+	}
+
+	// a typo changes nothing
+	contents = "ALLOW_ORG_SLUG=acme\nPROXY_DENY_PATHS=(\n"
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloadConfig(); err == nil {
+		t.Error("expected an error for an invalid path pattern")
+	}
+	if got := allowedOrgSlugs.Get(); !slices.Equal(got, []string{"acme", "friends"}) {
+		t.Errorf("expected allowed orgs to be left alone, but got %v", got)
+	}
+}
+
+func TestReloadUnsetsSettingsTakenOutOfFile(t *testing.T) {
+	restoreReloadable(t)
+
+	path := filepath.Join(t.TempDir(), "rchab.env")
+	if err := os.WriteFile(path, []byte("ALLOW_ORG_SLUG=acme\nRATE_LIMIT_BUILDS=10/1h\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	for _, key := range []string{"ALLOW_ORG_SLUG", "RATE_LIMIT_BUILDS"} {
+		t.Setenv(key, "")
+	}
+	if _, err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if buildRateLimit.Load() == nil {
+		t.Fatal("expected a build limit from the file")
+	}
+
+	// deleting the lines goes back to the defaults
+	if err := os.WriteFile(path, []byte("# nothing\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := os.LookupEnv("RATE_LIMIT_BUILDS"); ok {
+		t.Errorf("expected RATE_LIMIT_BUILDS to be unset, but it's %q", val)
+	}
+	if buildRateLimit.Load() != nil {
+		t.Error("expected no build limit once it's taken out of the file")
+	}
+	if got := allowedOrgSlugs.Get(); len(got) != 0 {
+		t.Errorf("expected no allowed orgs once they're taken out of the file, but got %v", got)
+	}
+}
+
+func TestReloadLogLevelTypo(t *testing.T) {
+	restoreReloadable(t)
+	log.SetLevel(logrus.WarnLevel)
+
+	path := filepath.Join(t.TempDir(), "rchab.env")
+	if err := os.WriteFile(path, []byte("LOG_LEVEL=debgu\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("LOG_LEVEL", "")
+
+	if _, err := reloadConfig(); err == nil || !strings.Contains(err.Error(), "LOG_LEVEL") {
+		t.Errorf("expected an error about LOG_LEVEL, but got %v", err)
+	}
+	if log.GetLevel() != logrus.WarnLevel {
+		t.Errorf("expected the log level to be left alone, but got %s", log.GetLevel())
+	}
+}
+
+func TestReloadKeepsEnvironmentOverFile(t *testing.T) {
+	restoreReloadable(t)
+	defer func(s map[string]bool) { settingsOverFile = s }(settingsOverFile)
+	settingsOverFile = map[string]bool{"LOG_LEVEL": true}
+
+	path := filepath.Join(t.TempDir(), "rchab.env")
+	if err := os.WriteFile(path, []byte("LOG_LEVEL=debug\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("LOG_LEVEL", "warn")
+
+	if _, err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if log.GetLevel() != logrus.WarnLevel {
+		t.Errorf("expected the environment's log level warn, but got %s", log.GetLevel())
+	}
+}
+
+func TestReloadRoute(t *testing.T) {
+	restoreReloadable(t)
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "admin-token"
+
+	path := filepath.Join(t.TempDir(), "rchab.env")
+	if err := os.WriteFile(path, []byte("LOG_LEVEL=debug\nLISTEN_ADDRS=:9999\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("LOG_LEVEL", "")
+	t.Setenv("LISTEN_ADDRS", "")
+
+	mux := http.NewServeMux()
+	registerAdminRoutes(mux)
+	r := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+	r.Header.Set("Authorization", "Bearer admin-token")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, but got %d: %s", w.Code, w.Body)
+	}
+
+	var resp struct {
+		RestartRequired []string `json:"restartRequired"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(resp.RestartRequired, "LISTEN_ADDRS") {
+		t.Errorf("expected LISTEN_ADDRS to need a restart, but got %v", resp.RestartRequired)
+	}
+	if log.GetLevel() != logrus.DebugLevel {
+		t.Errorf("expected log level debug, but got %s", log.GetLevel())
+	}
+}
+
+func TestLoadConfigFileInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rchab.env")
+	if err := os.WriteFile(path, []byte("LOG_LEVEL\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(path); err == nil {
+		t.Error("expected an error for a line without =")
+	}
+	if err := loadConfigFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestGetIdleDuration(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":      10 * time.Minute,
+		"30m":   30 * time.Minute,
+		"5s":    minIdleDuration,
+		"720h":  maxIdleLimit,
+		"bogus": 10 * time.Minute,
+	}
+	for val, expected := range cases {
+		t.Setenv("MAX_IDLE_DURATION", val)
+		if got := getIdleDuration(); got != expected {
+			t.Errorf("%q: expected %s, but got %s", val, expected, got)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/superfly/rchab/dockerproxy/internal/daemon"
+)
+
+const (
+	remoteCachePartSize = 64 << 20
+	// the longest kill_timeout Fly allows, draining, stopping dockerd and
+	// saving the copy all have to fit in it
+	flyMaxKillTimeout = 5 * time.Minute
+)
+
+// buildsRan is set once a build gets going, so a builder that only answered
+// pings doesn't overwrite the remote cache with an older copy of itself.
+var buildsRan atomic.Bool
+
+// remoteCache keeps a copy of the builder's cache in S3 compatible object
+// storage, like Tigris. A builder starting on an empty volume restores the
+// copy saved by the one before it, so its first builds aren't from scratch,
+// and saves its own once it has stopped dockerd.
+//
+// buildkit in dockerd keeps its cache in dockerd's image store, so the whole
+// data root is copied. In BUILDKITD_ONLY mode it's just buildkitd's state.
+type remoteCache struct {
+	store *s3Client
+	// object holding the copy, keyed by REMOTE_CACHE_KEY
+	key string
+	// directory copied
+	root    string
+	timeout time.Duration
+}
+
+// remoteCacheFromEnv reads the remote cache settings. It's nil when
+// REMOTE_CACHE_BUCKET isn't set.
+func remoteCacheFromEnv() (*remoteCache, error) {
+	bucket := os.Getenv("REMOTE_CACHE_BUCKET")
+	if bucket == "" {
+		return nil, nil
+	}
+	endpoint, err := url.Parse(getEnvDefault("AWS_ENDPOINT_URL_S3", "https://fly.storage.tigris.dev"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid AWS_ENDPOINT_URL_S3 %q", os.Getenv("AWS_ENDPOINT_URL_S3"))
+	}
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("REMOTE_CACHE_BUCKET needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	// builders of the same organization share the builder app
+	key := getEnvDefault("REMOTE_CACHE_KEY", os.Getenv("FLY_APP_NAME"))
+	if key == "" {
+		return nil, errors.New("REMOTE_CACHE_BUCKET needs REMOTE_CACHE_KEY, or FLY_APP_NAME to default to")
+	}
+
+	root := getEnvDefault("DOCKER_DATA_ROOT", "/data/docker")
+	if buildkitdOnly {
+		root = filepath.Join(dataDir, "buildkit")
+	}
+
+	return &remoteCache{
+		store: &s3Client{
+			endpoint:  endpoint,
+			bucket:    bucket,
+			region:    getEnvDefault("AWS_REGION", "auto"),
+			accessKey: accessKey,
+			secretKey: secretKey,
+			partSize:  remoteCachePartSize,
+			client:    &http.Client{Transport: http.DefaultTransport},
+			now:       time.Now,
+		},
+		key:     path.Join(strings.Trim(key, "/"), "build-cache.tar.gz"),
+		root:    root,
+		timeout: getEnvPositiveDuration("REMOTE_CACHE_TIMEOUT", 2*time.Minute),
+	}, nil
+}
+
+// tarArgs are the flags for copying the data root as is: overlay whiteouts,
+// xattrs and owners included.
+var tarArgs = []string{"--numeric-owner", "--xattrs", "--xattrs-include=*", "--use-compress-program=pigz"}
+
+// restore unpacks the saved cache into an empty root. A warm volume keeps
+// what it has. On failure the root is emptied again, so dockerd starts cold
+// rather than on half a cache.
+func (c *remoteCache) restore(ctx context.Context) (int64, error) {
+	empty, err := cacheRootEmpty(c.root)
+	if err != nil || !empty {
+		return 0, err
+	}
+	body, err := c.store.get(ctx, c.key)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	if err := os.MkdirAll(c.root, 0o711); err != nil {
+		return 0, err
+	}
+
+	counted := &countingReader{ReadCloser: body}
+	var stderr bytes.Buffer
+	cmd := exec.Command("tar", append(append([]string{"--extract"}, tarArgs...), "-C", c.root, "-f", "-")...)
+	cmd.Stdin = counted
+	cmd.Stderr = &stderr
+	if err := daemon.RunChild(cmd); err != nil {
+		if cerr := clearDir(c.root); cerr != nil {
+			log.Errorf("could not clear %s after a failed cache restore: %v", c.root, cerr)
+		}
+		return counted.n, fmt.Errorf("could not unpack the cache: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return counted.n, nil
+}
+
+// save uploads a copy of the root, replacing the saved one only once the
+// upload completes. dockerd must be stopped, so the copy is consistent.
+func (c *remoteCache) save(ctx context.Context) (int64, error) {
+	var stderr bytes.Buffer
+	args := append(append([]string{"--create"}, tarArgs...), "--exclude=./tmp", "-C", c.root, "-f", "-", ".")
+	cmd := exec.Command("tar", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := daemon.StartChild(cmd); err != nil {
+		return 0, err
+	}
+
+	// tar is waited on at the end of its output, so an archive cut short by
+	// an error is abandoned along with the upload instead of completing it
+	waited := false
+	archive := readerFunc(func(p []byte) (int, error) {
+		n, err := out.Read(p)
+		if err == io.EOF && !waited {
+			waited = true
+			if err := daemon.WaitChild(cmd); err != nil {
+				return n, fmt.Errorf("could not pack the cache: %v: %s", err, strings.TrimSpace(stderr.String()))
+			}
+		}
+		return n, err
+	})
+
+	n, err := c.store.upload(ctx, c.key, archive)
+	if !waited {
+		cmd.Process.Kill()
+		daemon.WaitChild(cmd)
+	}
+	return n, err
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+// cacheRootEmpty reports whether root holds nothing but dockerd's tmp
+// directory, which DOCKER_TMPDIR has created ahead of it.
+func cacheRootEmpty(root string) (bool, error) {
+	entries, err := os.ReadDir(root)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if entry.Name() != "tmp" {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// clearDir removes everything in dir, leaving dir itself.
+func clearDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoteCacheFromEnv(t *testing.T) {
+	if c, err := remoteCacheFromEnv(); c != nil || err != nil {
+		t.Errorf("expected no remote cache without a bucket, but got %+v, %v", c, err)
+	}
+
+	t.Setenv("REMOTE_CACHE_BUCKET", "builder-cache")
+	if _, err := remoteCacheFromEnv(); err == nil {
+		t.Error("expected an error without credentials")
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("FLY_APP_NAME", "")
+	if _, err := remoteCacheFromEnv(); err == nil {
+		t.Error("expected an error without a key")
+	}
+
+	t.Setenv("FLY_APP_NAME", "fly-builder-abc")
+	c, err := remoteCacheFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.key != "fly-builder-abc/build-cache.tar.gz" {
+		t.Errorf("expected the key to default to the builder app, but got %q", c.key)
+	}
+	if c.store.endpoint.String() != "https://fly.storage.tigris.dev" || c.store.region != "auto" {
+		t.Errorf("expected Tigris by default, but got %s in %s", c.store.endpoint, c.store.region)
+	}
+}
+
+func TestCacheRootEmpty(t *testing.T) {
+	root := t.TempDir()
+
+	if empty, err := cacheRootEmpty(filepath.Join(root, "missing")); !empty || err != nil {
+		t.Errorf("expected a missing root to be empty, but got %v, %v", empty, err)
+	}
+
+	os.Mkdir(filepath.Join(root, "tmp"), 0o755)
+	if empty, err := cacheRootEmpty(root); !empty || err != nil {
+		t.Errorf("expected a root with only tmp to be empty, but got %v, %v", empty, err)
+	}
+
+	os.Mkdir(filepath.Join(root, "overlay2"), 0o755)
+	if empty, err := cacheRootEmpty(root); empty || err != nil {
+		t.Errorf("expected a warm root not to be empty, but got %v, %v", empty, err)
+	}
+
+	if err := clearDir(root); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("expected clearDir to empty the root, but it has %d entries", len(entries))
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errObjectNotFound = errors.New("object not found")
+
+// s3Client talks to an S3 compatible object store, like Tigris, with just
+// the calls the remote cache needs. Requests are signed with AWS signature
+// version 4 and use path-style URLs, endpoint/bucket/key.
+type s3Client struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	// uploads are sent in parts of this size, each held in memory
+	partSize int
+	client   *http.Client
+	now      func() time.Time
+}
+
+// get opens the object at key, or returns errObjectNotFound.
+func (c *s3Client) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// upload stores everything read from r at key, in a multipart upload so it
+// needn't fit in memory or be sized up front. The object only appears once
+// all of it is uploaded. It returns the bytes uploaded.
+func (c *s3Client) upload(ctx context.Context, key string, r io.Reader) (int64, error) {
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := c.doXML(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, &created); err != nil {
+		return 0, err
+	}
+	uploadID := created.UploadID
+
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var (
+		parts []part
+		total int64
+		buf   = make([]byte, c.partSize)
+	)
+	err := func() error {
+		for n := 1; ; n++ {
+			size, err := io.ReadFull(r, buf)
+			if err == io.EOF && n > 1 {
+				return nil
+			}
+			if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+				return err
+			}
+			query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+			resp, perr := c.do(ctx, http.MethodPut, key, query, buf[:size])
+			if perr != nil {
+				return perr
+			}
+			resp.Body.Close()
+			parts = append(parts, part{PartNumber: n, ETag: resp.Header.Get("ETag")})
+			total += int64(size)
+			if err != nil {
+				return nil
+			}
+		}
+	}()
+	if err == nil {
+		body, _ := xml.Marshal(struct {
+			XMLName xml.Name `xml:"CompleteMultipartUpload"`
+			Parts   []part   `xml:"Part"`
+		}{Parts: parts})
+		err = c.doXML(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body, nil)
+	}
+	if err != nil {
+		// parts of an abandoned upload are billed until they're aborted
+		abortCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if resp, aerr := c.do(abortCtx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil); aerr == nil {
+			resp.Body.Close()
+		}
+		return total, err
+	}
+	return total, nil
+}
+
+// doXML makes a request and decodes its XML answer into out, if given.
+// Completing a multipart upload can fail after answering 200, with an error
+// in the body.
+func (c *s3Client) doXML(ctx context.Context, method, key string, query url.Values, body []byte, out any) error {
+	resp, err := c.do(ctx, method, key, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var s3Err struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(b, &s3Err) == nil && s3Err.XMLName.Local == "Error" {
+		return fmt.Errorf("%s %s: %s: %s", method, key, s3Err.Code, s3Err.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return xml.Unmarshal(b, out)
+}
+
+// do sends a signed request, turning error statuses into errors.
+func (c *s3Client) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket + "/" + key
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, body)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && method == http.MethodGet {
+		return nil, fmt.Errorf("%s: %w", key, errObjectNotFound)
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("%s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// sign adds an AWS signature version 4 Authorization header to req, covering
+// the host and every header already set.
+func (c *s3Client) sign(req *http.Request, body []byte) {
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, vals := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(vals, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscape(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	for _, part := range []string{c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.accessKey, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for name, vals := range query {
+		for _, val := range vals {
+			pairs = append(pairs, awsEscape(name, true)+"="+awsEscape(val, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes everything but unreserved characters, and
+// slashes too unless they're kept, as signature version 4 expects.
+func awsEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~', ch == '/' && !escapeSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/sirupsen/logrus"
+)
+
+// secretPattern matches credentials that could end up in a log line: HTTP
+// authorization values and Fly macaroons, wherever they appear.
+var secretPattern = regexp.MustCompile(`(?i)\b(basic|bearer|flyv1)\s+[^\s"]+|\bfm[12][ar]?_[A-Za-z0-9_+/=-]+`)
+
+// scrubSecrets redacts credentials from s, keeping the auth scheme so the
+// line still says what kind of credential was there.
+func scrubSecrets(s string) string {
+	return secretPattern.ReplaceAllStringFunc(s, func(match string) string {
+		if m := secretPattern.FindStringSubmatch(match); m[1] != "" {
+			return m[1] + " [redacted]"
+		}
+		return "[redacted]"
+	})
+}
+
+// scrubHook redacts credentials from every log entry, including those the
+// fly-go client and dockerd write through our logger.
+type scrubHook struct{}
+
+func (scrubHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (scrubHook) Fire(entry *logrus.Entry) error {
+	entry.Message = scrubSecrets(entry.Message)
+	for k, v := range entry.Data {
+		if s, ok := v.(string); ok {
+			entry.Data[k] = scrubSecrets(s)
+		}
+	}
+	return nil
+}
+
+func newLogger() *logrus.Logger {
+	l := logrus.New()
+	l.AddHook(scrubHook{})
+	return l
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/rchab/dockerproxy/internal/auth"
+	"github.com/superfly/rchab/dockerproxy/internal/harness"
+)
+
+func TestScrubSecrets(t *testing.T) {
+	tests := map[string]string{
+		"Authorization: Basic bXktYXBwOnRva2Vu":     "Authorization: Basic [redacted]",
+		"Bearer abc123 next":                        "Bearer [redacted] next",
+		`token "FlyV1 fm2_abc,fm2_def" rejected`:    `token "FlyV1 [redacted]" rejected`,
+		"password fm2_lJPECAAAAAAAA+/= in body":     "password [redacted] in body",
+		"nothing secret about building my-app here": "nothing secret about building my-app here",
+	}
+	for in, want := range tests {
+		if got := scrubSecrets(in); got != want {
+			t.Errorf("scrubSecrets(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// TestLogsScrubSecrets runs requests with credentials through the pipeline
+// at debug level and checks none of them show up in the logs or at dockerd.
+func TestLogsScrubSecrets(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+
+	var out bytes.Buffer
+	defer func(w io.Writer, level logrus.Level) {
+		log.SetOutput(w)
+		log.SetLevel(level)
+	}(log.Out, log.GetLevel())
+	log.SetOutput(&out)
+	log.SetLevel(logrus.DebugLevel)
+
+	const secret = "fm2_supersecretvalue"
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			t.Errorf("expected no credentials to reach dockerd, but got %q", auth)
+		}
+		io.WriteString(w, "OK")
+	}))
+
+	authz := auth.AuthorizerFunc(func(_ context.Context, appName, authToken string) (bool, auth.DenyReason) {
+		log.Debugf("checking token %s for %s", authToken, appName)
+		return authToken == "FlyV1 "+secret, auth.DenyBadCredentials
+	})
+	h := accessLog(newAuthRequest(authz, newDockerProxy(dockerd)))
+
+	for _, token := range []string{"FlyV1 " + secret, "FlyV1 " + secret + "x"} {
+		r := httptest.NewRequest(http.MethodGet, "/_ping", nil)
+		r.SetBasicAuth("my-app", token)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	log.WithField("header", "Basic "+secret).Debug("a field")
+
+	if out.Len() == 0 {
+		t.Fatal("expected some log output")
+	}
+	if strings.Contains(out.String(), "supersecret") {
+		t.Errorf("expected no secrets in the logs, but got:\n%s", out.String())
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+type builderStatus struct {
+	Version           string         `json:"version"`
+	BuildTime         string         `json:"build_time"`
+	Ready             bool           `json:"ready"`
+	Draining          bool           `json:"draining"`
+	Dockerd           string         `json:"dockerd"`
+	PendingRequests   uint64         `json:"pending_requests"`
+	ActiveBuilds      []buildOutcome `json:"active_builds"`
+	QueuedBuilds      int64          `json:"queued_builds"`
+	RunningContainers int            `json:"running_containers"`
+	IdleDeadline      time.Time      `json:"idle_deadline"`
+	IdleRemaining     float64        `json:"idle_remaining_seconds"`
+	Disk              *diskStatus    `json:"disk,omitempty"`
+}
+
+type diskStatus struct {
+	TotalBytes  uint64  `json:"total_bytes"`
+	FreeBytes   uint64  `json:"free_bytes"`
+	UsedPercent float64 `json:"used_percent"`
+	Low         bool    `json:"low"`
+}
+
+// statusHandler reports what the builder is up to, for debugging builders
+// that seem stuck.
+func statusHandler(dockerClient *client.Client) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		deadline := time.Unix(0, jobDeadlineAt.Load()).UTC()
+		status := builderStatus{
+			Version:         gitSha,
+			BuildTime:       buildTime,
+			Ready:           dockerReady.Load(),
+			Draining:        draining.Load(),
+			Dockerd:         "ok",
+			PendingRequests: pendingRequests.Load(),
+			ActiveBuilds:    activeBuilds.list(),
+			QueuedBuilds:    buildSlots.queueDepth(),
+			IdleDeadline:    deadline,
+			IdleRemaining:   max(time.Until(deadline), 0).Seconds(),
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), healthPingTimeout)
+		defer cancel()
+		if _, err := dockerClient.Ping(ctx); err != nil {
+			status.Dockerd = err.Error()
+		} else {
+			containers, err := dockerClient.ContainerList(ctx, types.ContainerListOptions{Filters: filters.NewArgs(filters.Arg("status", "running"))})
+			if err != nil {
+				requestLogger(r.Context()).Warnf("could not list containers for status: %v", err)
+			}
+			status.RunningContainers = len(containers)
+		}
+
+		if di, _ := diskLow(); di.Total > 0 {
+			status.Disk = &diskStatus{
+				TotalBytes:  di.Total,
+				FreeBytes:   di.Free,
+				UsedPercent: float64(di.Total-di.Free) / float64(di.Total) * 100,
+				Low:         isDiskLow(di),
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			log.Warnln("error writing status response", err)
+		}
+	})
+}
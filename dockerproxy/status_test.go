@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/superfly/rchab/dockerproxy/internal/harness"
+)
+
+func TestStatusHandler(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	defer func(at int64) { jobDeadlineAt.Store(at) }(jobDeadlineAt.Load())
+	jobDeadlineAt.Store(time.Now().Add(time.Minute).UnixNano())
+
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/_ping":
+			io.WriteString(w, "OK")
+		case strings.HasSuffix(r.URL.Path, "/containers/json"):
+			io.WriteString(w, `[{"Id":"abc"},{"Id":"def"}]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	dockerClient, err := client.NewClientWithOpts(client.WithHost("unix://" + dockerd.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(builds *buildSet) { activeBuilds = builds }(activeBuilds)
+	activeBuilds = newBuildSet()
+	activeBuilds.add(&buildOutcome{App: "my-app", Time: time.Now()})
+
+	w := httptest.NewRecorder()
+	statusHandler(dockerClient).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/flyio/v1/status", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, but got %d", http.StatusOK, w.Code)
+	}
+
+	var status builderStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Ready || status.Dockerd != "ok" {
+		t.Errorf("expected a ready builder with dockerd ok, but got ready %v, dockerd %q", status.Ready, status.Dockerd)
+	}
+	if status.RunningContainers != 2 {
+		t.Errorf("expected 2 running containers, but got %d", status.RunningContainers)
+	}
+	if len(status.ActiveBuilds) != 1 || status.ActiveBuilds[0].App != "my-app" {
+		t.Errorf("expected the active build for my-app, but got %+v", status.ActiveBuilds)
+	}
+	if status.IdleRemaining <= 0 || status.IdleRemaining > 60 {
+		t.Errorf("expected about a minute left on the idle deadline, but got %fs", status.IdleRemaining)
+	}
+}
@@ -2,6 +2,11 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
@@ -9,23 +14,71 @@ import (
 	"github.com/minio/minio/pkg/disk"
 )
 
+// pruneMu keeps scheduled and on-demand prunes from running on top of each
+// other, dockerd would only make the second one wait anyway.
+var pruneMu sync.Mutex
+
+// needsPrune reports whether /data is past the high-water mark.
+func needsPrune(di disk.Info) bool {
+	if di.Total == 0 {
+		return false
+	}
+	percentUsed := (float64(di.Total-di.Free) / float64(di.Total))
+	return percentUsed >= pruneThresholdUsedPercent || di.Free <= uint64(pruneThresholdFreeBytes)
+}
+
 // tryPrune frees disk space if necessary
 func tryPrune(ctx context.Context, dockerClient *client.Client) {
-	di, err := disk.GetInfo("/data")
+	di, err := disk.GetInfo(dataDir)
 	if err != nil {
 		log.Errorf("could not get disk usage: %v", err)
 		return
 	}
 
-	percentUsed := (float64(di.Total-di.Free) / float64(di.Total))
-	log.Infof("disk space used: %0.2f%%", percentUsed*100)
-	if percentUsed >= pruneThresholdUsedPercent || di.Free <= uint64(pruneThresholdFreeBytes) {
+	log.Infof("disk space used: %0.2f%%", float64(di.Total-di.Free)/float64(di.Total)*100)
+	if needsPrune(di) {
 		log.Info("Not enough disk space, pruning")
-		prune(ctx, dockerClient, "12h")
+		pruneMu.Lock()
+		defer pruneMu.Unlock()
+		prune(ctx, dockerClient, "12h", "high_water")
 	}
 }
 
-func prune(ctx context.Context, dockerClient *client.Client, until string) {
+// schedulePrunes checks disk usage every interval until ctx is done, pruning
+// when it crosses the high-water mark. Checks are skipped while another prune
+// is still running.
+func schedulePrunes(ctx context.Context, dockerClient *client.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		di, err := disk.GetInfo(dataDir)
+		if err != nil {
+			log.Errorf("could not get disk usage: %v", err)
+			continue
+		}
+		if !needsPrune(di) || !pruneMu.TryLock() {
+			continue
+		}
+		log.Infof("disk space used above %0.f%%, pruning", pruneThresholdUsedPercent*100)
+		prune(ctx, dockerClient, "12h", "scheduled")
+		pruneMu.Unlock()
+	}
+}
+
+// prune removes images, volumes and build cache older than until, keeping the
+// most recently used PRUNE_KEEP_CACHE_GB of build cache. It returns the bytes
+// reclaimed.
+func prune(ctx context.Context, dockerClient *client.Client, until, trigger string) uint64 {
+	metricPrunes.inc(trigger)
+	var reclaimed uint64
+
 	imgReport, err := dockerClient.ImagesPrune(ctx, filters.NewArgs(
 		// Remove images created before the duration string (e.g. 12h).
 		filters.Arg("until", until),
@@ -38,6 +91,7 @@ func prune(ctx context.Context, dockerClient *client.Client, until string) {
 		log.Errorf("error pruning images: %v", err)
 	} else {
 		log.Infof("Pruned %d bytes of images", imgReport.SpaceReclaimed)
+		reclaimed += imgReport.SpaceReclaimed
 	}
 
 	volReport, err := dockerClient.VolumesPrune(ctx, filters.NewArgs())
@@ -45,16 +99,49 @@ func prune(ctx context.Context, dockerClient *client.Client, until string) {
 		log.Errorf("error pruning volumes: %v", err)
 	} else {
 		log.Infof("Pruned %d bytes of volumes", volReport.SpaceReclaimed)
+		reclaimed += volReport.SpaceReclaimed
 	}
 
 	bcReport, err := dockerClient.BuildCachePrune(ctx, types.BuildCachePruneOptions{
-		All:     true,
-		Filters: filters.NewArgs(filters.Arg("until", until)),
+		All:         true,
+		KeepStorage: pruneKeepStorage,
+		Filters:     filters.NewArgs(filters.Arg("until", until)),
 	})
 
 	if err != nil {
 		log.Errorf("error pruning build cache: %v", err)
 	} else {
 		log.Infof("Pruned %d bytes from build cache", bcReport.SpaceReclaimed)
+		reclaimed += bcReport.SpaceReclaimed
 	}
+
+	metricPrunedBytes.add(float64(reclaimed))
+	return reclaimed
+}
+
+func pruneHandler(client *client.Client) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		until := strings.TrimSpace(r.URL.Query().Get("since"))
+		if until == "" {
+			until = "1s"
+		}
+
+		pruneMu.Lock()
+		reclaimed := prune(r.Context(), client, until, "request")
+		pruneMu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		err := json.NewEncoder(w).Encode(map[string]uint64{
+			"space_reclaimed": reclaimed,
+		})
+		if err != nil {
+			log.Warnln("error writing prune response", err)
+		}
+	})
 }
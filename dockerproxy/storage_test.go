@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/client"
+	"github.com/minio/minio/pkg/disk"
+	"github.com/superfly/rchab/dockerproxy/internal/harness"
+)
+
+func TestNeedsPrune(t *testing.T) {
+	cases := []struct {
+		name string
+		di   disk.Info
+		want bool
+	}{
+		{"plenty free", disk.Info{Total: 100 * gb, Free: 50 * gb}, false},
+		{"above the high-water mark", disk.Info{Total: 100 * gb, Free: 19 * gb}, true},
+		{"too few bytes free", disk.Info{Total: 50 * gb, Free: 14 * gb}, true},
+		{"unknown size", disk.Info{}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := needsPrune(tc.di); got != tc.want {
+				t.Errorf("expected %v, but got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestPruneHandler(t *testing.T) {
+	var keepStorage string
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/images/prune"):
+			io.WriteString(w, `{"SpaceReclaimed":100}`)
+		case strings.HasSuffix(r.URL.Path, "/volumes/prune"):
+			io.WriteString(w, `{"SpaceReclaimed":20}`)
+		case strings.HasSuffix(r.URL.Path, "/build/prune"):
+			keepStorage = r.URL.Query().Get("keep-storage")
+			io.WriteString(w, `{"SpaceReclaimed":3}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	dockerClient, err := client.NewClientWithOpts(client.WithHost("unix://" + dockerd.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(keep int64) { pruneKeepStorage = keep }(pruneKeepStorage)
+	pruneKeepStorage = 5 * gb
+
+	w := httptest.NewRecorder()
+	pruneHandler(dockerClient).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/flyio/v1/prune", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET to be refused with %d, but got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	pruneHandler(dockerClient).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/flyio/v1/prune?since=1h", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, but got %d", http.StatusOK, w.Code)
+	}
+	var body map[string]uint64
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body["space_reclaimed"] != 123 {
+		t.Errorf("expected 123 bytes reclaimed, but got %d", body["space_reclaimed"])
+	}
+	if keepStorage != "5000000000" {
+		t.Errorf("expected the build cache prune to keep 5GB, but got keep-storage=%q", keepStorage)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/felixge/httpsnoop"
+)
+
+var (
+	eventsPath        = regexp.MustCompile("^(/v[0-9.]*)?/events$")
+	containerLogsPath = regexp.MustCompile("^(/v[0-9.]*)?/containers/[^/]+/logs$")
+)
+
+// followStreams is cancelled once the builder starts shutting down, ending
+// docker events and docker logs -f rather than holding up the drain.
+var followStreams, stopFollowStreams = context.WithCancel(context.Background())
+
+// isFollowStream reports whether r watches dockerd until the client hangs
+// up: docker events, and docker logs -f.
+func isFollowStream(r *http.Request) bool {
+	if eventsPath.MatchString(r.URL.Path) {
+		return true
+	}
+	return containerLogsPath.MatchString(r.URL.Path) && queryBool(r, "follow")
+}
+
+// queryBool reads a boolean query parameter the way dockerd does.
+func queryBool(r *http.Request, key string) bool {
+	switch strings.ToLower(strings.TrimSpace(r.URL.Query().Get(key))) {
+	case "", "0", "no", "false", "none":
+		return false
+	}
+	return true
+}
+
+// serveFollowStream proxies a follow stream with next, which has to flush
+// every write. dockerd answers these with headers straight away and then
+// nothing until there's something to tell, so the headers are flushed too,
+// or clients would sit waiting for the response until the first event.
+func serveFollowStream(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	defer context.AfterFunc(followStreams, cancel)()
+
+	rc := http.NewResponseController(w)
+	w = httpsnoop.Wrap(w, httpsnoop.Hooks{
+		WriteHeader: func(writeHeader httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+			return func(code int) {
+				writeHeader(code)
+				rc.Flush()
+			}
+		},
+	})
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/superfly/rchab/dockerproxy/internal/harness"
+)
+
+func TestIsFollowStream(t *testing.T) {
+	for path, want := range map[string]bool{
+		"/v1.41/events":                          true,
+		"/events?since=1700000000":               true,
+		"/v1.41/containers/abc/logs?follow=1":    true,
+		"/v1.41/containers/abc/logs?follow=true": true,
+		"/v1.41/containers/abc/logs?follow=0":    false,
+		"/v1.41/containers/abc/logs":             false,
+		"/v1.41/containers/json":                 false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if got := isFollowStream(r); got != want {
+			t.Errorf("%s: expected follow stream %v, but got %v", path, want, got)
+		}
+	}
+}
+
+// TestRequestPipelineFollowStream watches docker events through the proxy.
+func TestRequestPipelineFollowStream(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	defer operatorApps.Set(operatorApps.Get())
+	operatorApps.Set([]string{"my-app"})
+	defer func(token string) { operatorToken = token }(operatorToken)
+	operatorToken = "operator-token"
+	defer func(ctx context.Context, stop context.CancelFunc) {
+		followStreams, stopFollowStreams = ctx, stop
+	}(followStreams, stopFollowStreams)
+	followStreams, stopFollowStreams = context.WithCancel(context.Background())
+	defer func(d time.Duration) { proxyFlushInterval = d }(proxyFlushInterval)
+	proxyFlushInterval = time.Minute
+
+	event := make(chan struct{})
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-event:
+				io.WriteString(w, `{"Type":"container","Action":"start"}`+"\n")
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+
+	api := httptest.NewServer(accessLog(newAuthRequest(fakeAuthorizer, newDockerProxy(dockerd))))
+	defer api.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, _ := http.NewRequestWithContext(ctx, http.MethodGet, api.URL+"/v1.41/events", nil)
+	r.SetBasicAuth("my-app", "good-token")
+	r.Header.Set(operatorTokenHeader, "operator-token")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("expected the response before any event, but got %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Fatalf("expected a chunked stream, but got %d %v", resp.StatusCode, resp.TransferEncoding)
+	}
+	if n := pendingRequests.Load(); n != 0 {
+		t.Errorf("expected watching events not to keep the builder running, but %d requests are pending", n)
+	}
+
+	br := bufio.NewReader(resp.Body)
+	for i := 0; i < 2; i++ {
+		event <- struct{}{}
+		line, err := br.ReadString('\n')
+		if err != nil || !strings.Contains(line, `"Action":"start"`) {
+			t.Fatalf("expected the event as dockerd sent it, but got %q, %v", line, err)
+		}
+	}
+
+	// shutting down ends the stream
+	stopFollowStreams()
+	if _, err := io.ReadAll(br); ctx.Err() != nil {
+		t.Errorf("expected the stream to end on shutdown, but got %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/rchab/dockerproxy/internal/daemon"
+)
+
+// daemonProcess is one run of dockerd, or of buildkitd in its place.
+type daemonProcess struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+	// the end of its output, for when it won't start; nil if not kept
+	stderrTail *tailBuffer
+	// the kernel's OOM kill count when it started, see daemon.ClassifyExit
+	oomBefore int64
+}
+
+// daemonSupervisor keeps the daemon builds run on up. If it exits it's
+// restarted, with requests getting 503 until it's back, and after
+// maxRestarts restarts in a row giveUp is called instead.
+type daemonSupervisor struct {
+	name        string
+	logger      logrus.FieldLogger
+	maxRestarts int
+	// start launches a run of the daemon, ready returns once that run takes
+	// requests
+	start func() (*daemonProcess, error)
+	ready func(*daemonProcess) error
+	// stop asks p to exit, it's killed if that takes longer than stopTimeout
+	stop        func(p *daemonProcess) error
+	stopTimeout time.Duration
+	giveUp      func()
+
+	mu       sync.Mutex
+	current  *daemonProcess
+	stopping chan struct{}
+}
+
+// run starts the daemon and returns once it's ready, along with a func
+// stopping it for good.
+func (s *daemonSupervisor) run() (func() error, error) {
+	lastStart := time.Now()
+	p, err := s.start()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ready(p); err != nil {
+		p.cmd.Process.Kill()
+		return nil, err
+	}
+	s.current = p
+	s.stopping = make(chan struct{})
+
+	go s.restart(lastStart)
+	return s.stopCurrent, nil
+}
+
+// restart waits for the current run to exit and starts another.
+func (s *daemonSupervisor) restart(lastStart time.Time) {
+	restarts := 0
+	for {
+		s.mu.Lock()
+		p := s.current
+		s.mu.Unlock()
+
+		select {
+		case <-s.stopping:
+			return
+		case <-p.done:
+		}
+		select {
+		case <-s.stopping:
+			return
+		default:
+		}
+
+		dockerReady.Store(false)
+		recordDaemonExit(daemon.ClassifyExit(s.name, p.cmd.ProcessState, p.oomBefore))
+
+		// tried until a run starts, a failed start has no exit of its own
+		// to record, so it's only counted against maxRestarts
+		for {
+			// one that stayed up for a while crashed on its own, not in a loop
+			if time.Since(lastStart) > dockerdStableAfter {
+				restarts = 0
+			}
+			if restarts >= s.maxRestarts {
+				if p.stderrTail != nil {
+					s.logger.Errorf("%s exited %d times, giving up, %s stderr:\n%s", s.name, restarts+1, s.name, p.stderrTail)
+				} else {
+					s.logger.Errorf("%s exited %d times, giving up", s.name, restarts+1)
+				}
+				s.giveUp()
+				return
+			}
+			backoff := dockerdRestartBackoff(restarts)
+			restarts++
+			s.logger.Errorf("%s exited unexpectedly, restarting in %s (attempt %d of %d)", s.name, backoff, restarts, s.maxRestarts)
+
+			select {
+			case <-s.stopping:
+				return
+			case <-time.After(backoff):
+			}
+
+			lastStart = time.Now()
+			next, err := s.start()
+			if err != nil {
+				s.logger.Errorf("failed to restart %s: %v", s.name, err)
+				continue
+			}
+			s.mu.Lock()
+			s.current = next
+			s.mu.Unlock()
+
+			if err := s.ready(next); err != nil {
+				s.logger.Errorf("restarted %s did not become ready: %v", s.name, err)
+				// kill it, so its exit is recorded and it's restarted again
+				next.cmd.Process.Kill()
+				break
+			}
+			metricDockerdRestarts.inc()
+			dockerReady.Store(true)
+			s.logger.Infof("%s restarted, accepting builds again", s.name)
+			break
+		}
+	}
+}
+
+// stopCurrent stops restarting the daemon and stops the run that's up.
+func (s *daemonSupervisor) stopCurrent() error {
+	close(s.stopping)
+	s.mu.Lock()
+	p := s.current
+	s.mu.Unlock()
+
+	if p.cmd == nil || p.cmd.Process == nil {
+		return nil
+	}
+	select {
+	case <-p.done:
+		return nil
+	default:
+	}
+
+	if err := s.stop(p); err != nil {
+		return err
+	}
+	select {
+	case <-p.done:
+		s.logger.Infof("%s has exited", s.name)
+	case <-time.After(s.stopTimeout):
+		// better than the machine being killed with everything else still up
+		s.logger.Warnf("%s did not exit within %s, killing it", s.name, s.stopTimeout)
+		p.cmd.Process.Kill()
+		<-p.done
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/superfly/rchab/dockerproxy/internal/daemon"
+)
+
+func TestSupervisorFailedRestartRecordsOneExit(t *testing.T) {
+	defer dockerReady.Store(dockerReady.Load())
+
+	starts := 0
+	start := func() (*daemonProcess, error) {
+		starts++
+		if starts > 1 {
+			return nil, errors.New("no more")
+		}
+		p := &daemonProcess{cmd: exec.Command("sleep", "0.1"), done: make(chan struct{})}
+		if err := daemon.StartChild(p.cmd); err != nil {
+			return nil, err
+		}
+		go func() {
+			daemon.WaitChild(p.cmd)
+			close(p.done)
+		}()
+		return p, nil
+	}
+	gaveUp := make(chan struct{})
+	s := &daemonSupervisor{
+		name:        "supervisortest",
+		logger:      log,
+		maxRestarts: 1,
+		start:       start,
+		ready:       func(*daemonProcess) error { return nil },
+		stop:        func(*daemonProcess) error { return nil },
+		giveUp:      func() { close(gaveUp) },
+	}
+	stop, err := s.run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	select {
+	case <-gaveUp:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the supervisor to give up")
+	}
+	if starts != 2 {
+		t.Errorf("expected one restart attempt, but got %d", starts-1)
+	}
+	exits := 0.0
+	metricDaemonExits.mu.Lock()
+	for labels, v := range metricDaemonExits.values {
+		if strings.Contains(labels, `"supervisortest"`) {
+			exits += v
+		}
+	}
+	metricDaemonExits.mu.Unlock()
+	if exits != 1 {
+		t.Errorf("expected the exit to be recorded once, but it was %v times", exits)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/superfly/rchab/dockerproxy/internal/proxy"
+)
+
+// imageTransferPath matches docker load and save, which stream whole images.
+var imageTransferPath = regexp.MustCompile("^(/v[0-9.]*)?/images/(load|get|.+/get)$")
+
+// containerWaitPath is how docker run waits for a container to exit, which
+// is answered once it does.
+var containerWaitPath = regexp.MustCompile("^(/v[0-9.]*)?/containers/[^/]+/wait$")
+
+// isStreamingRequest reports whether r can legitimately run for as long as a
+// build does: builds and their sessions, image transfers, gRPC calls,
+// waiting for containers, follow streams and hijacked connections. These get
+// no read or write deadline.
+func isStreamingRequest(r *http.Request) bool {
+	if proxy.IsUpgrade(r) || isGRPCRequest(r) || isFollowStream(r) {
+		return true
+	}
+	for _, path := range []*regexp.Regexp{buildPath, sessionPath, grpcPath, imagePushPath, imagePullPath, imageTransferPath, containerWaitPath} {
+		if path.MatchString(r.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyServerLimits bounds how long clients get to send their headers, how
+// big those can be, and how long idle keep-alive connections stay open.
+// These are the same for every request, slow clients are turned away before
+// it's known which request they're making.
+func applyServerLimits(s *http.Server, c ServerConfig) *http.Server {
+	s.ReadHeaderTimeout = c.ReadHeaderTimeout
+	s.IdleTimeout = c.IdleTimeout
+	s.MaxHeaderBytes = c.MaxHeaderBytes
+	return s
+}
+
+// pathTimeout bounds requests for paths matching path, both sending their
+// body and being answered, streaming or not. 0 doesn't limit them.
+type pathTimeout struct {
+	path    *regexp.Regexp
+	timeout time.Duration
+}
+
+// parsePathTimeouts reads PATH_TIMEOUTS, regexp=duration entries separated
+// by commas. The duration is after the last =, regular expressions can
+// have one too.
+func parsePathTimeouts(val string) ([]pathTimeout, error) {
+	var timeouts []pathTimeout
+	for _, entry := range splitList(val) {
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid PATH_TIMEOUTS entry %q, expected regexp=duration", entry)
+		}
+		path, err := regexp.Compile(entry[:i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid PATH_TIMEOUTS entry %q: %v", entry, err)
+		}
+		timeout, err := time.ParseDuration(entry[i+1:])
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("invalid PATH_TIMEOUTS entry %q, expected a duration like 4h after the =", entry)
+		}
+		timeouts = append(timeouts, pathTimeout{path: path, timeout: timeout})
+	}
+	return timeouts, nil
+}
+
+// requestTimeouts is how long r gets to send its body and to be answered:
+// the timeout of the first of c.PathTimeouts matching its path, otherwise
+// none for streaming requests and c.ReadTimeout and c.WriteTimeout for the
+// rest.
+func requestTimeouts(c ServerConfig, r *http.Request) (read, write time.Duration) {
+	for _, pt := range c.PathTimeouts {
+		if pt.path.MatchString(r.URL.Path) {
+			return pt.timeout, pt.timeout
+		}
+	}
+	if isStreamingRequest(r) {
+		return 0, 0
+	}
+	return c.ReadTimeout, c.WriteTimeout
+}
+
+// requestDeadlines sets the read and write deadlines of each request from
+// its requestTimeouts, 0 for no limit. It sets them per request rather than
+// on the server, since the server's would cut off hour-long builds. It has
+// to wrap the server's own ResponseWriter to reach the connection.
+func requestDeadlines(c ServerConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// cleared rather than left alone, the server doesn't reset a
+		// previous request's write deadline on a keep-alive connection
+		var readDeadline, writeDeadline time.Time
+		readTimeout, writeTimeout := requestTimeouts(c, r)
+		now := time.Now()
+		if readTimeout > 0 {
+			readDeadline = now.Add(readTimeout)
+		}
+		if writeTimeout > 0 {
+			writeDeadline = now.Add(writeTimeout)
+		}
+
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(readDeadline); err != nil {
+			requestLogger(r.Context()).Debugf("could not set the read deadline: %v", err)
+		}
+		if err := rc.SetWriteDeadline(writeDeadline); err != nil {
+			requestLogger(r.Context()).Debugf("could not set the write deadline: %v", err)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
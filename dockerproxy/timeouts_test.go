@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsStreamingRequest(t *testing.T) {
+	for path, want := range map[string]bool{
+		"/v1.41/build":                           true,
+		"/session":                               true,
+		"/v1.41/images/registry.fly.io/app/push": true,
+		"/v1.41/images/create":                   true,
+		"/v1.41/images/load":                     true,
+		"/v1.41/images/get":                      true,
+		"/v1.41/images/alpine/get":               true,
+		"/v1.41/containers/abc/wait":             true,
+		"/v1.41/containers/json":                 false,
+		"/v1.41/images/json":                     false,
+		"/flyio/v1/status":                       false,
+	} {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		if got := isStreamingRequest(r); got != want {
+			t.Errorf("%s: expected streaming %v, but got %v", path, want, got)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/v1.41/exec/abc/start", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "tcp")
+	if !isStreamingRequest(r) {
+		t.Error("expected an upgraded connection to be streaming")
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/moby.buildkit.v1.Control/Status", nil)
+	r.ProtoMajor = 2
+	r.Header.Set("Content-Type", "application/grpc")
+	if !isStreamingRequest(r) {
+		t.Error("expected a gRPC call to be streaming")
+	}
+}
+
+func TestRequestDeadlines(t *testing.T) {
+	// answers slower than the write timeout, in more than one write so the
+	// deadline is hit rather than the response sitting in a buffer
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			time.Sleep(100 * time.Millisecond)
+			io.WriteString(w, strings.Repeat("x", 64<<10))
+			w.(http.Flusher).Flush()
+		}
+	})
+	server := httptest.NewServer(requestDeadlines(ServerConfig{ReadTimeout: time.Minute, WriteTimeout: 50 * time.Millisecond}, slow))
+	defer server.Close()
+
+	get := func(path string) error {
+		resp, err := http.Post(server.URL+path, "application/json", nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+
+	if err := get("/v1.41/containers/json"); err == nil {
+		t.Error("expected a slow answer to a bounded request to be cut off")
+	}
+	if err := get("/v1.41/build"); err != nil {
+		t.Errorf("expected a build to take as long as it needs, but got %v", err)
+	}
+}
+
+func TestRequestTimeouts(t *testing.T) {
+	c, err := loadConfig(nil, []string{`PATH_TIMEOUTS=^(/v[0-9.]*)?/build$=4h, ^(/v[0-9.]*)?/containers/json$=5s, /events=0`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]time.Duration{
+		"/v1.41/build":           4 * time.Hour,
+		"/v1.41/containers/json": 5 * time.Second,
+		"/v1.41/events":          0,
+		"/v1.41/images/create":   0,
+		"/v1.41/images/json":     15 * time.Minute,
+	} {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		if read, write := requestTimeouts(c.Server, r); read != want || write != want {
+			t.Errorf("%s: expected %s, but got %s to read and %s to write", path, want, read, write)
+		}
+	}
+
+	for _, val := range []string{"/build", "/build=forever", "(=1s", "/build=-1s"} {
+		if _, err := loadConfig(nil, []string{"PATH_TIMEOUTS=" + val}); err == nil || !strings.Contains(err.Error(), "PATH_TIMEOUTS") {
+			t.Errorf("%s: expected an error, but got %v", val, err)
+		}
+	}
+}
+
+func TestRequestDeadlinesPathTimeout(t *testing.T) {
+	// builds are streaming, but capped by PATH_TIMEOUTS
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			time.Sleep(100 * time.Millisecond)
+			io.WriteString(w, strings.Repeat("x", 64<<10))
+			w.(http.Flusher).Flush()
+		}
+	})
+	timeouts, err := parsePathTimeouts("/build$=50ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(requestDeadlines(ServerConfig{PathTimeouts: timeouts}, slow))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/v1.41/build", "application/json", nil)
+	if err == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Error("expected a build over its path timeout to be cut off")
+	}
+}
+
+func TestRequestDeadlinesKeepAlive(t *testing.T) {
+	// fast answers leave the connection open with a deadline set, which the
+	// next request mustn't inherit
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if buildPath.MatchString(r.URL.Path) {
+			time.Sleep(200 * time.Millisecond)
+		}
+		io.WriteString(w, "OK")
+	})
+	server := httptest.NewServer(requestDeadlines(ServerConfig{ReadTimeout: time.Minute, WriteTimeout: 100 * time.Millisecond}, h))
+	defer server.Close()
+
+	client := server.Client()
+	for _, path := range []string{"/_ping", "/v1.41/build"} {
+		resp, err := client.Post(server.URL+path, "application/json", nil)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(body) != "OK" {
+			t.Errorf("%s: expected OK, but got %q, %v", path, body, err)
+		}
+	}
+}
+
+func TestApplyServerLimits(t *testing.T) {
+	c, err := loadConfig(nil, []string{"READ_HEADER_TIMEOUT=5s", "MAX_HEADER_BYTES=4096"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := applyServerLimits(&http.Server{}, c.Server)
+	if s.ReadHeaderTimeout != 5*time.Second || s.IdleTimeout != 2*time.Minute || s.MaxHeaderBytes != 4096 {
+		t.Errorf("expected the configured limits, but got %s, %s, %d", s.ReadHeaderTimeout, s.IdleTimeout, s.MaxHeaderBytes)
+	}
+	if s.ReadTimeout != 0 || s.WriteTimeout != 0 {
+		t.Error("expected no server wide read or write timeout")
+	}
+
+	if _, err := loadConfig(nil, []string{"MAX_HEADER_BYTES=0"}); err == nil || !strings.Contains(err.Error(), "MAX_HEADER_BYTES") {
+		t.Errorf("expected MAX_HEADER_BYTES=0 to be an error, but got %v", err)
+	}
+}
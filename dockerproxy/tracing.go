@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// traceparentPattern matches a version 00 W3C traceparent header.
+var traceparentPattern = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+const (
+	invalidTraceID = "00000000000000000000000000000000"
+	invalidSpanID  = "0000000000000000"
+)
+
+// traceContext identifies this builder's span within a W3C trace.
+type traceContext struct {
+	traceID  string
+	parentID string
+	spanID   string
+	flags    string
+}
+
+// newTraceContext joins the client's trace when it sent a valid traceparent,
+// and starts a new one otherwise.
+func newTraceContext(r *http.Request) traceContext {
+	tc := traceContext{spanID: randomHex(8), flags: "01"}
+
+	if m := traceparentPattern.FindStringSubmatch(r.Header.Get("traceparent")); m != nil && m[1] != invalidTraceID && m[2] != invalidSpanID {
+		tc.traceID, tc.parentID, tc.flags = m[1], m[2], m[3]
+		return tc
+	}
+
+	tc.traceID = randomHex(16)
+	return tc
+}
+
+// traceparent formats the header dockerd and anything else downstream should
+// see, with this builder's span as their parent.
+func (tc traceContext) traceparent() string {
+	return "00-" + tc.traceID + "-" + tc.spanID + "-" + tc.flags
+}
+
+// sampled reports whether the client asked for the trace to be recorded.
+func (tc traceContext) sampled() bool {
+	flags, err := strconv.ParseUint(tc.flags, 16, 8)
+	return err == nil && flags&1 == 1
+}
+
+// span is a timed phase of a request, like the auth lookup or the round trip
+// to dockerd, exported as a child of the request's span. Spans of requests
+// that didn't go through accessLog are nil, and all methods are no-ops then.
+type span struct {
+	info     *requestInfo
+	name     string
+	spanID   string
+	parentID string
+	start    time.Time
+	end      time.Time
+	attrs    map[string]any
+	err      string
+}
+
+// startSpan starts a span for ctx's request, as a child of the span already
+// in ctx if there is one.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	info := requestInfoFromContext(ctx)
+	if info == nil {
+		return ctx, nil
+	}
+	parentID := info.trace.spanID
+	if parent := spanFromContext(ctx); parent != nil {
+		parentID = parent.spanID
+	}
+	s := &span{
+		info:     info,
+		name:     name,
+		spanID:   randomHex(8),
+		parentID: parentID,
+		start:    time.Now(),
+		attrs:    map[string]any{},
+	}
+	return context.WithValue(ctx, currentSpanKey, s), s
+}
+
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(currentSpanKey).(*span)
+	return s
+}
+
+// set records an attribute, a string, bool or integer.
+func (s *span) set(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.info.mu.Lock()
+	s.attrs[key] = value
+	s.info.mu.Unlock()
+}
+
+func (s *span) fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.info.mu.Lock()
+	s.err = err.Error()
+	s.info.mu.Unlock()
+}
+
+// finish ends the span and keeps it for export along with its request.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.info.mu.Lock()
+	s.end = time.Now()
+	s.info.spans = append(s.info.spans, s)
+	s.info.mu.Unlock()
+}
+
+// tracedDialer wraps dial in a dockerd.dial span.
+func tracedDialer(dial func(ctx context.Context) (net.Conn, error)) func(ctx context.Context) (net.Conn, error) {
+	return func(ctx context.Context) (net.Conn, error) {
+		_, s := startSpan(ctx, "dockerd.dial")
+		defer s.finish()
+		conn, err := dial(ctx)
+		s.fail(err)
+		return conn, err
+	}
+}
+
+// tracedTransport times requests to dockerd up to the response headers.
+// Streamed bodies like build output are part of the request's own span.
+type tracedTransport struct {
+	http.RoundTripper
+}
+
+func (t tracedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx, s := startSpan(r.Context(), "dockerd.request")
+	defer s.finish()
+	s.set("http.method", r.Method)
+	s.set("http.path", r.URL.Path)
+
+	resp, err := t.RoundTripper.RoundTrip(r.WithContext(ctx))
+	if err != nil {
+		s.fail(err)
+		return nil, err
+	}
+	s.set("http.status_code", resp.StatusCode)
+	return resp, nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Warnln("error generating random id", err)
+	}
+	return hex.EncodeToString(b)
+}
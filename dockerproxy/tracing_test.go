@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewTraceContext(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/_ping", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	tc := newTraceContext(r)
+	if tc.traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || tc.parentID != "00f067aa0ba902b7" {
+		t.Errorf("expected to join the client's trace, but got %+v", tc)
+	}
+	if tc.spanID == tc.parentID || len(tc.spanID) != 16 {
+		t.Errorf("expected a new span id, but got %q", tc.spanID)
+	}
+	if !traceparentPattern.MatchString(tc.traceparent()) {
+		t.Errorf("expected a valid traceparent, but got %q", tc.traceparent())
+	}
+}
+
+func TestNewTraceContextInvalid(t *testing.T) {
+	for _, header := range []string{
+		"",
+		"garbage",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/_ping", nil)
+		r.Header.Set("traceparent", header)
+
+		tc := newTraceContext(r)
+		if tc.parentID != "" || len(tc.traceID) != 32 || tc.traceID == "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("%q: expected a new trace, but got %+v", header, tc)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/superfly/rchab/dockerproxy/internal/proxy"
+)
+
+// dockerDialer connects to the dockerd at target, over its unix socket, TCP
+// or ssh, retrying for up to DOCKERD_DIAL_TIMEOUT while it isn't listening.
+func dockerDialer(target *url.URL) func(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	switch target.Scheme {
+	case "unix":
+		return tracedDialer(retryDial(func(ctx context.Context) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", target.Path)
+		}, dockerdDialTimeout))
+	case "ssh":
+		return tracedDialer(func(ctx context.Context) (net.Conn, error) {
+			return dialSSH(ctx, target)
+		})
+	}
+	return tracedDialer(retryDial(func(ctx context.Context) (net.Conn, error) {
+		return dialer.DialContext(ctx, "tcp", target.Host)
+	}, dockerdDialTimeout))
+}
+
+// upgradeProxy proxies requests that hijack the connection. Unlike
+// httputil.ReverseProxy it passes half-closes through, so the remote end
+// still gets to answer once the client's stdin is done, and it lifts the
+// server's read and write timeouts from the hijacked connection so
+// interactive sessions can outlast them.
+type upgradeProxy struct {
+	dial func(ctx context.Context) (net.Conn, error)
+}
+
+func newUpgradeProxy(target *url.URL) *upgradeProxy {
+	return &upgradeProxy{dial: dockerDialer(target)}
+}
+
+func (p *upgradeProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l := requestLogger(r.Context())
+	backend, err := p.dial(r.Context())
+	if err != nil {
+		l.Errorf("error proxying to dockerd path=%s: %v", r.URL.Path, err)
+		writeDockerError(w, http.StatusBadGateway, "could not reach the Docker daemon on the builder")
+		return
+	}
+	defer backend.Close()
+
+	outreq := r.Clone(r.Context())
+	outreq.RequestURI = ""
+	if err := outreq.Write(backend); err != nil {
+		l.Errorf("error proxying to dockerd path=%s: %v", r.URL.Path, err)
+		writeDockerError(w, http.StatusBadGateway, "could not reach the Docker daemon on the builder")
+		return
+	}
+
+	backendReader := bufio.NewReader(backend)
+	resp, err := http.ReadResponse(backendReader, outreq)
+	if err != nil {
+		l.Errorf("error reading dockerd response path=%s: %v", r.URL.Path, err)
+		writeDockerError(w, http.StatusBadGateway, "could not reach the Docker daemon on the builder")
+		return
+	}
+
+	// dockerd refused the upgrade, pass its answer on as is
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	conn, clientRW, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		l.Errorf("could not hijack connection path=%s: %v", r.URL.Path, err)
+		writeDockerError(w, http.StatusInternalServerError, "could not switch protocols")
+		return
+	}
+	defer conn.Close()
+	defer hijackedConns.Track(conn)()
+	conn.SetDeadline(time.Time{})
+
+	if err := resp.Write(clientRW); err != nil {
+		l.Warnf("error writing upgrade response path=%s: %v", r.URL.Path, err)
+		return
+	}
+	if err := clientRW.Flush(); err != nil {
+		l.Warnf("error writing upgrade response path=%s: %v", r.URL.Path, err)
+		return
+	}
+
+	proxy.Splice(r.Context(), conn, clientRW, backend, backendReader)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+)
+
+// docker pull and the pulls before a push go through /images/create
+var imagePullPath = regexp.MustCompile("^(/v[0-9.]*)?/images/create$")
+
+var usageSince = time.Now()
+
+// appUsage counts what each app has used the builder for since it started,
+// for charging apps back for a builder they share.
+type appUsage struct {
+	mu   sync.Mutex
+	apps map[string]*usageCounters
+}
+
+type usageCounters struct {
+	BuildsStarted   int64   `json:"builds_started"`
+	BuildsSucceeded int64   `json:"builds_succeeded"`
+	BuildsFailed    int64   `json:"builds_failed"`
+	BuildSeconds    float64 `json:"build_seconds"`
+	BytesPushed     int64   `json:"bytes_pushed"`
+	BytesPulled     int64   `json:"bytes_pulled"`
+}
+
+func newAppUsage() *appUsage {
+	return &appUsage{apps: map[string]*usageCounters{}}
+}
+
+// add updates app's counters with fn.
+func (u *appUsage) add(app string, fn func(*usageCounters)) {
+	if app == "" {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	c, ok := u.apps[app]
+	if !ok {
+		c = &usageCounters{}
+		u.apps[app] = c
+	}
+	fn(c)
+}
+
+func (u *appUsage) snapshot() map[string]usageCounters {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	out := make(map[string]usageCounters, len(u.apps))
+	for app, c := range u.apps {
+		out[app] = *c
+	}
+	return out
+}
+
+// transferStats follows the JSON progress stream of a push or pull for the
+// bytes moved: how far each layer got. Layers already in place move nothing.
+type transferStats struct {
+	partial []byte
+	layers  map[string]int64
+}
+
+func (t *transferStats) Write(p []byte) (int, error) {
+	t.partial = splitMessages(append(t.partial, p...), t.message)
+	return len(p), nil
+}
+
+func (t *transferStats) message(line []byte) {
+	var msg struct {
+		ID             string `json:"id"`
+		Status         string `json:"status"`
+		ProgressDetail struct {
+			Current int64 `json:"current"`
+		} `json:"progressDetail"`
+	}
+	if len(line) == 0 || json.Unmarshal(line, &msg) != nil {
+		return
+	}
+	if (msg.Status == "Pushing" || msg.Status == "Downloading") && msg.ProgressDetail.Current > t.layers[msg.ID] {
+		t.layers[msg.ID] = msg.ProgressDetail.Current
+	}
+}
+
+func (t *transferStats) total() int64 {
+	var total int64
+	for _, n := range t.layers {
+		total += n
+	}
+	return total
+}
+
+// serveTransfer proxies a push or pull, adding the bytes it moved to the
+// app's usage.
+func serveTransfer(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	stats := &transferStats{layers: map[string]int64{}}
+	w = httpsnoop.Wrap(w, httpsnoop.Hooks{
+		Write: func(write httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+			return func(b []byte) (int, error) {
+				stats.Write(b)
+				return write(b)
+			}
+		},
+	})
+
+	var app string
+	if info := requestInfoFromContext(r.Context()); info != nil {
+		app = info.appName
+	}
+	// like builds, the proxy panics when the client hangs up mid-stream
+	defer func() {
+		pushed := imagePushPath.MatchString(r.URL.Path)
+		appsUsage.add(app, func(c *usageCounters) {
+			if pushed {
+				c.BytesPushed += stats.total()
+			} else {
+				c.BytesPulled += stats.total()
+			}
+		})
+	}()
+
+	next.ServeHTTP(w, r)
+}
+
+func appUsageHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(newUsageReport()); err != nil {
+			log.Warnln("error writing usage response", err)
+		}
+	})
+}
+
+// usageReport is what's reported to USAGE_REPORT_URL. Counters add up from
+// when the builder started, so a lost report loses nothing. Receivers tell
+// builders apart by machine.
+type usageReport struct {
+	Machine string                   `json:"machine"`
+	Since   time.Time                `json:"since"`
+	Time    time.Time                `json:"time"`
+	Apps    map[string]usageCounters `json:"apps"`
+}
+
+func newUsageReport() usageReport {
+	return usageReport{
+		Machine: os.Getenv("FLY_MACHINE_ID"),
+		Since:   usageSince,
+		Time:    time.Now(),
+		Apps:    appsUsage.snapshot(),
+	}
+}
+
+// reportUsage posts a usage report every interval until ctx is done. Nothing
+// is reported before any app has used the builder.
+func reportUsage(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if len(appsUsage.snapshot()) == 0 {
+			continue
+		}
+		if err := sendUsageReport(ctx); err != nil {
+			log.Warnf("could not report usage: %v", err)
+		}
+	}
+}
+
+func sendUsageReport(ctx context.Context) error {
+	body, err := json.Marshal(newUsageReport())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, usageReportURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if usageReportToken != "" {
+		req.Header.Set("Authorization", "Bearer "+usageReportToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("%s answered %s", usageReportURL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/superfly/rchab/dockerproxy/internal/harness"
+)
+
+func TestRequestPipelineRecordsUsage(t *testing.T) {
+	defer dockerReady.Store(false)
+	dockerReady.Store(true)
+	defer func(usage *appUsage) { appsUsage = usage }(appsUsage)
+	appsUsage = newAppUsage()
+
+	dockerd := harness.ServeUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case buildPath.MatchString(r.URL.Path):
+			io.WriteString(w, `{"stream":"Successfully built abc"}`+"\n")
+		case imagePushPath.MatchString(r.URL.Path):
+			io.WriteString(w, `{"status":"Pushing","progressDetail":{"current":100,"total":300},"id":"a"}`+"\r\n"+
+				`{"status":"Pushing","progressDetail":{"current":300,"total":300},"id":"a"}`+"\r\n"+
+				`{"status":"Pushed","progressDetail":{},"id":"a"}`+"\r\n"+
+				`{"status":"Layer already exists","progressDetail":{},"id":"b"}`+"\r\n"+
+				`{"status":"Pushing","progressDetail":{"current":50,"total":50},"id":"c"}`+"\r\n")
+		case imagePullPath.MatchString(r.URL.Path):
+			io.WriteString(w, `{"status":"Downloading","progressDetail":{"current":70,"total":70},"id":"a"}`+"\r\n")
+		}
+	}))
+
+	h := accessLog(newAuthRequest(fakeAuthorizer, newDockerProxy(dockerd)))
+	for _, path := range []string{"/v1.41/build", "/v1.41/build", "/v1.41/images/registry.fly.io/my-app/push", "/v1.41/images/create"} {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r.SetBasicAuth("my-app", "good-token")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	usage := appsUsage.snapshot()["my-app"]
+	if usage.BuildsStarted != 2 || usage.BuildsSucceeded != 2 || usage.BuildsFailed != 0 {
+		t.Errorf("expected 2 successful builds, but got %+v", usage)
+	}
+	if usage.BytesPushed != 350 || usage.BytesPulled != 70 {
+		t.Errorf("expected 350 bytes pushed and 70 pulled, but got %+v", usage)
+	}
+}
+
+func TestSendUsageReport(t *testing.T) {
+	defer func(usage *appUsage, url, token string) {
+		appsUsage, usageReportURL, usageReportToken = usage, url, token
+	}(appsUsage, usageReportURL, usageReportToken)
+	appsUsage = newAppUsage()
+	appsUsage.add("my-app", func(c *usageCounters) { c.BuildsFailed++ })
+
+	var report usageReport
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&report)
+	}))
+	defer server.Close()
+	usageReportURL, usageReportToken = server.URL, "secret"
+
+	if err := sendUsageReport(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if report.Apps["my-app"].BuildsFailed != 1 || report.Since.IsZero() {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	usageReportToken = "wrong"
+	if err := sendUsageReport(context.Background()); err == nil {
+		t.Error("expected an error when the endpoint refuses the report")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// allowInsecureConfig lets the builder start with settings that are fine for
+// local dev but dangerous on Fly, see validateConfig.
+var allowInsecureConfig = os.Getenv("ALLOW_INSECURE_CONFIG") == "1"
+
+// validateConfig checks the settings before anything starts, so a builder
+// that would turn every client away, or let anyone in, doesn't start at all.
+// Settings that only make sense in local dev are refused on Fly, where
+// FLY_APP_NAME is set, unless ALLOW_INSECURE_CONFIG=1.
+func validateConfig() error {
+	var errs []error
+
+	if val, ok := os.LookupEnv("ALLOW_ORG_SLUG"); ok && len(splitList(val)) == 0 {
+		errs = append(errs, fmt.Errorf("ALLOW_ORG_SLUG is set to %q, which names no organization, unset it to accept the builder's own", val))
+	}
+	if authMode == authModeFly && !noAuth && !noAppName && len(allowedOrgSlugs.Get()) == 0 && os.Getenv("FLY_APP_NAME") == "" {
+		errs = append(errs, errors.New("AUTH_MODE=fly needs FLY_APP_NAME to find the builder's organization, or ALLOW_ORG_SLUG"))
+	}
+
+	if authMode == authModeJWT && !noAuth {
+		for _, key := range []string{"JWT_ISSUER", "JWT_AUDIENCE"} {
+			if os.Getenv(key) == "" {
+				errs = append(errs, fmt.Errorf("AUTH_MODE=jwt needs %s, or tokens any client of the issuer can get would be let in", key))
+			}
+		}
+	}
+
+	if mockFlyAPI && authMode != authModeFly {
+		errs = append(errs, fmt.Errorf("MOCK_FLY_API=1 needs AUTH_MODE=fly, but it's %q", authMode))
+	}
+
+	switch mode := os.Getenv("AUTH_API_FAILURE_MODE"); mode {
+	case "", "closed", "open":
+	default:
+		errs = append(errs, fmt.Errorf("unknown AUTH_API_FAILURE_MODE %q, expected \"open\" or \"closed\"", mode))
+	}
+	switch mode := os.Getenv("SERIALIZE_APP_BUILDS"); mode {
+	case "", serializeBuildsWait, serializeBuildsReject:
+	default:
+		errs = append(errs, fmt.Errorf("unknown SERIALIZE_APP_BUILDS %q, expected %q or %q", mode, serializeBuildsWait, serializeBuildsReject))
+	}
+
+	if adminAddr != "" && adminToken == "" {
+		errs = append(errs, errors.New("ADMIN_ADDR needs ADMIN_TOKEN, admin routes are disabled without one"))
+	}
+	if len(operatorApps.Get()) > 0 && operatorToken == "" {
+		errs = append(errs, errors.New("OPERATOR_APPS needs OPERATOR_TOKEN, operators are refused without one"))
+	}
+	if builderOrgNeeded() && builderOrgSlug == "" && builderToken == "" {
+		errs = append(errs, errors.New("FLY_ORG or FLY_API_TOKEN has to be set, to know the builder's organization before taking requests"))
+	}
+	if os.Getenv("BUILDKIT_ADDR") != "" && !noAuth {
+		switch {
+		case authMode == authModeFly && builderToken == "":
+			errs = append(errs, errors.New("BUILDKIT_ADDR needs FLY_API_TOKEN, the apps buildkit clients' certificates name are looked up with it"))
+		case authMode == authModeStatic || authMode == authModeJWT:
+			errs = append(errs, fmt.Errorf("BUILDKIT_ADDR can't be used with AUTH_MODE=%s, certificates carry no token to check", authMode))
+		}
+	}
+
+	if os.Getenv("FLY_APP_NAME") != "" {
+		var insecure []string
+		if noAuth {
+			insecure = append(insecure, "NO_AUTH=1 lets anyone use the builder")
+		}
+		if authMode == authModeNone {
+			insecure = append(insecure, "AUTH_MODE=none lets anyone use the builder")
+		}
+		if noAppName {
+			insecure = append(insecure, "NO_APP_NAME=1 lets apps from any organization use the builder")
+		}
+		if mockFlyAPI {
+			insecure = append(insecure, "MOCK_FLY_API=1 lets anyone with a mock token use the builder")
+		}
+		if noFilter {
+			insecure = append(insecure, "NO_FILTER=1 lets clients use the whole Docker API")
+		}
+		for _, setting := range insecure {
+			if !allowInsecureConfig {
+				errs = append(errs, fmt.Errorf("%s, set ALLOW_INSECURE_CONFIG=1 if that's intended", setting))
+				continue
+			}
+			log.Warnf("%s, allowed by ALLOW_INSECURE_CONFIG", setting)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// secretSettingWords mark settings whose values are redacted when logged.
+var secretSettingWords = []string{"TOKEN", "SECRET", "PASSWORD", "KEY", "AUTH", "CREDENTIAL"}
+
+// processSettings are set by the OS or shell rather than to configure the
+// builder, so aren't worth logging.
+var processSettings = map[string]bool{"HOME": true, "HOSTNAME": true, "OLDPWD": true, "PATH": true, "PWD": true, "SHLVL": true, "TERM": true, "_": true}
+
+// effectiveConfig is the environment the builder runs with, with secrets
+// redacted: the values of settings named like secrets, and passwords in
+// URLs. Paths to files of secrets, the _FILE settings, are kept.
+func effectiveConfig() map[string]string {
+	config := map[string]string{}
+	for _, kv := range os.Environ() {
+		key, val, _ := strings.Cut(kv, "=")
+		if processSettings[key] {
+			continue
+		}
+		config[key] = redactSetting(key, val)
+	}
+	return config
+}
+
+func redactSetting(key, val string) string {
+	if val == "" || val == "0" || val == "1" || strings.HasSuffix(key, "_FILE") {
+		return val
+	}
+	for _, word := range secretSettingWords {
+		if strings.Contains(key, word) {
+			return "[redacted]"
+		}
+	}
+	if u, err := url.Parse(val); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "redacted")
+			return u.String()
+		}
+	}
+	return val
+}
+
+// logEffectiveConfig logs the settings the builder starts with, so what it
+// was told is in the logs when it doesn't behave.
+func logEffectiveConfig() {
+	fields := logrus.Fields{}
+	for key, val := range effectiveConfig() {
+		fields[key] = val
+	}
+	log.WithFields(fields).Info("effective configuration")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/superfly/rchab/dockerproxy/internal/daemon"
+)
+
+const buildxInspectTimeout = 10 * time.Second
+
+type builderVersion struct {
+	Version   string   `json:"version"`
+	BuildTime string   `json:"build_time"`
+	GoVersion string   `json:"go_version"`
+	Dockerd   string   `json:"dockerd,omitempty"`
+	Buildkit  string   `json:"buildkit,omitempty"`
+	Platforms []string `json:"platforms,omitempty"`
+}
+
+// versionHandler reports what the builder is running. dockerd and buildkit
+// versions are left out when they can't be had, e.g. while dockerd restarts.
+func versionHandler(dockerClient *client.Client) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		logger := requestLogger(r.Context())
+
+		version := builderVersion{
+			Version:   gitSha,
+			BuildTime: buildTime,
+			GoVersion: runtime.Version(),
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), healthPingTimeout)
+		defer cancel()
+		if v, err := dockerClient.ServerVersion(ctx); err != nil {
+			logger.Warnf("could not get the dockerd version: %v", err)
+		} else {
+			version.Dockerd = v.Version
+		}
+
+		ctx, cancel = context.WithTimeout(r.Context(), buildxInspectTimeout)
+		defer cancel()
+		var out bytes.Buffer
+		cmd := exec.CommandContext(ctx, "docker", "buildx", "inspect")
+		cmd.Stdout = &out
+		if err := daemon.RunChild(cmd); err != nil {
+			logger.Warnf("could not inspect the buildx builder: %v", err)
+		} else {
+			version.Buildkit, version.Platforms = parseBuildxInspect(out.String())
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(version); err != nil {
+			log.Warnln("error writing version response", err)
+		}
+	})
+}
+
+// parseBuildxInspect picks the buildkit version and platforms out of
+// `docker buildx inspect` output, from the first node that lists them.
+func parseBuildxInspect(out string) (buildkit string, platforms []string) {
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "Buildkit", "BuildKit version":
+			if buildkit == "" {
+				buildkit = value
+			}
+		case "Platforms":
+			if platforms == nil {
+				for _, p := range strings.Split(value, ",") {
+					if p = strings.TrimSpace(p); p != "" {
+						platforms = append(platforms, strings.TrimSuffix(p, "*"))
+					}
+				}
+			}
+		}
+	}
+	return buildkit, platforms
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBuildxInspect(t *testing.T) {
+	out := `Name:          default
+Driver:        docker
+Last Activity: 2024-01-10 12:00:00 +0000 UTC
+
+Nodes:
+Name:      default
+Endpoint:  default
+Status:    running
+Buildkit:  v0.12.5
+Platforms: linux/amd64, linux/amd64/v2, linux/arm64*, linux/386
+Labels:
+ org.mobyproject.buildkit.worker.moby.host-gateway-ip: 172.17.0.1
+`
+	buildkit, platforms := parseBuildxInspect(out)
+	if buildkit != "v0.12.5" {
+		t.Errorf("expected buildkit v0.12.5, but got %q", buildkit)
+	}
+	want := []string{"linux/amd64", "linux/amd64/v2", "linux/arm64", "linux/386"}
+	if !reflect.DeepEqual(platforms, want) {
+		t.Errorf("expected platforms %v, but got %v", want, platforms)
+	}
+
+	if buildkit, platforms := parseBuildxInspect("Name: default\n"); buildkit != "" || platforms != nil {
+		t.Errorf("expected nothing from output without nodes, but got %q and %v", buildkit, platforms)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	buildEventStarted   = "build.started"
+	buildEventSucceeded = "build.succeeded"
+	buildEventFailed    = "build.failed"
+
+	webhookAttempts = 3
+)
+
+// buildWebhook notifies WEBHOOK_URL of builds starting and finishing. nil,
+// notifying nobody, unless WEBHOOK_URL is set.
+var buildWebhook = newWebhookSender()
+
+type buildEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	App   string    `json:"app"`
+	// set once the build is done
+	Status          string  `json:"status,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+	// the ID of the image built, sha256 of its config
+	ImageDigest string           `json:"image_digest,omitempty"`
+	Cache       *buildEventCache `json:"cache,omitempty"`
+}
+
+type buildEventCache struct {
+	Steps  int `json:"steps"`
+	Cached int `json:"cached"`
+}
+
+// webhookSender posts build events as JSON, one at a time in the order they
+// happened. The body is signed with an HMAC-SHA256 of WEBHOOK_SECRET in
+// X-Rchab-Signature, so receivers can tell the events are the builder's.
+type webhookSender struct {
+	*batchSender[buildEvent]
+
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func newWebhookSender() *webhookSender {
+	url := os.Getenv("WEBHOOK_URL")
+	if url == "" {
+		return nil
+	}
+	s := &webhookSender{
+		url:    url,
+		secret: []byte(os.Getenv("WEBHOOK_SECRET")),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	s.batchSender = newBatchSender("webhooks", 1, 256, 0, func(events []buildEvent) {
+		for _, ev := range events {
+			s.send(ev)
+		}
+	})
+	return s
+}
+
+// notify queues ev to be sent.
+func (s *webhookSender) notify(ev buildEvent) {
+	if s == nil {
+		return
+	}
+	if !s.batchSender.add(ev) {
+		log.Warnf("webhook queue full, dropping %s event for app %s", ev.Event, ev.App)
+	}
+}
+
+// send posts ev, retrying with backoff on errors and 5xx answers.
+func (s *webhookSender) send(ev buildEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Warnf("could not encode %s webhook: %v", ev.Event, err)
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		err = s.post(ev.Event, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			break
+		}
+		select {
+		case <-time.After(time.Duration(attempt) * time.Second):
+		case <-s.stopping():
+			// shutting down, don't hold the queue up
+			attempt = webhookAttempts - 1
+		}
+	}
+	log.Warnf("could not send %s webhook for app %s: %v", ev.Event, ev.App, err)
+}
+
+func (s *webhookSender) post(event string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Rchab-Event", event)
+	req.Header.Set("X-Rchab-Signature", "sha256="+webhookSignature(s.secret, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		// the receiver won't change its mind on a retry
+		log.Warnf("%s webhook answered %s", event, resp.Status)
+	}
+	return nil
+}
+
+// webhookSignature is the hex HMAC-SHA256 of body, like GitHub's
+// X-Hub-Signature-256.
+func webhookSignature(secret, body []byte) string {
+	return hex.EncodeToString(hmacSHA256(secret, string(body)))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookSender(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		events   []buildEvent
+		attempts int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		// the first attempt fails, to be retried
+		if attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		if sig := r.Header.Get("X-Rchab-Signature"); sig != "sha256="+webhookSignature([]byte("secret"), body) {
+			t.Errorf("unexpected signature %q", sig)
+		}
+		var ev buildEvent
+		if err := json.Unmarshal(body, &ev); err != nil {
+			t.Error(err)
+		}
+		if r.Header.Get("X-Rchab-Event") != ev.Event {
+			t.Errorf("expected X-Rchab-Event %s, but got %s", ev.Event, r.Header.Get("X-Rchab-Event"))
+		}
+		events = append(events, ev)
+	}))
+	defer server.Close()
+
+	t.Setenv("WEBHOOK_URL", server.URL)
+	t.Setenv("WEBHOOK_SECRET", "secret")
+	s := newWebhookSender()
+	go s.run()
+
+	s.notify(buildEvent{Event: buildEventStarted, App: "my-app"})
+	s.notify(buildEvent{
+		Event:       buildEventSucceeded,
+		App:         "my-app",
+		Status:      buildStatusOK,
+		ImageDigest: "sha256:1234",
+		Cache:       &buildEventCache{Steps: 2, Cached: 1},
+	})
+	s.close(10 * time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 2 || events[0].Event != buildEventStarted || events[1].Event != buildEventSucceeded {
+		t.Fatalf("expected the started and succeeded events in order, but got %+v", events)
+	}
+	if events[1].ImageDigest != "sha256:1234" || events[1].Cache.Cached != 1 {
+		t.Errorf("unexpected succeeded event %+v", events[1])
+	}
+}
+
+func TestWebhookSenderDisabled(t *testing.T) {
+	t.Setenv("WEBHOOK_URL", "")
+	s := newWebhookSender()
+	if s != nil {
+		t.Fatal("expected no sender without WEBHOOK_URL")
+	}
+	// builds call it regardless
+	s.notify(buildEvent{Event: buildEventStarted})
+}